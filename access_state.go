@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --- Persisted access records ---
+
+// The access records count each IP's matches until it reaches its rule's threshold. So that
+// a restart does not give an IP part way there a clean slate, the records still running are
+// written to the access state file by the periodic save task and at shutdown, and read back
+// at startup. With storage = sqlite the database keeps them instead.
+
+// accessStateVersion is the version of the access state file format.
+const accessStateVersion = 1
+
+// accessState is the content of the access state file.
+type accessState struct {
+	Version int                      `json:"version"`
+	Records map[string]*AccessRecord `json:"records"`
+}
+
+// accessStatePath returns the access state file: accessStateFile, or accessrecords.json
+// beside the blocklist.
+func accessStatePath() string {
+	if accessStateFile != "" {
+		return accessStateFile
+	}
+	return filepath.Join(filepath.Dir(blocklistFilePath), "accessrecords.json")
+}
+
+// saveAccessState writes the access records that have not expired to the access state file.
+func saveAccessState() error {
+	if storage == "sqlite" {
+		return nil
+	}
+	now := time.Now()
+	state := accessState{Version: accessStateVersion, Records: make(map[string]*AccessRecord)}
+	mu.Lock()
+	for ip, record := range ipAccessLog {
+		if now.Before(record.ExpiresAt) {
+			copied := *record
+			state.Records[ip] = &copied
+		}
+	}
+	mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access records: %v", err)
+	}
+	if err := writeFileAtomic(accessStatePath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write access state file: %v", err)
+	}
+	if debug {
+		log.Printf("Saved %d access records to %s", len(state.Records), accessStatePath())
+	}
+	return nil
+}
+
+// loadAccessState reads the access records back from the access state file, skipping those
+// that expired meanwhile. A missing file is normal; a corrupt one is ignored with a warning.
+func loadAccessState() {
+	if storage == "sqlite" {
+		return
+	}
+	path := accessStatePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to read access state file %s: %v", path, err)
+		}
+		return
+	}
+	var state accessState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Warning: Ignoring corrupt access state file %s: %v", path, err)
+		return
+	}
+	if state.Version > accessStateVersion {
+		log.Printf("Warning: Ignoring access state file %s, written by a newer version (format %d)", path, state.Version)
+		return
+	}
+
+	now := time.Now()
+	loaded := 0
+	mu.Lock()
+	for ip, record := range state.Records {
+		if record == nil || !now.Before(record.ExpiresAt) || !isValidIPOrCIDR(ip) {
+			continue
+		}
+		// Matches seen since startup take precedence
+		if _, exists := ipAccessLog[ip]; !exists {
+			ipAccessLog[ip] = record
+			loaded++
+		}
+	}
+	mu.Unlock()
+	if debug {
+		log.Printf("Loaded %d access records from %s", loaded, path)
+	}
+}
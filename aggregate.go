@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// --- Aggregation of blocked IPs ---
+
+// With aggregateDensity set, the periodic task folds individually blocked IPs into covering
+// CIDRs, which keeps the ruleset small when many addresses of one range are blocked. A CIDR
+// (no larger than aggregateMinPrefix, or aggregateMinPrefix6 for IPv6) is formed when at
+// least aggregateMinIPs of its addresses are blocked and they make up at least
+// aggregateDensity of it. The largest qualifying CIDR wins. Its entry keeps the folded IPs
+// as members; unblocking one of them splits the aggregate back into the others, and that IP
+// is recorded as a hole that later aggregates leave out until it is blocked again.
+//
+// Only entries blocked locally with the same action and ports are folded, and no aggregate covers a
+// whitelisted address or overlaps another blocked subnet.
+
+// aggregateCandidate is a CIDR and the blocked IPs it would replace.
+type aggregateCandidate struct {
+	cidr    string
+	members []string
+}
+
+// findAggregatesLocked returns the CIDRs that qualify for aggregation. The caller must hold mu.
+func findAggregatesLocked() []aggregateCandidate {
+	type poolKey struct {
+		is4    bool
+		action string
+		ports  string
+	}
+	pools := make(map[poolKey][]netip.Addr)
+	for ip := range blockedIPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !isLocalEntryLocked(ip) {
+			continue
+		}
+		key := poolKey{addr.Is4(), blockedActions[ip], ""}
+		if meta := blockedMeta[ip]; meta != nil {
+			key.ports = strings.Join(meta.Ports, ",")
+		}
+		pools[key] = append(pools[key], addr)
+	}
+
+	var found []aggregateCandidate
+	for key, addrs := range pools {
+		minBits, maxBits := aggregateMinPrefix, 31
+		if !key.is4 {
+			minBits, maxBits = aggregateMinPrefix6, 127
+		}
+		folded := make(map[netip.Addr]bool)
+		for bits := minBits; bits <= maxBits; bits++ {
+			groups := make(map[netip.Prefix][]netip.Addr)
+			for _, addr := range addrs {
+				if !folded[addr] {
+					prefix, _ := addr.Prefix(bits)
+					groups[prefix] = append(groups[prefix], addr)
+				}
+			}
+			for prefix, members := range groups {
+				size := math.Ldexp(1, prefix.Addr().BitLen()-bits)
+				if len(members) < aggregateMinIPs || float64(len(members))/size < aggregateDensity {
+					continue
+				}
+				if overlapsBlockedSubnetLocked(prefix) || containsHoleLocked(prefix) {
+					continue
+				}
+				candidate := aggregateCandidate{cidr: prefix.String()}
+				for _, addr := range members {
+					folded[addr] = true
+					candidate.members = append(candidate.members, addr.String())
+				}
+				found = append(found, candidate)
+			}
+		}
+	}
+	return found
+}
+
+// overlapsBlockedSubnetLocked reports whether prefix overlaps a blocked or pending subnet.
+// The caller must hold mu.
+func overlapsBlockedSubnetLocked(prefix netip.Prefix) bool {
+	for _, subnets := range []map[string]struct{}{blockedSubnets, pendingBlocks} {
+		for subnet := range subnets {
+			if other, err := netip.ParsePrefix(subnet); err == nil && other.Overlaps(prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsHoleLocked reports whether prefix contains an IP unblocked out of an aggregate.
+// The caller must hold mu.
+func containsHoleLocked(prefix netip.Prefix) bool {
+	for ip := range aggregateHoles {
+		if addr, err := netip.ParseAddr(ip); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateBlocks folds blocked IPs into covering CIDRs if aggregation is enabled. It is
+// called by the periodic save task, before the save.
+func aggregateBlocks() {
+	if aggregateDensity <= 0 {
+		return
+	}
+	mu.Lock()
+	candidates := findAggregatesLocked()
+	for _, candidate := range candidates {
+		pendingBlocks[candidate.cidr] = struct{}{} // Claim the CIDR while its rule is added
+	}
+	mu.Unlock()
+
+	for _, candidate := range candidates {
+		foldAggregate(candidate)
+	}
+}
+
+// foldAggregate replaces the rules of a candidate's members with one rule for the CIDR.
+func foldAggregate(candidate aggregateCandidate) {
+	cidr := candidate.cidr
+	if addrs := whitelistedWithin(cidr); len(addrs) > 0 {
+		if debug {
+			log.Printf("Not aggregating %s, which contains the whitelisted %s", cidr, addrs[0])
+		}
+		mu.Lock()
+		delete(pendingBlocks, cidr)
+		mu.Unlock()
+		return
+	}
+
+	mu.Lock()
+	var members []BlockEntry
+	var action string
+	var ports []string
+	var latest time.Time
+	permanent := false
+	for _, ip := range candidate.members {
+		if _, ok := blockedIPs[ip]; !ok {
+			continue // Unblocked since
+		}
+		entry := blockEntryLocked(ip)
+		members = append(members, entry)
+		action, ports = entry.Action, entry.Ports
+		if entry.ExpiresAt == nil {
+			permanent = true
+		} else if entry.ExpiresAt.After(latest) {
+			latest = *entry.ExpiresAt
+		}
+	}
+	if len(members) < aggregateMinIPs {
+		delete(pendingBlocks, cidr)
+		mu.Unlock()
+		return
+	}
+	mu.Unlock()
+
+	// The aggregate lasts as long as its longest-lasting member
+	opts := RuleOptions{Reason: fmt.Sprintf("aggregate of %d IPs", len(members)), Action: action, Ports: ports}
+	if !permanent {
+		opts.Timeout = remainingTimeout(latest)
+	}
+	err := addFirewallRule(cidr, opts)
+
+	mu.Lock()
+	delete(pendingBlocks, cidr)
+	if err == nil {
+		now := time.Now()
+		meta := &BlockEntry{Address: cidr, Type: "subnet", Reason: opts.Reason, FirstSeen: &now, BlockedAt: &now, Members: members, Ports: ports}
+		for _, member := range members {
+			meta.MatchCount += member.MatchCount
+			if member.FirstSeen != nil && member.FirstSeen.Before(*meta.FirstSeen) {
+				meta.FirstSeen = member.FirstSeen
+			}
+			delete(blockedIPs, member.Address)
+			forgetEntryMetaLocked(member.Address)
+		}
+		addBlockedSubnetLocked(cidr)
+		blockedMeta[cidr] = meta
+		setBlockedActionLocked(cidr, action)
+		if !permanent {
+			blockedExpiry[cidr] = latest
+		}
+	}
+	mu.Unlock()
+
+	if err != nil {
+		logBlockFailure("aggregate", cidr, err)
+		return
+	}
+	for _, member := range members {
+		var removeErr error
+		if challengeEnable {
+			removeErr = fwManager.RemoveRedirectRule(member.Address)
+		} else {
+			removeErr = fwManager.RemoveBlockRule(member.Address)
+		}
+		if removeErr != nil {
+			log.Printf("Warning: Failed to remove rule for IP %s after aggregating it into %s: %v", member.Address, cidr, removeErr)
+		}
+	}
+	log.Printf("Aggregated %d blocked IPs into %s", len(members), cidr)
+}
+
+// splitAggregate unblocks ip out of the aggregate subnet by replacing the aggregate with
+// its other members, each with its own metadata again. Subnet blocks that absorbed blocked
+// IPs are split the same way. It returns false, doing nothing, if subnet has no members.
+// The caller saves the blocklist.
+func splitAggregate(subnet, ip string) bool {
+	mu.Lock()
+	meta := blockedMeta[subnet]
+	if meta == nil || len(meta.Members) == 0 {
+		mu.Unlock()
+		return false
+	}
+	// Keep the next aggregation pass from covering ip again
+	aggregateHoles[ip] = struct{}{}
+	rest := make(map[string]BlockEntry, len(meta.Members))
+	for _, member := range meta.Members {
+		if member.Address != ip {
+			rest[member.Address] = member
+		}
+	}
+	mu.Unlock()
+
+	changes := applyBlockListChanges(rest, []string{subnet}, "splitting aggregate "+subnet)
+	log.Printf("Split aggregate %s to unblock %s: %s", subnet, ip, changes)
+	return true
+}
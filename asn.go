@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// --- ASN rules and escalation by announced prefix ---
+
+// With asnDBPath set to a MaxMind GeoLite2 ASN database, rules can be limited to clients
+// from some networks ("asns", the numbers of their autonomous systems), and -list and
+// -check show the AS of blocked IPs. The database is opened and checked like the GeoIP
+// one. A /24 is often the wrong size for subnet blocking: bulletproof hosters announce
+// /19s, and CGNAT providers share a /24 among thousands of users. With subnetBlockMode
+// set to "announced", an IP counts toward blocking the prefix its AS announces for it
+// (the network of its database entry), but no broader than subnetMinPrefix (or
+// subnetMinPrefix6 for IPv6). IPs missing from the database, or all of them without a
+// usable one, fall back to the fixed /24 and /64.
+
+var (
+	asnDBPath        = ""      // MaxMind ASN database; empty disables the ASN rules and output
+	subnetBlockMode  = "fixed" // "fixed" (/24 and /64) or "announced" (the announced prefix)
+	subnetMinPrefix  = 20      // Broadest IPv4 prefix blocked in announced mode
+	subnetMinPrefix6 = 32      // Broadest IPv6 prefix blocked in announced mode
+
+	asnDB = &mmdbFile{name: "ASN", path: &asnDBPath}
+)
+
+// asnRecord is what is read of an ASN database entry.
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// asnOf returns the AS of ip and the prefix it is announced in (nil if the database does
+// not know it), and false if there is no usable database.
+func asnOf(ip string) (asnRecord, *net.IPNet, bool) {
+	var record asnRecord
+	network, ok := asnDB.lookup(ip, &record)
+	return record, network, ok
+}
+
+// ipASN describes the AS of an IP target, e.g. "AS64496 Example Hosting", or returns ""
+// if it is a subnet or its AS is unknown.
+func ipASN(target string) string {
+	if asnDBPath == "" || entryType(target) == "subnet" {
+		return ""
+	}
+	record, _, _ := asnOf(target)
+	if record.Number == 0 {
+		return ""
+	}
+	if record.Organization == "" {
+		return fmt.Sprintf("AS%d", record.Number)
+	}
+	return fmt.Sprintf("AS%d %s", record.Number, record.Organization)
+}
+
+// matchesASN reports whether client is from a network the rule applies to. A rule with
+// asns never matches without a usable database, or an address of unknown AS.
+func (r *Rule) matchesASN(client string, trace *lineTrace) bool {
+	if len(r.ASNs) == 0 {
+		return true
+	}
+	record, _, ok := asnOf(client)
+	if !ok {
+		trace.printf("Rule %s did not match (no ASN database for its asns)", r.Name)
+		return false
+	}
+	if !slices.Contains(r.ASNs, record.Number) {
+		trace.printf("Rule %s did not match (AS%d of %s not in its asns)", r.Name, record.Number, client)
+		return false
+	}
+	return true
+}
+
+// escalationSubnet returns the subnet ip counts toward for subnet blocking: its /24 or
+// /64, or in announced mode the prefix announced for it, no broader than the minimum
+// prefix of its family.
+func escalationSubnet(ip string) string {
+	if subnetBlockMode != "announced" {
+		return getSubnet(ip)
+	}
+	_, network, _ := asnOf(ip)
+	if network == nil {
+		return getSubnet(ip)
+	}
+	ones, bits := network.Mask.Size()
+	minimum := subnetMinPrefix
+	if bits == 128 {
+		minimum = subnetMinPrefix6
+	}
+	if ones < minimum {
+		mask := net.CIDRMask(minimum, bits)
+		network = &net.IPNet{IP: parseClientIP(ip).Mask(mask), Mask: mask}
+	}
+	return network.String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Audit log ---
+
+// With auditLog set, every block, unblock and solved challenge is appended to that file as
+// one JSON line, with the rule or reason, where the action came from and, for blocks from a
+// log file, the matched line and user agent. The file is only ever appended to; rotating or
+// truncating it is left to the operator (e.g. logrotate with copytruncate). The server
+// buffers the writes and flushes them every few seconds and at shutdown; client commands
+// that run without a server write each record straight through.
+
+// auditFlushInterval is how often the server flushes buffered audit records.
+const auditFlushInterval = 5 * time.Second
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"` // "block", "unblock", "skip", "allow", "disallow", "restore" or "challenge"
+	Target    string    `json:"target"`
+	Reason    string    `json:"reason,omitempty"` // The match (rule name and status), or why the action was taken
+	Rule      string    `json:"rule,omitempty"`   // Name of the rule that matched, for blocks from the logs
+	Source    string    `json:"source"`           // "log", "socket", "cli", "challenge", "peer", "whitelist" or "expiry"
+	LogFile   string    `json:"logFile,omitempty"`
+	Request   string    `json:"request,omitempty"` // The matched log line
+	UserAgent string    `json:"userAgent,omitempty"`
+	Domain    string    `json:"domain,omitempty"`
+	Country   string    `json:"country,omitempty"` // Of an IP target, with geoipDBPath set
+	DryRun    bool      `json:"dryRun,omitempty"`
+}
+
+var (
+	auditMu       sync.Mutex // Guards the audit log state below
+	auditFile     *os.File
+	auditWriter   *bufio.Writer
+	auditBuffered bool // Set by startAuditLog; until then every record is flushed as written
+	auditFailed   bool // The file could not be opened, so writes are no longer attempted
+)
+
+// openAuditLogLocked opens the audit log for appending if it is not open yet. The caller
+// must hold auditMu.
+func openAuditLogLocked() bool {
+	if auditWriter != nil {
+		return true
+	}
+	if auditFailed {
+		return false
+	}
+	// O_APPEND without O_TRUNC: existing records are never overwritten
+	file, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Printf("Warning: Failed to open audit log %s, audit records will not be written: %v", auditLogPath, err)
+		auditFailed = true
+		return false
+	}
+	auditFile, auditWriter = file, bufio.NewWriter(file)
+	return true
+}
+
+// writeAudit appends a record to the audit log, if one is configured.
+func writeAudit(record auditRecord) {
+	if auditLogPath == "" {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	record.DryRun = dryRun
+	if record.Country == "" {
+		record.Country = ipCountry(record.Target)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: Failed to encode audit record for %s: %v", record.Target, err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if !openAuditLogLocked() {
+		return
+	}
+	data = append(data, '\n')
+	if _, err := auditWriter.Write(data); err != nil {
+		log.Printf("Warning: Failed to write audit log %s: %v", auditLogPath, err)
+		return
+	}
+	if !auditBuffered {
+		flushAuditLogLocked()
+	}
+}
+
+// flushAuditLogLocked writes out the buffered records and syncs the file. The caller must
+// hold auditMu.
+func flushAuditLogLocked() {
+	if auditWriter == nil || auditWriter.Buffered() == 0 {
+		return
+	}
+	if err := auditWriter.Flush(); err != nil {
+		log.Printf("Warning: Failed to flush audit log %s: %v", auditLogPath, err)
+		return
+	}
+	if err := auditFile.Sync(); err != nil {
+		log.Printf("Warning: Failed to sync audit log %s: %v", auditLogPath, err)
+	}
+}
+
+// flushAuditLog writes out the buffered records. main calls it at shutdown.
+func flushAuditLog() {
+	auditMu.Lock()
+	flushAuditLogLocked()
+	auditMu.Unlock()
+}
+
+// startAuditLog switches the server to buffered audit writes, flushed periodically.
+func startAuditLog() {
+	if auditLogPath == "" {
+		return
+	}
+	auditMu.Lock()
+	opened := openAuditLogLocked()
+	auditBuffered = opened
+	auditMu.Unlock()
+	if !opened {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(auditFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			flushAuditLog()
+		}
+	}()
+	if debug {
+		log.Printf("Writing audit records to %s", auditLogPath)
+	}
+}
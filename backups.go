@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Blocklist backups ---
+
+// The periodic save task keeps blocklistBackups rotated copies of the blocklist beside the
+// blocklist file, .1 being the newest. A new copy is taken once blocklistBackupInterval has
+// passed since the last one and the blocklist changed, or sooner once blocklistBackupChanges
+// entries were added or removed. The copies are blocklist files, also with storage = sqlite.
+// -restoreBlocklist applies one of them, or any blocklist file, to the running blocklist.
+
+var (
+	backupMu          sync.Mutex // Guards the rotation and the state below
+	lastBackupAt      time.Time
+	lastBackupTargets map[string]bool // Entries of the newest copy, nil until it is read
+)
+
+// backupPath returns the path of the backup with the given index.
+func backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", activeBlocklistPath(), index)
+}
+
+// blockListTargets returns the valid entries of a loaded blocklist by address, including
+// those of version 1 files.
+func blockListTargets(blocklist BlockList) map[string]BlockEntry {
+	entries := make(map[string]BlockEntry, len(blocklist.Entries)+len(blocklist.IPs)+len(blocklist.Subnets))
+	if len(blocklist.Entries) > 0 {
+		for _, entry := range blocklist.Entries {
+			if isValidIPOrCIDR(entry.Address) {
+				target := normalizeTarget(entry.Address)
+				entry.Address, entry.Type = target, entryType(target)
+				entries[target] = entry
+			}
+		}
+		return entries
+	}
+	for _, address := range append(blocklist.IPs, blocklist.Subnets...) {
+		if !isValidIPOrCIDR(address) {
+			continue
+		}
+		target := normalizeTarget(address)
+		entry := BlockEntry{Address: target, Type: entryType(target), Action: blocklist.Actions[address]}
+		if expiry, ok := blocklist.Expires[address]; ok {
+			entry.ExpiresAt = &expiry
+		}
+		entries[target] = entry
+	}
+	return entries
+}
+
+// rotateBlocklistBackups takes a new backup if one is due. It is called by the periodic save task.
+func rotateBlocklistBackups() {
+	if blocklistBackups <= 0 {
+		return
+	}
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	if lastBackupTargets == nil {
+		lastBackupTargets = make(map[string]bool)
+		if info, err := os.Stat(backupPath(1)); err == nil {
+			lastBackupAt = info.ModTime()
+			if backup, err := readBlockListFile(backupPath(1)); err == nil {
+				for target := range blockListTargets(backup) {
+					lastBackupTargets[target] = true
+				}
+			}
+		}
+	}
+
+	mu.Lock()
+	blocklist := snapshotBlockListLocked()
+	mu.Unlock()
+	current := make(map[string]bool, len(blocklist.Entries))
+	changes := 0
+	for _, entry := range blocklist.Entries {
+		current[entry.Address] = true
+		if !lastBackupTargets[entry.Address] {
+			changes++
+		}
+	}
+	for target := range lastBackupTargets {
+		if !current[target] {
+			changes++
+		}
+	}
+
+	due := changes > 0 && time.Since(lastBackupAt) >= blocklistBackupInterval
+	if blocklistBackupChanges > 0 && changes >= blocklistBackupChanges {
+		due = true
+	}
+	if !due {
+		return
+	}
+	if err := writeBlocklistBackupLocked(blocklist, current); err != nil {
+		log.Printf("Warning: Failed to back up blocklist: %v", err)
+		return
+	}
+	if debug {
+		log.Printf("Backed up blocklist to %s (%d entries, %d changed since the previous backup)", backupPath(1), len(current), changes)
+	}
+}
+
+// writeBlocklistBackupLocked shifts the backups up by one, dropping the oldest, and writes
+// blocklist as .1. The caller must hold backupMu.
+func writeBlocklistBackupLocked(blocklist BlockList, targets map[string]bool) error {
+	data, err := json.MarshalIndent(blocklist, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal blocklist: %v", err)
+	}
+	for i := blocklistBackups; i > 1; i-- {
+		if err := os.Rename(backupPath(i-1), backupPath(i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %s: %v", backupPath(i-1), err)
+		}
+	}
+	if err := writeFileAtomic(backupPath(1), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", backupPath(1), err)
+	}
+	lastBackupAt, lastBackupTargets = time.Now(), targets
+	return nil
+}
+
+// restoreBlockList makes the blocklist match a backup, given by index (1 = newest) or by
+// path: entries missing from the backup are unblocked and its other entries blocked, with
+// their metadata. The current blocklist is first backed up itself, so a restore can be
+// undone with -restoreBlocklist 1. It returns a summary for the client.
+func restoreBlockList(spec string) (string, error) {
+	path, label := spec, spec
+	if index, err := strconv.Atoi(spec); err == nil {
+		if index < 1 {
+			return "", fmt.Errorf("invalid backup index %d (1 is the newest backup)", index)
+		}
+		// Named by index, as backing up the current blocklist shifts the files
+		path, label = backupPath(index), fmt.Sprintf("backup %d", index)
+	}
+	backup, err := readBlockListFile(path)
+	if err != nil {
+		return "", err
+	}
+	if backup.DryRun && !dryRun {
+		return "", fmt.Errorf("%s was recorded in dry-run mode, refusing to apply it", path)
+	}
+	want := blockListTargets(backup)
+
+	if blocklistBackups > 0 {
+		backupMu.Lock()
+		mu.Lock()
+		current := snapshotBlockListLocked()
+		mu.Unlock()
+		targets := make(map[string]bool, len(current.Entries))
+		for _, entry := range current.Entries {
+			targets[entry.Address] = true
+		}
+		err := writeBlocklistBackupLocked(current, targets)
+		backupMu.Unlock()
+		if err != nil {
+			return "", fmt.Errorf("failed to back up the current blocklist before restoring: %v", err)
+		}
+	}
+
+	var remove []string
+	mu.Lock()
+	for _, targets := range []map[string]struct{}{blockedIPs, blockedSubnets} {
+		for target := range targets {
+			if _, ok := want[target]; !ok {
+				remove = append(remove, target)
+			}
+		}
+	}
+	mu.Unlock()
+
+	changes := applyBlockListChanges(want, remove, "restoring "+label)
+	if err := saveBlockList(); err != nil {
+		log.Printf("Warning: Failed to save blocklist after restoring %s: %v", label, err)
+	}
+	result := fmt.Sprintf("Restored blocklist from %s: %s", label, changes)
+	log.Println(result)
+	return result, nil
+}
+
+// blockListChanges counts the outcome of applyBlockListChanges.
+type blockListChanges struct {
+	blocked, unblocked, whitelisted, addFailed, removeFailed int
+}
+
+// String summarises the changes, e.g. "3 blocked, 1 unblocked".
+func (c blockListChanges) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d blocked, %d unblocked", c.blocked, c.unblocked)
+	if c.whitelisted > 0 {
+		fmt.Fprintf(&b, ", %d whitelisted entries skipped", c.whitelisted)
+	}
+	if c.addFailed > 0 || c.removeFailed > 0 {
+		fmt.Fprintf(&b, " (%d rules failed to add, %d to remove; see the server log)", c.addFailed, c.removeFailed)
+	}
+	return b.String()
+}
+
+// applyBlockListChanges blocks the entries of add that are not blocked yet, with their
+// metadata, and unblocks the targets of remove, updating the firewall. Expired and
+// whitelisted entries are not added. context ("restoring backup 2") goes into the log
+// messages. The caller saves the blocklist.
+func applyBlockListChanges(add map[string]BlockEntry, remove []string, context string) blockListChanges {
+	var changes blockListChanges
+	now := time.Now()
+	var candidates, toRemove []string
+	mu.Lock()
+	for target, entry := range add {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		_, pending := pendingBlocks[target]
+		expired := entry.ExpiresAt != nil && !entry.ExpiresAt.After(now)
+		if !isIP && !isSubnet && !pending && !expired {
+			candidates = append(candidates, target)
+		}
+	}
+	for _, target := range remove {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		if isIP || isSubnet {
+			toRemove = append(toRemove, target)
+		}
+	}
+	mu.Unlock()
+
+	var toAdd []string
+	for _, target := range candidates {
+		if isWhitelisted(target) {
+			changes.whitelisted++
+			continue
+		}
+		toAdd = append(toAdd, target)
+	}
+
+	mu.Lock()
+	for _, target := range toRemove {
+		delete(blockedIPs, target)
+		removeBlockedSubnetLocked(target)
+		delete(subnetBlockedIPs, target)
+		forgetEntryMetaLocked(target)
+	}
+	for _, target := range toAdd {
+		pendingBlocks[target] = struct{}{}
+		// Read by installRules for the rule's action, ports and timeout
+		entry := add[target]
+		setBlockedActionLocked(target, entry.Action)
+		if len(entry.Ports) > 0 {
+			blockedMeta[target] = &BlockEntry{Address: target, Type: entryType(target), Ports: entry.Ports}
+		}
+		if entry.ExpiresAt != nil {
+			blockedExpiry[target] = *entry.ExpiresAt
+		}
+	}
+	mu.Unlock()
+
+	for _, target := range toRemove {
+		removeBlockInfo(target)
+		var err error
+		if challengeEnable {
+			err = fwManager.RemoveRedirectRule(target)
+		} else {
+			err = fwManager.RemoveBlockRule(target)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to remove firewall rule for %s while %s: %v", target, context, err)
+			changes.removeFailed++
+		}
+	}
+	changes.unblocked = len(toRemove)
+
+	failed := installRules(toAdd, context)
+
+	mu.Lock()
+	for _, target := range toAdd {
+		delete(pendingBlocks, target)
+		if failed[target] != nil {
+			forgetEntryMetaLocked(target)
+			continue
+		}
+		restoreBlockEntryLocked(add[target])
+	}
+	mu.Unlock()
+	for target, err := range failed {
+		log.Printf("Failed to add firewall rule for %s while %s: %v", target, context, err)
+	}
+	for _, target := range toAdd {
+		if failed[target] == nil {
+			exemptSubnet(target, false)
+		}
+	}
+	changes.blocked = len(toAdd) - len(failed)
+	changes.addFailed = len(failed)
+	return changes
+}
@@ -6,11 +6,33 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
-// saveBlockList saves the current list of blocked IPs and subnets to a file
+// activeBlocklistPath returns the blocklist file in use. Dry-run mode keeps its entries in a
+// separate shadow file so that they are not applied when dry-run is turned off.
+func activeBlocklistPath() string {
+	if dryRun {
+		return blocklistFilePath + ".dryrun"
+	}
+	return blocklistFilePath
+}
+
+// saveBlockList saves the current list of blocked IPs and subnets to a file, or to the
+// database when storage is sqlite
 func saveBlockList() error {
-	dir := filepath.Dir(blocklistFilePath)
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	markBlockListSaved()
+	if storage == "sqlite" {
+		return saveBlockListDB()
+	}
+	// Apply external edits first, so that this save does not overwrite them
+	checkBlocklistFile()
+
+	path := activeBlocklistPath()
+	dir := filepath.Dir(path)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %v", dir, err)
@@ -18,80 +40,223 @@ func saveBlockList() error {
 	}
 
 	mu.Lock()
+	blocklist := snapshotBlockListLocked()
+	data, err := json.MarshalIndent(blocklist, "", "  ")
+	mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal blocklist: %v", err)
+	}
+
+	blocklistFileMu.Lock()
+	err = writeFileAtomic(path, data, 0644)
+	if err == nil {
+		recordBlocklistFileLocked(path, data, entryTargets(blocklist))
+	}
+	blocklistFileMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write blocklist file: %v", err)
+	}
+	// The backup is what loadBlockList falls back to if the primary cannot be read
+	if err := writeFileAtomic(path+".bak", data, 0644); err != nil {
+		log.Printf("Warning: Failed to write blocklist backup %s: %v", path+".bak", err)
+	}
+
+	if debug {
+		log.Printf("Saved blocklist to %s: %d IPs, %d subnets",
+			path, len(blocklist.IPs), len(blocklist.Subnets))
+	}
+
+	return nil
+}
+
+// snapshotBlockListLocked copies the blocklist into its persisted form. The caller must hold mu.
+func snapshotBlockListLocked() BlockList {
 	blocklist := BlockList{
+		Version: blockListVersion,
+		Entries: make([]BlockEntry, 0, len(blockedIPs)+len(blockedSubnets)),
 		IPs:     make([]string, 0, len(blockedIPs)),
 		Subnets: make([]string, 0, len(blockedSubnets)),
+		DryRun:  dryRun,
 	}
 
 	for ip := range blockedIPs {
 		blocklist.IPs = append(blocklist.IPs, ip)
+		blocklist.Entries = append(blocklist.Entries, blockEntryLocked(ip))
 	}
 
 	for subnet := range blockedSubnets {
 		blocklist.Subnets = append(blocklist.Subnets, subnet)
+		blocklist.Entries = append(blocklist.Entries, blockEntryLocked(subnet))
 	}
 
-	data, err := json.MarshalIndent(blocklist, "", "  ")
-	mu.Unlock()
+	// Offenses are kept for targets no longer blocked, so a returning offender escalates
+	if len(blockOffenses) > 0 {
+		blocklist.Offenses = make(map[string]int, len(blockOffenses))
+		for target, count := range blockOffenses {
+			blocklist.Offenses[target] = count
+		}
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to marshal blocklist: %v", err)
+	for target := range feedExclusions {
+		blocklist.FeedExclusions = append(blocklist.FeedExclusions, target)
 	}
+	sort.Strings(blocklist.FeedExclusions)
 
-	if err := os.WriteFile(blocklistFilePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write blocklist file: %v", err)
+	for ip := range aggregateHoles {
+		blocklist.AggregateHoles = append(blocklist.AggregateHoles, ip)
 	}
+	sort.Strings(blocklist.AggregateHoles)
 
-	if debug {
-		log.Printf("Saved blocklist to %s: %d IPs, %d subnets",
-			blocklistFilePath, len(blocklist.IPs), len(blocklist.Subnets))
+	cloudflareRulesMu.Lock()
+	if len(cloudflareRules) > 0 {
+		blocklist.CloudflareRules = make(map[string]CloudflareRule, len(cloudflareRules))
+		for target, rule := range cloudflareRules {
+			blocklist.CloudflareRules[target] = rule
+		}
 	}
+	cloudflareRulesMu.Unlock()
+	return blocklist
+}
 
-	return nil
+// readBlockListFile reads and parses a blocklist file.
+func readBlockListFile(path string) (BlockList, error) {
+	var blocklist BlockList
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return blocklist, fmt.Errorf("failed to read blocklist file: %v", err)
+	}
+	if err := json.Unmarshal(data, &blocklist); err != nil {
+		return blocklist, fmt.Errorf("failed to unmarshal blocklist: %v", err)
+	}
+	return blocklist, nil
 }
 
-// loadBlockList loads the list of blocked IPs and subnets from a file
+// loadBlockList loads the list of blocked IPs and subnets from a file, or from the
+// database when storage is sqlite
 func loadBlockList() error {
+	if storage == "sqlite" {
+		return loadBlockListDB()
+	}
+	return loadBlockListFile()
+}
+
+// loadBlockListFile loads the blocklist from the JSON file
+func loadBlockListFile() error {
+	path := activeBlocklistPath()
+
 	// Check if the file exists
-	if _, err := os.Stat(blocklistFilePath); os.IsNotExist(err) {
-		log.Printf("Blocklist file does not exist: %s", blocklistFilePath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("Blocklist file does not exist: %s", path)
 		return nil
 	}
 
-	// Read the file
-	data, err := os.ReadFile(blocklistFilePath)
+	blocklist, err := readBlockListFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to read blocklist file: %v", err)
+		// Fall back to the copy written by the last successful save
+		backup, backupErr := readBlockListFile(path + ".bak")
+		if backupErr != nil {
+			return fmt.Errorf("%v (backup %s.bak: %v)", err, path, backupErr)
+		}
+		log.Printf("Warning: Could not load blocklist %s: %v; loaded the backup %s.bak instead", path, err, path)
+		blocklist = backup
 	}
-
-	// Unmarshal JSON
-	var blocklist BlockList
-	if err := json.Unmarshal(data, &blocklist); err != nil {
-		return fmt.Errorf("failed to unmarshal blocklist: %v", err)
+	if blocklist.DryRun && !dryRun {
+		return fmt.Errorf("blocklist %s was recorded in dry-run mode, refusing to apply it", path)
 	}
 
-	// Apply the blocklist
 	mu.Lock()
-	defer mu.Unlock()
+	applyBlockListLocked(blocklist)
+	ipCount, subnetCount := len(blockedIPs), len(blockedSubnets)
+	loaded := snapshotBlockListLocked()
+	mu.Unlock()
+
+	// Remember the file as loaded, so that later edits to it can be told apart
+	if data, err := os.ReadFile(path); err == nil {
+		blocklistFileMu.Lock()
+		recordBlocklistFileLocked(path, data, entryTargets(loaded))
+		blocklistFileMu.Unlock()
+	}
+
+	// Log load success only in debug
+	if debug {
+		log.Printf("Loaded blocklist from %s (version %d): %d IPs, %d subnets",
+			path, max(blocklist.Version, 1), ipCount, subnetCount)
+	}
 
+	return nil
+}
+
+// applyBlockListLocked replaces the blocklist with a loaded one. The caller must hold mu.
+func applyBlockListLocked(blocklist BlockList) {
 	// Clear existing maps
 	blockedIPs = make(map[string]struct{})
-	blockedSubnets = make(map[string]struct{})
+	resetBlockedSubnetsLocked()
+	blockedActions = make(map[string]string)
+	blockedExpiry = make(map[string]time.Time)
+	blockedMeta = make(map[string]*BlockEntry)
+
+	// Version 2 files describe each entry; the bare lists beside them are only for older versions
+	if len(blocklist.Entries) > 0 {
+		for _, entry := range blocklist.Entries {
+			if !restoreBlockEntryLocked(entry) {
+				log.Printf("Warning: Skipping invalid entry in blocklist: %s", entry.Address)
+			}
+		}
+		blocklist.IPs, blocklist.Subnets = nil, nil
+	}
 
 	// Add IPs and subnets to maps
 	for _, ip := range blocklist.IPs {
-		blockedIPs[ip] = struct{}{}
+		if !isValidIPOrCIDR(ip) {
+			log.Printf("Warning: Skipping invalid IP in blocklist: %s", ip)
+			continue
+		}
+		blockedIPs[normalizeTarget(ip)] = struct{}{}
 	}
 
 	for _, subnet := range blocklist.Subnets {
-		blockedSubnets[subnet] = struct{}{}
+		if !isValidIPOrCIDR(subnet) {
+			log.Printf("Warning: Skipping invalid subnet in blocklist: %s", subnet)
+			continue
+		}
+		addBlockedSubnetLocked(normalizeTarget(subnet))
 	}
 
-	// Log load success only in debug
-	if debug {
-		log.Printf("Loaded blocklist from %s: %d IPs, %d subnets",
-			blocklistFilePath, len(blocklist.IPs), len(blocklist.Subnets))
+	for target, action := range blocklist.Actions {
+		switch action {
+		case "drop", "reject", "ratelimit":
+			blockedActions[normalizeTarget(target)] = action
+		default:
+			log.Printf("Warning: Ignoring invalid action %q for %s in blocklist", action, target)
+		}
 	}
 
-	return nil
+	blockOffenses = make(map[string]int, len(blocklist.Offenses))
+	for target, count := range blocklist.Offenses {
+		blockOffenses[normalizeTarget(target)] = count
+	}
+
+	// Entries that expired while we were not running are removed by pruneExpiredBlocks
+	for target, expiry := range blocklist.Expires {
+		blockedExpiry[normalizeTarget(target)] = expiry
+	}
+
+	feedExclusions = make(map[string]struct{}, len(blocklist.FeedExclusions))
+	for _, target := range blocklist.FeedExclusions {
+		feedExclusions[normalizeTarget(target)] = struct{}{}
+	}
+
+	aggregateHoles = make(map[string]struct{}, len(blocklist.AggregateHoles))
+	for _, ip := range blocklist.AggregateHoles {
+		aggregateHoles[normalizeTarget(ip)] = struct{}{}
+	}
+
+	// Restore the IDs of the Cloudflare rules we created, so they can be deleted on unblock
+	cloudflareRulesMu.Lock()
+	cloudflareRules = make(map[string]CloudflareRule, len(blocklist.CloudflareRules))
+	for target, rule := range blocklist.CloudflareRules {
+		cloudflareRules[normalizeTarget(target)] = rule
+	}
+	cloudflareRulesMu.Unlock()
 }
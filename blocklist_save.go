@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// --- Debounced blocklist saves ---
+
+// During a scan, automatic blocks arrive in bursts, and rewriting the whole blocklist for
+// each of them hammers the disk. They mark the blocklist dirty instead, and the saver writes
+// it at most once per blocklistSaveDelay. If the server crashes, the automatic blocks of
+// those last few seconds are missing from the blocklist on restart; their offenders are
+// blocked again by the rules if they come back. Client block and unblock commands still
+// save before they return, and so does shutdown.
+
+// blocklistSaveDelay is the shortest time between two saves by the saver.
+const blocklistSaveDelay = 5 * time.Second
+
+var (
+	saveMu       sync.Mutex    // Serializes saveBlockList, so an older snapshot never overwrites a newer one
+	saveStateMu  sync.Mutex    // Guards the state below
+	saveDirty    bool          // The blocklist changed since the last save
+	saveWake     chan struct{} // Signals the saver; nil until startBlockListSaver, when requests save at once
+	saveLastDone time.Time     // When the saver last wrote the blocklist
+)
+
+// requestBlockListSave marks the blocklist for saving by the saver. Without a running saver,
+// e.g. in client commands, it saves at once.
+func requestBlockListSave() {
+	saveStateMu.Lock()
+	wake := saveWake
+	if wake != nil {
+		saveDirty = true
+	}
+	saveStateMu.Unlock()
+
+	if wake == nil {
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: Failed to save blocklist: %v", err)
+		}
+		return
+	}
+	select {
+	case wake <- struct{}{}:
+	default: // The saver is already woken
+	}
+}
+
+// markBlockListSaved clears the dirty flag. saveBlockList calls it before taking its
+// snapshot, so changes made after the snapshot mark the blocklist dirty again.
+func markBlockListSaved() {
+	saveStateMu.Lock()
+	saveDirty = false
+	saveStateMu.Unlock()
+}
+
+// startBlockListSaver starts the saver, after which requestBlockListSave is debounced.
+func startBlockListSaver() {
+	wake := make(chan struct{}, 1)
+	saveStateMu.Lock()
+	saveWake = wake
+	saveStateMu.Unlock()
+	go runBlockListSaver(wake, blocklistSaveDelay, saveBlockList)
+}
+
+// runBlockListSaver saves the blocklist with save whenever it is woken and the blocklist
+// is dirty, waiting until delay has passed since its previous save.
+func runBlockListSaver(wake <-chan struct{}, delay time.Duration, save func() error) {
+	for range wake {
+		saveStateMu.Lock()
+		wait := delay - time.Since(saveLastDone)
+		saveStateMu.Unlock()
+		if wait > 0 {
+			// Requests made meanwhile are covered by this save
+			time.Sleep(wait)
+		}
+
+		saveStateMu.Lock()
+		dirty := saveDirty
+		saveStateMu.Unlock()
+		if !dirty {
+			continue // Saved by someone else meanwhile
+		}
+		if err := save(); err != nil {
+			log.Printf("Warning: Failed to save blocklist: %v", err)
+		}
+		saveStateMu.Lock()
+		saveLastDone = time.Now()
+		saveStateMu.Unlock()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useBlockListSaver runs a saver saving with save after delay for the test, counting its
+// saves, and returns the count.
+func useBlockListSaver(t *testing.T, delay time.Duration, save func() error) *int32 {
+	t.Helper()
+	var saves int32
+	wake := make(chan struct{}, 1)
+	saveStateMu.Lock()
+	saveWake, saveDirty, saveLastDone = wake, false, time.Time{}
+	saveStateMu.Unlock()
+	go runBlockListSaver(wake, delay, func() error {
+		atomic.AddInt32(&saves, 1)
+		return save()
+	})
+	t.Cleanup(func() {
+		saveStateMu.Lock()
+		saveWake, saveDirty, saveLastDone = nil, false, time.Time{}
+		saveStateMu.Unlock()
+		close(wake)
+	})
+	return &saves
+}
+
+// waitForSaves waits until the saver saved want times, failing the test after a few seconds.
+func waitForSaves(t *testing.T, saves *int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(saves) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d saves, want %d", atomic.LoadInt32(saves), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBlockListSaveDebounced checks that a burst of save requests is written once, the
+// delay after the previous save.
+func TestBlockListSaveDebounced(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	saves := useBlockListSaver(t, delay, func() error {
+		markBlockListSaved() // As saveBlockList does
+		return nil
+	})
+
+	// The first request after a quiet time is saved at once
+	requestBlockListSave()
+	waitForSaves(t, saves, 1)
+	saved := time.Now()
+
+	for i := 0; i < 100; i++ {
+		requestBlockListSave()
+	}
+	time.Sleep(delay / 3)
+	if got := atomic.LoadInt32(saves); got != 1 {
+		t.Fatalf("%d saves within the delay, want 1", got)
+	}
+	waitForSaves(t, saves, 2)
+	if elapsed := time.Since(saved); elapsed < delay*9/10 {
+		t.Fatalf("burst saved %v after the previous save, want %v", elapsed, delay)
+	}
+
+	// Nothing is left to save
+	time.Sleep(2 * delay)
+	if got := atomic.LoadInt32(saves); got != 2 {
+		t.Fatalf("%d saves after the burst, want 2", got)
+	}
+}
+
+// useTempBlockList keeps the blocklist in a temporary file for the test, starting empty.
+func useTempBlockList(t *testing.T) string {
+	t.Helper()
+	savedPath, savedStorage, savedDryRun := blocklistFilePath, storage, dryRun
+	blocklistFilePath, storage, dryRun = filepath.Join(t.TempDir(), "blocklist.json"), "json", false
+	mu.Lock()
+	savedIPs, savedSubnets, savedRanges := blockedIPs, blockedSubnets, blockedSubnetRanges
+	blockedIPs = make(map[string]struct{})
+	resetBlockedSubnetsLocked()
+	mu.Unlock()
+	blocklistFileMu.Lock()
+	savedSum, savedModTime, savedSize, savedTargets := blocklistFileSum, blocklistFileModTime, blocklistFileSize, blocklistFileTargets
+	blocklistFileMu.Unlock()
+	t.Cleanup(func() {
+		blocklistFilePath, storage, dryRun = savedPath, savedStorage, savedDryRun
+		mu.Lock()
+		blockedIPs, blockedSubnets, blockedSubnetRanges = savedIPs, savedSubnets, savedRanges
+		mu.Unlock()
+		blocklistFileMu.Lock()
+		blocklistFileSum, blocklistFileModTime, blocklistFileSize, blocklistFileTargets = savedSum, savedModTime, savedSize, savedTargets
+		blocklistFileMu.Unlock()
+	})
+	return blocklistFilePath
+}
+
+// blockListFileHas reports whether the blocklist file lists ip.
+func blockListFileHas(t *testing.T, path, ip string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Contains(string(data), `"`+ip+`"`)
+}
+
+// TestShutdownSavesPendingBlocks checks that the save at shutdown writes the blocks the
+// saver is still waiting to write, leaving it nothing to save.
+func TestShutdownSavesPendingBlocks(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	path := useTempBlockList(t)
+	saves := useBlockListSaver(t, delay, saveBlockList)
+
+	mu.Lock()
+	blockedIPs["192.0.2.1"] = struct{}{}
+	mu.Unlock()
+	requestBlockListSave()
+	waitForSaves(t, saves, 1)
+
+	mu.Lock()
+	blockedIPs["192.0.2.2"] = struct{}{}
+	mu.Unlock()
+	requestBlockListSave()
+	time.Sleep(delay / 3)
+	if blockListFileHas(t, path, "192.0.2.2") {
+		t.Fatal("the second block was saved within the delay")
+	}
+
+	// What main does on shutdown
+	if err := saveBlockList(); err != nil {
+		t.Fatal(err)
+	}
+	if !blockListFileHas(t, path, "192.0.2.1") || !blockListFileHas(t, path, "192.0.2.2") {
+		t.Fatal("the blocks were not saved at shutdown")
+	}
+	time.Sleep(2 * delay)
+	if got := atomic.LoadInt32(saves); got != 1 {
+		t.Fatalf("the saver saved %d times, want once, as shutdown saved the rest", got)
+	}
+}
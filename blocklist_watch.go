@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// --- External blocklist edits ---
+
+// Tools such as configuration management may edit the blocklist file while the server runs.
+// The file's content as last written or loaded is remembered; a file that differs from it
+// was changed by someone else. Entries added to it are blocked and entries removed from it
+// unblocked before the next save writes the file again, so the edit is merged rather than
+// overwritten. The checksum keeps our own saves from being taken for edits.
+
+var (
+	blocklistFileMu      sync.Mutex // Held while the blocklist file is written or checked; guards the state below
+	blocklistFileSum     [sha256.Size]byte
+	blocklistFileModTime time.Time
+	blocklistFileSize    int64
+	blocklistFileTargets map[string]bool // Entries of the file as last written or loaded
+)
+
+// recordBlocklistFileLocked remembers the blocklist file as we left it. The caller must
+// hold blocklistFileMu.
+func recordBlocklistFileLocked(path string, data []byte, targets map[string]bool) {
+	blocklistFileSum = sha256.Sum256(data)
+	blocklistFileModTime, blocklistFileSize = time.Time{}, -1
+	if info, err := os.Stat(path); err == nil {
+		blocklistFileModTime, blocklistFileSize = info.ModTime(), info.Size()
+	}
+	blocklistFileTargets = targets
+}
+
+// entryTargets returns the addresses of a blocklist snapshot.
+func entryTargets(blocklist BlockList) map[string]bool {
+	targets := make(map[string]bool, len(blocklist.Entries))
+	for _, entry := range blocklist.Entries {
+		targets[entry.Address] = true
+	}
+	return targets
+}
+
+// checkBlocklistFile applies the changes made to the blocklist file since we last wrote or
+// loaded it, and reports whether there were any. The caller saves the blocklist.
+func checkBlocklistFile() bool {
+	if storage != "json" {
+		return false
+	}
+	path := activeBlocklistPath()
+	blocklistFileMu.Lock()
+	info, err := os.Stat(path)
+	if err != nil || (info.ModTime().Equal(blocklistFileModTime) && info.Size() == blocklistFileSize) {
+		blocklistFileMu.Unlock()
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		blocklistFileMu.Unlock()
+		return false
+	}
+	if sha256.Sum256(data) == blocklistFileSum {
+		blocklistFileModTime, blocklistFileSize = info.ModTime(), info.Size()
+		blocklistFileMu.Unlock()
+		return false
+	}
+
+	previous := blocklistFileTargets
+	var blocklist BlockList
+	if err := json.Unmarshal(data, &blocklist); err != nil {
+		// Probably still being written; a later edit is checked again
+		log.Printf("Warning: Ignoring change to blocklist %s, which cannot be parsed: %v", path, err)
+		recordBlocklistFileLocked(path, data, previous)
+		blocklistFileMu.Unlock()
+		return false
+	}
+	want := blockListTargets(blocklist)
+	targets := make(map[string]bool, len(want))
+	add := make(map[string]BlockEntry)
+	for target, entry := range want {
+		targets[target] = true
+		if !previous[target] {
+			add[target] = entry
+		}
+	}
+	var remove []string
+	for target := range previous {
+		if !targets[target] {
+			remove = append(remove, target)
+		}
+	}
+	recordBlocklistFileLocked(path, data, targets)
+	blocklistFileMu.Unlock()
+
+	if len(add) == 0 && len(remove) == 0 {
+		return false
+	}
+	changes := applyBlockListChanges(add, remove, "reloading "+path)
+	log.Printf("Blocklist %s was changed outside apacheblock (%d entries added, %d removed): %s", path, len(add), len(remove), changes)
+	return true
+}
+
+// startBlocklistWatch watches the blocklist file and applies external edits shortly after
+// they are made. Saves check the file as well, so edits are not lost if an event is missed.
+func startBlocklistWatch() error {
+	if storage != "json" {
+		return nil
+	}
+	path := filepath.Clean(activeBlocklistPath())
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	// Watch the directory, as saves and most editors replace the file by renaming over it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %v", filepath.Dir(path), err)
+	}
+
+	reload := func() {
+		if checkBlocklistFile() {
+			if err := saveBlockList(); err != nil {
+				log.Printf("Warning: Failed to save blocklist after reloading %s: %v", path, err)
+			}
+		}
+	}
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				// Wait for a burst of writes to settle
+				if timer == nil {
+					timer = time.AfterFunc(time.Second, reload)
+				} else {
+					timer.Reset(time.Second)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Warning: Blocklist watcher error: %v", err)
+			}
+		}
+	}()
+
+	if debug {
+		log.Printf("Watching %s for external changes", path)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// --- Blocklist entry metadata ---
+
+// recordBlockMetaLocked records why and when a target was blocked. The first sighting and
+// match count come from the access records behind it: the IP's own record, or for a subnet
+// those of its blocked IPs. The caller must hold mu.
+func recordBlockMetaLocked(target, reason, userAgent string) {
+	now := time.Now()
+	entry := &BlockEntry{
+		Address:       target,
+		Type:          entryType(target),
+		Reason:        reason,
+		FirstSeen:     &now,
+		BlockedAt:     &now,
+		LastUserAgent: userAgent,
+	}
+
+	records := []*AccessRecord{ipAccessLog[target]}
+	if entry.Type == "subnet" {
+		records = records[:0]
+		for ip := range subnetBlockedIPs[target] {
+			records = append(records, ipAccessLog[ip])
+			if meta := blockedMeta[ip]; meta != nil && entry.LastUserAgent == "" {
+				entry.LastUserAgent = meta.LastUserAgent
+			}
+		}
+	}
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		entry.MatchCount += record.Count
+		if !record.FirstSeen.IsZero() && record.FirstSeen.Before(*entry.FirstSeen) {
+			firstSeen := record.FirstSeen
+			entry.FirstSeen = &firstSeen
+		}
+	}
+	blockedMeta[target] = entry
+	delete(aggregateHoles, target) // Blocked again, so it may be aggregated
+}
+
+// entryType returns the type field of a blocklist entry: "ip" or "subnet".
+func entryType(target string) string {
+	if strings.Contains(target, "/") {
+		return "subnet"
+	}
+	return "ip"
+}
+
+// blockEntryLocked builds the persisted form of a blocklist entry from its metadata, action
+// and expiry. The caller must hold mu.
+func blockEntryLocked(target string) BlockEntry {
+	entry := BlockEntry{Address: target, Type: entryType(target)}
+	if meta := blockedMeta[target]; meta != nil {
+		entry = *meta
+		entry.Address, entry.Type = target, entryType(target)
+	}
+	entry.Action = blockedActions[target]
+	entry.ExpiresAt = nil
+	if expiry, ok := blockedExpiry[target]; ok {
+		entry.ExpiresAt = &expiry
+	}
+	return entry
+}
+
+// restoreBlockEntryLocked adds a loaded entry to the blocklist with its metadata, action
+// and expiry, returning false for an invalid entry. The caller must hold mu.
+func restoreBlockEntryLocked(entry BlockEntry) bool {
+	if !isValidIPOrCIDR(entry.Address) {
+		return false
+	}
+	target := normalizeTarget(entry.Address)
+	if entryType(target) == "subnet" {
+		addBlockedSubnetLocked(target)
+	} else {
+		blockedIPs[target] = struct{}{}
+	}
+	switch entry.Action {
+	case "":
+	case "drop", "reject", "ratelimit":
+		blockedActions[target] = entry.Action
+	default:
+		log.Printf("Warning: Ignoring invalid action %q for %s in blocklist", entry.Action, target)
+	}
+	// Entries that expired while we were not running are removed by pruneExpiredBlocks
+	if entry.ExpiresAt != nil {
+		blockedExpiry[target] = *entry.ExpiresAt
+	}
+
+	if len(entry.Ports) > 0 {
+		ports, err := parsePortList(strings.Join(entry.Ports, ","))
+		if err != nil {
+			log.Printf("Warning: Ignoring invalid ports for %s in blocklist: %v", target, err)
+		}
+		entry.Ports = ports
+	}
+
+	meta := entry
+	meta.Address, meta.Type, meta.Action, meta.ExpiresAt = target, entryType(target), "", nil
+	blockedMeta[target] = &meta
+	return true
+}
+
+// entryNoteLocked describes a blocklist entry for -list output: its expiry, then the rule
+// that blocked it, when, how many matches led to it and the last User-Agent seen, e.g.
+// " (expires in 3h12m0s) [reason: wp-login, blocked 2024-05-01 10:00:00, 12 matches]".
+// The caller must hold mu.
+func entryNoteLocked(target string) string {
+	note := expiryNoteLocked(target)
+	meta := blockedMeta[target]
+	if meta == nil {
+		return note
+	}
+	var parts []string
+	if meta.Reason != "" {
+		parts = append(parts, "reason: "+meta.Reason)
+	}
+	if len(meta.Ports) > 0 {
+		parts = append(parts, "ports "+strings.Join(meta.Ports, ","))
+	}
+	if country := ipCountry(target); country != "" {
+		parts = append(parts, "country: "+country)
+	}
+	if asn := ipASN(target); asn != "" {
+		parts = append(parts, asn)
+	}
+	if meta.BlockedAt != nil {
+		parts = append(parts, "blocked "+meta.BlockedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	if meta.MatchCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d matches", meta.MatchCount))
+	}
+	if meta.FirstSeen != nil && meta.BlockedAt != nil && meta.BlockedAt.Sub(*meta.FirstSeen) >= time.Second {
+		parts = append(parts, "first seen "+meta.FirstSeen.Local().Format("2006-01-02 15:04:05"))
+	}
+	if meta.LastUserAgent != "" {
+		parts = append(parts, "User-Agent: "+meta.LastUserAgent)
+	}
+	if meta.Source != "" {
+		parts = append(parts, "feed: "+meta.Source)
+	}
+	if meta.Peer != "" {
+		parts = append(parts, "peer: "+meta.Peer)
+	}
+	if len(parts) == 0 {
+		return note
+	}
+	return note + " [" + strings.Join(parts, ", ") + "]"
+}
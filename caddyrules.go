@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// --- Rules on the fields of Caddy logs ---
+
+// A regex over a whole Caddy JSON line also matches the referer, the user agent and any
+// other header logged, so Caddy rules match the fields of the decoded entry instead:
+// uriRegex on the request URI (with the query string), statusCodes and methods on the
+// status and method, and hostRegex (case-insensitive) on the requested host. All of the
+// fields given must match. Caddy rules with none of them fall back to regex over the raw
+// line, and then match whatever the status. Rules with these fields only apply to Caddy
+// lines.
+
+// caddyLine is a Caddy log line, decoded when a rule first needs its fields.
+type caddyLine struct {
+	raw     string
+	decoded bool
+	err     error
+	entry   CaddyLogEntry
+}
+
+// get returns the decoded entry of the line.
+func (c *caddyLine) get() (*CaddyLogEntry, error) {
+	if !c.decoded {
+		c.decoded = true
+		c.err = json.Unmarshal([]byte(c.raw), &c.entry)
+	}
+	return &c.entry, c.err
+}
+
+// hasCaddyFields reports whether the rule matches the fields of Caddy entries.
+func (r *Rule) hasCaddyFields() bool {
+	return r.URIRegex != "" || len(r.StatusCodes) > 0 || len(r.Methods) > 0 || r.HostRegex != ""
+}
+
+// compileCaddyFields compiles the uriRegex and hostRegex of a rule, reporting false if
+// one is invalid.
+func compileCaddyFields(rule *Rule) bool {
+	if !rule.hasCaddyFields() {
+		if rule.LogFormat == "caddy" {
+			rule.warnf("Caddy rule %s has no uriRegex, statusCodes, methods or hostRegex; its regex is run over the whole JSON line and any status counts", rule.Name)
+		}
+		return true
+	}
+	if rule.URIRegex != "" {
+		regex, err := regexp.Compile(rule.URIRegex)
+		if err != nil {
+			rule.warnf("Invalid uriRegex in rule %s (%s): %v", rule.Name, rule.source, err)
+			return false
+		}
+		rule.compiledURI = regex
+	}
+	if rule.HostRegex != "" {
+		regex, err := regexp.Compile("(?i)" + rule.HostRegex)
+		if err != nil {
+			rule.warnf("Invalid hostRegex in rule %s (%s): %v", rule.Name, rule.source, err)
+			return false
+		}
+		rule.compiledHost = regex
+	}
+	return true
+}
+
+// matchesCaddyEntry reports whether every field matcher of the rule matches entry.
+func (r *Rule) matchesCaddyEntry(entry *CaddyLogEntry) bool {
+	if r.compiledURI != nil && !r.compiledURI.MatchString(entry.Request.URI) {
+		return false
+	}
+	if r.compiledHost != nil && !r.compiledHost.MatchString(entry.Request.Host) {
+		return false
+	}
+	if len(r.StatusCodes) > 0 && !containsInt(r.StatusCodes, int(entry.Status)) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		for _, method := range r.Methods {
+			if strings.EqualFold(method, entry.Request.Method) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// containsInt reports whether values holds value.
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCaddyRule matches a Caddy line against a rule, returning the client IP and the
+// reason (the rule's name and the status).
+func matchCaddyRule(rule *Rule, line *caddyLine, trace *lineTrace) (string, string, bool) {
+	var matches []string
+	if !rule.hasCaddyFields() {
+		if !rule.mayMatch(line.raw) {
+			return "", "", false
+		}
+		var ok bool
+		if matches, ok = rule.submatch(line.raw); !ok {
+			return "", "", false
+		}
+	}
+	entry, err := line.get()
+	if err != nil {
+		trace.printf("Failed to parse Caddy JSON: %v", err)
+		return "", "", false
+	}
+	if rule.hasCaddyFields() && !rule.matchesCaddyEntry(entry) {
+		return "", "", false
+	}
+	var ip string
+	if rule.ipGroup > 0 && matches != nil {
+		if ip = rule.namedIP(matches, trace); ip == "" {
+			return "", "", false
+		}
+	} else if clientIP := parseClientIP(entry.Request.ClientIP); clientIP != nil {
+		ip = clientIP.String()
+	} else {
+		trace.printf("Rule %s matched a Caddy entry without a valid client_ip (%q)", rule.Name, entry.Request.ClientIP)
+		return "", "", false
+	}
+	reason := rule.matchReason(matches, fmt.Sprint(entry.Status))
+	trace.printf("Caddy match: IP %s, Reason %s", ip, reason)
+	return ip, reason, true
+}
@@ -22,21 +22,12 @@ import (
 	"time"
 )
 
-func isTrustedProxy(remoteAddr string) bool {
-	host, _, err := net.SplitHostPort(remoteAddr)
+func getClientIP(r *http.Request) string {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = remoteAddr
-	}
-	for _, tp := range trustedProxies {
-		if host == tp {
-			return true
-		}
+		remoteHost = r.RemoteAddr
 	}
-	return false
-}
-
-func getClientIP(r *http.Request) string {
-	if isTrustedProxy(r.RemoteAddr) {
+	if isTrustedProxy(remoteHost) {
 		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
 			return realIP
 		} else if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
@@ -453,6 +444,11 @@ func handleVerifyRequest(w http.ResponseWriter, r *http.Request) {
 	blockInfo := getBlockInfo(clientIP)
 
 	log.Printf("Verification successful for IP: %s on domain %s (User-Agent: %s) false_positive=%v", clientIP, domainName, userAgent, falsePositive)
+	challengeReason := "challenge solved"
+	if falsePositive {
+		challengeReason += ", reported as a false positive"
+	}
+	writeAudit(auditRecord{Action: "challenge", Target: clientIP, Reason: challengeReason, Source: "challenge", UserAgent: userAgent, Domain: domainName})
 
 	if fwManager == nil {
 		http.Error(w, "Firewall manager not initialized.", http.StatusInternalServerError)
@@ -499,7 +495,7 @@ func handleVerifyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Printf("Successfully removed redirect rule for %s on domain %s", clientIP, domainName)
 
-		if err := clientUnblockIP(clientIP); err != nil {
+		if err := clientUnblockIP(clientIP, "challenge", true); err != nil {
 			log.Printf("Error updating internal blocklist for %s on domain %s after challenge: %v", clientIP, domainName, err)
 		} else if debug {
 			log.Printf("Successfully removed %s from internal blocklist (domain: %s).", clientIP, domainName)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// FirewallCheck reports where a target stands in the blocklist and in the live firewall,
+// so that drift (rules added or deleted by hand) shows up. The socket check command
+// returns it in the "check" field of its response.
+type FirewallCheck struct {
+	Target          string   `json:"target"`
+	Country         string   `json:"country,omitempty"`
+	ASN             string   `json:"asn,omitempty"`
+	InBlocklist     bool     `json:"in_blocklist"`
+	BlocklistEntry  string   `json:"blocklist_entry,omitempty"` // The target or the subnet containing it
+	InFilterChain   bool     `json:"in_filter_chain"`
+	FilterEntry     string   `json:"filter_entry,omitempty"`
+	InRedirectChain bool     `json:"in_redirect_chain"`
+	RedirectEntry   string   `json:"redirect_entry,omitempty"`
+	Mismatch        bool     `json:"mismatch"`
+	Problems        []string `json:"problems,omitempty"`
+	Error           string   `json:"error,omitempty"` // Set if the firewall could not be read; the chain fields are then unknown
+}
+
+// coveringEntry returns the entry of entries that equals target or, for an address or a
+// smaller range, contains it; "" if there is none.
+func coveringEntry(entries []string, target string) string {
+	target = hostForm(target)
+	ip := net.ParseIP(target)
+	ones := -1
+	if ip == nil {
+		if _, targetNet, err := net.ParseCIDR(target); err == nil {
+			ip = targetNet.IP
+			ones, _ = targetNet.Mask.Size()
+		}
+	}
+	for _, entry := range entries {
+		entry = hostForm(entry)
+		if entry == target {
+			return entry
+		}
+		if _, entryNet, err := net.ParseCIDR(entry); err == nil && ip != nil && entryNet.Contains(ip) {
+			if entryOnes, _ := entryNet.Mask.Size(); entryOnes <= ones || ones < 0 {
+				return entry
+			}
+		}
+	}
+	return ""
+}
+
+// checkFirewallState compares a target's blocklist entry with the block and redirect
+// rules the backend reports. The blocklist must already be loaded.
+func checkFirewallState(manager FirewallManager, target string) *FirewallCheck {
+	target = normalizeTarget(target)
+	check := &FirewallCheck{Target: target, Country: ipCountry(target), ASN: ipASN(target)}
+	mu.Lock()
+	entries := make([]string, 0, len(blockedIPs)+len(blockedSubnets))
+	for ip := range blockedIPs {
+		entries = append(entries, ip)
+	}
+	for subnet := range blockedSubnets {
+		entries = append(entries, subnet)
+	}
+	mu.Unlock()
+	check.BlocklistEntry = coveringEntry(entries, target)
+	check.InBlocklist = check.BlocklistEntry != ""
+
+	lister, ok := manager.(ruleLister)
+	if !ok {
+		check.Error = fmt.Sprintf("the %s backend cannot list its rules", firewallType)
+		if dryRun {
+			check.Error = "dry-run mode applies no firewall rules"
+		}
+		return check
+	}
+	blockTargets, err := lister.ListRuleTargets(false)
+	if err != nil {
+		check.Error = fmt.Sprintf("failed to list block rules: %v", err)
+		return check
+	}
+	check.FilterEntry = coveringEntry(blockTargets, target)
+	check.InFilterChain = check.FilterEntry != ""
+
+	redirectTargets, err := lister.ListRuleTargets(true)
+	if err != nil {
+		if challengeEnable {
+			check.Error = fmt.Sprintf("failed to list redirect rules: %v", err)
+			return check
+		}
+		// Outside challenge mode the redirect chain may simply not exist
+		if debug {
+			log.Printf("Could not list redirect rules: %v", err)
+		}
+	}
+	check.RedirectEntry = coveringEntry(redirectTargets, target)
+	check.InRedirectChain = check.RedirectEntry != ""
+
+	wantFilter := check.InBlocklist && !challengeEnable
+	wantRedirect := check.InBlocklist && challengeEnable
+	switch {
+	case wantFilter && !check.InFilterChain:
+		check.Problems = append(check.Problems, "in the blocklist but the firewall has no block rule for it")
+	case !wantFilter && check.InFilterChain:
+		check.Problems = append(check.Problems, fmt.Sprintf("block rule for %s in the firewall but not in the blocklist", check.FilterEntry))
+	}
+	switch {
+	case wantRedirect && !check.InRedirectChain:
+		check.Problems = append(check.Problems, "in the blocklist but the firewall has no redirect rule for it")
+	case !wantRedirect && check.InRedirectChain:
+		check.Problems = append(check.Problems, fmt.Sprintf("redirect rule for %s in the firewall but not in the blocklist", check.RedirectEntry))
+	}
+	check.Mismatch = len(check.Problems) > 0
+	return check
+}
+
+// String formats the check as the lines added to -check output.
+func (c *FirewallCheck) String() string {
+	yesNo := func(present bool, entry string) string {
+		if !present {
+			return "no"
+		}
+		if entry != "" && entry != c.Target {
+			return "yes (" + entry + ")"
+		}
+		return "yes"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "In blocklist: %s", yesNo(c.InBlocklist, c.BlocklistEntry))
+	if c.Country != "" {
+		fmt.Fprintf(&b, "\nCountry: %s", c.Country)
+	}
+	if c.ASN != "" {
+		fmt.Fprintf(&b, "\nNetwork: %s", c.ASN)
+	}
+	if c.Error != "" {
+		fmt.Fprintf(&b, "\nFirewall state unknown: %s", c.Error)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nIn filter chain: %s", yesNo(c.InFilterChain, c.FilterEntry))
+	fmt.Fprintf(&b, "\nIn redirect chain: %s", yesNo(c.InRedirectChain, c.RedirectEntry))
+	for _, problem := range c.Problems {
+		fmt.Fprintf(&b, "\nMISMATCH: %s", problem)
+	}
+	return b.String()
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"sort"
 	"strings"
 )
 
@@ -16,10 +18,31 @@ const (
 	CheckCommand   ClientCommand = "check"
 	ListCommand    ClientCommand = "list"
 	DebugCommand   ClientCommand = "debug"
+	StatusCommand  ClientCommand = "status"
+	AllowCommand   ClientCommand = "allow"
+	ExportCommand  ClientCommand = "export"
+	RestoreCommand ClientCommand = "restore"
+	ImportCommand  ClientCommand = "import"
+	TraceCommand   ClientCommand = "trace"
+	StatsCommand   ClientCommand = "stats"
+	ReloadCommand  ClientCommand = "reload"
+
+	EnableRuleCommand  ClientCommand = "enable-rule"
+	DisableRuleCommand ClientCommand = "disable-rule"
+	ShowRulesCommand   ClientCommand = "show-rules"
+
+	WhitelistAddCommand    ClientCommand = "whitelist-add"
+	WhitelistRemoveCommand ClientCommand = "whitelist-remove"
+	WhitelistListCommand   ClientCommand = "whitelist-list"
 )
 
-// clientBlockIP manually blocks an IP or subnet
-func clientBlockIP(target string) error {
+// clientBlockIP manually blocks an IP or subnet. source ("socket" or "cli") goes into the audit log.
+func clientBlockIP(target, source string) error {
+	target = normalizeTarget(target)
+	if !isValidIPOrCIDR(target) {
+		return fmt.Errorf("invalid IP address or CIDR range: %s", target)
+	}
+
 	// Check if it's already blocked
 	isBlocked, subnet, err := isIPBlocked(target)
 	if err != nil {
@@ -35,42 +58,41 @@ func clientBlockIP(target string) error {
 		return nil
 	}
 
+	// A manual block ends an earlier -unblock -force
+	mu.Lock()
+	delete(feedExclusions, target)
+	mu.Unlock()
+
 	// Determine if it's an IP or subnet
 	if strings.Contains(target, "/") {
 		// It's a subnet
-		mu.Lock()
-		blockedSubnets[target] = struct{}{}
-		mu.Unlock()
-
 		// Use fwManager method
-		var addErr error
-		if challengeEnable {
-			addErr = fwManager.AddRedirectRule(target)
-		} else {
-			addErr = fwManager.AddBlockRule(target)
-		}
+		addErr := addFirewallRule(target, RuleOptions{Reason: "manual block"})
 		if addErr != nil {
 			return fmt.Errorf("failed to add firewall rule for subnet %s: %v", target, addErr)
 		}
 
-		fmt.Printf("Blocked subnet: %s\n", target)
-	} else {
-		// It's an IP
+		// Only record the block once the rule has landed
 		mu.Lock()
-		blockedIPs[target] = struct{}{}
+		addBlockedSubnetLocked(target)
+		recordBlockMetaLocked(target, "manual block", "")
 		mu.Unlock()
 
+		fmt.Printf("Blocked subnet: %s\n", target)
+	} else {
+		// It's an IP
 		// Use fwManager method
-		var addErr error
-		if challengeEnable {
-			addErr = fwManager.AddRedirectRule(target)
-		} else {
-			addErr = fwManager.AddBlockRule(target)
-		}
+		addErr := addFirewallRule(target, RuleOptions{Reason: "manual block"})
 		if addErr != nil {
 			return fmt.Errorf("failed to add firewall rule for IP %s: %v", target, addErr)
 		}
 
+		// Only record the block once the rule has landed
+		mu.Lock()
+		blockedIPs[target] = struct{}{}
+		recordBlockMetaLocked(target, "manual block", "")
+		mu.Unlock()
+
 		fmt.Printf("Blocked IP: %s\n", target)
 	}
 
@@ -78,33 +100,78 @@ func clientBlockIP(target string) error {
 	if err := saveBlockList(); err != nil {
 		log.Printf("Warning: Failed to save blocklist after blocking %s: %v", target, err)
 	}
+	publishPeerBlock(target)
+	writeAudit(auditRecord{Action: "block", Target: target, Reason: "manual block", Source: source})
 
 	return nil
 }
 
-// clientUnblockIP manually unblocks an IP or subnet
-func clientUnblockIP(target string) error {
+// clientUnblockIP manually unblocks an IP or subnet and passes the unblock on to the peers.
+// source ("socket", "cli" or "challenge") goes into the audit log. With restoreMembers, the
+// IPs a subnet absorbed are blocked again individually.
+func clientUnblockIP(target, source string, restoreMembers bool) error {
+	unblocked, err := unblockTarget(target, restoreMembers)
+	if unblocked {
+		publishPeerUnblock(normalizeTarget(target))
+		writeAudit(auditRecord{Action: "unblock", Target: normalizeTarget(target), Source: source})
+	}
+	return err
+}
+
+// unblockTarget removes an IP or subnet from the blocklist and the firewall, reporting
+// whether it was blocked. With restoreMembers, the members of a subnet (the IPs folded
+// into an aggregate or absorbed by a subnet block) are blocked again individually.
+func unblockTarget(target string, restoreMembers bool) (bool, error) {
+	target = normalizeTarget(target)
+
 	// Check if it's blocked
-	isBlocked, _, err := isIPBlocked(target)
+	isBlocked, subnet, err := isIPBlocked(target)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if !isBlocked {
 		fmt.Printf("%s is not blocked\n", target)
-		return nil
+		return false, nil
+	}
+	if subnet != "" && strings.Contains(target, "/") {
+		return false, fmt.Errorf("%s is part of the blocked subnet %s; unblock %s instead", target, subnet, subnet)
+	}
+
+	// An IP folded into an aggregate, or absorbed by a subnet block, is unblocked by
+	// splitting the subnet
+	if subnet != "" && splitAggregate(subnet, target) {
+		mu.Lock()
+		delete(blockOffenses, target)
+		mu.Unlock()
+		fmt.Printf("Unblocked: %s\n", target)
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: Failed to save blocklist after unblocking %s: %v", target, err)
+		}
+		return true, nil
 	}
 
-	// Remove from blocklist and access log
+	// Remove from blocklist and access log. A manual unblock also forgives earlier
+	// offenses, so the next automatic block starts again at the base duration.
+	var members map[string]BlockEntry
 	mu.Lock()
+	delete(blockOffenses, target)
 	if strings.Contains(target, "/") {
-		delete(blockedSubnets, target)
+		if meta := blockedMeta[target]; meta != nil && restoreMembers && len(meta.Members) > 0 {
+			members = make(map[string]BlockEntry, len(meta.Members))
+			for _, member := range meta.Members {
+				members[member.Address] = member
+			}
+		}
+		removeBlockedSubnetLocked(target)
+		forgetEntryMetaLocked(target)
 		delete(subnetBlockedIPs, target)
 		_, subnet, err := net.ParseCIDR(target)
 		if err == nil {
 			for ip := range ipAccessLog {
 				if parsedIP := net.ParseIP(ip); parsedIP != nil && subnet.Contains(parsedIP) {
 					delete(ipAccessLog, ip)
+					delete(ipScores, ip)
 					if debug {
 						log.Printf("Removed access log entry for IP %s (in unblocked subnet %s)", ip, target)
 					}
@@ -113,7 +180,9 @@ func clientUnblockIP(target string) error {
 		}
 	} else {
 		delete(blockedIPs, target)
+		forgetEntryMetaLocked(target)
 		removeBlockInfo(target)
+		delete(ipScores, target)
 		if _, exists := ipAccessLog[target]; exists {
 			delete(ipAccessLog, target)
 			if debug {
@@ -141,13 +210,17 @@ func clientUnblockIP(target string) error {
 	}
 
 	fmt.Printf("Unblocked: %s\n", target)
+	if len(members) > 0 {
+		changes := applyBlockListChanges(members, nil, "restoring the members of "+target)
+		fmt.Printf("Restored the individual blocks %s had absorbed: %s\n", target, changes)
+	}
 
 	// Save the blocklist
 	if err := saveBlockList(); err != nil {
 		log.Printf("Warning: Failed to save blocklist after unblocking %s: %v", target, err)
 	}
 
-	return nil
+	return true, nil
 }
 
 // clientCheckIP checks if an IP or subnet is blocked
@@ -156,16 +229,21 @@ func clientCheckIP(target string) error {
 	if err != nil {
 		return err
 	}
-
-	if isBlocked {
-		if subnet != "" {
-			fmt.Printf("%s is blocked (contained in subnet %s)\n", target, subnet)
-		} else {
-			fmt.Printf("%s is blocked\n", target)
+	fmt.Println(blockStateText(target, isBlocked, subnet))
+
+	// Without a server, read the firewall through a manager that is not set up, since
+	// Setup would rebuild the chain
+	manager := fwManager
+	if manager == nil {
+		if manager, err = newFirewallManager(); err != nil {
+			fmt.Printf("Firewall state unknown: %v\n", err)
+			return nil
+		}
+		if prober, ok := manager.(interface{ probeIPv6() }); ok {
+			prober.probeIPv6()
 		}
-	} else {
-		fmt.Printf("%s is not blocked\n", target)
 	}
+	fmt.Println(checkFirewallState(manager, target))
 
 	return nil
 }
@@ -180,33 +258,58 @@ func clientListBlocked() error {
 		return nil
 	}
 
+	if dryRun {
+		fmt.Println(dryRunListHeader)
+	}
 	fmt.Println("Blocked IPs and subnets:")
 
 	// Print blocked IPs
 	for ip := range blockedIPs {
-		fmt.Printf("IP: %s\n", ip)
+		fmt.Printf("IP: %s%s\n", ip, entryNoteLocked(ip))
 	}
 
 	// Print blocked subnets
 	for subnet := range blockedSubnets {
-		fmt.Printf("Subnet: %s\n", subnet)
+		fmt.Printf("Subnet: %s%s\n", subnet, entryNoteLocked(subnet))
 	}
 
 	return nil
 }
 
+// dryRunListHeader is printed above list output in dry-run mode
+const dryRunListHeader = "DRY-RUN mode: these entries are simulated, no firewall rules were applied"
+
+// simulatedNote marks check results as simulated in dry-run mode
+func simulatedNote() string {
+	if dryRun {
+		return " (simulated, dry-run)"
+	}
+	return ""
+}
+
 // isIPBlocked checks if an IP or subnet is blocked
 // Returns: isBlocked, containingSubnet, error
 // If the IP is directly blocked, containingSubnet will be empty
 // If the IP is blocked because it's in a subnet, containingSubnet will contain that subnet
 func isIPBlocked(target string) (bool, string, error) {
+	target = normalizeTarget(target)
+
 	mu.Lock()
 	defer mu.Unlock()
 
-	// Check if it's a subnet
+	// Check if it's a subnet, blocked itself or as part of a larger blocked subnet
 	if strings.Contains(target, "/") {
-		_, exists := blockedSubnets[target]
-		return exists, "", nil
+		if _, exists := blockedSubnets[target]; exists {
+			return true, "", nil
+		}
+		prefix, err := netip.ParsePrefix(target)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid CIDR range: %s", target)
+		}
+		if subnet, covered := blockedSubnetRanges.covering(prefix.Addr(), prefix.Bits()); covered {
+			return true, subnet, nil
+		}
+		return false, "", nil
 	}
 
 	// Check if it's an IP
@@ -215,26 +318,85 @@ func isIPBlocked(target string) (bool, string, error) {
 	}
 
 	// Check if the IP is in a blocked subnet
-	ip := net.ParseIP(target)
-	if ip == nil {
+	ip, err := netip.ParseAddr(target)
+	if err != nil {
 		return false, "", fmt.Errorf("invalid IP address: %s", target)
 	}
 
+	if subnet, covered := blockedSubnetRanges.covering(ip, -1); covered {
+		return true, subnet, nil
+	}
+
+	return false, "", nil
+}
+
+// blockedWithin returns the blocked IPs and subnets inside the range target, sorted; nil if
+// target is an address.
+func blockedWithin(target string) []string {
+	prefix, err := netip.ParsePrefix(normalizeTarget(target))
+	if err != nil {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var within []string
+	for ip := range blockedIPs {
+		if addr, err := netip.ParseAddr(ip); err == nil && prefix.Contains(addr) {
+			within = append(within, ip)
+		}
+	}
 	for subnet := range blockedSubnets {
-		_, ipNet, err := net.ParseCIDR(subnet)
-		if err != nil {
-			continue
+		if other, err := netip.ParsePrefix(subnet); err == nil && other.Bits() > prefix.Bits() && prefix.Contains(other.Addr()) {
+			within = append(within, subnet)
 		}
+	}
+	sort.Strings(within)
+	return within
+}
 
-		if ipNet.Contains(ip) {
-			return true, subnet, nil
+// blockStateText describes target for check output given the result of isIPBlocked, e.g.
+// "203.0.113.0/25 is blocked (contained in subnet 203.0.113.0/24)". A range that is not
+// blocked itself but holds blocked entries is "partially blocked", with up to 10 of them.
+func blockStateText(target string, isBlocked bool, subnet string) string {
+	if isBlocked {
+		state := blockedState(target, subnet)
+		if subnet != "" {
+			return fmt.Sprintf("%s is %s%s (contained in subnet %s)%s", target, state, simulatedNote(), subnet, expiryNote(subnet))
 		}
+		return fmt.Sprintf("%s is %s%s%s", target, state, simulatedNote(), expiryNote(target))
+	}
+	within := blockedWithin(target)
+	if len(within) == 0 {
+		return fmt.Sprintf("%s is not blocked", target)
 	}
+	noun := "entries"
+	if len(within) == 1 {
+		noun = "entry"
+	}
+	listed := within
+	more := ""
+	if len(listed) > 10 {
+		listed, more = listed[:10], fmt.Sprintf(" and %d more", len(within)-10)
+	}
+	return fmt.Sprintf("%s is partially blocked%s: %d blocked %s within it (%s%s)", target, simulatedNote(), len(within), noun, strings.Join(listed, ", "), more)
+}
 
-	return false, "", nil
+// blockedState describes a blocked target for check output: "rate limited" when its
+// entry (the containing subnet, if given) uses the ratelimit action, otherwise "blocked".
+func blockedState(target, subnet string) string {
+	entry := normalizeTarget(target)
+	if subnet != "" {
+		entry = subnet
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if entryAction(entry) == "ratelimit" && !challengeEnable {
+		return "rate limited"
+	}
+	return "blocked"
 }
 
-// isValidIPOrCIDR validates an IP address or CIDR range
+// isValidIPOrCIDR validates an IPv4 or IPv6 address or CIDR range
 func isValidIPOrCIDR(target string) bool {
 	// Check if it's a CIDR range
 	if strings.Contains(target, "/") {
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -18,6 +21,12 @@ const (
 
 // readConfigFile reads configuration settings from a file
 func readConfigFile(configPath string) error {
+	return readConfigKeys(configPath, nil)
+}
+
+// readConfigKeys is readConfigFile applying only the keys in only, or all of them if only
+// is nil.
+func readConfigKeys(configPath string, only map[string]bool) error {
 	// Check if the file exists
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		if debug {
@@ -38,6 +47,7 @@ func readConfigFile(configPath string) error {
 
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
+	logPathSet := false // Repeated logPath keys add directories
 	for scanner.Scan() {
 		lineNum++
 		line := strings.TrimSpace(scanner.Text())
@@ -56,58 +66,326 @@ func readConfigFile(configPath string) error {
 
 		key := strings.TrimSpace(parts[0])
 		value := strings.TrimSpace(parts[1])
+		if only != nil && !only[key] {
+			continue
+		}
 
 		// Apply the configuration
 		switch key {
 		case "server":
-			if value == "apache" || value == "caddy" {
-				logFormat = value
-				// Keep this log minimal unless debugging
-				// log.Printf("Config: Set server to %s", value)
-			} else {
-				log.Printf("Warning: Invalid server value: %s", value)
+			// Custom formats are not loaded yet, so main checks the name
+			logFormat = value
+			if debug {
+				log.Printf("Config: Set server to %s", value)
 			}
 		case "logPath":
-			if _, err := os.Stat(value); err == nil {
-				logpath = value
-				// Keep this log minimal unless debugging
-				// log.Printf("Config: Set logPath to %s", value)
-			} else {
-				log.Printf("Warning: Invalid logPath value: %s", value)
+			// Missing directories are watched for once they appear
+			addLogPath(value, !logPathSet)
+			logPathSet = true
+			if debug {
+				log.Printf("Config: Set logPath to %s", logpath)
 			}
 		case "whitelist":
 			whitelistFilePath = value
 			if debug {
 				log.Printf("Config: Set whitelist to %s", value)
 			}
+		case "whitelistRefreshInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				whitelistRefreshInterval = duration
+				if debug {
+					log.Printf("Config: Set whitelistRefreshInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid whitelistRefreshInterval value: %s", value)
+			}
 		case "domainWhitelist":
 			domainWhitelistPath = value
 			if debug {
 				log.Printf("Config: Set domainWhitelist to %s", value)
 			}
+		case "dnsCacheTTL":
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				dnsCacheTTL = duration
+				if debug {
+					log.Printf("Config: Set dnsCacheTTL to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid dnsCacheTTL value: %s", value)
+			}
+		case "dnsNegativeCacheTTL":
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				dnsNegativeCacheTTL = duration
+				if debug {
+					log.Printf("Config: Set dnsNegativeCacheTTL to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid dnsNegativeCacheTTL value: %s", value)
+			}
+		case "dnsLookupTimeout":
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				dnsLookupTimeout = duration
+				if debug {
+					log.Printf("Config: Set dnsLookupTimeout to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid dnsLookupTimeout value: %s", value)
+			}
+		case "dnsCacheSize":
+			if val, err := strconv.Atoi(value); err == nil && val > 0 {
+				dnsCacheSize = val
+				if debug {
+					log.Printf("Config: Set dnsCacheSize to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid dnsCacheSize value: %s", value)
+			}
+		case "dnsMaxLookups":
+			if val, err := strconv.Atoi(value); err == nil && val > 0 {
+				dnsMaxLookups = val
+				if debug {
+					log.Printf("Config: Set dnsMaxLookups to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid dnsMaxLookups value: %s", value)
+			}
+		case "whitelistSearchBots":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				whitelistSearchBots = bVal
+				if debug {
+					log.Printf("Config: Set whitelistSearchBots to %v", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid whitelistSearchBots value: %s", value)
+			}
+		case "searchBotDomains":
+			searchBotDomains = parseSearchBotDomains(value)
+			if debug {
+				log.Printf("Config: Set searchBotDomains to %s", searchBotDomainList(searchBotDomains))
+			}
 		case "blocklist":
 			blocklistFilePath = value
 			if debug {
 				log.Printf("Config: Set blocklist to %s", value)
 			}
+		case "storage":
+			if value == "json" || value == "sqlite" {
+				storage = value
+				if debug {
+					log.Printf("Config: Set storage to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid storage value: %s (must be 'json' or 'sqlite')", value)
+			}
+		case "storageDBPath":
+			storageDBPath = value
+			if debug {
+				log.Printf("Config: Set storageDBPath to %s", value)
+			}
+		case "rulesDir":
+			rulesDir = value
+			if debug {
+				log.Printf("Config: Set rulesDir to %s", value)
+			}
+		case "rulesURL":
+			if value == "" || strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+				rulesURL = value
+				if debug {
+					log.Printf("Config: Set rulesURL to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid rulesURL: %s (must be http or https)", value)
+			}
+		case "rulesRefreshInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				rulesRefreshInterval = duration
+				if debug {
+					log.Printf("Config: Set rulesRefreshInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid rulesRefreshInterval value: %s", value)
+			}
+		case "rulesSHA256":
+			// Kept even if invalid, so that the fetched rules are refused rather than
+			// loaded unchecked
+			rulesSHA256 = value
+			if sum, err := hex.DecodeString(value); value != "" && (err != nil || len(sum) != sha256.Size) {
+				log.Printf("Warning: Invalid rulesSHA256 value: %s (must be 64 hex digits)", value)
+			} else if debug {
+				log.Printf("Config: Set rulesSHA256 to %s", value)
+			}
+		case "rulesPublicKey":
+			rulesPublicKey = value
+			if _, _, err := parsePublicKey(value); value != "" && err != nil {
+				log.Printf("Warning: Invalid rulesPublicKey: %v", err)
+			} else if debug {
+				log.Printf("Config: Set rulesPublicKey to %s", value)
+			}
+		case "rulesSignatureURL":
+			rulesSignatureURL = value
+			if debug {
+				log.Printf("Config: Set rulesSignatureURL to %s", value)
+			}
 		case "rules":
 			rulesFilePath = value
 			if debug {
 				log.Printf("Config: Set rules to %s", value)
 			}
+		case "overrides":
+			overridesPath = value
+			if debug {
+				log.Printf("Config: Set overrides to %s", value)
+			}
+		case "logFormats":
+			logFormatsPath = value
+			if debug {
+				log.Printf("Config: Set logFormats to %s", value)
+			}
 		case "firewallChain": // Renamed from table
 			firewallChain = value
 			if debug {
 				log.Printf("Config: Set firewallChain to %s", value)
 			}
 		case "firewallType": // New
-			if value == "iptables" || value == "nftables" {
+			if value == "iptables" || value == "nftables" || value == "cloudflare" || value == "pf" || value == "denyfile" || value == "caddy" {
 				firewallType = value
 				if debug {
 					log.Printf("Config: Set firewallType to %s", value)
 				}
 			} else {
-				log.Printf("Warning: Invalid firewallType value: %s (must be 'iptables' or 'nftables')", value)
+				log.Printf("Warning: Invalid firewallType value: %s (must be 'iptables', 'nftables', 'cloudflare', 'pf', 'denyfile' or 'caddy')", value)
+			}
+		case "denyFilePath":
+			denyFilePath = value
+			if debug {
+				log.Printf("Config: Set denyFilePath to %s", value)
+			}
+		case "denyFileFormat":
+			if value == "apache" || value == "nginx" {
+				denyFileFormat = value
+				if debug {
+					log.Printf("Config: Set denyFileFormat to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid denyFileFormat value: %s (must be 'apache' or 'nginx')", value)
+			}
+		case "reloadCommand":
+			reloadCommand = value
+			if debug {
+				log.Printf("Config: Set reloadCommand to %s", value)
+			}
+		case "caddyAdminURL":
+			caddyAdminURL = value
+			if debug {
+				log.Printf("Config: Set caddyAdminURL to %s", value)
+			}
+		case "caddyServer":
+			caddyServer = value
+			if debug {
+				log.Printf("Config: Set caddyServer to %s", value)
+			}
+		case "caddyAdminToken":
+			caddyAdminToken = value
+			if debug {
+				log.Printf("Config: Set caddyAdminToken")
+			}
+		case "cloudflareAPIToken":
+			cloudflareAPIToken = value
+			if debug {
+				log.Printf("Config: Set cloudflareAPIToken")
+			}
+		case "cloudflareZoneID":
+			cloudflareZoneID = value
+			if debug {
+				log.Printf("Config: Set cloudflareZoneID to %s", value)
+			}
+		case "attachChains":
+			var chains []string
+			for _, chain := range strings.Split(value, ",") {
+				if chain = strings.TrimSpace(chain); chain != "" {
+					chains = append(chains, chain)
+				}
+			}
+			if len(chains) > 0 {
+				attachChains = chains
+				if debug {
+					log.Printf("Config: Set attachChains to %s", strings.Join(chains, ","))
+				}
+			} else {
+				log.Printf("Warning: Invalid attachChains value: %s (must list at least one chain)", value)
+			}
+		case "iptablesPath":
+			iptablesPath = value
+			if debug {
+				log.Printf("Config: Set iptablesPath to %s", value)
+			}
+		case "ip6tablesPath":
+			ip6tablesPath = value
+			if debug {
+				log.Printf("Config: Set ip6tablesPath to %s", value)
+			}
+		case "useIPSet":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				useIPSet = bVal
+				if debug {
+					log.Printf("Config: Set useIPSet to %t", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid useIPSet value: %s (must be true or false)", value)
+			}
+		case "dryRun":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				dryRun = bVal
+				if debug {
+					log.Printf("Config: Set dryRun to %t", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid dryRun value: %s (must be true or false)", value)
+			}
+		case "removeRulesOnExit":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				removeRulesOnExit = bVal
+				if debug {
+					log.Printf("Config: Set removeRulesOnExit to %t", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid removeRulesOnExit value: %s (must be true or false)", value)
+			}
+		case "blockAction":
+			if value == "drop" || value == "reject" || value == "ratelimit" {
+				blockAction = value
+				if debug {
+					log.Printf("Config: Set blockAction to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid blockAction value: %s (must be 'drop', 'reject' or 'ratelimit')", value)
+			}
+		case "rateLimit":
+			if isValidRate(value) {
+				rateLimit = value
+				if debug {
+					log.Printf("Config: Set rateLimit to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid rateLimit value: %s (must be like 10/min; units sec, min, hour, day)", value)
+			}
+		case "blockScope":
+			if value == "web" || value == "all" {
+				blockScope = value
+				if debug {
+					log.Printf("Config: Set blockScope to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid blockScope value: %s (must be 'web' or 'all')", value)
+			}
+		case "blockPorts":
+			if ports, err := parsePortList(value); err == nil {
+				blockPorts = ports
+				if debug {
+					log.Printf("Config: Set blockPorts to %s", strings.Join(ports, ","))
+				}
+			} else {
+				log.Printf("Warning: Invalid blockPorts value: %s (%v)", value, err)
 			}
 		case "apiKey":
 			apiKey = value
@@ -137,6 +415,24 @@ func readConfigFile(configPath string) error {
 			} else {
 				log.Printf("Warning: Invalid verbose value: %s (must be true or false)", value)
 			}
+		case "verboseSampleRate":
+			if val, err := strconv.Atoi(value); err == nil && val >= 1 {
+				verboseSampleRate = val
+				if debug {
+					log.Printf("Config: Set verboseSampleRate to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid verboseSampleRate value: %s (must be 1 or more)", value)
+			}
+		case "verboseMatchOnly":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				verboseMatchOnly = bVal
+				if debug {
+					log.Printf("Config: Set verboseMatchOnly to %v", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid verboseMatchOnly value: %s (must be true or false)", value)
+			}
 		case "expirationPeriod":
 			if duration, err := time.ParseDuration(value); err == nil {
 				expirationPeriod = duration
@@ -146,6 +442,33 @@ func readConfigFile(configPath string) error {
 			} else {
 				log.Printf("Warning: Invalid expirationPeriod value: %s", value)
 			}
+		case "scoreThreshold":
+			if val, err := strconv.ParseFloat(value, 64); err == nil && val >= 0 {
+				scoreThreshold = val
+				if debug {
+					log.Printf("Config: Set scoreThreshold to %g", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid scoreThreshold value: %s", value)
+			}
+		case "scoreHalfLife":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				scoreHalfLife = duration
+				if debug {
+					log.Printf("Config: Set scoreHalfLife to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid scoreHalfLife value: %s", value)
+			}
+		case "matchAll":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				matchAll = bVal
+				if debug {
+					log.Printf("Config: Set matchAll to %v", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid matchAll value: %s (must be true or false)", value)
+			}
 		case "threshold":
 			var val int
 			if _, err := fmt.Sscanf(value, "%d", &val); err == nil {
@@ -175,9 +498,59 @@ func readConfigFile(configPath string) error {
 			} else {
 				log.Printf("Warning: Invalid disableSubnetBlocking value: %s (must be true or false)", value)
 			}
+		case "subnetBlockMode":
+			if value == "fixed" || value == "announced" {
+				subnetBlockMode = value
+				if debug {
+					log.Printf("Config: Set subnetBlockMode to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid subnetBlockMode value: %s (must be fixed or announced)", value)
+			}
+		case "subnetMinPrefix":
+			if val, err := strconv.Atoi(value); err == nil && val >= 8 && val <= 32 {
+				subnetMinPrefix = val
+				if debug {
+					log.Printf("Config: Set subnetMinPrefix to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid subnetMinPrefix value: %s (must be 8 to 32)", value)
+			}
+		case "subnetMinPrefix6":
+			if val, err := strconv.Atoi(value); err == nil && val >= 16 && val <= 128 {
+				subnetMinPrefix6 = val
+				if debug {
+					log.Printf("Config: Set subnetMinPrefix6 to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid subnetMinPrefix6 value: %s (must be 16 to 128)", value)
+			}
+		case "asnDBPath":
+			asnDBPath = value
+			if debug {
+				log.Printf("Config: Set asnDBPath to %s", value)
+			}
+		case "processRotated":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				processRotated = bVal
+				if debug {
+					log.Printf("Config: Set processRotated to %t", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid processRotated value: %s (must be true or false)", value)
+			}
+		case "processRotatedMaxAge":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				processRotatedMaxAge = duration
+				if debug {
+					log.Printf("Config: Set processRotatedMaxAge to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid processRotatedMaxAge value: %s", value)
+			}
 		case "startupLines":
 			var val int
-			if _, err := fmt.Sscanf(value, "%d", &val); err == nil {
+			if _, err := fmt.Sscanf(value, "%d", &val); err == nil && val >= -1 {
 				startupLines = val
 				if debug {
 					log.Printf("Config: Set startupLines to %d", val)
@@ -185,6 +558,217 @@ func readConfigFile(configPath string) error {
 			} else {
 				log.Printf("Warning: Invalid startupLines value: %s", value)
 			}
+		case "startupWindow":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				startupWindow = duration
+				if debug {
+					log.Printf("Config: Set startupWindow to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid startupWindow value: %s", value)
+			}
+		case "matchWorkers":
+			if val, err := strconv.Atoi(value); err == nil && val >= 0 {
+				matchWorkers = val
+				if debug {
+					log.Printf("Config: Set matchWorkers to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid matchWorkers value: %s", value)
+			}
+		case "matchQueueSize":
+			if val, err := strconv.Atoi(value); err == nil && val > 0 {
+				matchQueueSize = val
+				if debug {
+					log.Printf("Config: Set matchQueueSize to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid matchQueueSize value: %s", value)
+			}
+		case "maxLineLength":
+			if val, err := strconv.Atoi(value); err == nil && val >= 0 {
+				maxLineLength = val
+				if debug {
+					log.Printf("Config: Set maxLineLength to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid maxLineLength value: %s", value)
+			}
+		case "reconcileInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				reconcileInterval = duration
+				if debug {
+					log.Printf("Config: Set reconcileInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid reconcileInterval value: %s", value)
+			}
+		case "blocklistFeeds":
+			var feeds []string
+			for _, feed := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				if strings.HasPrefix(feed, "http://") || strings.HasPrefix(feed, "https://") {
+					feeds = append(feeds, feed)
+				} else {
+					log.Printf("Warning: Invalid blocklistFeeds URL: %s (must be http or https)", feed)
+				}
+			}
+			blocklistFeeds = feeds
+			if debug {
+				log.Printf("Config: Set blocklistFeeds to %s", strings.Join(feeds, ","))
+			}
+		case "blocklistFeedInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				blocklistFeedInterval = duration
+				if debug {
+					log.Printf("Config: Set blocklistFeedInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid blocklistFeedInterval value: %s", value)
+			}
+		case "blocklistBackups":
+			if val, err := strconv.Atoi(value); err == nil && val >= 0 {
+				blocklistBackups = val
+				if debug {
+					log.Printf("Config: Set blocklistBackups to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid blocklistBackups value: %s", value)
+			}
+		case "blocklistBackupInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				blocklistBackupInterval = duration
+				if debug {
+					log.Printf("Config: Set blocklistBackupInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid blocklistBackupInterval value: %s", value)
+			}
+		case "blocklistBackupChanges":
+			if val, err := strconv.Atoi(value); err == nil && val >= 0 {
+				blocklistBackupChanges = val
+				if debug {
+					log.Printf("Config: Set blocklistBackupChanges to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid blocklistBackupChanges value: %s", value)
+			}
+		case "aggregateDensity":
+			if val, err := strconv.ParseFloat(value, 64); err == nil && val >= 0 && val <= 1 {
+				aggregateDensity = val
+				if debug {
+					log.Printf("Config: Set aggregateDensity to %v", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid aggregateDensity value: %s (must be between 0 and 1)", value)
+			}
+		case "aggregateMinIPs":
+			if val, err := strconv.Atoi(value); err == nil && val >= 2 {
+				aggregateMinIPs = val
+				if debug {
+					log.Printf("Config: Set aggregateMinIPs to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid aggregateMinIPs value: %s (must be at least 2)", value)
+			}
+		case "aggregateMinPrefix":
+			if val, err := strconv.Atoi(value); err == nil && val >= 8 && val <= 31 {
+				aggregateMinPrefix = val
+				if debug {
+					log.Printf("Config: Set aggregateMinPrefix to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid aggregateMinPrefix value: %s (must be between 8 and 31)", value)
+			}
+		case "aggregateMinPrefix6":
+			if val, err := strconv.Atoi(value); err == nil && val >= 32 && val <= 127 {
+				aggregateMinPrefix6 = val
+				if debug {
+					log.Printf("Config: Set aggregateMinPrefix6 to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid aggregateMinPrefix6 value: %s (must be between 32 and 127)", value)
+			}
+		case "peers":
+			var endpoints []string
+			for _, endpoint := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				if _, _, err := net.SplitHostPort(endpoint); err == nil {
+					endpoints = append(endpoints, endpoint)
+				} else {
+					log.Printf("Warning: Invalid peers entry: %s (must be host:port)", endpoint)
+				}
+			}
+			peers = endpoints
+			if debug {
+				log.Printf("Config: Set peers to %s", strings.Join(endpoints, ","))
+			}
+		case "peerSecret":
+			peerSecret = value
+			// Never log the secret, even in debug
+		case "peerListen":
+			peerListen = value
+			if debug {
+				log.Printf("Config: Set peerListen to %s", value)
+			}
+		case "peerNodeName":
+			peerNodeName = value
+			if debug {
+				log.Printf("Config: Set peerNodeName to %s", value)
+			}
+		case "firewallCommandTimeout":
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				firewallCommandTimeout = duration
+				if debug {
+					log.Printf("Config: Set firewallCommandTimeout to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid firewallCommandTimeout value: %s", value)
+			}
+		case "firewallCommandRetries":
+			var val int
+			if _, err := fmt.Sscanf(value, "%d", &val); err == nil && val >= 0 {
+				firewallCommandRetries = val
+				if debug {
+					log.Printf("Config: Set firewallCommandRetries to %d", val)
+				}
+			} else {
+				log.Printf("Warning: Invalid firewallCommandRetries value: %s", value)
+			}
+		case "blockDuration":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				blockDuration = duration
+				if debug {
+					log.Printf("Config: Set blockDuration to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid blockDuration value: %s", value)
+			}
+		case "blockEscalation":
+			if factor, err := strconv.ParseFloat(value, 64); err == nil && factor >= 1 {
+				blockEscalation = factor
+				if debug {
+					log.Printf("Config: Set blockEscalation to %v", factor)
+				}
+			} else {
+				log.Printf("Warning: Invalid blockEscalation value (must be at least 1): %s", value)
+			}
+		case "maxBlockDuration":
+			if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+				maxBlockDuration = duration
+				if debug {
+					log.Printf("Config: Set maxBlockDuration to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid maxBlockDuration value: %s", value)
+			}
+		case "reconcileRemoveExtra":
+			if bVal, err := strconv.ParseBool(value); err == nil {
+				reconcileRemoveExtra = bVal
+				if debug {
+					log.Printf("Config: Set reconcileRemoveExtra to %t", bVal)
+				}
+			} else {
+				log.Printf("Warning: Invalid reconcileRemoveExtra value: %s (must be true or false)", value)
+			}
 			// Challenge Feature Configuration Parsing
 		case "challengeEnable":
 			if bVal, err := strconv.ParseBool(value); err == nil {
@@ -241,14 +825,13 @@ func readConfigFile(configPath string) error {
 				log.Printf("Warning: Invalid challengeHTTPPort value: %s (must be between 1 and 65535)", value)
 			}
 		case "trustedProxies":
-			for _, part := range strings.Split(value, ",") {
-				ip := strings.TrimSpace(part)
-				if ip != "" {
-					trustedProxies = append(trustedProxies, ip)
+			if prefixes, err := parseTrustedProxies(value); err == nil {
+				trustedProxies = prefixes
+				if debug {
+					log.Printf("Config: Set trustedProxies to %v", prefixes)
 				}
-			}
-			if debug {
-				log.Printf("Config: Set trustedProxies to %v", trustedProxies)
+			} else {
+				log.Printf("Warning: Invalid trustedProxies value: %v", err)
 			}
 		case "logOutput":
 			if value == "stdout" || value == "syslog" {
@@ -261,6 +844,113 @@ func readConfigFile(configPath string) error {
 			if debug {
 				log.Printf("Config: Set ignoreFiles to %s", value)
 			}
+		case "logDepth":
+			if depth, err := strconv.Atoi(value); err == nil && depth >= 0 {
+				logDepth = depth
+				if debug {
+					log.Printf("Config: Set logDepth to %d", depth)
+				}
+			} else {
+				log.Printf("Warning: Invalid logDepth value: %s (must be 0 or more)", value)
+			}
+		case "timestampLayouts":
+			if err := parseTimestampLayouts(value); err != nil {
+				log.Printf("Warning: Invalid timestampLayouts value: %v", err)
+			} else if debug {
+				log.Printf("Config: Set timestampLayouts to %s", value)
+			}
+		case "formatMap":
+			formatMap = value
+			if debug {
+				log.Printf("Config: Set formatMap to %s", value)
+			}
+		case "errorLogSuffix":
+			errorLogSuffix = value
+			if debug {
+				log.Printf("Config: Set errorLogSuffix to %s", value)
+			}
+		case "watchMode":
+			if value == "auto" || value == "inotify" || value == "poll" {
+				watchMode = value
+				if debug {
+					log.Printf("Config: Set watchMode to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid watchMode value: %s (must be 'auto', 'inotify' or 'poll')", value)
+			}
+		case "pollInterval":
+			if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+				pollInterval = duration
+				if debug {
+					log.Printf("Config: Set pollInterval to %v", duration)
+				}
+			} else {
+				log.Printf("Warning: Invalid pollInterval value: %s", value)
+			}
+		case "logSource":
+			if value == "files" || value == "journald" {
+				logSource = value
+				if debug {
+					log.Printf("Config: Set logSource to %s", value)
+				}
+			} else {
+				log.Printf("Warning: Invalid logSource value: %s (must be 'files' or 'journald')", value)
+			}
+		case "journalUnit":
+			journalUnit = value
+			if debug {
+				log.Printf("Config: Set journalUnit to %s", value)
+			}
+		case "journalCursorFile":
+			journalCursorFile = value
+			if debug {
+				log.Printf("Config: Set journalCursorFile to %s", value)
+			}
+		case "realIPHeader":
+			realIPHeader = value
+			if debug {
+				log.Printf("Config: Set realIPHeader to %s", value)
+			}
+		case "syslogListen":
+			syslogListen = value
+			if debug {
+				log.Printf("Config: Set syslogListen to %s", value)
+			}
+		case "syslogFormats":
+			syslogFormats = value
+			if debug {
+				log.Printf("Config: Set syslogFormats to %s", value)
+			}
+		case "logInclude":
+			logIncludePatterns = parseLogPatterns(key, value)
+			if debug {
+				log.Printf("Config: Set logInclude to %v", logIncludePatterns)
+			}
+		case "logExclude":
+			logExcludePatterns = parseLogPatterns(key, value)
+			if debug {
+				log.Printf("Config: Set logExclude to %v", logExcludePatterns)
+			}
+		case "geoipDBPath":
+			geoipDBPath = value
+			if debug {
+				log.Printf("Config: Set geoipDBPath to %s", value)
+			}
+		case "auditLog":
+			auditLogPath = value
+			if debug {
+				log.Printf("Config: Set auditLog to %s", value)
+			}
+		case "logOffsetsFile":
+			logOffsetsFile = value
+			if debug {
+				log.Printf("Config: Set logOffsetsFile to %s", value)
+			}
+		case "accessStateFile":
+			accessStateFile = value
+			if debug {
+				log.Printf("Config: Set accessStateFile to %s", value)
+			}
 		case "reportEmail":
 			reportEmail = value
 		case "reportSMTPHost":
@@ -292,6 +982,44 @@ func readConfigFile(configPath string) error {
 	return nil
 }
 
+// parsePortList parses a comma-separated list of TCP ports such as "80,443,8080"
+func parsePortList(value string) ([]string, error) {
+	var ports []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		portStr := strconv.Itoa(port)
+		if !seen[portStr] {
+			seen[portStr] = true
+			ports = append(ports, portStr)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ports, nil
+}
+
+// isValidRate reports whether value is a rate such as "10/min" (units sec, min, hour, day)
+func isValidRate(value string) bool {
+	count, unit, ok := strings.Cut(value, "/")
+	if n, err := strconv.Atoi(count); !ok || err != nil || n < 1 {
+		return false
+	}
+	switch unit {
+	case "sec", "min", "hour", "day":
+		return true
+	}
+	return false
+}
+
 // createExampleConfigFile creates an example configuration file with comments and default values
 func createExampleConfigFile(configPath string) error {
 	// Ensure the directory exists
@@ -306,33 +1034,208 @@ func createExampleConfigFile(configPath string) error {
 # This file contains configuration settings for the Apache Block service.
 # Lines starting with # are comments and will be ignored.
 
-# Log format: apache or caddy
+# Log format: apache, apache-vhost (vhost_combined), nginx (combined format), caddy,
+# or the name of a format defined in the log formats file
 server = apache
 
-# Path to log files
+# Directories of log files, separated by commas (or repeat the key)
 logPath = /var/customers/logs
 
+# Levels of directories below each log directory searched for log files: 0 for none,
+# 1 for direct subdirectories, 2 for /var/www/vhosts/<domain>/logs from /var/www/vhosts
+logDepth = 1
+
+# Also monitor the Apache error logs ending in this suffix (e.g. error.log), in the
+# apache-error format, for rules on ModSecurity denials and authentication failures
+# errorLogSuffix = error.log
+
+# Log formats of the files matching globs on their name or path, for servers writing
+# different formats into the same log directories (the other files use server; a text
+# server format also switches to caddy for files whose first line is JSON)
+# formatMap = *caddy*.log=caddy, vhosts-*.log=apache-vhost
+
+# Go time layouts of the bracketed timestamp of apache, apache-vhost and nginx lines, as
+# format=layout pairs (repeat a format for more layouts); Apache's %t and ISO 8601 are
+# always tried after them
+# timestampLayouts = apache=2006-01-02 15:04:05.000, nginx=02.01.2006 15:04:05
+
+# How new log files are found: inotify (fsnotify events, with a full scan every
+# 300 poll intervals), poll (a scan every 10 poll intervals, for NFS and other network
+# file systems), or auto (inotify, switching to poll if a directory cannot be watched).
+# pollInterval is how often files are checked for new lines.
+watchMode = auto
+pollInterval = 1s
+
+# Where log lines come from: files (in logPath) or journald (the systemd journal, see
+# README). journalUnit limits the journal to these units, separated by commas.
+logSource = files
+# journalUnit = apache2.service
+# journalCursorFile = /etc/apacheblock/journalcursor
+
+# Receive access logs from remote web servers by syslog (udp://, tcp:// or both,
+# separated by commas). syslogFormats gives the log format of senders (IP address,
+# CIDR range or syslog hostname) whose format is not the server format.
+# syslogListen = udp://0.0.0.0:5514,tcp://0.0.0.0:5514
+# syslogFormats = 10.0.1.0/24=caddy,edge1=nginx
+
 # Path to whitelist file
 whitelist = /etc/apacheblock/whitelist.txt
 
+# How often the hostnames in the whitelist file are resolved again (0 = only when the
+# file is read)
+whitelistRefreshInterval = 10m
+
 # Path to domain whitelist file
 domainWhitelist = /etc/apacheblock/domainwhitelist.txt
 
+# The domain whitelist lookups are cached by IP: the verified hostnames for dnsCacheTTL,
+# and no hostname or a failed lookup for dnsNegativeCacheTTL, for up to dnsCacheSize IPs.
+# Each DNS query times out after dnsLookupTimeout, and at most dnsMaxLookups run at once
+dnsCacheTTL = 1h
+dnsNegativeCacheTTL = 10m
+dnsCacheSize = 10000
+dnsLookupTimeout = 2s
+dnsMaxLookups = 16
+
+# Don't count the matches of verified search engine bots (Googlebot, Bingbot, Applebot,
+# ...): clients whose reverse DNS name is in one of their domains and resolves back.
+# searchBotDomains replaces the built-in domains, as domain=name entries
+whitelistSearchBots = false
+# searchBotDomains = googlebot.com=Googlebot,google.com=Googlebot,search.msn.com=Bingbot
+
 # Path to file listing log files to ignore (one basename or full path per line)
 ignoreFiles = /etc/apacheblock/ignorefiles.txt
 
+# Glob patterns, separated by commas, matched against the base name and full path of
+# log files: only files matching logInclude are monitored (all if empty), and files
+# matching logExclude never are. SIGHUP re-reads both.
+# logInclude = *-access.log
+# logExclude = staging-*-access.log,/var/log/apache2/cdn-*
+
 # Path to blocklist file
 blocklist = /etc/apacheblock/blocklist.json
 
-# Path to rules file
+# Where the match counts of IPs not blocked yet are kept across restarts (storage = json;
+# the database keeps them with storage = sqlite). Defaults to accessrecords.json beside
+# the blocklist.
+# accessStateFile = /etc/apacheblock/accessrecords.json
+
+# Where the read offset of each log file is kept across restarts, so reading resumes
+# where it stopped. Defaults to logoffsets.json beside the blocklist.
+# logOffsetsFile = /etc/apacheblock/logoffsets.json
+
+# Append-only audit log: one JSON line per block, unblock and solved challenge, with the
+# rule, the source and the matched log line (empty disables). apacheblock never truncates it.
+# auditLog = /var/log/apacheblock/audit.log
+
+# MaxMind GeoLite2 Country (or City) database, for the countries and excludeCountries of
+# rules and the countries of blocked IPs in the audit log, -list and -check (empty
+# disables). A missing database, or one older than 90 days, is ignored with a warning.
+# geoipDBPath = /var/lib/GeoIP/GeoLite2-Country.mmdb
+
+# MaxMind GeoLite2 ASN database, for the asns of rules, the networks of blocked IPs in
+# -list and -check, and subnetBlockMode = announced (empty disables)
+# asnDBPath = /var/lib/GeoIP/GeoLite2-ASN.mmdb
+
+# Where blocks are kept: json (the blocklist file) or sqlite (storageDBPath, which also
+# keeps the access records across restarts). Switching to sqlite imports the blocklist
+# file once.
+storage = json
+storageDBPath = /etc/apacheblock/apacheblock.db
+
+# Path to rules file (YAML if it ends in .yaml or .yml)
 rules = /etc/apacheblock/rules.json
 
-# Firewall type: iptables or nftables
+# Directory of additional rule files: every *.json, *.yaml and *.yml file in it is read
+# after the rules file, in name order, and a rule named like an earlier one replaces it
+rulesDir = /etc/apacheblock/rules.d
+
+# Fetch the rules file from this URL instead (empty uses the local one), at startup and
+# every rulesRefreshInterval (0 = at startup only). The fetched file must have the
+# SHA-256 checksum rulesSHA256 and a valid signature by rulesPublicKey (a minisign or
+# bare base64 ed25519 key; the signature is at rulesSignatureURL, by default the URL with
+# .minisig appended), where those are set. The last fetched rules are kept in rules.json.remote.
+rulesURL =
+rulesRefreshInterval = 1h
+# rulesSHA256 =
+# rulesPublicKey =
+# rulesSignatureURL =
+
+# Path to the file defining custom log formats (see README)
+# logFormats = /etc/apacheblock/logformats.json
+
+# Path to the file with per-site overrides of the thresholds and rules (see README)
+# overrides = /etc/apacheblock/overrides.json
+
+# Firewall type: iptables, nftables, cloudflare, pf (FreeBSD/OpenBSD, see README),
+# denyfile (web server deny list, see README) or caddy (Caddy admin API, see README)
 firewallType = iptables
 
+# Cloudflare API token (Zone > Firewall Services > Edit) and zone ID, used when
+# firewallType = cloudflare. Blocks become IP Access Rules enforced at the edge.
+cloudflareAPIToken =
+cloudflareZoneID =
+
+# firewallType = denyfile: the file the web server includes, its syntax (apache or
+# nginx), and the command run after it changes (empty runs nothing)
+denyFilePath = /etc/apacheblock/deny.conf
+denyFileFormat = apache
+reloadCommand =
+
+# firewallType = caddy: Caddy's admin API, the server that gets the block route, and a
+# bearer token if the API sits behind an authenticating proxy (empty sends none)
+caddyAdminURL = http://localhost:2019
+caddyServer = srv0
+caddyAdminToken =
+
 # Name of the firewall chain to use for blocking rules (e.g., iptables chain)
 firewallChain = apacheblock
 
+# Comma-separated iptables chains that jump to firewallChain. Add DOCKER-USER to block
+# traffic to published Docker container ports, e.g. attachChains = INPUT,DOCKER-USER
+# (iptables only; the nftables backend always hooks input)
+attachChains = INPUT
+
+# iptables and ip6tables commands to run, e.g. /usr/sbin/iptables-legacy when Docker
+# uses the legacy backend but iptables in PATH is the nf_tables one (empty uses PATH).
+# apacheblock warns at startup when both backends hold rules.
+iptablesPath =
+ip6tablesPath =
+
+# Store blocked addresses in ipsets instead of one iptables rule per address (true/false)
+# Requires the ipset command; falls back to per-address rules if it is missing.
+useIPSet = false
+
+# Deadline for each iptables/ipset/nft command (for iptables, how long to wait for the
+# xtables lock), and how many times a command that hit the xtables lock (or the deadline)
+# is retried with exponential backoff before giving up
+firewallCommandTimeout = 10s
+firewallCommandRetries = 3
+
+# Log what would be blocked without changing the firewall (true/false). Simulated blocks
+# are saved to <blocklist>.dryrun and are never applied once dry-run is turned off.
+dryRun = false
+
+# Remove the firewall chain and rules when the service stops (true/false). The blocklist
+# is still saved and re-applied on the next start.
+removeRulesOnExit = false
+
+# Firewall action for blocked addresses: drop (silently discard), reject (send a TCP reset)
+# or ratelimit (drop new connections above rateLimit). Rules can override it with "action".
+blockAction = drop
+
+# New connections per source allowed by the ratelimit action (units: sec, min, hour, day)
+rateLimit = 10/min
+
+# Comma-separated destination ports to block (a rule's blockPorts replaces them for its
+# offenders). In challenge mode, ports ending in 443 are redirected to challengePort and
+# all others to challengeHTTPPort.
+blockPorts = 80,443
+
+# What to block for an offender: web (only blockPorts) or all (every port and protocol).
+# Challenge mode only redirects blockPorts, so it ignores this setting.
+blockScope = web
+
 # API key for socket authentication (leave empty for no authentication)
 apiKey = 
 
@@ -348,21 +1251,110 @@ logOutput = stdout
 # Enable verbose debug mode (true/false)
 verbose = false
 
+# In verbose mode, trace one processed line in this many, and with verboseMatchOnly only
+# the lines a rule matches
+verboseSampleRate = 1
+verboseMatchOnly = false
+
 # Time period to monitor for malicious activity (e.g., 5m, 10m, 1h)
 expirationPeriod = 5m
 
 # Number of suspicious requests to trigger IP blocking
 threshold = 3
 
+# Block IPs on the sum of the "score" of the rules they matched instead (0 = off); scores
+# halve every scoreHalfLife
+scoreThreshold = 0
+scoreHalfLife = 10m
+
+# Count a line for every rule it matches, each with its own counter, instead of only for
+# the first rule (by priority)
+matchAll = false
+
 # Number of IPs from a subnet to trigger subnet blocking
 subnetThreshold = 3
 
 # Disable automatic subnet blocking (true/false)
 disableSubnetBlocking = false
 
-# Number of log lines to process at startup
+# Subnet blocked for repeat offenders: fixed (their /24 or /64) or announced (the prefix
+# their network announces, per asnDBPath), no broader than subnetMinPrefix and
+# subnetMinPrefix6
+subnetBlockMode = fixed
+subnetMinPrefix = 20
+subnetMinPrefix6 = 32
+
+# Number of log lines to process at startup: -1 for whole files, 0 for new lines only
 startupLines = 5000
 
+# Instead, read log files at startup from their first entry within this window (e.g.
+# 30m); older entries are skipped. Files without timestamps fall back to startupLines.
+# 0 uses startupLines.
+startupWindow = 0
+
+# Also read the rotated copies of the log files (access.log.1, access.log.2.gz, ...) at
+# startup. Only entries within the longest rule duration are processed, or within
+# processRotatedMaxAge if that is shorter (0 = no extra cap).
+processRotated = false
+processRotatedMaxAge = 0
+
+# Goroutines matching log lines against the rules (0 = one per CPU), and how many lines
+# may wait for them before log reading is held back
+matchWorkers = 0
+matchQueueSize = 1000
+
+# Bytes of a log line kept (0 = no limit); the rest of a longer line is discarded, and
+# caddy lines this long are skipped
+maxLineLength = 65536
+
+# How long automatic blocks last before they are lifted (e.g. 24h). 0 keeps them until
+# unblocked. Rules can override it with "blockDuration". With nftables the entries time
+# out in the kernel's sets. Manual blocks are not affected.
+blockDuration = 0
+
+# Repeat offenders: each earlier automatic block multiplies the duration by
+# blockEscalation (1 disables escalation), up to maxBlockDuration (0 = no cap).
+# A manual -unblock resets the count.
+blockEscalation = 2
+maxBlockDuration = 720h
+
+# How often to compare the firewall rules with the blocklist and re-add missing rules
+# (e.g. after a manual flush of the chain). Set to 0 to disable.
+reconcileInterval = 10m
+
+# Also remove firewall rules for addresses that are not in the blocklist (true/false)
+reconcileRemoveExtra = false
+
+# Comma-separated URLs of blocklist feeds: one IP or CIDR per line, with comments after
+# "#" or ";" (e.g. https://www.spamhaus.org/drop/drop.txt). Each refresh blocks the new
+# entries and lifts entries that left the feed; locally blocked entries are kept.
+blocklistFeeds =
+blocklistFeedInterval = 1h
+
+# Rotated backups of the blocklist (blocklist.json.1 is the newest, up to blocklistBackups).
+# A copy is taken when the blocklist changed and blocklistBackupInterval has passed, or once
+# blocklistBackupChanges entries were added or removed. Roll back with -restoreBlocklist 1.
+blocklistBackups = 3
+blocklistBackupInterval = 1h
+blocklistBackupChanges = 100
+
+# Fold individually blocked IPs into covering CIDRs to keep the ruleset small. A CIDR no
+# larger than aggregateMinPrefix (aggregateMinPrefix6 for IPv6) replaces its blocked IPs
+# when at least aggregateMinIPs of them make up at least aggregateDensity of its addresses
+# (e.g. 0.05: 205 IPs of a /20). Unblocking one of them splits the aggregate. 0 disables.
+aggregateDensity = 0
+aggregateMinIPs = 16
+aggregateMinPrefix = 20
+aggregateMinPrefix6 = 120
+
+# Peer synchronization: share blocks with other apacheblock servers (e.g. behind DNS
+# round-robin). List the other servers' peerListen addresses as host:port; each server
+# needs the same peerSecret and lists all the others. peerNodeName defaults to the hostname.
+peers =
+peerSecret =
+peerListen = :7891
+peerNodeName =
+
 # --- Challenge Feature Configuration ---
 
 # Enable the reCAPTCHA challenge feature (true/false)
@@ -388,9 +1380,11 @@ challengeTempWhitelistDuration = 5m
 # Port for the internal HTTP server that redirects to the HTTPS challenge server (listens on HTTP)
 challengeHTTPPort = 8088
 
-# Comma-separated list of trusted reverse proxy IPs
-# Only trust X-Forwarded-For/X-Real-IP headers from these addresses
+# Trusted reverse proxies: IP addresses or CIDR ranges, separated by commas. Only
+# their forwarded headers are trusted, by the challenge server and for log lines, whose
+# client is then taken from the realIPHeader value logged after the User-Agent
 trustedProxies =
+# realIPHeader = X-Forwarded-For
 
 # --- False Positive Reporting ---
 # When a user checks "I believe this block was made in error" and passes the challenge,
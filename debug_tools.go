@@ -5,29 +5,35 @@ import (
 	"os/exec"
 )
 
-// listIPTablesRules lists all iptables rules for debugging purposes
+// listIPTablesRules lists all iptables and ip6tables rules for debugging purposes
 func listIPTablesRules() {
 	if debug {
-		log.Println("Listing current iptables rules for debugging:")
+		for _, bin := range []string{"iptables", "ip6tables"} {
+			command := iptablesCommand(bin)
+			if _, err := exec.LookPath(command); err != nil {
+				continue
+			}
+			log.Printf("Listing current %s rules for debugging:", command)
 
-		// List filter table rules
-		log.Println("Filter table rules:")
-		cmd := exec.Command("iptables", "-t", "filter", "-L", "-v", "-n")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("Error listing filter table rules: %v", err)
-		} else {
-			log.Printf("\n%s", string(output))
-		}
+			// List filter table rules
+			log.Println("Filter table rules:")
+			cmd := exec.Command(command, "-t", "filter", "-L", "-v", "-n")
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				log.Printf("Error listing filter table rules: %v", err)
+			} else {
+				log.Printf("\n%s", string(output))
+			}
 
-		// List NAT table rules
-		log.Println("NAT table rules:")
-		cmd = exec.Command("iptables", "-t", "nat", "-L", "-v", "-n")
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("Error listing NAT table rules: %v", err)
-		} else {
-			log.Printf("\n%s", string(output))
+			// List NAT table rules
+			log.Println("NAT table rules:")
+			cmd = exec.Command(command, "-t", "nat", "-L", "-v", "-n")
+			output, err = cmd.CombinedOutput()
+			if err != nil {
+				log.Printf("Error listing NAT table rules: %v", err)
+			} else {
+				log.Printf("\n%s", string(output))
+			}
 		}
 	}
 }
@@ -60,6 +66,30 @@ func listFirewallRules() {
 		listIPTablesRules()
 	case "nftables":
 		listNFTablesRules()
+	case "cloudflare":
+		cloudflareRulesMu.Lock()
+		for target, rule := range cloudflareRules {
+			log.Printf("Cloudflare %s rule %s: %s", rule.Mode, rule.ID, target)
+		}
+		cloudflareRulesMu.Unlock()
+	case "pf":
+		for _, table := range []string{firewallChain, firewallChain + "_challenge"} {
+			output, err := exec.Command("pfctl", "-t", table, "-T", "show").CombinedOutput()
+			if err != nil {
+				log.Printf("Error listing pf table %s: %v", table, err)
+			} else {
+				log.Printf("pf table %s:\n%s", table, string(output))
+			}
+		}
+	case "caddy":
+		if lister, ok := fwManager.(ruleLister); ok {
+			targets, err := lister.ListRuleTargets(false)
+			if err != nil {
+				log.Printf("Error listing Caddy route %s: %v", firewallChain, err)
+			} else {
+				log.Printf("Caddy route %s: %v", firewallChain, targets)
+			}
+		}
 	default:
 		log.Printf("Unknown firewall type: %s", firewallType)
 	}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Domain whitelist lookups ---
+
+// Checking the domain whitelist takes a reverse lookup of the client and a forward lookup
+// of each name it returns, and a busy scanner sends many lines, so the verified hostnames
+// of an IP are cached: for dnsCacheTTL if it has any, and for dnsNegativeCacheTTL if it
+// has none or the lookup failed, so a slow DNS server is not asked again for every line.
+// The cache keeps the hostnames rather than the outcome, so a reload of the domain
+// whitelist applies to cached IPs at once. It holds at most dnsCacheSize IPs, dropping the
+// least recently used. Each query gives up after dnsLookupTimeout, and at most
+// dnsMaxLookups lookups run at once; a line that cannot get one in time is treated as not
+// whitelisted, without caching that. Lookups of the same IP made at once share one.
+
+var (
+	dnsCacheTTL         = time.Hour        // How long the verified hostnames of an IP are kept
+	dnsNegativeCacheTTL = 10 * time.Minute // How long an IP without one is remembered
+	dnsCacheSize        = 10000            // IPs kept in the cache
+	dnsLookupTimeout    = 2 * time.Second  // Timeout of each DNS query
+	dnsMaxLookups       = 16               // Lookups running at once
+
+	dnsResolver = &net.Resolver{}
+	dnsCache    = &hostnameCache{entries: make(map[string]*list.Element), order: list.New(), inflight: make(map[string]chan struct{})}
+)
+
+// hostnameEntry is a cached lookup.
+type hostnameEntry struct {
+	ip        string
+	hostnames []string // Hostnames whose forward lookup confirmed the IP
+	expires   time.Time
+}
+
+// hostnameCache is an LRU cache of verified hostnames by IP.
+type hostnameCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List               // Entries, most recently used first
+	inflight map[string]chan struct{} // Lookups running, closed when they finish
+	slots    chan struct{}            // Holds a token per running lookup, made on first use
+	hits     int64
+	misses   int64
+	skipped  int64 // Lookups not made because dnsMaxLookups were running
+}
+
+// verifiedHostnames returns the hostnames of ip whose forward lookup confirms it, from the
+// cache if it has them. The caller must hold reloadMu (read), for the settings.
+func (c *hostnameCache) verifiedHostnames(ip string) []string {
+	var done chan struct{}
+	for done == nil {
+		c.mu.Lock()
+		if element, ok := c.entries[ip]; ok {
+			entry := element.Value.(*hostnameEntry)
+			if time.Now().Before(entry.expires) {
+				c.order.MoveToFront(element)
+				c.hits++
+				c.mu.Unlock()
+				return entry.hostnames
+			}
+			c.order.Remove(element)
+			delete(c.entries, ip)
+		}
+		if wait, running := c.inflight[ip]; running {
+			c.mu.Unlock()
+			<-wait
+			continue
+		}
+		c.misses++
+		done = make(chan struct{})
+		c.inflight[ip] = done
+		if c.slots == nil {
+			c.slots = make(chan struct{}, dnsMaxLookups)
+		}
+		c.mu.Unlock()
+	}
+
+	hostnames, looked := c.lookup(ip)
+	c.mu.Lock()
+	delete(c.inflight, ip)
+	close(done)
+	if looked {
+		ttl := dnsCacheTTL
+		if len(hostnames) == 0 {
+			ttl = dnsNegativeCacheTTL
+		}
+		c.storeLocked(&hostnameEntry{ip: ip, hostnames: hostnames, expires: time.Now().Add(ttl)})
+	} else {
+		c.skipped++
+	}
+	c.mu.Unlock()
+	return hostnames
+}
+
+// storeLocked caches entry, dropping the least recently used entries beyond dnsCacheSize.
+// The caller must hold c.mu.
+func (c *hostnameCache) storeLocked(entry *hostnameEntry) {
+	c.entries[entry.ip] = c.order.PushFront(entry)
+	for c.order.Len() > dnsCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hostnameEntry).ip)
+	}
+}
+
+// lookup resolves the verified hostnames of ip once a lookup slot is free, returning false
+// if none was within dnsLookupTimeout.
+func (c *hostnameCache) lookup(ip string) ([]string, bool) {
+	timer := time.NewTimer(dnsLookupTimeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		defer func() { <-c.slots }()
+	case <-timer.C:
+		if debug {
+			log.Printf("Skipped the DNS lookup of %s, as %d lookups are running", ip, dnsMaxLookups)
+		}
+		return nil, false
+	}
+
+	// Perform reverse DNS lookup
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	names, err := dnsResolver.LookupAddr(ctx, ip)
+	cancel()
+	if err != nil || len(names) == 0 {
+		// Log lookup failure only in debug
+		if debug {
+			log.Printf("No reverse DNS records found for IP %s or lookup error: %v", ip, err)
+		}
+		return nil, true
+	}
+
+	var hostnames []string
+	for _, hostname := range names {
+		// Remove trailing dot if present
+		hostname = strings.TrimSuffix(hostname, ".")
+
+		// Log reverse lookup result only in debug
+		if debug {
+			log.Printf("Reverse DNS lookup for IP %s returned hostname: %s", ip, hostname)
+		}
+
+		// Verify with forward lookup
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		ips, err := dnsResolver.LookupHost(ctx, hostname)
+		cancel()
+		if err != nil {
+			// Log forward lookup failure only in debug
+			if debug {
+				log.Printf("Forward DNS lookup failed for hostname %s: %v", hostname, err)
+			}
+			continue
+		}
+
+		// Check if the original IP is in the forward lookup results
+		ipFound := false
+		for _, resolvedIP := range ips {
+			if resolvedIP == ip {
+				ipFound = true
+				break
+			}
+		}
+		if !ipFound {
+			// Log forward verification failure only in debug
+			if debug {
+				log.Printf("Forward DNS verification failed: IP %s not found in results for %s", ip, hostname)
+			}
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames, true
+}
+
+// dnsCacheStats describes the cache for -stats, and zeroes its counters if reset is set.
+func dnsCacheStats(reset bool) string {
+	dnsCache.mu.Lock()
+	defer dnsCache.mu.Unlock()
+	result := fmt.Sprintf("Domain whitelist DNS cache: %d IPs, %d hits, %d misses", len(dnsCache.entries), dnsCache.hits, dnsCache.misses)
+	if total := dnsCache.hits + dnsCache.misses; total > 0 {
+		result += fmt.Sprintf(" (%.0f%% hits)", float64(dnsCache.hits)*100/float64(total))
+	}
+	if dnsCache.skipped > 0 {
+		result += fmt.Sprintf(", %d lookups skipped with dnsMaxLookups running", dnsCache.skipped)
+	}
+	if reset {
+		dnsCache.hits, dnsCache.misses, dnsCache.skipped = 0, 0, 0
+	}
+	return result
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -43,11 +42,8 @@ func readDomainWhitelistFile(filePath string) error {
 	}
 	defer file.Close()
 
-	// Clear existing domain whitelist
-	domainWhitelistMu.Lock()
-	domainWhitelist = make(map[string]bool)
-	domainWhitelistMu.Unlock()
-
+	// Build a new domain whitelist, replacing the current one once the whole file is read
+	domains := make(map[string]bool)
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
 	for scanner.Scan() {
@@ -60,9 +56,7 @@ func readDomainWhitelistFile(filePath string) error {
 		}
 
 		// Add domain to whitelist
-		domainWhitelistMu.Lock()
-		domainWhitelist[line] = true
-		domainWhitelistMu.Unlock()
+		domains[line] = true
 
 		// Log adding domain only in debug
 		if debug {
@@ -74,6 +68,9 @@ func readDomainWhitelistFile(filePath string) error {
 		return fmt.Errorf("error reading domain whitelist file: %v", err)
 	}
 
+	domainWhitelistMu.Lock()
+	domainWhitelist = domains
+	domainWhitelistMu.Unlock()
 	return nil
 }
 
@@ -96,7 +93,7 @@ func createExampleDomainWhitelistFile(filePath string) error {
 
 // isDomainWhitelisted checks if an IP address belongs to a whitelisted domain
 // It performs reverse DNS lookup on the IP, verifies with forward lookup,
-// and checks if the hostname matches any domain in the whitelist
+// and checks if the hostname matches any domain in the whitelist. The lookups are cached
 func isDomainWhitelisted(ip string) bool {
 	// Skip if domain whitelist is empty
 	domainWhitelistMu.RLock()
@@ -107,53 +104,7 @@ func isDomainWhitelisted(ip string) bool {
 		return false
 	}
 
-	// Perform reverse DNS lookup
-	hostnames, err := net.LookupAddr(ip)
-	if err != nil || len(hostnames) == 0 {
-		// Log lookup failure only in debug
-		if debug {
-			log.Printf("No reverse DNS records found for IP %s or lookup error: %v", ip, err)
-		}
-		return false
-	}
-
-	// For each hostname returned by reverse lookup
-	for _, hostname := range hostnames {
-		// Remove trailing dot if present
-		hostname = strings.TrimSuffix(hostname, ".")
-
-		// Log reverse lookup result only in debug
-		if debug {
-			log.Printf("Reverse DNS lookup for IP %s returned hostname: %s", ip, hostname)
-		}
-
-		// Verify with forward lookup
-		ips, err := net.LookupHost(hostname)
-		if err != nil {
-			// Log forward lookup failure only in debug
-			if debug {
-				log.Printf("Forward DNS lookup failed for hostname %s: %v", hostname, err)
-			}
-			continue
-		}
-
-		// Check if the original IP is in the forward lookup results
-		ipFound := false
-		for _, resolvedIP := range ips {
-			if resolvedIP == ip {
-				ipFound = true
-				break
-			}
-		}
-
-		if !ipFound {
-			// Log forward verification failure only in debug
-			if debug {
-				log.Printf("Forward DNS verification failed: IP %s not found in results for %s", ip, hostname)
-			}
-			continue
-		}
-
+	for _, hostname := range dnsCache.verifiedHostnames(ip) {
 		// Check if the hostname matches any domain in the whitelist
 		domainWhitelistMu.RLock()
 		for domain := range domainWhitelist {
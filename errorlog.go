@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Apache error logs ---
+
+// ModSecurity denials and authentication failures are written to Apache's error log, often
+// before the access log shows anything. With errorLogSuffix set (e.g. error.log), files
+// ending in it are monitored alongside the access logs in the apache-error format: the
+// timestamp is the leading [Wed Oct 11 14:32:52.123456 2023] in local time, and the
+// offender the address of the [client 1.2.3.4:56789] token. Rules for them set logFormat
+// to apache-error and match the message, e.g. "ModSecurity: Access denied"; their
+// capture groups are not used.
+
+// errorLogTimestampRegex matches the timestamp of an error log line, with or without the
+// microseconds Apache 2.4 adds.
+var errorLogTimestampRegex = regexp.MustCompile(`^\[(\w{3} \w{3} +\d{1,2} \d{2}:\d{2}:\d{2}(?:\.\d+)? \d{4})\]`)
+
+// errorLogClientRegex matches the client token of an error log line, whose address may be
+// a bracketed IPv6 one.
+var errorLogClientRegex = regexp.MustCompile(`\[client (\[[^\]\s]+\](?::\d+)?|[^\]\s]+)\]`)
+
+// extractErrorLogTimestamp extracts the timestamp of an error log line.
+func extractErrorLogTimestamp(line string) (time.Time, bool) {
+	matches := errorLogTimestampRegex.FindStringSubmatch(line)
+	if len(matches) < 2 {
+		return time.Time{}, false
+	}
+	// Go accepts fractional seconds after the seconds field when parsing
+	timestamp, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(strings.Fields(matches[1]), " "), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
+
+// errorLogClient returns the client address of an error log line, or "".
+func errorLogClient(line string) string {
+	matches := errorLogClientRegex.FindStringSubmatch(line)
+	if len(matches) < 2 {
+		return ""
+	}
+	if ip := parseClientIP(matches[1]); ip != nil {
+		return ip.String()
+	}
+	// Apache 2.4 appends the port: 1.2.3.4:56789, 2001:db8::1:56789 or [2001:db8::1]:56789
+	if colon := strings.LastIndexByte(matches[1], ':'); colon > 0 {
+		if ip := parseClientIP(matches[1][:colon]); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
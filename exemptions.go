@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// exemptionManager is implemented by backends that can let whitelisted addresses through
+// a blocked subnet. The whitelist only stops new blocks, so without an exemption a
+// customer's static IP inside a blocked /24 would be cut off with the rest of the range.
+type exemptionManager interface {
+	// SetExemptions makes addrs exactly the exempted addresses of subnet, placed above every
+	// block rule. Removing the subnet's block (RemoveBlockRule) removes its exemptions too.
+	SetExemptions(subnet string, addrs []string) error
+}
+
+var exemptionWarnOnce sync.Once
+
+// whitelistedWithin returns the whitelist entries (addresses or ranges) inside subnet.
+func whitelistedWithin(subnet string) []string {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil
+	}
+	subnetOnes, _ := ipNet.Mask.Size()
+
+	whitelistMu.RLock()
+	defer whitelistMu.RUnlock()
+	var addrs []string
+	for entry := range whitelist {
+		if ip := net.ParseIP(entry); ip != nil {
+			if ipNet.Contains(ip) {
+				addrs = append(addrs, entry)
+			}
+			continue
+		}
+		// A range is exempted if it lies entirely inside the subnet
+		if _, entryNet, err := net.ParseCIDR(entry); err == nil {
+			ones, _ := entryNet.Mask.Size()
+			if ones > subnetOnes && ipNet.Contains(entryNet.IP) {
+				addrs = append(addrs, entry)
+			}
+		}
+	}
+	return addrs
+}
+
+// exemptSubnet installs exemptions for the whitelisted addresses inside a blocked subnet.
+// Nothing is done for single addresses or subnets holding no whitelisted address, unless
+// force is set, which also clears exemptions for entries that are no longer whitelisted.
+func exemptSubnet(subnet string, force bool) {
+	if !strings.Contains(subnet, "/") || challengeEnable {
+		return
+	}
+	addrs := whitelistedWithin(subnet)
+	if len(addrs) == 0 && !force {
+		return
+	}
+	exempter, ok := fwManager.(exemptionManager)
+	if !ok {
+		if len(addrs) > 0 {
+			exemptionWarnOnce.Do(func() {
+				log.Printf("Warning: The %s backend cannot exempt whitelisted addresses inside blocked subnets (e.g. %s in %s)", firewallType, addrs[0], subnet)
+			})
+		}
+		return
+	}
+	if err := exempter.SetExemptions(subnet, addrs); err != nil {
+		log.Printf("Warning: Failed to exempt whitelisted addresses in subnet %s: %v", subnet, err)
+		return
+	}
+	if len(addrs) > 0 && !dryRun {
+		log.Printf("Exempted whitelisted %s from the block of subnet %s", strings.Join(addrs, ", "), subnet)
+	}
+}
+
+// exemptBlockedSubnets installs exemptions for every blocked subnet, for applyBlockList.
+func exemptBlockedSubnets() {
+	mu.Lock()
+	subnets := make([]string, 0, len(blockedSubnets))
+	for subnet := range blockedSubnets {
+		subnets = append(subnets, subnet)
+	}
+	mu.Unlock()
+	for _, subnet := range subnets {
+		exemptSubnet(subnet, false)
+	}
+}
+
+// blockedSubnetsOverlapping returns the blocked subnets containing target's address, or,
+// for a range, its network address.
+func blockedSubnetsOverlapping(target string) []string {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(target)
+		if err != nil {
+			return nil
+		}
+		addr = prefix.Masked().Addr()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return blockedSubnetRanges.containing(addr, -1)
+}
+
+// clientAllowIP adds a target to the whitelist file and the running whitelist, and exempts
+// it from the subnet blocks that contain it. It returns a message describing the result.
+func clientAllowIP(target string) (string, error) {
+	added, err := addWhitelistEntry(whitelistFilePath, target)
+	if err != nil {
+		return "", err
+	}
+	result := fmt.Sprintf("Added %s to the whitelist", target)
+	if !added {
+		result = fmt.Sprintf("%s is already whitelisted", target)
+	}
+
+	if fwManager != nil {
+		for _, subnet := range blockedSubnetsOverlapping(target) {
+			exemptSubnet(subnet, true)
+			result += fmt.Sprintf("\nExempted it from the block of subnet %s", subnet)
+		}
+	}
+
+	mu.Lock()
+	_, blocked := blockedIPs[target]
+	mu.Unlock()
+	if blocked {
+		result += fmt.Sprintf("\n%s itself is still blocked; run -unblock %s to lift it", target, target)
+	}
+	return result, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// blockDurationForLocked returns how long a new automatic block of target by rule lasts:
+// the rule's blockDuration (or the global one), multiplied by blockEscalation for every
+// earlier block of the target, and capped at maxBlockDuration. 0 means the block does not
+// expire. The caller must hold mu.
+func blockDurationForLocked(target, rule string) time.Duration {
+	duration := ruleBlockDuration(rule)
+	if duration <= 0 {
+		return 0
+	}
+	const ceiling = 100 * 365 * 24 * time.Hour // Keeps the product far from overflowing
+	for i := 0; i < blockOffenses[target] && blockEscalation > 1; i++ {
+		duration = time.Duration(float64(duration) * blockEscalation)
+		if duration > ceiling || (maxBlockDuration > 0 && duration >= maxBlockDuration) {
+			break
+		}
+	}
+	if maxBlockDuration > 0 && duration > maxBlockDuration {
+		duration = maxBlockDuration
+	}
+	if duration > ceiling {
+		duration = ceiling
+	}
+	if debug && blockOffenses[target] > 0 {
+		log.Printf("Block %d for %s lasts %v", blockOffenses[target]+1, target, duration)
+	}
+	return duration
+}
+
+// remainingTimeout returns the timeout of a block expiring at expiry, for RuleOptions. A
+// block at or past its expiry gets a second, rather than 0, which means it never expires.
+func remainingTimeout(expiry time.Time) time.Duration {
+	if remaining := time.Until(expiry); remaining > time.Second {
+		return remaining
+	}
+	return time.Second
+}
+
+// expiryNote describes when a blocklist entry expires for -list and -check output, e.g.
+// " (expires in 3h12m0s)", or "" for entries that do not expire.
+func expiryNote(target string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return expiryNoteLocked(target)
+}
+
+// expiryNoteLocked is expiryNote for callers that hold mu.
+func expiryNoteLocked(target string) string {
+	expiry, ok := blockedExpiry[target]
+	if !ok {
+		return ""
+	}
+	remaining := time.Until(expiry)
+	if remaining < time.Second {
+		return " (expiring)"
+	}
+	return fmt.Sprintf(" (expires in %v)", remaining.Truncate(time.Second))
+}
+
+// pruneExpiredBlocks lifts automatic blocks whose blockDuration has passed. With readBack,
+// backends that expire entries in the kernel (kernelExpirer) are read back, so the rules
+// of entries that have already timed out there are not removed again. Only our clock
+// decides what has expired: an entry missing from the firewall before its expiry is left
+// to the reconcile task. readBack must be false before applyBlockList has installed the
+// entries. It returns the number of entries removed.
+func pruneExpiredBlocks(readBack bool) int {
+	now := time.Now()
+	expired := make(map[string]bool)
+	var pending []string
+
+	mu.Lock()
+	for target, expiry := range blockedExpiry {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		if !isIP && !isSubnet {
+			delete(blockedExpiry, target)
+			continue
+		}
+		if !now.Before(expiry) {
+			expired[target] = true
+			pending = append(pending, target)
+		}
+	}
+	mu.Unlock()
+	if len(expired) == 0 {
+		return 0
+	}
+
+	gone := make(map[string]bool)
+	if expirer, ok := fwManager.(kernelExpirer); ok && readBack && !dryRun {
+		if targets, err := expirer.ExpiredTargets(pending); err != nil {
+			log.Printf("Warning: Failed to read expired entries back from the firewall: %v", err)
+		} else {
+			for _, target := range targets {
+				gone[target] = true
+			}
+		}
+	}
+
+	mu.Lock()
+	for target := range expired {
+		if strings.Contains(target, "/") {
+			removeBlockedSubnetLocked(target)
+			delete(subnetBlockedIPs, target)
+		} else {
+			delete(blockedIPs, target)
+		}
+		forgetEntryMetaLocked(target)
+	}
+	mu.Unlock()
+
+	for target := range expired {
+		removeBlockInfo(target)
+		writeAudit(auditRecord{Action: "unblock", Target: target, Reason: "expired", Source: "expiry"})
+		if gone[target] {
+			continue // Already removed by the kernel
+		}
+		var err error
+		if challengeEnable {
+			err = fwManager.RemoveRedirectRule(target)
+		} else {
+			err = fwManager.RemoveBlockRule(target)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to remove firewall rule for expired block %s: %v", target, err)
+		}
+		if debug {
+			log.Printf("Block for %s expired", target)
+		}
+	}
+
+	log.Printf("Lifted %d expired blocks", len(expired))
+	if err := saveBlockList(); err != nil {
+		log.Printf("Warning: Failed to save blocklist after lifting expired blocks: %v", err)
+	}
+	return len(expired)
+}
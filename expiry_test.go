@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTempAuditLog writes the audit log to a temporary file for the test.
+func useTempAuditLog(t *testing.T) string {
+	t.Helper()
+	closeAudit := func() {
+		auditMu.Lock()
+		flushAuditLogLocked()
+		if auditFile != nil {
+			auditFile.Close()
+		}
+		auditFile, auditWriter, auditFailed = nil, nil, false
+		auditMu.Unlock()
+	}
+	saved := auditLogPath
+	closeAudit()
+	auditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	t.Cleanup(func() {
+		closeAudit()
+		auditLogPath = saved
+	})
+	return auditLogPath
+}
+
+// readAuditLog returns the records of the audit log at path.
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	flushAuditLog()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// TestExpiredBlocksAudited checks that lifting expired blocks removes their rules and
+// records an unblock of each in the audit log, leaving the blocks still running alone.
+func TestExpiredBlocksAudited(t *testing.T) {
+	m, ipt4, _ := newFakeIPTablesManager(t)
+	useTempBlockList(t)
+	auditPath := useTempAuditLog(t)
+	savedManager := fwManager
+	fwManager = m
+	mu.Lock()
+	savedExpiry := blockedExpiry
+	blockedExpiry = make(map[string]time.Time)
+	mu.Unlock()
+	t.Cleanup(func() {
+		fwManager = savedManager
+		mu.Lock()
+		blockedExpiry = savedExpiry
+		mu.Unlock()
+	})
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	expiries := map[string]time.Time{
+		"192.0.2.1":       time.Now().Add(-time.Minute),
+		"198.51.100.0/24": time.Now().Add(-time.Second),
+		"192.0.2.2":       time.Now().Add(time.Hour),
+	}
+	for target, expiry := range expiries {
+		if err := m.AddBlockRule(target, RuleOptions{Reason: "test", Ports: []string{"80"}}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if target == "198.51.100.0/24" {
+			addBlockedSubnetLocked(target)
+		} else {
+			blockedIPs[target] = struct{}{}
+		}
+		blockedExpiry[target] = expiry
+		mu.Unlock()
+	}
+
+	if n := pruneExpiredBlocks(true); n != 2 {
+		t.Fatalf("%d blocks lifted, want 2", n)
+	}
+	checkRules(t, ipt4, "filter", "apacheblock", "-s 192.0.2.2/32 -p tcp --dport 80 -j DROP")
+
+	unblocked := make(map[string]bool)
+	for _, record := range readAuditLog(t, auditPath) {
+		if record.Action != "unblock" || record.Reason != "expired" || record.Source != "expiry" {
+			t.Errorf("audit record %+v, want an unblock for expiry", record)
+		}
+		unblocked[record.Target] = true
+	}
+	if len(unblocked) != 2 || !unblocked["192.0.2.1"] || !unblocked["198.51.100.0/24"] {
+		t.Fatalf("unblocks of %v audited, want 192.0.2.1 and 198.51.100.0/24", unblocked)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Blocklist export ---
+
+// exportFormats are the formats accepted by -export and the socket export command.
+var exportFormats = []string{"plain", "csv", "ipset", "nft"}
+
+// isExportFormat reports whether format is one of exportFormats.
+func isExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedBlockEntries returns every blocklist entry, IPs before subnets, each in address order
+// (IPv4 before IPv6), so that successive exports diff cleanly.
+func sortedBlockEntries() []BlockEntry {
+	mu.Lock()
+	entries := make([]BlockEntry, 0, len(blockedIPs)+len(blockedSubnets))
+	for ip := range blockedIPs {
+		entries = append(entries, blockEntryLocked(ip))
+	}
+	for subnet := range blockedSubnets {
+		entries = append(entries, blockEntryLocked(subnet))
+	}
+	mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Type != b.Type {
+			return a.Type == "ip"
+		}
+		pa, errA := netip.ParsePrefix(exportCIDR(a))
+		pb, errB := netip.ParsePrefix(exportCIDR(b))
+		if errA != nil || errB != nil {
+			return a.Address < b.Address
+		}
+		if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+			return c < 0
+		}
+		return pa.Bits() < pb.Bits()
+	})
+	return entries
+}
+
+// exportCIDR returns an entry in CIDR form: /32 or /128 for a single address.
+func exportCIDR(entry BlockEntry) string {
+	if strings.Contains(entry.Address, "/") {
+		return entry.Address
+	}
+	if strings.Contains(entry.Address, ":") {
+		return entry.Address + "/128"
+	}
+	return entry.Address + "/32"
+}
+
+// exportBlockList formats the blocklist for other systems:
+//   - plain: one CIDR per line, single addresses as /32 or /128
+//   - csv: one row per entry, with a type column and the entry's metadata (empty if unknown)
+//   - ipset: `ipset restore` input for the sets the ipset backend uses
+//   - nft: an `nft -f` script adding the entries to the nftables backend's sets
+func exportBlockList(format string) (string, error) {
+	entries := sortedBlockEntries()
+	var b strings.Builder
+	switch format {
+	case "plain":
+		for _, entry := range entries {
+			fmt.Fprintln(&b, exportCIDR(entry))
+		}
+	case "csv":
+		w := csv.NewWriter(&b)
+		w.Write([]string{"address", "type", "reason", "first_seen", "blocked_at", "expires_at", "match_count", "action", "last_user_agent", "source", "peer"})
+		for _, entry := range entries {
+			matches := ""
+			if entry.MatchCount > 0 {
+				matches = strconv.Itoa(entry.MatchCount)
+			}
+			w.Write([]string{
+				entry.Address,
+				entry.Type,
+				entry.Reason,
+				exportTime(entry.FirstSeen),
+				exportTime(entry.BlockedAt),
+				exportTime(entry.ExpiresAt),
+				matches,
+				entry.Action,
+				entry.LastUserAgent,
+				entry.Source,
+				entry.Peer,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", fmt.Errorf("failed to write CSV: %v", err)
+		}
+	case "ipset":
+		for _, set := range exportSets() {
+			fmt.Fprintf(&b, "create %s %s family %s -exist\n", set.name, set.kind, set.family)
+		}
+		for _, entry := range entries {
+			fmt.Fprintf(&b, "add %s %s -exist\n", exportSetFor(entry).name, entry.Address)
+		}
+	case "nft":
+		table := "inet apacheblock"
+		fmt.Fprintf(&b, "add table %s\n", table)
+		for _, set := range exportSets() {
+			flags := ""
+			if set.kind == "hash:net" {
+				flags = " flags interval;"
+			}
+			fmt.Fprintf(&b, "add set %s %s { type %s;%s }\n", table, set.name, set.addrType, flags)
+		}
+		for _, set := range exportSets() {
+			var elements []string
+			for _, entry := range entries {
+				if exportSetFor(entry).name == set.name {
+					elements = append(elements, entry.Address)
+				}
+			}
+			if len(elements) > 0 {
+				fmt.Fprintf(&b, "add element %s %s { %s }\n", table, set.name, strings.Join(elements, ", "))
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown export format %q (valid formats: %s)", format, strings.Join(exportFormats, ", "))
+	}
+	return b.String(), nil
+}
+
+// exportSet describes a set in the ipset and nft exports.
+type exportSet struct {
+	name, kind, family, addrType string
+}
+
+// exportSets returns the sets of the ipset and nft exports, named after firewallChain as the
+// ipset and nftables backends name theirs: addresses and subnets, per family.
+func exportSets() []exportSet {
+	return []exportSet{
+		{firewallChain + "_ip", "hash:ip", "inet", "ipv4_addr"},
+		{firewallChain + "_net", "hash:net", "inet", "ipv4_addr"},
+		{firewallChain + "_ip6", "hash:ip", "inet6", "ipv6_addr"},
+		{firewallChain + "_net6", "hash:net", "inet6", "ipv6_addr"},
+	}
+}
+
+// exportSetFor returns the set an entry belongs in.
+func exportSetFor(entry BlockEntry) exportSet {
+	sets := exportSets()
+	i := 0
+	if entry.Type == "subnet" {
+		i = 1
+	}
+	if strings.Contains(entry.Address, ":") {
+		i += 2
+	}
+	return sets[i]
+}
+
+// exportTime formats an optional timestamp for CSV output.
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// requestExport asks a running server for an export. An error means the server could not
+// be reached; a failed export is reported in the response.
+func requestExport(format string) (*Message, error) {
+	conn, err := dialServer()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	msg := Message{Command: string(ExportCommand), Format: format, APIKey: apiKey}
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return nil, fmt.Errorf("failed to send command: %v", err)
+	}
+	var response Message
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return &response, nil
+}
+
+// writeExport writes export output to path, or to stdout if path is empty.
+func writeExport(output, path string) error {
+	if path == "" {
+		fmt.Print(output)
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(output), 0644); err != nil {
+		return fmt.Errorf("failed to write export file: %v", err)
+	}
+	return nil
+}
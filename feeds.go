@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Blocklist feeds ---
+
+// Entries imported from a feed carry its URL as their source. A refresh blocks the feed's
+// new entries and lifts those of its entries that left the feed; entries blocked locally
+// are never lifted. An operator's -unblock of a feed entry lasts until the next refresh,
+// unless it was given -force, which records the entry in feedExclusions.
+
+// maxFeedSize caps the bytes read from a feed.
+const maxFeedSize = 16 << 20
+
+// feedClient fetches blocklist feeds.
+var feedClient = &http.Client{Timeout: 30 * time.Second}
+
+// parseFeed reads one IP or CIDR per line. Anything after "#" or ";" is a comment, which
+// covers the Spamhaus DROP format ("1.10.16.0/20 ; SBL256894"). It returns the entries
+// and the number of lines that held no valid address.
+func parseFeed(r io.Reader) ([]string, int, error) {
+	var entries []string
+	invalid := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !isValidIPOrCIDR(fields[0]) {
+			invalid++
+			continue
+		}
+		entries = append(entries, normalizeTarget(fields[0]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, invalid, err
+	}
+	return entries, invalid, nil
+}
+
+// fetchFeed downloads and parses a feed.
+func fetchFeed(url string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL: %v", err)
+	}
+	req.Header.Set("User-Agent", "apacheblock")
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch feed: HTTP %s", resp.Status)
+	}
+
+	entries, invalid, err := parseFeed(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed: %v", err)
+	}
+	if invalid > 0 {
+		log.Printf("Warning: Skipped %d invalid lines in blocklist feed %s", invalid, url)
+	}
+	return entries, nil
+}
+
+// feedSourceOf returns the feed a blocklist entry was imported from, or "". The caller must hold mu.
+func feedSourceOf(target string) string {
+	if meta := blockedMeta[target]; meta != nil {
+		return meta.Source
+	}
+	return ""
+}
+
+// excludeFromFeeds keeps a target from being imported by any feed, for -unblock -force.
+func excludeFromFeeds(target string) {
+	mu.Lock()
+	feedExclusions[target] = struct{}{}
+	mu.Unlock()
+}
+
+// refreshFeed brings the blocklist in line with a feed. If the feed cannot be fetched its
+// entries are left as they are.
+func refreshFeed(url string) {
+	want, err := fetchFeed(url)
+	if err != nil {
+		log.Printf("Warning: Blocklist feed %s: %v", url, err)
+		return
+	}
+	inFeed := make(map[string]bool, len(want))
+	for _, target := range want {
+		inFeed[target] = true
+	}
+
+	var candidates []string
+	mu.Lock()
+	for _, target := range want {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		_, pending := pendingBlocks[target]
+		_, excluded := feedExclusions[target]
+		if !isIP && !isSubnet && !pending && !excluded {
+			candidates = append(candidates, target)
+		}
+	}
+	mu.Unlock()
+	removed := removeFeedEntries(func(source, target string) bool {
+		return source == url && !inFeed[target]
+	})
+
+	var toAdd []string
+	for _, target := range candidates {
+		if isWhitelisted(target) {
+			if debug {
+				log.Printf("Not importing whitelisted %s from blocklist feed %s", target, url)
+			}
+			continue
+		}
+		toAdd = append(toAdd, target)
+	}
+	mu.Lock()
+	for _, target := range toAdd {
+		pendingBlocks[target] = struct{}{}
+	}
+	mu.Unlock()
+
+	failed := installRules(toAdd, "blocklist feed "+url)
+
+	mu.Lock()
+	for _, target := range toAdd {
+		delete(pendingBlocks, target)
+		if failed[target] != nil {
+			continue
+		}
+		if strings.Contains(target, "/") {
+			addBlockedSubnetLocked(target)
+		} else {
+			blockedIPs[target] = struct{}{}
+		}
+		recordBlockMetaLocked(target, "blocklist feed", "")
+		blockedMeta[target].Source = url
+	}
+	mu.Unlock()
+
+	for target, err := range failed {
+		log.Printf("Failed to add firewall rule for %s from blocklist feed %s (will retry on the next refresh): %v", target, url, err)
+	}
+	for _, target := range toAdd {
+		if failed[target] == nil {
+			exemptSubnet(target, false)
+		}
+	}
+
+	added := len(toAdd) - len(failed)
+	if added > 0 || removed > 0 {
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: Failed to save blocklist after refreshing feed %s: %v", url, err)
+		}
+	}
+	log.Printf("Blocklist feed %s: %d entries, %d blocked, %d lifted, %d failed", url, len(want), added, removed, len(failed))
+}
+
+// removeFeedEntries lifts the feed entries for which drop returns true, and returns how many
+// were lifted. It does not save the blocklist.
+func removeFeedEntries(drop func(source, target string) bool) int {
+	var targets []string
+	mu.Lock()
+	for target, meta := range blockedMeta {
+		if meta.Source == "" || !drop(meta.Source, target) {
+			continue
+		}
+		if strings.Contains(target, "/") {
+			removeBlockedSubnetLocked(target)
+			delete(subnetBlockedIPs, target)
+		} else {
+			delete(blockedIPs, target)
+		}
+		forgetEntryMetaLocked(target)
+		targets = append(targets, target)
+	}
+	mu.Unlock()
+
+	for _, target := range targets {
+		var err error
+		if challengeEnable {
+			err = fwManager.RemoveRedirectRule(target)
+		} else {
+			err = fwManager.RemoveBlockRule(target)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to remove firewall rule for feed entry %s: %v", target, err)
+		}
+		if debug {
+			log.Printf("Lifted %s, which left its blocklist feed", target)
+		}
+	}
+	return len(targets)
+}
+
+// startFeedTask lifts the entries of feeds no longer configured, then fetches every feed
+// now and every blocklistFeedInterval (only now if the interval is 0).
+func startFeedTask() {
+	configured := make(map[string]bool, len(blocklistFeeds))
+	for _, url := range blocklistFeeds {
+		configured[url] = true
+	}
+	if removed := removeFeedEntries(func(source, _ string) bool { return !configured[source] }); removed > 0 {
+		log.Printf("Lifted %d entries of blocklist feeds no longer configured", removed)
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: Failed to save blocklist after removing old feed entries: %v", err)
+		}
+	}
+	if len(blocklistFeeds) == 0 {
+		return
+	}
+
+	refresh := func() {
+		for _, url := range blocklistFeeds {
+			refreshFeed(url)
+		}
+	}
+	go func() {
+		refresh()
+		if blocklistFeedInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(blocklistFeedInterval)
+		for range ticker.C {
+			refresh()
+		}
+	}()
+
+	if debug {
+		log.Printf("Started blocklist feed import for %d feeds every %v", len(blocklistFeeds), blocklistFeedInterval)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Log format of each file ---
+
+// One instance can watch log files in different formats. The format of a file is the
+// first of: the format formatMap gives for it (glob=format pairs separated by commas,
+// the globs matching the file name or full path, as for logInclude), apache-error for
+// files ending in errorLogSuffix, caddy if the file's first line is a JSON object while
+// server is a text format, and server. Files matching a formatMap glob are monitored
+// whatever their suffix. The format is resolved when a file is opened and kept in its
+// FileState.
+
+// formatMapRule gives the log format of the files matching pattern.
+type formatMapRule struct {
+	pattern string
+	format  string
+}
+
+// formatMapRules holds the parsed formatMap, set at startup once the custom log formats
+// are loaded.
+var formatMapRules []formatMapRule
+
+// parseFormatMap parses formatMap into formatMapRules.
+func parseFormatMap() error {
+	var parsed []formatMapRule
+	for _, item := range strings.Split(formatMap, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		pattern, format, found := strings.Cut(item, "=")
+		pattern, format = strings.TrimSpace(pattern), strings.TrimSpace(format)
+		if !found || pattern == "" {
+			return fmt.Errorf("invalid formatMap entry %q (must be glob=format)", item)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid formatMap glob %q: %v", pattern, err)
+		}
+		if !isBuiltinLogFormat(format) && customLogFormats[format] == nil {
+			return fmt.Errorf("unknown log format %q for %s", format, pattern)
+		}
+		parsed = append(parsed, formatMapRule{pattern: pattern, format: format})
+	}
+	formatMapRules = parsed
+	return nil
+}
+
+// mappedLogFormat returns the format formatMap gives for path, or "".
+func mappedLogFormat(path string) string {
+	for _, rule := range formatMapRules {
+		if matchesLogPattern(path, []string{rule.pattern}) {
+			return rule.format
+		}
+	}
+	return ""
+}
+
+// logFormatFor returns the log format of the file at path without looking at its
+// content: the formatMap format, apache-error for error logs, else logFormat.
+func logFormatFor(path string) string {
+	if format := mappedLogFormat(path); format != "" {
+		return format
+	}
+	if errorLogSuffix != "" && strings.HasSuffix(path, errorLogSuffix) {
+		return "apache-error"
+	}
+	return logFormat
+}
+
+// detectLogFormat returns the log format of the file at path, reading its first line if
+// neither formatMap nor errorLogSuffix decide: JSON lines are caddy's when server is one
+// of the text formats.
+func detectLogFormat(path string) string {
+	format := logFormatFor(path)
+	if format != logFormat || (logFormat != "apache" && logFormat != "apache-vhost" && logFormat != "nginx") {
+		return format
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return format
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			return "caddy"
+		}
+		break
+	}
+	return format
+}
+
+// logFileSuffixes returns the suffixes of the files monitored in the log directories.
+func logFileSuffixes() []string {
+	if errorLogSuffix != "" && errorLogSuffix != fileSuffix {
+		return []string{fileSuffix, errorLogSuffix}
+	}
+	return []string{fileSuffix}
+}
+
+// isLogFileName reports whether path ends in one of the log file suffixes or matches a
+// formatMap glob.
+func isLogFileName(path string) bool {
+	for _, suffix := range logFileSuffixes() {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return mappedLogFormat(path) != ""
+}
+
+// globLogFiles returns the log files in dir.
+func globLogFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if isLogFileName(path) {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
@@ -1,620 +1,266 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os/exec"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // --- Firewall Manager Interface ---
 
 // FirewallManager defines the interface for interacting with different firewall backends.
 type FirewallManager interface {
-	Setup() error                                   // Ensure necessary chains/tables exist.
-	AddBlockRule(target string) error               // Add a rule to block traffic (DROP).
-	RemoveBlockRule(target string) error            // Remove a blocking rule.
-	AddRedirectRule(target string) error            // Add a rule to redirect traffic (for challenge).
-	RemoveRedirectRule(target string) error         // Remove a redirect rule.
-	Flush() error                                   // Flush all rules added by this tool.
-	IsRulePresent(checkArgs []string) (bool, error) // Check if a specific rule exists.
+	Setup() error                                          // Ensure necessary chains/tables exist.
+	AddBlockRule(target string, opts RuleOptions) error    // Add a rule to block traffic (DROP, REJECT or rate limit, per opts.Action or blockAction).
+	RemoveBlockRule(target string) error                   // Remove a blocking rule.
+	AddRedirectRule(target string, opts RuleOptions) error // Add a rule to redirect traffic (for challenge).
+	RemoveRedirectRule(target string) error                // Remove a redirect rule.
+	Flush() error                                          // Flush all rules added by this tool.
+	Teardown() error                                       // Flush rules and detach/remove our chains (used on exit).
+	IsRulePresent(checkArgs []string) (bool, error)        // Check if a specific rule exists.
 }
 
-// Global instance of the firewall manager
-var (
-	fwManager FirewallManager
-	fwOnce    sync.Once // To initialize the manager only once
-)
+// RuleOptions carries per-rule metadata from the caller down to the firewall backend.
+type RuleOptions struct {
+	Reason string   // Why the target is blocked (rule name, "manual block", ...), recorded in the rule comment
+	Action string   // "drop", "reject" or "ratelimit"; empty uses blockAction
+	Ports  []string // Ports to block, from the rule's blockPorts; empty uses blockPorts and blockScope
 
-// InitFirewallManager selects and initializes the appropriate firewall manager based on config.
-func InitFirewallManager() error {
-	var initErr error
-	fwOnce.Do(func() {
-		log.Printf("Initializing Firewall Manager (Type: %s)...", firewallType)
-		switch firewallType {
-		case "iptables":
-			fwManager = &IPTablesManager{chainName: firewallChain}
-			initErr = fwManager.Setup()
-		case "nftables":
-			// Define table name (e.g., "inet apacheblock") and chain names
-			tableName := "inet apacheblock" // Includes family
-			filterChainName := firewallChain
-			natChainName := firewallChain + "_nat"
-			fwManager = &NFTablesManager{tableName: tableName, filterChain: filterChainName, natChain: natChainName}
-			initErr = fwManager.Setup()
-		default:
-			initErr = fmt.Errorf("unsupported firewallType: %s", firewallType)
-		}
-		if initErr != nil {
-			log.Printf("Firewall Manager initialization failed: %v", initErr)
-		} else {
-			log.Printf("Firewall Manager initialized successfully.")
-		}
-	})
-	return initErr
+	// Timeout lets backends that support it (nftables sets) expire the block themselves; 0 = never
+	Timeout time.Duration
 }
 
-// --- IPTables Implementation ---
-
-// IPTablesManager implements FirewallManager using iptables commands.
-type IPTablesManager struct {
-	chainName string
-}
-
-// Setup ensures the iptables chain exists and is linked.
-func (m *IPTablesManager) Setup() error {
-	log.Println("Setting up iptables...")
-	if _, err := exec.LookPath("iptables"); err != nil {
-		return fmt.Errorf("iptables command not found: %v", err)
+// action returns the block action for the rule, falling back to blockAction.
+func (o RuleOptions) action() string {
+	if o.Action != "" {
+		return o.Action
 	}
-	versionCmd := exec.Command("iptables", "-V")
-	output, err := versionCmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("cannot run iptables (permission issue?): %v, output: %s", err, string(output))
-	}
-	if debug {
-		log.Printf("Using iptables version: %s", strings.TrimSpace(string(output)))
-	}
-
-	cmd := exec.Command("iptables", "-w", "-t", "filter", "-L", m.chainName, "-n")
-	output, err = cmd.CombinedOutput()
-	chainExists := err == nil
+	return blockAction
+}
 
-	if !chainExists {
-		log.Printf("Creating custom iptables chain: %s", m.chainName)
-		cmd = exec.Command("iptables", "-w", "-t", "filter", "-N", m.chainName)
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("failed to create chain %s: %v, output: %s", m.chainName, err, string(output))
-		}
+// ports returns the ports to block for the rule, falling back to blockPorts.
+func (o RuleOptions) ports() []string {
+	if len(o.Ports) > 0 {
+		return o.Ports
 	}
+	return blockPorts
+}
 
-	checkLinkCmd := exec.Command("iptables", "-w", "-t", "filter", "-C", "INPUT", "-j", m.chainName)
-	if err := checkLinkCmd.Run(); err != nil {
-		log.Printf("Linking chain %s to INPUT chain", m.chainName)
-		insertLinkCmd := exec.Command("iptables", "-w", "-t", "filter", "-I", "INPUT", "1", "-j", m.chainName)
-		output, err = insertLinkCmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("failed to link chain %s to INPUT: %v, output: %s", m.chainName, err, string(output))
-		}
-	} else {
-		log.Printf("Chain %s is already linked to INPUT chain", m.chainName)
+// scope returns the block scope for the rule: "web" (its ports) if it has its own ports,
+// and blockScope otherwise.
+func (o RuleOptions) scope() string {
+	if len(o.Ports) > 0 {
+		return "web"
 	}
+	return blockScope
+}
 
-	if chainExists {
-		if err := m.Flush(); err != nil {
-			if !strings.Contains(err.Error(), "doesn't exist") {
-				return fmt.Errorf("failed to flush existing chain %s: %v", m.chainName, err)
-			}
-		} else {
-			log.Printf("Using existing iptables chain: %s (flushed)", m.chainName)
-		}
-	} else {
-		log.Printf("Successfully created and configured iptables chain: %s", m.chainName)
-	}
-	return nil
+// entryAction returns the block action in effect for a blocklist entry. The caller must hold mu.
+func entryAction(target string) string {
+	return RuleOptions{Action: blockedActions[target]}.action()
 }
 
-// Flush removes all rules added by this tool from the filter chain and NAT table.
-func (m *IPTablesManager) Flush() error {
-	// Flush the filter chain
-	log.Printf("Flushing iptables filter chain: %s", m.chainName)
-	cmd := exec.Command("iptables", "-w", "-t", "filter", "-F", m.chainName)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if strings.Contains(string(output), "No chain/target/match by that name") {
-			log.Printf("Chain %s doesn't exist, nothing to flush.", m.chainName)
-		} else {
-			log.Printf("Warning: Failed to flush iptables filter chain %s: %v, output: %s", m.chainName, err, string(output))
-			// Continue to try NAT cleanup
-		}
+// setBlockedActionLocked records a per-entry action; an empty action clears it. The caller must hold mu.
+func setBlockedActionLocked(target, action string) {
+	if action == "" {
+		delete(blockedActions, target)
 	} else {
-		log.Printf("Flushed filter chain: %s", m.chainName)
-	}
-
-	// Clean up NAT table redirect rules in PREROUTING chain
-	log.Printf("Cleaning up NAT redirect rules in PREROUTING chain")
-
-	// Clean up port 80 redirects
-	cleanedCount80 := 0
-	for {
-		// Find and remove any redirects to our HTTP challenge port
-		checkArgs := []string{"-w", "-t", "nat", "-C", "PREROUTING", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", challengeHTTPPort)}
-		cmd := exec.Command("iptables", checkArgs...)
-		checkErr := cmd.Run()
-
-		if checkErr != nil {
-			// No more matching rules
-			break
-		}
-
-		// Rule exists, delete it
-		deleteArgs := []string{"-w", "-t", "nat", "-D", "PREROUTING", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", challengeHTTPPort)}
-		deleteCmd := exec.Command("iptables", deleteArgs...)
-		deleteErr := deleteCmd.Run()
-
-		if deleteErr != nil {
-			log.Printf("Warning: Failed to delete NAT redirect rule for port 80: %v", deleteErr)
-			break
-		}
-
-		cleanedCount80++
-	}
-
-	// Clean up port 443 redirects
-	cleanedCount443 := 0
-	for {
-		// Find and remove any redirects to our HTTPS challenge port
-		checkArgs := []string{"-w", "-t", "nat", "-C", "PREROUTING", "-p", "tcp", "--dport", "443", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", challengePort)}
-		cmd := exec.Command("iptables", checkArgs...)
-		checkErr := cmd.Run()
-
-		if checkErr != nil {
-			// No more matching rules
-			break
-		}
-
-		// Rule exists, delete it
-		deleteArgs := []string{"-w", "-t", "nat", "-D", "PREROUTING", "-p", "tcp", "--dport", "443", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", challengePort)}
-		deleteCmd := exec.Command("iptables", deleteArgs...)
-		deleteErr := deleteCmd.Run()
-
-		if deleteErr != nil {
-			log.Printf("Warning: Failed to delete NAT redirect rule for port 443: %v", deleteErr)
-			break
-		}
-
-		cleanedCount443++
-	}
-
-	if cleanedCount80 > 0 || cleanedCount443 > 0 {
-		log.Printf("Cleaned up NAT redirect rules: %d for port 80, %d for port 443", cleanedCount80, cleanedCount443)
+		blockedActions[target] = action
 	}
-
-	return nil
 }
 
-// IsRulePresent checks if a specific iptables rule exists.
-func (m *IPTablesManager) IsRulePresent(checkArgs []string) (bool, error) {
-	fullArgs := append([]string{"-w"}, checkArgs...)
-	cmd := exec.Command("iptables", fullArgs...)
-	output, err := cmd.CombinedOutput()
-	if err == nil {
-		return true, nil
-	}
-	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-		return false, nil
+// setBlockExpiryLocked records when an automatic block ends, if it lasts a limited time
+// (see blockDurationForLocked), and counts the offense. The caller must hold mu.
+func setBlockExpiryLocked(target string, duration time.Duration) {
+	if duration > 0 {
+		blockedExpiry[target] = time.Now().Add(duration)
 	}
-	return false, fmt.Errorf("error checking iptables rule %v: %v, output: %s", checkArgs, err, string(output))
+	blockOffenses[target]++
 }
 
-// AddBlockRule adds a standard DROP rule using delete-then-insert.
-func (m *IPTablesManager) AddBlockRule(target string) error {
-	deleteArgs80 := []string{"-w", "-t", "filter", "-D", m.chainName, "-s", target, "-p", "tcp", "--dport", "80", "-j", "DROP"}
-	exec.Command("iptables", deleteArgs80...).Run() // Ignore error
-	insertArgs80 := []string{"-w", "-t", "filter", "-I", m.chainName, "1", "-s", target, "-p", "tcp", "--dport", "80", "-j", "DROP"}
-	_, err80 := exec.Command("iptables", insertArgs80...).CombinedOutput()
-	// Log errors unconditionally
-	if err80 != nil {
-		log.Printf("Failed to insert block rule for %s port 80: %v", target, err80)
-	} else if debug { // Log success only in debug
-		log.Printf("Ensured block rule exists for %s on port 80", target)
+// setBlockedPortsLocked records the ports of a block by a rule with its own blockPorts
+// in the entry's metadata, which must have been recorded. The caller must hold mu.
+func setBlockedPortsLocked(target string, ports []string) {
+	if meta := blockedMeta[target]; meta != nil {
+		meta.Ports = ports
 	}
+}
 
-	deleteArgs443 := []string{"-w", "-t", "filter", "-D", m.chainName, "-s", target, "-p", "tcp", "--dport", "443", "-j", "DROP"}
-	exec.Command("iptables", deleteArgs443...).Run() // Ignore error
-	insertArgs443 := []string{"-w", "-t", "filter", "-I", m.chainName, "1", "-s", target, "-p", "tcp", "--dport", "443", "-j", "DROP"}
-	_, err443 := exec.Command("iptables", insertArgs443...).CombinedOutput()
-	// Log errors unconditionally
-	if err443 != nil {
-		log.Printf("Failed to insert block rule for %s port 443: %v", target, err443)
-	} else if debug { // Log success only in debug
-		log.Printf("Ensured block rule exists for %s on port 443", target)
+// samePorts reports whether the entry with metadata meta was blocked on ports (its rule's
+// own blockPorts, or nil for blockPorts).
+func samePorts(meta *BlockEntry, ports []string) bool {
+	var entryPorts []string
+	if meta != nil {
+		entryPorts = meta.Ports
 	}
+	return strings.Join(entryPorts, ",") == strings.Join(ports, ",")
+}
 
-	if err80 != nil {
-		return fmt.Errorf("port 80 block failed: %w", err80)
-	}
-	if err443 != nil {
-		return fmt.Errorf("port 443 block failed: %w", err443)
-	}
-	return nil
+// forgetEntryMetaLocked drops the per-entry action, expiry and metadata of a removed entry. The caller must hold mu.
+func forgetEntryMetaLocked(target string) {
+	delete(blockedActions, target)
+	delete(blockedExpiry, target)
+	delete(blockedMeta, target)
 }
 
-// RemoveBlockRule removes a standard DROP rule.
-func (m *IPTablesManager) RemoveBlockRule(target string) error {
-	var errors []string
-	ruleSpecs := [][]string{
-		{"-t", "filter", "-s", target, "-p", "tcp", "--dport", "80", "-j", "DROP"},
-		{"-t", "filter", "-s", target, "-p", "tcp", "--dport", "443", "-j", "DROP"},
-	}
-	rulesRemoved := 0
-	for _, spec := range ruleSpecs {
-		for {
-			deleteArgs := append([]string{"-w", "-D", m.chainName}, spec...)
-			cmd := exec.Command("iptables", deleteArgs...)
-			_, err := cmd.CombinedOutput()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-					break
-				}
-				errMsg := fmt.Sprintf("failed to remove block rule %v: %v", deleteArgs, err)
-				log.Println(errMsg)
-				errors = append(errors, errMsg)
-				break
-			}
-			if debug { // Log success only in debug
-				log.Printf("Successfully removed block rule instance: %v", deleteArgs)
-			}
-			rulesRemoved++
-		}
+// ruleOptionsFor builds the rule options for re-applying an existing blocklist entry,
+// using reason unless the entry's BlockInfo records the rule that blocked it.
+func ruleOptionsFor(target, reason string) RuleOptions {
+	mu.Lock()
+	opts := RuleOptions{Reason: reason, Action: blockedActions[target]}
+	if meta := blockedMeta[target]; meta != nil {
+		opts.Ports = meta.Ports
 	}
-	if len(errors) > 0 {
-		return fmt.Errorf("errors removing block rules for %s: %s", target, strings.Join(errors, "; "))
+	if expiry, ok := blockedExpiry[target]; ok {
+		opts.Timeout = remainingTimeout(expiry)
 	}
-	if rulesRemoved > 0 {
-		log.Printf("Successfully removed %d block rule instance(s) for %s", rulesRemoved, target)
+	mu.Unlock()
+	if info := getBlockInfo(target); info != nil {
+		opts.Reason = info.Rule
 	}
-	return nil
+	return opts
 }
 
-// AddRedirectRule adds NAT redirect rules using delete-then-insert.
-func (m *IPTablesManager) AddRedirectRule(target string) error {
-	challengeHTTPSPortStr := fmt.Sprintf("%d", challengePort)
-	challengeHTTPPortStr := fmt.Sprintf("%d", challengeHTTPPort)
-	addRuleSpecs := [][]string{
-		{"-w", "-t", "nat", "-I", "PREROUTING", "1", "-s", target, "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-port", challengeHTTPPortStr},
-		{"-w", "-t", "nat", "-I", "PREROUTING", "1", "-s", target, "-p", "tcp", "--dport", "443", "-j", "REDIRECT", "--to-port", challengeHTTPSPortStr},
-	}
-	var firstErr error
-	rulesAdded := 0
-	for _, addArgs := range addRuleSpecs {
-		spec := make([]string, 0, len(addArgs)-3)
-		for i, arg := range addArgs {
-			if i > 0 && addArgs[i-1] == "-I" {
-				continue
-			}
-			if arg != "-w" && arg != "-I" {
-				spec = append(spec, arg)
-			}
-		}
-		deleteArgs := append([]string{"-w", "-D", "PREROUTING"}, spec...)
-		exec.Command("iptables", deleteArgs...).Run() // Ignore error
-		cmdIns := exec.Command("iptables", addArgs...)
-		_, err := cmdIns.CombinedOutput()
-		if err != nil {
-			log.Printf("Failed to insert redirect rule (iptables %v): %v", strings.Join(addArgs, " "), err)
-			if firstErr == nil {
-				firstErr = err
-			}
-		} else {
-			if debug { // Log success only in debug
-				log.Printf("Ensured redirect rule exists: iptables %v", strings.Join(addArgs, " "))
-			}
-			rulesAdded++
+// ruleComment builds the "apacheblock: <reason> <RFC3339 time>" comment attached to rules.
+// The reason is shortened so the whole comment fits in maxLen bytes, and characters that
+// would need quoting in firewall listings are dropped.
+func ruleComment(opts RuleOptions, maxLen int) string {
+	const prefix = "apacheblock: "
+	suffix := " " + time.Now().Format(time.RFC3339)
+
+	reason := strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < ' ' || r == 0x7f {
+			return -1
 		}
+		return r
+	}, strings.TrimSpace(opts.Reason))
+	if reason == "" {
+		reason = "blocked"
 	}
-	if rulesAdded > 0 {
-		log.Printf("Ensured redirect rules are present for %s (Port 80 -> %s, Port 443 -> %s)", target, challengeHTTPPortStr, challengeHTTPSPortStr)
-	}
-	if firstErr != nil {
-		return fmt.Errorf("failed to ensure redirect rule(s): %w", firstErr)
-	}
-	return nil
-}
 
-// RemoveRedirectRule removes NAT redirect rules.
-func (m *IPTablesManager) RemoveRedirectRule(target string) error {
-	challengeHTTPSPortStr := fmt.Sprintf("%d", challengePort)
-	challengeHTTPPortStr := fmt.Sprintf("%d", challengeHTTPPort)
-	ruleSpecs := [][]string{
-		{"-t", "nat", "-s", target, "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-port", challengeHTTPPortStr},
-		{"-t", "nat", "-s", target, "-p", "tcp", "--dport", "443", "-j", "REDIRECT", "--to-port", challengeHTTPSPortStr},
-	}
-	var errors []string
-	rulesRemoved := 0
-	for _, spec := range ruleSpecs {
-		for {
-			deleteArgs := append([]string{"-w", "-D", "PREROUTING"}, spec...)
-			cmd := exec.Command("iptables", deleteArgs...)
-			_, err := cmd.CombinedOutput()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-					if debug && rulesRemoved == 0 {
-						log.Printf("Redirect rule spec not found: iptables %v", deleteArgs)
-					}
-					break
-				}
-				errMsg := fmt.Sprintf("failed to remove redirect rule %v: %v", deleteArgs, err)
-				log.Println(errMsg)
-				errors = append(errors, errMsg)
-				break
-			}
-			if debug { // Log success only in debug
-				log.Printf("Successfully removed redirect rule instance: %v", deleteArgs)
-			}
-			rulesRemoved++
+	if room := maxLen - len(prefix) - len(suffix); len(reason) > room {
+		if room < 0 {
+			room = 0
+		}
+		reason = reason[:room]
+		// Do not leave half of a multi-byte character at the end
+		for len(reason) > 0 && !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
 		}
 	}
-	if len(errors) > 0 {
-		return fmt.Errorf("errors removing redirect rules for %s: %s", target, strings.Join(errors, "; "))
-	}
-	if rulesRemoved > 0 {
-		log.Printf("Successfully removed %d redirect rule instance(s) for %s", rulesRemoved, target)
-	}
-	return nil
+	return prefix + reason + suffix
 }
 
-// --- NFTables Implementation ---
-
-// NFTablesManager implements FirewallManager using nft commands.
-type NFTablesManager struct {
-	tableName   string // e.g., "inet apacheblock"
-	filterChain string // e.g., "apacheblock_filter"
-	natChain    string // e.g., "apacheblock_nat" (nft uses prerouting hook in nat table)
+// batchApplier is implemented by backends that can install many block rules in one
+// operation. applyBlockList prefers it over adding rules one target at a time.
+// opts holds per-target rule options; targets without an entry get the zero value.
+type batchApplier interface {
+	ApplyBlockRules(targets []string, opts map[string]RuleOptions) error
 }
 
-// runNFTCommand executes an nft command and returns its output.
-func (m *NFTablesManager) runNFTCommand(args ...string) ([]byte, error) {
-	cmd := exec.Command("nft", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Include output in error message for better debugging
-		return output, fmt.Errorf("nft command failed (%v): %v, output: %s", args, err, string(output))
-	}
-	// Only log success in debug mode
-	if debug {
-		log.Printf("Successfully ran nft command: %v", args)
-	}
-	return output, nil
+// ruleLister is implemented by backends that can report which targets currently have
+// rules installed. The reconcile task uses it to detect rules removed behind our back.
+type ruleLister interface {
+	// ListRuleTargets returns the targets with block rules, or with redirect rules if redirect is set.
+	ListRuleTargets(redirect bool) ([]string, error)
 }
 
-// Setup creates the necessary nftables table and chains.
-func (m *NFTablesManager) Setup() error {
-	log.Println("Setting up nftables...")
-	if _, err := exec.LookPath("nft"); err != nil {
-		return fmt.Errorf("nft command not found: %v", err)
-	}
-
-	// Check permissions
-	permCheckCmd := exec.Command("nft", "list", "tables")
-	_, err := permCheckCmd.CombinedOutput()
-	if err != nil {
-		if strings.Contains(err.Error(), "permission denied") || strings.Contains(err.Error(), "Operation not permitted") {
-			return fmt.Errorf("cannot run nft (permission issue?): %v", err)
-		}
-		log.Printf("Warning: nft permission check failed, proceeding cautiously: %v", err)
-	}
-
-	// Use a single transaction for setup
-	// Assumes tableName is like "inet familyname"
-	_, tableNameOnly := m.parseTableName() // Use blank identifier for unused family
-	if tableNameOnly == "" {
-		return fmt.Errorf("invalid nftables table name format: %s", m.tableName)
-	}
-	natTableName := "ip " + tableNameOnly // NAT table is typically ip family
-
-	nftCommands := fmt.Sprintf(`
-        add table %s;
-        add chain %s %s { type filter hook input priority filter; policy accept; };
-        add table %s;
-        add chain %s %s { type nat hook prerouting priority dstnat; policy accept; };
-    `, m.tableName, m.tableName, m.filterChain, natTableName, natTableName, m.natChain)
-
-	cmd := exec.Command("nft", "-f", "-")
-	cmd.Stdin = strings.NewReader(nftCommands)
-	output, err := cmd.CombinedOutput()
-
-	// Ignore errors indicating components already exist
-	if err != nil && !strings.Contains(string(output), "File exists") && !strings.Contains(string(output), "Object exists") {
-		return fmt.Errorf("nftables setup transaction failed: %v, output: %s", err, string(output))
-	}
-
-	log.Println("NFTables setup complete (errors ignored if components already exist).")
-	return nil
+// kernelExpirer is implemented by backends that time out blocks themselves (nftables set
+// elements). ExpiredTargets returns which of the given targets have expired and are no
+// longer installed, so the daemon does not remove their rules again.
+type kernelExpirer interface {
+	ExpiredTargets(targets []string) ([]string, error)
 }
 
-// Flush removes rules from our specific chains.
-func (m *NFTablesManager) Flush() error {
-	_, tableNameOnly := m.parseTableName() // Use blank identifier for unused family
-	if tableNameOnly == "" {
-		return fmt.Errorf("invalid nftables table name format: %s", m.tableName)
-	}
-	natTableName := "ip " + tableNameOnly
-
-	log.Printf("Flushing nftables chains: %s/%s and %s/%s", m.tableName, m.filterChain, natTableName, m.natChain)
-	// Flush filter chain
-	_, errFilter := m.runNFTCommand("flush", "chain", m.tableName, m.filterChain)
-	if errFilter != nil && !strings.Contains(errFilter.Error(), "No such file or directory") {
-		log.Printf("Warning: Failed to flush nft filter chain: %v", errFilter)
-	}
-	// Flush nat chain
-	_, errNat := m.runNFTCommand("flush", "chain", natTableName, m.natChain)
-	if errNat != nil && !strings.Contains(errNat.Error(), "No such file or directory") {
-		log.Printf("Warning: Failed to flush nft nat chain: %v", errNat)
-	}
-
-	if errFilter != nil && !strings.Contains(errFilter.Error(), "No such file or directory") {
-		return errFilter
-	}
-	if errNat != nil && !strings.Contains(errNat.Error(), "No such file or directory") {
-		return errNat
-	}
-	return nil
-}
+// Global instance of the firewall manager
+var (
+	fwManager FirewallManager
+	fwOnce    sync.Once // To initialize the manager only once
+)
 
-// IsRulePresent is complex in nftables as it requires listing and parsing. Placeholder.
-func (m *NFTablesManager) IsRulePresent(checkArgs []string) (bool, error) {
-	// checkArgs are iptables-style args; for nftables we do a best-effort check
-	// by listing rules in our chains and searching for the target IP/subnet
-	var target string
-	for i, arg := range checkArgs {
-		if arg == "-s" && i+1 < len(checkArgs) {
-			target = checkArgs[i+1]
-			break
+// InitFirewallManager selects and initializes the appropriate firewall manager based on config.
+func InitFirewallManager() error {
+	var initErr error
+	fwOnce.Do(func() {
+		log.Printf("Initializing Firewall Manager (Type: %s)...", firewallType)
+		if fwManager, initErr = newFirewallManager(); initErr == nil {
+			initErr = fwManager.Setup()
 		}
-	}
-	if target == "" {
-		return false, nil
-	}
-
-	output, err := m.runNFTCommand("list", "ruleset")
-	if err != nil {
-		return false, nil
-	}
-	return strings.Contains(string(output), target), nil
-}
-
-// AddBlockRule adds a drop rule to the filter chain.
-func (m *NFTablesManager) AddBlockRule(target string) error {
-	rule := fmt.Sprintf("add rule %s %s ip saddr %s tcp dport {80, 443} drop", m.tableName, m.filterChain, target)
-	_, err := m.runNFTCommand(strings.Split(rule, " ")...)
-	if err != nil {
-		// Log existence check only in debug
-		if strings.Contains(err.Error(), "File exists") || strings.Contains(err.Error(), "Object exists") {
-			if debug {
-				log.Printf("NFTables block rule for %s likely already exists.", target)
-			}
-			return nil // Treat as success if rule exists
+		if initErr != nil {
+			log.Printf("Firewall Manager initialization failed: %v", initErr)
+		} else {
+			log.Printf("Firewall Manager initialized successfully.")
 		}
-		return fmt.Errorf("failed to add nft block rule for %s: %w", target, err)
-	}
-	log.Printf("Added nftables block rule for %s", target)
-	return nil
-}
-
-// RemoveBlockRule removes a drop rule. Requires knowing the rule handle or exact spec. Placeholder.
-func (m *NFTablesManager) RemoveBlockRule(target string) error {
-	return m.deleteRulesByTarget(m.tableName, m.filterChain, target)
+	})
+	return initErr
 }
 
-// AddRedirectRule adds redirect rules to the nat chain.
-func (m *NFTablesManager) AddRedirectRule(target string) error {
-	challengeHTTPSPortStr := fmt.Sprintf("%d", challengePort)
-	challengeHTTPPortStr := fmt.Sprintf("%d", challengeHTTPPort)
-	_, tableNameOnly := m.parseTableName()
-	if tableNameOnly == "" {
-		return fmt.Errorf("invalid nftables table name format: %s", m.tableName)
-	}
-	natTableName := "ip " + tableNameOnly
-
-	rules := []string{
-		fmt.Sprintf("add rule %s %s ip saddr %s tcp dport 80 redirect to :%s", natTableName, m.natChain, target, challengeHTTPPortStr),
-		fmt.Sprintf("add rule %s %s ip saddr %s tcp dport 443 redirect to :%s", natTableName, m.natChain, target, challengeHTTPSPortStr),
+// newFirewallManager returns the manager for the configured firewallType, without setting it up.
+func newFirewallManager() (FirewallManager, error) {
+	if dryRun {
+		return &DryRunManager{}, nil
 	}
-
-	var firstErr error
-	for _, rule := range rules {
-		_, err := m.runNFTCommand(strings.Split(rule, " ")...)
-		if err != nil {
-			if strings.Contains(err.Error(), "File exists") || strings.Contains(err.Error(), "Object exists") {
-				if debug {
-					log.Printf("NFTables redirect rule likely already exists: %s", rule)
-				}
-				continue // Treat as success if rule exists
-			}
-			log.Printf("Failed to add nft redirect rule (%s): %v", rule, err)
-			if firstErr == nil {
-				firstErr = err
+	switch firewallType {
+	case "iptables":
+		if useIPSet {
+			if _, err := exec.LookPath("ipset"); err == nil {
+				return newIPSetManager(firewallChain), nil
 			}
-		} else if debug { // Log success only in debug
-			log.Printf("Added nftables redirect rule: %s", rule)
-		}
-	}
-	if firstErr != nil {
-		return fmt.Errorf("failed to add nft redirect rule(s) for %s: %w", target, firstErr)
+			log.Printf("Warning: useIPSet is enabled but the ipset command was not found, falling back to per-address iptables rules")
+		}
+		return &IPTablesManager{chainName: firewallChain}, nil
+	case "nftables":
+		if len(attachChains) != 1 || attachChains[0] != "INPUT" {
+			log.Printf("Warning: attachChains is only supported by the iptables backend, nftables rules apply to input traffic only")
+		}
+		// Define table name (e.g., "inet apacheblock") and chain names
+		tableName := "inet apacheblock" // Includes family
+		filterChainName := firewallChain
+		natChainName := firewallChain + "_nat"
+		return &NFTablesManager{tableName: tableName, filterChain: filterChainName, natChain: natChainName}, nil
+	case "cloudflare":
+		return newCloudflareManager(cloudflareAPIToken, cloudflareZoneID)
+	case "pf":
+		return newPFManager(firewallChain), nil
+	case "denyfile":
+		return newDenyFileManager(denyFilePath, denyFileFormat, reloadCommand), nil
+	case "caddy":
+		return newCaddyManager(caddyAdminURL, caddyServer, caddyAdminToken, firewallChain)
+	default:
+		return nil, fmt.Errorf("unsupported firewallType: %s", firewallType)
 	}
-	log.Printf("Ensured nftables redirect rules are present for %s (Port 80 -> %s, Port 443 -> %s)", target, challengeHTTPPortStr, challengeHTTPSPortStr)
-	return nil
 }
 
-// RemoveRedirectRule removes redirect rules. Requires knowing the rule handle or exact spec. Placeholder.
-func (m *NFTablesManager) RemoveRedirectRule(target string) error {
-	_, tableNameOnly := m.parseTableName()
-	if tableNameOnly == "" {
-		return fmt.Errorf("invalid nftables table name format: %s", m.tableName)
-	}
-	natTableName := "ip " + tableNameOnly
-	return m.deleteRulesByTarget(natTableName, m.natChain, target)
-}
+// --- Helper functions previously global, now potentially methods or standalone ---
 
-// parseTableName splits "family name" into parts.
-func (m *NFTablesManager) parseTableName() (string, string) {
-	parts := strings.Fields(m.tableName)
-	if len(parts) == 2 {
-		return parts[0], parts[1]
+// redirectPortFor returns the challenge server port that traffic for a blocked port is
+// redirected to. 443 and other ports ending in 443 (8443, 9443, ...) are treated as TLS
+// and go to the HTTPS challenge server; everything else goes to the HTTP redirector.
+func redirectPortFor(port string) int {
+	if strings.HasSuffix(port, "443") {
+		return challengePort
 	}
-	return "", "" // Invalid format
+	return challengeHTTPPort
 }
 
-var nftHandleRe = regexp.MustCompile(`# handle (\d+)`)
-
-func (m *NFTablesManager) deleteRulesByTarget(tableName, chainName, target string) error {
-	output, err := m.runNFTCommand("-a", "list", "chain", tableName, chainName)
-	if err != nil {
-		return fmt.Errorf("failed to list chain %s %s: %w", tableName, chainName, err)
-	}
-
-	var handles []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, target) {
-			matches := nftHandleRe.FindStringSubmatch(line)
-			if len(matches) == 2 {
-				handles = append(handles, matches[1])
-			}
-		}
+// describeRedirects summarises the port mapping for log messages, e.g. "Port 80 -> 8088, Port 443 -> 4443".
+func describeRedirects(ports []string) string {
+	parts := make([]string, 0, len(ports))
+	for _, port := range ports {
+		parts = append(parts, fmt.Sprintf("Port %s -> %d", port, redirectPortFor(port)))
 	}
-
-	if len(handles) == 0 {
-		if debug {
-			log.Printf("No nft rules found for target %s in %s %s", target, tableName, chainName)
-		}
-		return nil
-	}
-
-	for _, handle := range handles {
-		_, err := m.runNFTCommand("delete", "rule", tableName, chainName, "handle", handle)
-		if err != nil {
-			log.Printf("Warning: failed to delete nft rule handle %s: %v", handle, err)
-		} else if debug {
-			log.Printf("Deleted nft rule handle %s for target %s", handle, target)
-		}
-	}
-
-	log.Printf("Removed %d nft rule(s) for %s in %s %s", len(handles), target, tableName, chainName)
-	return nil
+	return strings.Join(parts, ", ")
 }
 
-// --- Helper functions previously global, now potentially methods or standalone ---
-
-// removePortBlockingRules uses fwManager.Flush() to clean up all firewall rules and clears internal state
+// removePortBlockingRules uses fwManager.Teardown() to remove all firewall rules, unlink our
+// chains from their parents, and clear internal state
 func removePortBlockingRules() error {
 	if fwManager == nil {
 		return fmt.Errorf("firewall manager not initialized")
@@ -626,16 +272,19 @@ func removePortBlockingRules() error {
 		listFirewallRules()
 	}
 
-	// Flush firewall rules using the manager
-	if err := fwManager.Flush(); err != nil {
-		log.Printf("Warning: Failed to flush firewall rules via manager: %v", err)
+	// Remove firewall rules and chains using the manager
+	if err := fwManager.Teardown(); err != nil {
+		log.Printf("Warning: Failed to remove firewall rules via manager: %v", err)
 		// Continue to clear internal state anyway
 	}
 
 	// Clear the internal blocklist state
 	mu.Lock()
 	blockedIPs = make(map[string]struct{})
-	blockedSubnets = make(map[string]struct{})
+	resetBlockedSubnetsLocked()
+	blockedActions = make(map[string]string)
+	blockedExpiry = make(map[string]time.Time)
+	blockedMeta = make(map[string]*BlockEntry)
 	mu.Unlock()
 
 	// Save the empty blocklist file
@@ -653,6 +302,17 @@ func removePortBlockingRules() error {
 	return nil
 }
 
+// logBlockFailure reports a firewall rule that could not be added. The target stays out of
+// the blocklist, so the next matching log line tries again.
+func logBlockFailure(kind, target string, err error) {
+	var cmdErr *FirewallCommandError
+	if errors.As(err, &cmdErr) && cmdErr.GaveUp {
+		log.Printf("Failed to add firewall rule for %s %s, firewall busy (will retry on the next match): %v", kind, target, err)
+		return
+	}
+	log.Printf("Failed to add firewall rule for %s %s: %v", kind, target, err)
+}
+
 // blockIP adds an IP to the blocklist and blocks it in the firewall
 func getBlockInfo(ip string) *BlockInfo {
 	blockedIPInfoMu.RLock()
@@ -666,18 +326,23 @@ func removeBlockInfo(ip string) {
 	blockedIPInfoMu.Unlock()
 }
 
-func blockIP(ip, filePath string, rule string, triggeringRequest string, userAgent ...string) {
+// blockIP blocks ip for a match of the named rule, with the given reason, in filePath.
+func blockIP(ip, filePath, reason, rule, triggeringRequest string, userAgent ...string) {
 	if fwManager == nil {
 		log.Println("Error: Firewall manager not initialized in blockIP")
 		return
 	}
 	// Check if the IP is already in the blocklist
+	opts := RuleOptions{Reason: reason, Action: ruleAction(rule), Ports: ruleBlockPorts(rule)}
 	alreadyBlocked := false
 	mu.Lock()
-	if _, exists := blockedIPs[ip]; exists {
+	_, exists := blockedIPs[ip]
+	_, pending := pendingBlocks[ip]
+	if exists || pending {
 		alreadyBlocked = true
 	} else {
-		blockedIPs[ip] = struct{}{} // Add to internal list first
+		pendingBlocks[ip] = struct{}{} // Claim the IP while its rule is added
+		opts.Timeout = blockDurationForLocked(ip, rule)
 	}
 	mu.Unlock()
 
@@ -688,40 +353,53 @@ func blockIP(ip, filePath string, rule string, triggeringRequest string, userAge
 		return
 	}
 
+	ua := ""
+	if len(userAgent) > 0 {
+		ua = userAgent[0]
+	}
+
 	// Add the appropriate firewall rule
-	var err error
-	if challengeEnable {
-		err = fwManager.AddRedirectRule(ip)
-	} else {
-		err = fwManager.AddBlockRule(ip)
+	err := addFirewallRule(ip, opts)
+
+	// Only commit to the blocklist once the rule has landed
+	mu.Lock()
+	delete(pendingBlocks, ip)
+	if err == nil {
+		blockedIPs[ip] = struct{}{}
+		setBlockedActionLocked(ip, opts.Action)
+		setBlockExpiryLocked(ip, opts.Timeout)
+		recordBlockMetaLocked(ip, reason, ua)
+		setBlockedPortsLocked(ip, opts.Ports)
 	}
+	mu.Unlock()
 
 	if err != nil {
-		log.Printf("Failed to add firewall rule for IP %s: %v", ip, err)
-		mu.Lock()
-		delete(blockedIPs, ip) // Rollback internal state if firewall add failed
-		mu.Unlock()
+		logBlockFailure("IP", ip, err)
 		return
 	}
+	publishPeerBlock(ip)
 
-	// Save the updated blocklist
-	if err := saveBlockList(); err != nil {
-		log.Printf("Warning: Failed to save blocklist after blocking IP %s: %v", ip, err)
-	} else if debug { // Log success only in debug
-		log.Printf("Successfully saved blocklist to %s", blocklistFilePath)
-	}
+	// Save the updated blocklist with the next debounced save
+	requestBlockListSave()
 
+	rateLimited := opts.action() == "ratelimit" && !challengeEnable
+	action := "BLOCKED IP"
+	switch {
+	case dryRun && rateLimited:
+		action = "DRY-RUN would rate limit IP"
+	case dryRun:
+		action = "DRY-RUN would block IP"
+	case rateLimited:
+		action = "RATE LIMITED IP"
+	}
 	// Log with User-Agent if provided
-	if len(userAgent) > 0 && userAgent[0] != "" {
-		log.Printf("BLOCKED IP %s from %s for %s (User-Agent: %s) Request: %s", ip, filePath, rule, userAgent[0], triggeringRequest)
+	if ua != "" {
+		log.Printf("%s %s from %s for %s (User-Agent: %s) Request: %s", action, ip, filePath, reason, ua, triggeringRequest)
 	} else {
-		log.Printf("BLOCKED IP %s from %s for %s Request: %s", ip, filePath, rule, triggeringRequest)
+		log.Printf("%s %s from %s for %s Request: %s", action, ip, filePath, reason, triggeringRequest)
 	}
+	writeAudit(auditRecord{Action: "block", Target: ip, Reason: reason, Rule: rule, Source: "log", LogFile: filePath, Request: triggeringRequest, UserAgent: ua})
 
-	ua := ""
-	if len(userAgent) > 0 {
-		ua = userAgent[0]
-	}
 	blockedIPInfoMu.Lock()
 	blockedIPInfo[ip] = &BlockInfo{
 		IP:                ip,
@@ -734,18 +412,23 @@ func blockIP(ip, filePath string, rule string, triggeringRequest string, userAge
 	blockedIPInfoMu.Unlock()
 }
 
-// blockSubnet adds a subnet to the blocklist and blocks it in the firewall
-func blockSubnet(subnet string) {
+// blockSubnet adds a subnet to the blocklist and blocks it in the firewall.
+// reason is the match of the named rule that pushed the subnet over subnetThreshold.
+func blockSubnet(subnet, reason, rule string) {
 	if fwManager == nil {
 		log.Println("Error: Firewall manager not initialized in blockSubnet")
 		return
 	}
+	opts := RuleOptions{Reason: "subnet threshold: " + reason, Action: ruleAction(rule), Ports: ruleBlockPorts(rule)}
 	alreadyBlocked := false
 	mu.Lock()
-	if _, exists := blockedSubnets[subnet]; exists {
+	_, exists := blockedSubnets[subnet]
+	_, pending := pendingBlocks[subnet]
+	if exists || pending {
 		alreadyBlocked = true
 	} else {
-		blockedSubnets[subnet] = struct{}{} // Add to internal list first
+		pendingBlocks[subnet] = struct{}{} // Claim the subnet while its rule is added
+		opts.Timeout = blockDurationForLocked(subnet, rule)
 	}
 
 	ipsToRemove := make([]string, 0)
@@ -753,6 +436,9 @@ func blockSubnet(subnet string) {
 		_, ipNet, err := net.ParseCIDR(subnet)
 		if err == nil {
 			for ip := range blockedIPs {
+				if !samePorts(blockedMeta[ip], opts.Ports) {
+					continue // Keeps its own rule, for its own ports
+				}
 				if parsedIP := net.ParseIP(ip); parsedIP != nil && ipNet.Contains(parsedIP) {
 					ipsToRemove = append(ipsToRemove, ip)
 				}
@@ -769,26 +455,42 @@ func blockSubnet(subnet string) {
 	}
 
 	// Add the appropriate firewall rule
-	var err error
-	if challengeEnable {
-		err = fwManager.AddRedirectRule(subnet)
-	} else {
-		err = fwManager.AddBlockRule(subnet)
+	err := addFirewallRule(subnet, opts)
+
+	// Only commit to the blocklist once the rule has landed
+	mu.Lock()
+	delete(pendingBlocks, subnet)
+	if err == nil {
+		addBlockedSubnetLocked(subnet)
+		setBlockedActionLocked(subnet, opts.Action)
+		setBlockExpiryLocked(subnet, opts.Timeout)
+		recordBlockMetaLocked(subnet, reason, "")
+		setBlockedPortsLocked(subnet, opts.Ports)
 	}
+	mu.Unlock()
 
 	if err != nil {
-		log.Printf("Failed to add firewall rule for subnet %s: %v", subnet, err)
-		mu.Lock()
-		delete(blockedSubnets, subnet) // Rollback internal state
-		mu.Unlock()
+		logBlockFailure("subnet", subnet, err)
 		return
 	}
+	exemptSubnet(subnet, false)
+	publishPeerBlock(subnet)
+	writeAudit(auditRecord{Action: "block", Target: subnet, Reason: opts.Reason, Rule: rule, Source: "log"})
 
-	// If this is a new subnet block, remove individual IP rules for this subnet
+	// If this is a new subnet block, remove individual IP rules for this subnet. The
+	// subnet keeps their entries as members, to restore them if it is unblocked.
 	if len(ipsToRemove) > 0 {
 		mu.Lock()
+		var members []BlockEntry
 		for _, ip := range ipsToRemove {
+			if _, ok := blockedIPs[ip]; ok {
+				members = append(members, blockEntryLocked(ip))
+			}
 			delete(blockedIPs, ip)
+			forgetEntryMetaLocked(ip)
+		}
+		if meta := blockedMeta[subnet]; meta != nil {
+			meta.Members = members
 		}
 		mu.Unlock()
 
@@ -805,16 +507,19 @@ func blockSubnet(subnet string) {
 		}
 	}
 
-	// Save the updated blocklist
-	if err := saveBlockList(); err != nil {
-		log.Printf("Warning: Failed to save blocklist after blocking subnet %s: %v", subnet, err)
-	} else if debug { // Log success only in debug
-		log.Printf("Successfully saved blocklist to %s", blocklistFilePath)
+	// Save the updated blocklist with the next debounced save
+	requestBlockListSave()
+	if dryRun {
+		log.Printf("DRY-RUN would block subnet %s (rule %s) and remove %d individual IPs", subnet, reason, len(ipsToRemove))
+	} else {
+		log.Printf("Blocked subnet %s and removed %d individual IPs", subnet, len(ipsToRemove))
 	}
-	log.Printf("Blocked subnet %s and removed %d individual IPs", subnet, len(ipsToRemove))
 }
 
-// applyBlockList applies the current blocklist to the firewall
+// applyBlockList applies the current blocklist to the firewall. The blocklist is copied
+// under mu and the rules installed without holding it, in one batch where the backend
+// supports it or otherwise from a small worker pool. Entries whose rule cannot be added
+// stay in the blocklist, so the reconcile task can add them later.
 func applyBlockList() error {
 	if fwManager == nil {
 		return fmt.Errorf("firewall manager not initialized")
@@ -831,68 +536,122 @@ func applyBlockList() error {
 	}
 	mu.Unlock()
 
-	// Apply IP blocks/redirects
-	for _, ip := range ipsToApply {
-		var err error
-		if challengeEnable {
-			err = fwManager.AddRedirectRule(ip)
-		} else {
-			err = fwManager.AddBlockRule(ip)
+	// Backends that support it load the whole blocklist in one operation
+	if applier, ok := fwManager.(batchApplier); ok && !challengeEnable {
+		targets := append(append([]string{}, ipsToApply...), subnetsToApply...)
+		opts := make(map[string]RuleOptions, len(targets))
+		for _, target := range targets {
+			opts[target] = ruleOptionsFor(target, "restored from blocklist")
 		}
-		if err != nil {
-			log.Printf("Failed to apply firewall rule for IP %s: %v", ip, err)
+		err := applier.ApplyBlockRules(targets, opts)
+		if err == nil {
+			exemptBlockedSubnets()
+			log.Printf("Applied block rules to firewall: %d IPs, %d subnets", len(ipsToApply), len(subnetsToApply))
+			return nil
 		}
+		log.Printf("Warning: Batch apply failed, falling back to per-target rules: %v", err)
 	}
 
-	// Apply subnet blocks/redirects
-	for _, subnet := range subnetsToApply {
-		var err error
-		if challengeEnable {
-			err = fwManager.AddRedirectRule(subnet)
-		} else {
-			err = fwManager.AddBlockRule(subnet)
-		}
-		if err != nil {
-			log.Printf("Failed to apply firewall rule for subnet %s: %v", subnet, err)
+	// Apply IP and subnet blocks/redirects, retrying failures once
+	targets := append(append([]string{}, ipsToApply...), subnetsToApply...)
+	failed := installRules(targets, "restored from blocklist")
+	if len(failed) > 0 {
+		retry := make([]string, 0, len(failed))
+		for target := range failed {
+			retry = append(retry, target)
 		}
+		log.Printf("Retrying %d firewall rules that failed to apply", len(retry))
+		failed = installRules(retry, "restored from blocklist")
+	}
+	for target, err := range failed {
+		log.Printf("Failed to apply firewall rule for %s %s after a retry, it stays in the blocklist: %v", kindOf(target), target, err)
 	}
 
+	exemptBlockedSubnets()
+
 	action := "block rules"
 	if challengeEnable {
 		action = "redirect rules"
 	}
-	log.Printf("Applied %s to firewall: %d IPs, %d subnets",
-		action, len(ipsToApply), len(subnetsToApply))
+	log.Printf("Applied %s to firewall: %d IPs, %d subnets (%d succeeded, %d failed)",
+		action, len(ipsToApply), len(subnetsToApply), len(targets)-len(failed), len(failed))
 
 	return nil
 }
 
+// applyWorkers bounds how many rules installRules adds at once. Backends serialize their
+// own critical sections, so this mainly overlaps the waits of slow backends (API calls,
+// the xtables lock).
+const applyWorkers = 4
+
+// installRules adds the block or, in challenge mode, redirect rule for each target using
+// a pool of applyWorkers goroutines, and returns the targets that failed with their errors.
+// reason is used for targets whose BlockInfo records no rule.
+func installRules(targets []string, reason string) map[string]error {
+	jobs := make(chan string)
+	failed := make(map[string]error)
+	var failedMu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < applyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				opts := ruleOptionsFor(target, reason)
+				var err error
+				if challengeEnable {
+					err = fwManager.AddRedirectRule(target, opts)
+				} else {
+					err = fwManager.AddBlockRule(target, opts)
+				}
+				if err != nil {
+					failedMu.Lock()
+					failed[target] = err
+					failedMu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, target := range targets {
+		jobs <- target
+	}
+	close(jobs)
+	wg.Wait()
+	return failed
+}
+
 // findContainingSubnet returns the blocked subnet that contains the given IP, or "" if none.
 func findContainingSubnet(ip string) string {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
 		return ""
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	for subnet := range blockedSubnets {
-		_, ipNet, err := net.ParseCIDR(subnet)
-		if err != nil {
-			continue
-		}
-		if ipNet.Contains(parsedIP) {
-			return subnet
-		}
-	}
-	return ""
+	subnet, _ := blockedSubnetRanges.covering(addr, -1)
+	return subnet
 }
 
 // unblockIPFromSubnet removes the subnet-level firewall rule, re-adds individual
 // rules for all OTHER IPs that were tracked in that subnet, and removes the subnet
 // from the blocklist. The verified IP itself is NOT re-added.
 func unblockIPFromSubnet(ip, subnet string) error {
+	// Aggregates and subnets that absorbed blocked IPs record them with their metadata
+	if splitAggregate(subnet, ip) {
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: failed to save blocklist after splitting aggregate %s: %v", subnet, err)
+		}
+		return nil
+	}
+
 	// Collect the other IPs in this subnet while holding the lock
 	mu.Lock()
+	subnetAction := blockedActions[subnet]
+	subnetExpiry, subnetExpires := blockedExpiry[subnet]
+	var subnetPorts []string
+	if meta := blockedMeta[subnet]; meta != nil {
+		subnetPorts = meta.Ports
+	}
 	otherIPs := make([]string, 0)
 	if ips, ok := subnetBlockedIPs[subnet]; ok {
 		for otherIP := range ips {
@@ -902,7 +661,8 @@ func unblockIPFromSubnet(ip, subnet string) error {
 		}
 	}
 	delete(subnetBlockedIPs, subnet)
-	delete(blockedSubnets, subnet)
+	removeBlockedSubnetLocked(subnet)
+	forgetEntryMetaLocked(subnet)
 	mu.Unlock()
 
 	// Remove the subnet-level firewall rule
@@ -920,13 +680,20 @@ func unblockIPFromSubnet(ip, subnet string) error {
 	for _, otherIP := range otherIPs {
 		mu.Lock()
 		blockedIPs[otherIP] = struct{}{}
+		setBlockedActionLocked(otherIP, subnetAction)
+		if subnetExpires {
+			blockedExpiry[otherIP] = subnetExpiry
+		}
+		recordBlockMetaLocked(otherIP, "split from subnet "+subnet, "")
+		setBlockedPortsLocked(otherIP, subnetPorts)
 		mu.Unlock()
 
+		opts := ruleOptionsFor(otherIP, "split from subnet "+subnet)
 		var addErr error
 		if challengeEnable {
-			addErr = fwManager.AddRedirectRule(otherIP)
+			addErr = fwManager.AddRedirectRule(otherIP, opts)
 		} else {
-			addErr = fwManager.AddBlockRule(otherIP)
+			addErr = fwManager.AddBlockRule(otherIP, opts)
 		}
 		if addErr != nil {
 			log.Printf("Warning: failed to re-add individual rule for IP %s after splitting subnet %s: %v", otherIP, subnet, addErr)
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Caddy Implementation ---
+
+const (
+	caddyMaxAttempts = 3 // Attempts per admin API call before treating Caddy as unreachable
+)
+
+// CaddyManager blocks at a Caddy reverse proxy through its admin API. It keeps one route,
+// with @id routeID, at the top of an HTTP server's routes: a remote_ip matcher listing
+// the blocked targets and a handler that aborts the connection (blockAction = drop) or
+// answers 403 (blockAction = reject). Every change pushes the whole list, so one
+// successful call brings Caddy up to date.
+//
+// The local blocklist stays the source of truth: if Caddy cannot be reached, changes are
+// kept in targets, the manager is marked pending, and the list is pushed again by the
+// next change or reconcile run. A Caddy config reload drops the route; CheckChain reports
+// it missing so the self-heal recreates it.
+type CaddyManager struct {
+	adminURL string // e.g. "http://localhost:2019"
+	server   string // Name of the server under apps.http.servers, e.g. "srv0"
+	token    string // Sent as a bearer token when the admin API sits behind an authenticating proxy
+	routeID  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	targets map[string]bool
+	pending bool // targets has changes Caddy has not accepted yet
+}
+
+// caddyError is a failed admin API call. Status is 0 if Caddy could not be reached (or
+// only answered with server errors) after caddyMaxAttempts attempts.
+type caddyError struct {
+	Method, Path string
+	Status       int
+	Message      string
+}
+
+func (e *caddyError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("Caddy admin API %s %s unreachable: %s", e.Method, e.Path, e.Message)
+	}
+	return fmt.Sprintf("Caddy admin API %s %s failed: HTTP %d: %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// isCaddyUnreachable reports whether err means Caddy was down rather than refusing the call.
+func isCaddyUnreachable(err error) bool {
+	caddyErr, ok := err.(*caddyError)
+	return ok && caddyErr.Status == 0
+}
+
+// isCaddyNotFound reports whether err means the addressed object (our route) does not exist.
+func isCaddyNotFound(err error) bool {
+	caddyErr, ok := err.(*caddyError)
+	return ok && (caddyErr.Status == http.StatusNotFound || strings.Contains(caddyErr.Message, "unknown object ID"))
+}
+
+// newCaddyManager returns a manager for the route named after the firewall chain.
+func newCaddyManager(adminURL, server, token, chainName string) (*CaddyManager, error) {
+	if adminURL == "" || server == "" {
+		return nil, fmt.Errorf("firewallType caddy requires caddyAdminURL and caddyServer")
+	}
+	return &CaddyManager{
+		adminURL: strings.TrimSuffix(adminURL, "/"),
+		server:   server,
+		token:    token,
+		routeID:  chainName,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		targets:  make(map[string]bool),
+	}, nil
+}
+
+// call performs one admin API request, retrying connection failures and server-side (5xx)
+// errors with exponential backoff, and returns the response body.
+func (m *CaddyManager) call(method, path string, body interface{}) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to encode Caddy request: %v", err)
+		}
+	}
+
+	backoff := 500 * time.Millisecond
+	var lastErr string
+	for attempt := 1; attempt <= caddyMaxAttempts; attempt++ {
+		req, err := http.NewRequest(method, m.adminURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Caddy request: %v", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if m.token != "" {
+			req.Header.Set("Authorization", "Bearer "+m.token)
+		}
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			lastErr = err.Error()
+		} else {
+			data, readErr := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				if resp.StatusCode >= 300 {
+					return nil, &caddyError{Method: method, Path: path, Status: resp.StatusCode, Message: caddyErrorMessage(data)}
+				}
+				if readErr != nil {
+					return nil, fmt.Errorf("failed to read Caddy response: %v", readErr)
+				}
+				return data, nil
+			}
+			lastErr = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, caddyErrorMessage(data))
+		}
+
+		if attempt < caddyMaxAttempts {
+			if debug {
+				log.Printf("Caddy admin API %s %s: %s, retrying in %v (attempt %d/%d)", method, path, lastErr, backoff, attempt, caddyMaxAttempts)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, &caddyError{Method: method, Path: path, Message: lastErr}
+}
+
+// caddyErrorMessage extracts the "error" field Caddy puts in failed responses.
+func caddyErrorMessage(data []byte) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return body.Error
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// rangesPath is the config path of our matcher's address list.
+func (m *CaddyManager) rangesPath() string {
+	return "/id/" + m.routeID + "/match/0/remote_ip/ranges"
+}
+
+// handler returns the route handler for blockAction.
+func (m *CaddyManager) handler() map[string]interface{} {
+	if blockAction == "reject" {
+		return map[string]interface{}{"handler": "static_response", "status_code": 403, "body": "Forbidden"}
+	}
+	return map[string]interface{}{"handler": "static_response", "abort": true}
+}
+
+// sortedTargetsLocked returns the targets in a stable order. The caller holds m.mu.
+func (m *CaddyManager) sortedTargetsLocked() []string {
+	ranges := make([]string, 0, len(m.targets))
+	for target := range m.targets {
+		ranges = append(ranges, target)
+	}
+	sort.Strings(ranges)
+	return ranges
+}
+
+// fetchRanges returns the addresses currently in Caddy's matcher.
+func (m *CaddyManager) fetchRanges() ([]string, error) {
+	data, err := m.call("GET", m.rangesPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []string
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return nil, fmt.Errorf("invalid Caddy matcher list: %v", err)
+	}
+	return ranges, nil
+}
+
+// Setup makes sure our route exists, creating it at the top of the server's routes, and
+// loads the addresses already in it so a client-mode block run in another process does not
+// drop them. If Caddy is unreachable, startup continues with the local blocklist pending.
+func (m *CaddyManager) Setup() error {
+	log.Printf("Setting up Caddy route %s on server %s via %s...", m.routeID, m.server, m.adminURL)
+	if challengeEnable {
+		return fmt.Errorf("challenge mode is not supported by the caddy backend")
+	}
+	if blockAction == "ratelimit" {
+		log.Printf("Warning: The caddy backend cannot rate limit, blocked clients are disconnected instead")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ranges, err := m.fetchRanges()
+	switch {
+	case err == nil:
+		// Keep the handler in line with blockAction, which may have changed since the route was made
+		if _, err := m.call("PATCH", "/id/"+m.routeID+"/handle", []interface{}{m.handler()}); err != nil {
+			return err
+		}
+	case isCaddyUnreachable(err):
+		log.Printf("Warning: %v; blocks are kept locally and pushed to Caddy once it is reachable", err)
+		m.pending = true
+		return nil
+	case isCaddyNotFound(err):
+		if err := m.createRouteLocked(); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	m.targets = make(map[string]bool, len(ranges))
+	for _, target := range ranges {
+		m.targets[normalizeTarget(target)] = true
+	}
+	m.pending = false
+	log.Printf("Using Caddy route %s on server %s", m.routeID, m.server)
+	return nil
+}
+
+// createRouteLocked inserts our route, with an empty matcher list, before the server's
+// other routes. The caller holds m.mu.
+func (m *CaddyManager) createRouteLocked() error {
+	serverPath := "/config/apps/http/servers/" + m.server
+	data, err := m.call("GET", serverPath+"/routes", nil)
+	if err != nil {
+		if isCaddyNotFound(err) || strings.Contains(err.Error(), "invalid traversal path") {
+			return fmt.Errorf("Caddy has no HTTP server %s, set caddyServer to one of the names under apps.http.servers: %v", m.server, err)
+		}
+		return err
+	}
+
+	route := map[string]interface{}{
+		"@id":      m.routeID,
+		"match":    []interface{}{map[string]interface{}{"remote_ip": map[string]interface{}{"ranges": []string{}}}},
+		"handle":   []interface{}{m.handler()},
+		"terminal": true,
+	}
+	if trimmed := strings.TrimSpace(string(data)); trimmed == "null" || trimmed == "[]" {
+		// POST sets a missing key; the server had no routes yet
+		_, err = m.call("POST", serverPath+"/routes", []interface{}{route})
+	} else {
+		// PUT on an array index inserts before that element
+		_, err = m.call("PUT", serverPath+"/routes/0", route)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create Caddy route %s: %v", m.routeID, err)
+	}
+	log.Printf("Created Caddy route %s on server %s", m.routeID, m.server)
+	return nil
+}
+
+// pushLocked replaces Caddy's matcher list with the targets. If Caddy is unreachable the
+// change is kept pending and nil returned. The caller holds m.mu.
+func (m *CaddyManager) pushLocked() error {
+	ranges := m.sortedTargetsLocked()
+	_, err := m.call("PATCH", m.rangesPath(), ranges)
+	if err == nil {
+		if m.pending {
+			log.Printf("Caddy admin API reachable again, pushed %d entries", len(ranges))
+		} else if debug {
+			log.Printf("Pushed %d entries to Caddy route %s", len(ranges), m.routeID)
+		}
+		m.pending = false
+		return nil
+	}
+	if isCaddyUnreachable(err) {
+		if !m.pending {
+			log.Printf("Warning: %v; keeping %d entries locally until Caddy is reachable", err, len(ranges))
+		}
+		m.pending = true
+		return nil
+	}
+	return err
+}
+
+// AddBlockRule adds the target to the matcher list. Per-rule actions do not apply.
+func (m *CaddyManager) AddBlockRule(target string, opts RuleOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.targets[target] && !m.pending {
+		return nil
+	}
+	added := !m.targets[target]
+	m.targets[target] = true
+	if err := m.pushLocked(); err != nil {
+		if added {
+			delete(m.targets, target)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveBlockRule removes the target from the matcher list.
+func (m *CaddyManager) RemoveBlockRule(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.targets[target] && !m.pending {
+		return nil
+	}
+	delete(m.targets, target)
+	return m.pushLocked()
+}
+
+// AddRedirectRule is not supported; challenge mode needs a firewall redirect.
+func (m *CaddyManager) AddRedirectRule(target string, opts RuleOptions) error {
+	return fmt.Errorf("challenge mode is not supported by the caddy backend")
+}
+
+// RemoveRedirectRule does nothing, since no redirect rules are ever added.
+func (m *CaddyManager) RemoveRedirectRule(target string) error {
+	return nil
+}
+
+// Flush empties the matcher list. A missing route has nothing to flush.
+func (m *CaddyManager) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = make(map[string]bool)
+	if err := m.pushLocked(); err != nil && !isCaddyNotFound(err) {
+		return err
+	}
+	log.Printf("Flushed Caddy route %s", m.routeID)
+	return nil
+}
+
+// Teardown deletes our route from Caddy's config.
+func (m *CaddyManager) Teardown() error {
+	// Count what is in Caddy, since -uninstall does not run Setup
+	ranges, err := m.fetchRanges()
+	if isCaddyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := m.call("DELETE", "/id/"+m.routeID, nil); err != nil && !isCaddyNotFound(err) {
+		return fmt.Errorf("failed to delete Caddy route %s: %v", m.routeID, err)
+	}
+	noteRemoval("Caddy route %s with %d entries", m.routeID, len(ranges))
+	m.mu.Lock()
+	m.targets = make(map[string]bool)
+	m.pending = false
+	m.mu.Unlock()
+	return nil
+}
+
+// IsRulePresent reports whether the "-s" target in checkArgs is in the local list.
+func (m *CaddyManager) IsRulePresent(checkArgs []string) (bool, error) {
+	for i, arg := range checkArgs {
+		if arg == "-s" && i+1 < len(checkArgs) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.targets[normalizeTarget(checkArgs[i+1])], nil
+		}
+	}
+	return false, nil
+}
+
+// ListRuleTargets returns the addresses in Caddy's matcher list. There are no redirect rules.
+func (m *CaddyManager) ListRuleTargets(redirect bool) ([]string, error) {
+	if redirect {
+		return nil, nil
+	}
+	ranges, err := m.fetchRanges()
+	if err != nil {
+		return nil, err
+	}
+	for i, target := range ranges {
+		ranges[i] = hostForm(target)
+	}
+	return ranges, nil
+}
+
+// CheckChain reports our route missing (as after a Caddy config reload) so it is recreated,
+// and pushes pending changes once Caddy is reachable again. Other failures (Caddy down,
+// a rejected token) are not reported, since setting up again cannot help.
+func (m *CaddyManager) CheckChain() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.fetchRanges()
+	switch {
+	case isCaddyNotFound(err):
+		return fmt.Errorf("Caddy route %s is missing: %v", m.routeID, err)
+	case err != nil:
+		if debug {
+			log.Printf("Could not check Caddy route %s: %v", m.routeID, err)
+		}
+	case m.pending:
+		if err := m.pushLocked(); err != nil {
+			log.Printf("Warning: Failed to push pending changes to Caddy: %v", err)
+		}
+	}
+	return nil
+}
+
+// ApplyBlockRules replaces Caddy's matcher list with the blocklist in one call.
+func (m *CaddyManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = make(map[string]bool, len(targets))
+	for _, target := range targets {
+		m.targets[target] = true
+	}
+	return m.pushLocked()
+}
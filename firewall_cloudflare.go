@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Cloudflare Implementation ---
+
+const (
+	cloudflareAPIBase     = "https://api.cloudflare.com/client/v4"
+	cloudflareMaxNotes    = 500                    // Cloudflare's limit on the notes field of an access rule
+	cloudflareMaxAttempts = 5                      // Attempts per API call before giving up
+	cloudflareMinInterval = 250 * time.Millisecond // Spacing between calls (the API allows 1200 per 5 minutes)
+)
+
+// CloudflareRule records an IP Access Rule created by us, so that unblock and -clean
+// delete exactly that rule and never one that was added by hand in the dashboard.
+type CloudflareRule struct {
+	ID   string `json:"id"`
+	Mode string `json:"mode"` // "block" or "managed_challenge"
+}
+
+// Cloudflare rules we created, keyed by target. Persisted in the blocklist file.
+var (
+	cloudflareRules   = make(map[string]CloudflareRule)
+	cloudflareRulesMu sync.Mutex
+)
+
+// CloudflareManager enforces blocks at the Cloudflare edge with zone-level IP Access Rules
+// instead of the local firewall. Redirect (challenge) rules become "managed_challenge"
+// access rules, so Cloudflare shows its own challenge page rather than ours.
+type CloudflareManager struct {
+	apiToken string
+	zoneID   string
+	client   *http.Client
+
+	callMu   sync.Mutex // Serialises API calls so lastCall spacing holds
+	lastCall time.Time
+}
+
+// cloudflareResponse is the envelope returned by every v4 API call.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// cloudflareAccessRule is the part of an access rule we read back.
+type cloudflareAccessRule struct {
+	ID    string `json:"id"`
+	Mode  string `json:"mode"`
+	Notes string `json:"notes"`
+}
+
+// newCloudflareManager checks that the API token and zone are configured.
+func newCloudflareManager(apiToken, zoneID string) (*CloudflareManager, error) {
+	if apiToken == "" || zoneID == "" {
+		return nil, fmt.Errorf("firewallType cloudflare requires cloudflareAPIToken and cloudflareZoneID")
+	}
+	return &CloudflareManager{
+		apiToken: apiToken,
+		zoneID:   zoneID,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// call performs one API request, retrying rate-limited (429) and server-side (5xx) failures
+// with exponential backoff, honouring Retry-After when Cloudflare sends it.
+func (m *CloudflareManager) call(method, path string, body interface{}) (*cloudflareResponse, int, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, 0, fmt.Errorf("failed to encode Cloudflare request: %v", err)
+		}
+	}
+
+	m.callMu.Lock()
+	defer m.callMu.Unlock()
+
+	backoff := time.Second
+	var lastErr error
+	for attempt := 1; attempt <= cloudflareMaxAttempts; attempt++ {
+		if wait := cloudflareMinInterval - time.Since(m.lastCall); wait > 0 {
+			time.Sleep(wait)
+		}
+		m.lastCall = time.Now()
+
+		req, err := http.NewRequest(method, cloudflareAPIBase+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to create Cloudflare request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+m.apiToken)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("Cloudflare request %s %s failed: %v", method, path, err)
+		} else {
+			data, readErr := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				if readErr != nil {
+					return nil, resp.StatusCode, fmt.Errorf("failed to read Cloudflare response: %v", readErr)
+				}
+				var result cloudflareResponse
+				if err := json.Unmarshal(data, &result); err != nil {
+					return nil, resp.StatusCode, fmt.Errorf("invalid Cloudflare response (HTTP %d): %v", resp.StatusCode, err)
+				}
+				return &result, resp.StatusCode, nil
+			}
+			lastErr = fmt.Errorf("Cloudflare request %s %s failed: HTTP %d", method, path, resp.StatusCode)
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+				backoff = time.Duration(secs) * time.Second
+			}
+		}
+
+		if attempt < cloudflareMaxAttempts {
+			if debug {
+				log.Printf("%v, retrying in %v (attempt %d/%d)", lastErr, backoff, attempt, cloudflareMaxAttempts)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// apiError formats the errors in a failed response.
+func (r *cloudflareResponse) apiError() error {
+	msgs := make([]string, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+	}
+	if len(msgs) == 0 {
+		msgs = append(msgs, "unknown error")
+	}
+	return fmt.Errorf("Cloudflare API error: %s", strings.Join(msgs, "; "))
+}
+
+// ruleConfiguration maps a target to the access rule configuration. Cloudflare only accepts
+// /16 and /24 IPv4 ranges and /32, /48 and /64 IPv6 ranges.
+func ruleConfiguration(target string) (map[string]string, error) {
+	target = hostForm(target)
+	if !strings.Contains(target, "/") {
+		if isIPv6Target(target) {
+			return map[string]string{"target": "ip6", "value": target}, nil
+		}
+		return map[string]string{"target": "ip", "value": target}, nil
+	}
+	switch target[strings.Index(target, "/"):] {
+	case "/16", "/24", "/32", "/48", "/64":
+		return map[string]string{"target": "ip_range", "value": target}, nil
+	}
+	return nil, fmt.Errorf("Cloudflare does not support blocking the range %s", target)
+}
+
+// Setup verifies the API token. Existing rules are left alone; AddBlockRule skips targets
+// whose rule is already recorded, so a restart does not recreate every rule.
+func (m *CloudflareManager) Setup() error {
+	resp, _, err := m.call("GET", "/user/tokens/verify", nil)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("Cloudflare API token verification failed: %v", resp.apiError())
+	}
+	log.Printf("Using Cloudflare IP Access Rules in zone %s", m.zoneID)
+	return nil
+}
+
+// addRule creates an access rule with the given mode, replacing a recorded rule of another mode.
+func (m *CloudflareManager) addRule(target, mode string, opts RuleOptions) error {
+	cloudflareRulesMu.Lock()
+	existing, ok := cloudflareRules[target]
+	cloudflareRulesMu.Unlock()
+	if ok {
+		if existing.Mode == mode {
+			return nil
+		}
+		if err := m.removeRule(target); err != nil {
+			return err
+		}
+	}
+
+	config, err := ruleConfiguration(target)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"mode":          mode,
+		"configuration": config,
+		"notes":         ruleComment(opts, cloudflareMaxNotes),
+	}
+	resp, _, err := m.call("POST", "/zones/"+m.zoneID+"/firewall/access_rules/rules", body)
+	if err != nil {
+		return err
+	}
+
+	var rule cloudflareAccessRule
+	if resp.Success {
+		if err := json.Unmarshal(resp.Result, &rule); err != nil || rule.ID == "" {
+			return fmt.Errorf("Cloudflare did not return a rule ID for %s", target)
+		}
+	} else {
+		// A rule for this address may already exist, e.g. when our record of it was lost
+		// or a previous create succeeded after the client gave up on it
+		found, lookupErr := m.findRule(config)
+		if lookupErr != nil || found == nil {
+			return fmt.Errorf("failed to create Cloudflare rule for %s: %v", target, resp.apiError())
+		}
+		if !strings.HasPrefix(found.Notes, "apacheblock:") {
+			log.Printf("Warning: %s already has a Cloudflare access rule (mode %s) that was not created by apacheblock, leaving it alone",
+				target, found.Mode)
+			return nil
+		}
+		rule = *found
+	}
+
+	cloudflareRulesMu.Lock()
+	cloudflareRules[target] = CloudflareRule{ID: rule.ID, Mode: mode}
+	cloudflareRulesMu.Unlock()
+	if debug {
+		log.Printf("Created Cloudflare %s rule %s for %s", mode, rule.ID, target)
+	}
+	return nil
+}
+
+// findRule looks up an existing access rule for an address.
+func (m *CloudflareManager) findRule(config map[string]string) (*cloudflareAccessRule, error) {
+	query := url.Values{}
+	query.Set("configuration.target", config["target"])
+	query.Set("configuration.value", config["value"])
+	resp, _, err := m.call("GET", "/zones/"+m.zoneID+"/firewall/access_rules/rules?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, resp.apiError()
+	}
+	var rules []cloudflareAccessRule
+	if err := json.Unmarshal(resp.Result, &rules); err != nil {
+		return nil, fmt.Errorf("invalid Cloudflare rule list: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return &rules[0], nil
+}
+
+// removeRule deletes the recorded rule for a target. Unknown targets are not an error.
+func (m *CloudflareManager) removeRule(target string) error {
+	cloudflareRulesMu.Lock()
+	rule, ok := cloudflareRules[target]
+	cloudflareRulesMu.Unlock()
+	if !ok {
+		if debug {
+			log.Printf("No Cloudflare rule recorded for %s", target)
+		}
+		return nil
+	}
+
+	resp, status, err := m.call("DELETE", "/zones/"+m.zoneID+"/firewall/access_rules/rules/"+rule.ID, nil)
+	if err != nil {
+		return err
+	}
+	// 404 means the rule was already deleted (possibly by hand in the dashboard)
+	if !resp.Success && status != http.StatusNotFound {
+		return fmt.Errorf("failed to delete Cloudflare rule %s for %s: %v", rule.ID, target, resp.apiError())
+	}
+
+	cloudflareRulesMu.Lock()
+	delete(cloudflareRules, target)
+	cloudflareRulesMu.Unlock()
+	if debug {
+		log.Printf("Deleted Cloudflare rule %s for %s", rule.ID, target)
+	}
+	return nil
+}
+
+// AddBlockRule creates a "block" access rule for the target. Access rules cannot rate
+// limit, so the "ratelimit" action becomes a managed challenge instead.
+func (m *CloudflareManager) AddBlockRule(target string, opts RuleOptions) error {
+	if opts.action() == "ratelimit" {
+		return m.addRule(target, "managed_challenge", opts)
+	}
+	return m.addRule(target, "block", opts)
+}
+
+// RemoveBlockRule deletes the access rule we created for the target.
+func (m *CloudflareManager) RemoveBlockRule(target string) error {
+	return m.removeRule(target)
+}
+
+// AddRedirectRule creates a "managed_challenge" access rule for the target.
+func (m *CloudflareManager) AddRedirectRule(target string, opts RuleOptions) error {
+	return m.addRule(target, "managed_challenge", opts)
+}
+
+// RemoveRedirectRule deletes the access rule we created for the target.
+func (m *CloudflareManager) RemoveRedirectRule(target string) error {
+	return m.removeRule(target)
+}
+
+// Flush deletes every access rule we created.
+func (m *CloudflareManager) Flush() error {
+	cloudflareRulesMu.Lock()
+	targets := make([]string, 0, len(cloudflareRules))
+	for target := range cloudflareRules {
+		targets = append(targets, target)
+	}
+	cloudflareRulesMu.Unlock()
+
+	var firstErr error
+	for _, target := range targets {
+		if err := m.removeRule(target); err != nil {
+			log.Printf("Warning: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	log.Printf("Deleted %d Cloudflare access rules", len(targets))
+	if len(targets) > 0 {
+		noteRemoval("%d Cloudflare access rule(s)", len(targets))
+	}
+	return firstErr
+}
+
+// Teardown is the same as Flush; there are no chains to remove.
+func (m *CloudflareManager) Teardown() error {
+	return m.Flush()
+}
+
+// IsRulePresent reports whether a rule is recorded for the "-s" target in checkArgs.
+func (m *CloudflareManager) IsRulePresent(checkArgs []string) (bool, error) {
+	for i, arg := range checkArgs {
+		if arg == "-s" && i+1 < len(checkArgs) {
+			cloudflareRulesMu.Lock()
+			_, ok := cloudflareRules[normalizeTarget(checkArgs[i+1])]
+			cloudflareRulesMu.Unlock()
+			return ok, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --- Deny file Implementation ---
+
+// DenyFileManager blocks at the web server instead of the firewall, for hosts (such as
+// containers) where apacheblock cannot change firewall rules. The blocked targets are
+// written to denyFilePath in Apache ("Require not ip") or nginx ("deny") syntax, which
+// the web server includes, and reloadCommand is run after every change.
+type DenyFileManager struct {
+	path, format, reloadCommand string
+
+	mu      sync.Mutex
+	targets map[string]bool
+}
+
+// newDenyFileManager returns a manager writing path in format ("apache" or "nginx").
+func newDenyFileManager(path, format, reloadCommand string) *DenyFileManager {
+	return &DenyFileManager{path: path, format: format, reloadCommand: reloadCommand, targets: make(map[string]bool)}
+}
+
+// Setup checks that the file's directory is writable and loads the entries already in the
+// file, so a client-mode block run in another process does not drop them. The file is
+// rewritten by applyBlockList (through ApplyBlockRules), so startup reloads the web
+// server at most once.
+func (m *DenyFileManager) Setup() error {
+	log.Printf("Setting up %s deny file %s...", m.format, m.path)
+	if challengeEnable {
+		return fmt.Errorf("challenge mode is not supported by the denyfile backend")
+	}
+	dir := filepath.Dir(m.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".apacheblock-deny-*")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %v", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	m.mu.Lock()
+	m.targets = m.readFile()
+	m.mu.Unlock()
+	return nil
+}
+
+// readFile returns the targets listed in the file, if it exists.
+func (m *DenyFileManager) readFile() map[string]bool {
+	targets := make(map[string]bool)
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return targets
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		switch {
+		case len(fields) >= 4 && fields[0] == "Require" && fields[1] == "not" && fields[2] == "ip":
+			for _, target := range fields[3:] {
+				targets[normalizeTarget(target)] = true
+			}
+		case len(fields) == 2 && fields[0] == "deny":
+			targets[normalizeTarget(fields[1])] = true
+		}
+	}
+	return targets
+}
+
+// renderLocked returns the file contents for the current targets. The caller holds m.mu.
+func (m *DenyFileManager) renderLocked() []byte {
+	targets := make([]string, 0, len(m.targets))
+	for target := range m.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by apacheblock, do not edit. Blocked addresses: " + fmt.Sprint(len(targets)) + "\n")
+	if m.format == "nginx" {
+		for _, target := range targets {
+			fmt.Fprintf(&buf, "deny %s;\n", target)
+		}
+		return buf.Bytes()
+	}
+
+	buf.WriteString("<RequireAll>\n    Require all granted\n")
+	for _, target := range targets {
+		fmt.Fprintf(&buf, "    Require not ip %s\n", target)
+	}
+	buf.WriteString("</RequireAll>\n")
+	return buf.Bytes()
+}
+
+// writeLocked atomically replaces the file (temp file + rename) and runs reloadCommand.
+// Nothing is done if the contents would not change. A failed reload is only logged: the
+// file already holds the change, and the next successful reload applies it. The caller
+// holds m.mu.
+func (m *DenyFileManager) writeLocked() error {
+	data := m.renderLocked()
+	if current, err := os.ReadFile(m.path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	if err := writeFileAtomic(m.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write deny file %s: %v", m.path, err)
+	}
+	if debug {
+		log.Printf("Wrote %d entries to deny file %s", len(m.targets), m.path)
+	}
+
+	if m.reloadCommand == "" {
+		return nil
+	}
+	if output, err := runFirewallCommand("", "sh", "-c", m.reloadCommand); err != nil {
+		log.Printf("Warning: Deny file %s written, but reload command failed: %v", m.path, err)
+	} else if debug {
+		log.Printf("Ran reload command %q: %s", m.reloadCommand, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// AddBlockRule adds the target to the deny file. Per-rule actions do not apply.
+func (m *DenyFileManager) AddBlockRule(target string, opts RuleOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.targets[target] {
+		return nil
+	}
+	m.targets[target] = true
+	if err := m.writeLocked(); err != nil {
+		delete(m.targets, target)
+		return err
+	}
+	return nil
+}
+
+// RemoveBlockRule removes the target from the deny file.
+func (m *DenyFileManager) RemoveBlockRule(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.targets[target] {
+		return nil
+	}
+	delete(m.targets, target)
+	return m.writeLocked()
+}
+
+// AddRedirectRule is not supported; the web server has no way to send a client elsewhere
+// based on this file.
+func (m *DenyFileManager) AddRedirectRule(target string, opts RuleOptions) error {
+	return fmt.Errorf("challenge mode is not supported by the denyfile backend")
+}
+
+// RemoveRedirectRule does nothing, since no redirect rules are ever added.
+func (m *DenyFileManager) RemoveRedirectRule(target string) error {
+	return nil
+}
+
+// Flush rewrites the file with no entries.
+func (m *DenyFileManager) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = make(map[string]bool)
+	return m.writeLocked()
+}
+
+// Teardown empties the file. It is left in place, since the web server configuration includes it.
+func (m *DenyFileManager) Teardown() error {
+	// Count what is in the file, since -uninstall does not run Setup
+	if count := len(m.readFile()); count > 0 {
+		noteRemoval("%d entries in deny file %s", count, m.path)
+	}
+	return m.Flush()
+}
+
+// IsRulePresent reports whether the "-s" target in checkArgs is in the file.
+func (m *DenyFileManager) IsRulePresent(checkArgs []string) (bool, error) {
+	for i, arg := range checkArgs {
+		if arg == "-s" && i+1 < len(checkArgs) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.targets[normalizeTarget(checkArgs[i+1])], nil
+		}
+	}
+	return false, nil
+}
+
+// ApplyBlockRules regenerates the file from the blocklist in one write.
+func (m *DenyFileManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = make(map[string]bool, len(targets))
+	for _, target := range targets {
+		m.targets[target] = true
+	}
+	return m.writeLocked()
+}
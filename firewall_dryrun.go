@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// --- Dry-Run Implementation ---
+
+// DryRunManager implements FirewallManager without touching the firewall. Every change
+// is logged as what would have happened, so rules and thresholds can be evaluated safely.
+type DryRunManager struct{}
+
+// kindOf describes a target for log messages.
+func kindOf(target string) string {
+	if strings.Contains(target, "/") {
+		return "subnet"
+	}
+	return "IP"
+}
+
+// Setup does nothing; no chains are created in dry-run mode.
+func (m *DryRunManager) Setup() error {
+	log.Println("DRY-RUN mode: firewall rules will be logged but not applied")
+	return nil
+}
+
+// AddBlockRule logs the block that would have been added. blockIP and blockSubnet log
+// their own DRY-RUN line with more detail, so this one is debug only.
+func (m *DryRunManager) AddBlockRule(target string, opts RuleOptions) error {
+	if debug {
+		log.Printf("DRY-RUN would add %s rule for %s %s (rule %s)", opts.action(), kindOf(target), target, opts.Reason)
+	}
+	return nil
+}
+
+// RemoveBlockRule logs the block that would have been removed.
+func (m *DryRunManager) RemoveBlockRule(target string) error {
+	log.Printf("DRY-RUN would unblock %s %s", kindOf(target), target)
+	return nil
+}
+
+// AddRedirectRule logs the challenge redirect that would have been added.
+func (m *DryRunManager) AddRedirectRule(target string, opts RuleOptions) error {
+	if debug {
+		log.Printf("DRY-RUN would redirect %s %s to the challenge server (rule %s)", kindOf(target), target, opts.Reason)
+	}
+	return nil
+}
+
+// RemoveRedirectRule logs the challenge redirect that would have been removed.
+func (m *DryRunManager) RemoveRedirectRule(target string) error {
+	log.Printf("DRY-RUN would remove the challenge redirect for %s %s", kindOf(target), target)
+	return nil
+}
+
+// SetExemptions logs the whitelist exemptions that would have been installed.
+func (m *DryRunManager) SetExemptions(subnet string, addrs []string) error {
+	if len(addrs) > 0 {
+		log.Printf("DRY-RUN would exempt whitelisted %s from the block of subnet %s", strings.Join(addrs, ", "), subnet)
+	}
+	return nil
+}
+
+// Flush does nothing in dry-run mode.
+func (m *DryRunManager) Flush() error {
+	log.Println("DRY-RUN would flush all firewall rules")
+	return nil
+}
+
+// Teardown does nothing in dry-run mode.
+func (m *DryRunManager) Teardown() error {
+	log.Println("DRY-RUN would remove all firewall rules and chains")
+	return nil
+}
+
+// IsRulePresent always reports false since no rules are ever installed.
+func (m *DryRunManager) IsRulePresent(checkArgs []string) (bool, error) {
+	return false, nil
+}
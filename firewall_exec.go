@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// FirewallCommandError is returned when a firewall command (iptables, ipset, nft, ...) fails.
+// GaveUp distinguishes transient failures that outlasted every retry (xtables lock
+// contention, timeouts) from permanent ones such as a bad rule or a missing chain.
+type FirewallCommandError struct {
+	Command  string // Command line that failed
+	Output   string // Output of the last attempt
+	ExitCode int    // Exit status of the last attempt, -1 if the command did not exit normally
+	Attempts int
+	GaveUp   bool
+	Err      error
+}
+
+func (e *FirewallCommandError) Error() string {
+	msg := fmt.Sprintf("%s failed: %v", e.Command, e.Err)
+	if e.GaveUp {
+		msg = fmt.Sprintf("%s: gave up after %d attempts: %v", e.Command, e.Attempts, e.Err)
+	}
+	if e.Output != "" {
+		msg += ", output: " + e.Output
+	}
+	return msg
+}
+
+func (e *FirewallCommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandExitCode returns the exit status carried by a runFirewallCommand error, or -1.
+func commandExitCode(err error) int {
+	var cmdErr *FirewallCommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.ExitCode
+	}
+	return -1
+}
+
+// isLockContention reports whether a failed command lost a race for a lock that will be
+// released shortly: the xtables lock, or a busy netlink/ipset resource. iptables exits
+// with status 4 for resource problems, which includes failing to get the lock.
+func isLockContention(name, output string, exitCode int) bool {
+	lower := strings.ToLower(output)
+	if strings.Contains(lower, "xtables lock") ||
+		strings.Contains(lower, "resource temporarily unavailable") ||
+		strings.Contains(lower, "device or resource busy") {
+		return true
+	}
+	return exitCode == 4 && strings.Contains(name, "tables")
+}
+
+// runFirewallCommand runs a firewall tool with a firewallCommandTimeout deadline, feeding
+// it stdin if not empty, and returns its combined output. Lock contention and timeouts are
+// retried up to firewallCommandRetries times with exponential backoff.
+func runFirewallCommand(stdin string, name string, args ...string) ([]byte, error) {
+	cmdLine := strings.TrimSpace(name + " " + strings.Join(args, " "))
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+		cmd := exec.CommandContext(ctx, name, args...)
+		if stdin != "" {
+			cmd.Stdin = strings.NewReader(stdin)
+		}
+		output, err := cmd.CombinedOutput()
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return output, nil
+		}
+
+		cmdErr := &FirewallCommandError{
+			Command:  cmdLine,
+			Output:   strings.TrimSpace(string(output)),
+			ExitCode: -1,
+			Attempts: attempt,
+			Err:      err,
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && !timedOut {
+			cmdErr.ExitCode = exitErr.ExitCode()
+		}
+		if timedOut {
+			cmdErr.Err = fmt.Errorf("timed out after %v", firewallCommandTimeout)
+		}
+
+		transient := timedOut || isLockContention(name, cmdErr.Output, cmdErr.ExitCode)
+		if !transient {
+			return output, cmdErr
+		}
+		if attempt > firewallCommandRetries {
+			cmdErr.GaveUp = true
+			return output, cmdErr
+		}
+		if debug {
+			log.Printf("%s: %v, retrying in %v (attempt %d/%d)", cmdLine, cmdErr.Err, backoff, attempt, firewallCommandRetries+1)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// --- IPSet Implementation ---
+
+// IPSetManager keeps blocked addresses in two ipsets (hash:ip and hash:net) that are
+// matched by a fixed handful of rules in the iptables chain, so the chain stays small
+// no matter how many addresses are blocked. IPv6 addresses get their own pair of sets,
+// matched from the ip6tables chain. Redirect (challenge) rules are still managed per
+// target by the embedded IPTablesManager, as are block rules whose action differs from
+// blockAction (e.g. a rule with "action": "ratelimit") or that have their own ports,
+// since the match-set rules carry the blockAction jump and the blockPorts matches.
+type IPSetManager struct {
+	*IPTablesManager
+	ipSetName   string // hash:ip set for individual addresses
+	netSetName  string // hash:net set for subnets
+	ip6SetName  string // hash:ip set for individual IPv6 addresses
+	net6SetName string // hash:net set for IPv6 subnets
+}
+
+// ipSetSpec describes one of the managed sets.
+type ipSetSpec struct {
+	name, kind, family, bin string
+}
+
+// newIPSetManager derives the set names from the chain name.
+func newIPSetManager(chainName string) *IPSetManager {
+	return &IPSetManager{
+		IPTablesManager: &IPTablesManager{chainName: chainName},
+		ipSetName:       chainName + "_ip",
+		netSetName:      chainName + "_net",
+		ip6SetName:      chainName + "_ip6",
+		net6SetName:     chainName + "_net6",
+	}
+}
+
+// sets returns the sets in use; the IPv6 pair only when ip6tables is available.
+func (m *IPSetManager) sets() []ipSetSpec {
+	specs := []ipSetSpec{
+		{m.ipSetName, "hash:ip", "inet", "iptables"},
+		{m.netSetName, "hash:net", "inet", "iptables"},
+	}
+	if m.has6 {
+		specs = append(specs,
+			ipSetSpec{m.ip6SetName, "hash:ip", "inet6", "ip6tables"},
+			ipSetSpec{m.net6SetName, "hash:net", "inet6", "ip6tables"})
+	}
+	return specs
+}
+
+// runIPSetCommand executes an ipset command and returns its output.
+func runIPSetCommand(args ...string) ([]byte, error) {
+	return runFirewallCommand("", "ipset", args...)
+}
+
+// setFor returns the set a target belongs in.
+func (m *IPSetManager) setFor(target string) string {
+	isNet := strings.Contains(target, "/")
+	if isIPv6Target(target) {
+		if isNet {
+			return m.net6SetName
+		}
+		return m.ip6SetName
+	}
+	if isNet {
+		return m.netSetName
+	}
+	return m.ipSetName
+}
+
+// Setup prepares the iptables chain, creates both sets, and installs the match-set rules.
+func (m *IPSetManager) Setup() error {
+	if err := m.IPTablesManager.Setup(); err != nil {
+		return err
+	}
+
+	log.Println("Setting up ipsets...")
+	for _, set := range m.sets() {
+		if _, err := runIPSetCommand("create", set.name, set.kind, "family", set.family, "-exist"); err != nil {
+			return fmt.Errorf("failed to create ipset %s: %v", set.name, err)
+		}
+		if _, err := runIPSetCommand("flush", set.name); err != nil {
+			return fmt.Errorf("failed to flush ipset %s: %v", set.name, err)
+		}
+	}
+
+	// The chain was flushed by IPTablesManager.Setup, so append one blockAction rule per set
+	// and port (or a single port-less rule per set when blockScope is "all")
+	portMatches := [][]string{{}}
+	if blockScope != "all" {
+		portMatches = nil
+		for _, port := range blockPorts {
+			portMatches = append(portMatches, []string{"-p", "tcp", "--dport", port})
+		}
+	}
+	for _, set := range m.sets() {
+		for _, portMatch := range portMatches {
+			spec := []string{"-m", "set", "--match-set", set.name, "src"}
+			spec = append(append(spec, portMatch...), blockJumpArgs()...)
+			if err := m.ipt(set.bin, "-t filter -A "+m.chainName, func(cl iptablesClient) error {
+				return cl.Append("filter", m.chainName, spec...)
+			}); err != nil {
+				return fmt.Errorf("failed to add match-set rule for %s %v: %v", set.name, portMatch, err)
+			}
+		}
+	}
+
+	if m.has6 {
+		log.Printf("Using ipsets %s, %s, %s and %s for blocked addresses", m.ipSetName, m.netSetName, m.ip6SetName, m.net6SetName)
+	} else {
+		log.Printf("Using ipsets %s and %s for blocked addresses", m.ipSetName, m.netSetName)
+	}
+	return nil
+}
+
+// Flush empties both sets in addition to the chain and NAT cleanup done by IPTablesManager.
+func (m *IPSetManager) Flush() error {
+	err := m.IPTablesManager.Flush()
+	for _, set := range m.sets() {
+		setName := set.name
+		if _, flushErr := runIPSetCommand("flush", setName); flushErr != nil {
+			if strings.Contains(flushErr.Error(), "does not exist") {
+				continue
+			}
+			log.Printf("Warning: Failed to flush ipset %s: %v", setName, flushErr)
+			if err == nil {
+				err = flushErr
+			}
+		} else {
+			log.Printf("Flushed ipset: %s", setName)
+		}
+	}
+	return err
+}
+
+// Teardown removes the chain (and with it the match-set rules), then destroys the sets.
+func (m *IPSetManager) Teardown() error {
+	err := m.IPTablesManager.Teardown()
+	for _, set := range m.sets() {
+		if _, destroyErr := runIPSetCommand("destroy", set.name); destroyErr != nil {
+			if strings.Contains(destroyErr.Error(), "does not exist") {
+				continue
+			}
+			log.Printf("Warning: Failed to destroy ipset %s: %v", set.name, destroyErr)
+			if err == nil {
+				err = destroyErr
+			}
+		} else {
+			log.Printf("Destroyed ipset: %s", set.name)
+			noteRemoval("ipset %s", set.name)
+		}
+	}
+	return err
+}
+
+// IsRulePresent answers filter-table queries with `ipset test`; NAT queries go to iptables.
+func (m *IPSetManager) IsRulePresent(checkArgs []string) (bool, error) {
+	var target string
+	for i, arg := range checkArgs {
+		if arg == "-t" && i+1 < len(checkArgs) && checkArgs[i+1] == "nat" {
+			return m.IPTablesManager.IsRulePresent(checkArgs)
+		}
+		if arg == "-s" && i+1 < len(checkArgs) {
+			target = checkArgs[i+1]
+		}
+	}
+	if target == "" {
+		return false, nil
+	}
+	_, err := runIPSetCommand("test", m.setFor(target), target)
+	if err == nil {
+		return true, nil
+	}
+	if commandExitCode(err) == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("error testing ipset membership for %s: %v", target, err)
+}
+
+// usesSet reports whether a block rule with these options is stored as a set member.
+func (m *IPSetManager) usesSet(opts RuleOptions) bool {
+	return opts.action() == blockAction && len(opts.Ports) == 0
+}
+
+// AddBlockRule adds the target to the matching set. Set entries carry no comment.
+// Targets with their own action or ports get a per-address iptables rule instead.
+func (m *IPSetManager) AddBlockRule(target string, opts RuleOptions) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	if !m.usesSet(opts) {
+		if _, err := runIPSetCommand("del", m.setFor(target), target, "-exist"); err != nil && debug {
+			log.Printf("Could not remove %s from ipset: %v", target, err)
+		}
+		return m.IPTablesManager.AddBlockRule(target, opts)
+	}
+	if _, err := runIPSetCommand("add", m.setFor(target), target, "-exist"); err != nil {
+		return fmt.Errorf("failed to add %s to ipset: %w", target, err)
+	}
+	if debug {
+		log.Printf("Added %s to ipset %s", target, m.setFor(target))
+	}
+	return nil
+}
+
+// RemoveBlockRule removes the target from the matching set and any per-address rule it has.
+func (m *IPSetManager) RemoveBlockRule(target string) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	if _, err := runIPSetCommand("del", m.setFor(target), target, "-exist"); err != nil {
+		return fmt.Errorf("failed to remove %s from ipset: %w", target, err)
+	}
+	log.Printf("Removed %s from ipset %s", target, m.setFor(target))
+	return m.IPTablesManager.RemoveBlockRule(target)
+}
+
+// ApplyBlockRules loads every target into the sets with a single `ipset restore`.
+// Set entries carry no comment; targets with their own action or ports are added as rules.
+func (m *IPSetManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	start := time.Now()
+	var script strings.Builder
+	var ruleTargets []string
+	for _, target := range targets {
+		if err := m.checkFamily(target); err != nil {
+			log.Printf("Skipping %s: %v", target, err)
+			continue
+		}
+		if !m.usesSet(opts[target]) {
+			ruleTargets = append(ruleTargets, target)
+			continue
+		}
+		fmt.Fprintf(&script, "add %s %s\n", m.setFor(target), target)
+	}
+
+	if _, err := runFirewallCommand(script.String(), "ipset", "restore", "-exist"); err != nil {
+		return err
+	}
+	for _, target := range ruleTargets {
+		if err := m.IPTablesManager.AddBlockRule(target, opts[target]); err != nil {
+			log.Printf("Failed to apply firewall rule for %s: %v", target, err)
+		}
+	}
+
+	if debug {
+		log.Printf("Restored %d entries into ipsets in %v", len(targets), time.Since(start))
+	}
+	return nil
+}
+
+// ListRuleTargets returns the members of the sets plus targets with per-address rules;
+// redirect rules are listed by iptables.
+func (m *IPSetManager) ListRuleTargets(redirect bool) ([]string, error) {
+	targets, err := m.IPTablesManager.ListRuleTargets(redirect)
+	if err != nil || redirect {
+		return targets, err
+	}
+	for _, set := range m.sets() {
+		output, err := runIPSetCommand("save", set.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && fields[0] == "add" && fields[1] == set.name {
+				targets = append(targets, hostForm(fields[2]))
+			}
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// --- IPTables Implementation ---
+
+// IPTablesManager implements FirewallManager on top of the go-iptables library.
+// IPv6 targets are handled by ip6tables, which maintains a chain of the same name.
+type IPTablesManager struct {
+	chainName string
+	has6      bool // ip6tables is available, so IPv6 targets can be blocked
+
+	mu          sync.Mutex // Serializes list-then-delete sequences so rule positions stay valid
+	variantOnce sync.Once  // Reports the iptables variant on the first Setup only
+
+	clients   clientSet
+	newClient func(bin string) (iptablesClient, error) // Creates clients; nil means go-iptables
+}
+
+// iptablesMaxComment is the longest comment the xt_comment match accepts.
+const iptablesMaxComment = 255
+
+// binaryFor returns the iptables binary that handles the target's address family.
+func (m *IPTablesManager) binaryFor(target string) string {
+	if isIPv6Target(target) {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// binaries returns every binary whose tables this manager maintains.
+func (m *IPTablesManager) binaries() []string {
+	if m.has6 {
+		return []string{"iptables", "ip6tables"}
+	}
+	return []string{"iptables"}
+}
+
+// probeIPv6 sets has6 if ip6tables is usable, for managers used without Setup.
+func (m *IPTablesManager) probeIPv6() {
+	if !m.has6 {
+		if _, err := m.client("ip6tables"); err == nil {
+			m.has6 = true
+		}
+	}
+}
+
+// checkFamily returns an error if the target's address family cannot be handled.
+func (m *IPTablesManager) checkFamily(target string) error {
+	if isIPv6Target(target) && !m.has6 {
+		return fmt.Errorf("cannot block IPv6 target %s: ip6tables is not available", target)
+	}
+	return nil
+}
+
+// Setup ensures the iptables chain exists and is linked.
+func (m *IPTablesManager) Setup() error {
+	log.Println("Setting up iptables...")
+	cl, err := m.client("iptables")
+	if err != nil {
+		return fmt.Errorf("cannot run %s (not installed, or a permission issue?): %v", iptablesCommand("iptables"), err)
+	}
+	if debug {
+		if ipt, ok := cl.(*iptables.IPTables); ok {
+			v1, v2, v3 := ipt.GetIptablesVersion()
+			log.Printf("Using iptables version: v%d.%d.%d", v1, v2, v3)
+		}
+	}
+
+	if _, err := m.client("ip6tables"); err == nil {
+		m.has6 = true
+	} else {
+		log.Printf("Warning: ip6tables command not found, IPv6 addresses cannot be blocked")
+	}
+	m.variantOnce.Do(func() {
+		for _, bin := range m.binaries() {
+			checkIPTablesVariant(bin)
+		}
+	})
+
+	for _, bin := range m.binaries() {
+		if err := m.setupChain(bin); err != nil {
+			if bin == "ip6tables" {
+				// IPv4 blocking still works; only IPv6 targets will fail
+				log.Printf("Warning: Failed to set up ip6tables chain, IPv6 addresses cannot be blocked: %v", err)
+				m.has6 = false
+				continue
+			}
+			return err
+		}
+		if err := m.setupRedirectChain(bin); err != nil {
+			if challengeEnable && bin == "iptables" {
+				return err
+			}
+			log.Printf("Warning: Failed to set up %s redirect chain, challenge redirects will not work: %v", bin, err)
+		}
+	}
+	return nil
+}
+
+// setupChain creates, links, and flushes the chain for one binary (iptables or ip6tables).
+func (m *IPTablesManager) setupChain(bin string) error {
+	var chainExists bool
+	err := m.ipt(bin, "-t filter -S "+m.chainName, func(cl iptablesClient) error {
+		var err error
+		chainExists, err = cl.ChainExists("filter", m.chainName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check for chain %s: %v", m.chainName, err)
+	}
+
+	if !chainExists {
+		log.Printf("Creating custom %s chain: %s", bin, m.chainName)
+		if err := m.ipt(bin, "-t filter -N "+m.chainName, func(cl iptablesClient) error {
+			return cl.NewChain("filter", m.chainName)
+		}); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", m.chainName, err)
+		}
+	}
+
+	// Drop jumps from parent chains that are no longer in attachChains
+	keep := make(map[string]bool, len(attachChains))
+	for _, parent := range attachChains {
+		keep[parent] = true
+	}
+	if detached := m.detachChain(bin, keep); detached > 0 {
+		log.Printf("Unlinked chain %s from %d parent chain(s) no longer in attachChains (%s)", m.chainName, detached, bin)
+	}
+
+	for _, parent := range attachChains {
+		if m.isLinked(bin, parent) {
+			log.Printf("Chain %s is already linked to %s chain (%s)", m.chainName, parent, bin)
+			continue
+		}
+		log.Printf("Linking chain %s to %s chain (%s)", m.chainName, parent, bin)
+		if err := m.ipt(bin, "-t filter -I "+parent+" 1", func(cl iptablesClient) error {
+			return cl.Insert("filter", parent, 1, "-j", m.chainName)
+		}); err != nil {
+			if parent == "INPUT" {
+				return fmt.Errorf("failed to link chain %s to INPUT: %v", m.chainName, err)
+			}
+			// e.g. DOCKER-USER does not exist until Docker has started
+			log.Printf("Warning: Failed to link chain %s to %s (%s): %v", m.chainName, parent, bin, err)
+		}
+	}
+
+	if chainExists {
+		if err := m.flushBinary(bin); err != nil {
+			if !strings.Contains(err.Error(), "doesn't exist") {
+				return fmt.Errorf("failed to flush existing chain %s: %v", m.chainName, err)
+			}
+		} else {
+			log.Printf("Using existing %s chain: %s (flushed)", bin, m.chainName)
+		}
+	} else {
+		log.Printf("Successfully created and configured %s chain: %s", bin, m.chainName)
+	}
+	return nil
+}
+
+// isLinked reports whether parent jumps to our chain.
+func (m *IPTablesManager) isLinked(bin, parent string) bool {
+	var linked bool
+	err := m.ipt(bin, "-t filter -C "+parent, func(cl iptablesClient) error {
+		var err error
+		linked, err = cl.Exists("filter", parent, "-j", m.chainName)
+		return err
+	})
+	return err == nil && linked
+}
+
+// Flush removes all rules added by this tool from the filter and redirect chains.
+func (m *IPTablesManager) Flush() error {
+	for _, bin := range m.binaries() {
+		if err := m.flushBinary(bin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBinary flushes the filter and redirect chains for one binary.
+func (m *IPTablesManager) flushBinary(bin string) error {
+	// Flush the filter chain; ClearChain would create it if missing, so check first
+	log.Printf("Flushing %s filter chain: %s", bin, m.chainName)
+	var exists bool
+	err := m.ipt(bin, "-t filter -S "+m.chainName, func(cl iptablesClient) error {
+		var err error
+		exists, err = cl.ChainExists("filter", m.chainName)
+		return err
+	})
+	if err == nil && exists {
+		err = m.ipt(bin, "-t filter -F "+m.chainName, func(cl iptablesClient) error {
+			return cl.ClearChain("filter", m.chainName)
+		})
+	}
+	switch {
+	case err != nil:
+		log.Printf("Warning: Failed to flush %s filter chain %s: %v", bin, m.chainName, err)
+		// Continue to flush the redirect chain
+	case !exists:
+		log.Printf("Chain %s doesn't exist, nothing to flush.", m.chainName)
+	default:
+		log.Printf("Flushed filter chain: %s", m.chainName)
+	}
+
+	m.flushRedirectChain(bin)
+	return nil
+}
+
+// Teardown flushes the chains, unlinks them from their parent chains, and deletes them.
+func (m *IPTablesManager) Teardown() error {
+	// Setup is skipped by -uninstall, so ip6tables has not been probed yet
+	m.probeIPv6()
+
+	var errors []string
+	for _, bin := range m.binaries() {
+		if n := m.countRules(bin, "filter", m.chainName); n > 0 {
+			noteRemoval("%d rule(s) in %s chain %s", n, bin, m.chainName)
+		}
+		if err := m.flushBinary(bin); err != nil {
+			errors = append(errors, err.Error())
+		}
+
+		// Remove every jump to our chain, from any parent chain
+		m.detachChain(bin, nil)
+		if err := m.removeRedirectChain(bin); err != nil {
+			errors = append(errors, err.Error())
+		}
+
+		if err := m.ipt(bin, "-t filter -X "+m.chainName, func(cl iptablesClient) error {
+			return cl.DeleteChain("filter", m.chainName)
+		}); err != nil {
+			if !strings.Contains(err.Error(), "No chain/target/match by that name") {
+				errors = append(errors, fmt.Sprintf("failed to delete %s chain %s: %v", bin, m.chainName, err))
+			}
+		} else {
+			log.Printf("Removed %s chain %s", bin, m.chainName)
+			noteRemoval("%s chain %s", bin, m.chainName)
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("errors tearing down iptables: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// IsRulePresent checks if a specific iptables rule exists. checkArgs are iptables check
+// arguments ("-t nat -C apacheblock-redirect -s 1.2.3.4 ..."); the table defaults to filter and the
+// binary is chosen from the "-s" source argument, defaulting to iptables.
+func (m *IPTablesManager) IsRulePresent(checkArgs []string) (bool, error) {
+	bin, table, chain := "iptables", "filter", ""
+	var spec []string
+	for i := 0; i < len(checkArgs); i++ {
+		arg := checkArgs[i]
+		switch {
+		case (arg == "-t" || arg == "-C") && i+1 < len(checkArgs):
+			if arg == "-t" {
+				table = checkArgs[i+1]
+			} else {
+				chain = checkArgs[i+1]
+			}
+			i++
+			continue
+		case arg == "-w":
+			continue
+		case arg == "-s" && i+1 < len(checkArgs):
+			bin = m.binaryFor(checkArgs[i+1])
+		}
+		spec = append(spec, arg)
+	}
+	if chain == "" {
+		return false, fmt.Errorf("no chain (-C) in rule check %v", checkArgs)
+	}
+
+	var exists bool
+	err := m.ipt(bin, "-t "+table+" -C "+chain, func(cl iptablesClient) error {
+		var err error
+		exists, err = cl.Exists(table, chain, spec...)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking %s rule %v: %v", bin, checkArgs, err)
+	}
+	return exists, nil
+}
+
+// blockJump returns the iptables jump for a block action. A TCP reset needs a
+// "-p tcp" match, so port-less ("all" scope) rules reject with the default ICMP reply.
+// "ratelimit" drops new connections from each source above rateLimit; established
+// connections are left alone so throttled clients are slowed down rather than broken.
+func blockJump(action, scope string) []string {
+	switch {
+	case action == "ratelimit":
+		return []string{"-m", "conntrack", "--ctstate", "NEW",
+			"-m", "hashlimit", "--hashlimit-above", rateLimit, "--hashlimit-mode", "srcip",
+			"--hashlimit-name", hashlimitName(), "-j", "DROP"}
+	case action == "reject" && scope == "all":
+		return []string{"-j", "REJECT"}
+	case action == "reject":
+		return []string{"-j", "REJECT", "--reject-with", "tcp-reset"}
+	default:
+		return []string{"-j", "DROP"}
+	}
+}
+
+// hashlimitName names the hashlimit table shared by all ratelimit rules. Older kernels
+// limit the name to 15 characters.
+func hashlimitName() string {
+	name := firewallChain
+	if len(name) > 12 {
+		name = name[:12]
+	}
+	return name + "_rl"
+}
+
+// blockJumpArgs returns the jump arguments for the configured blockAction and blockScope.
+func blockJumpArgs() []string {
+	return blockJump(blockAction, blockScope)
+}
+
+// blockMatches returns the match arguments for the target's block rules under the rule's
+// scope: one per port for "web", or a single port-less match for "all".
+func blockMatches(target string, opts RuleOptions) [][]string {
+	if opts.scope() == "all" {
+		return [][]string{{"-s", target}}
+	}
+	ports := opts.ports()
+	matches := make([][]string, 0, len(ports))
+	for _, port := range ports {
+		matches = append(matches, []string{"-s", target, "-p", "tcp", "--dport", port})
+	}
+	return matches
+}
+
+// AddBlockRule ensures the DROP, REJECT or rate limit rules (per the rule's action and
+// ports, or blockScope) for the target are in place. Rules that already match are left alone; any
+// other rule for the target is replaced, whatever its shape, so changing either setting
+// replaces old rules.
+func (m *IPTablesManager) AddBlockRule(target string, opts RuleOptions) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	bin := m.binaryFor(target)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jump := blockJump(opts.action(), opts.scope())
+	var rules []iptablesRule
+	for _, match := range blockMatches(target, opts) {
+		rules = append(rules, iptablesRule{match: match, jump: jump})
+	}
+	ours := func(fields []string) bool {
+		return hasSource(fields, target) && !isExemption(fields)
+	}
+	present, err := m.ensureRulesLocked(bin, "filter", m.chainName, rules, ruleComment(opts, iptablesMaxComment), ours)
+	if err != nil {
+		// Log errors unconditionally
+		log.Printf("Failed to insert block rule for %s: %v", target, err)
+		// Do not leave some ports blocked when the caller treats the target as not blocked
+		m.deleteRulesLocked(bin, "filter", m.chainName, ours)
+		return fmt.Errorf("block rule for %s: %w", target, err)
+	}
+	if debug { // Log success only in debug
+		if present {
+			log.Printf("%s rules for %s already present", opts.action(), target)
+		} else {
+			log.Printf("Ensured %s rules exist for %s", opts.action(), target)
+		}
+	}
+	return nil
+}
+
+// RemoveBlockRule removes the target's block rules, whatever action, scope, or comment they
+// have, and the whitelist exemptions of a subnet target.
+func (m *IPTablesManager) RemoveBlockRule(target string) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	bin := m.binaryFor(target)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rulesRemoved, err := m.deleteRulesLocked(bin, "filter", m.chainName, func(fields []string) bool {
+		return (hasSource(fields, target) && !isExemption(fields)) || isExemptionOf(fields, target)
+	})
+	if err != nil {
+		return fmt.Errorf("errors removing block rules for %s: %v", target, err)
+	}
+	if rulesRemoved > 0 {
+		log.Printf("Successfully removed %d block rule instance(s) for %s", rulesRemoved, target)
+	}
+	return nil
+}
+
+// AddRedirectRule ensures the NAT redirect rules for the target are in place, leaving
+// matching rules alone and replacing any other redirect of the target.
+func (m *IPTablesManager) AddRedirectRule(target string, opts RuleOptions) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	bin := m.binaryFor(target)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []iptablesRule
+	for _, port := range opts.ports() {
+		rules = append(rules, iptablesRule{
+			match: []string{"-s", target, "-p", "tcp", "--dport", port},
+			jump:  []string{"-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", redirectPortFor(port))},
+		})
+	}
+	ours := func(fields []string) bool {
+		return hasSource(fields, target) && isChallengeRedirect(fields)
+	}
+	present, err := m.ensureRulesLocked(bin, "nat", m.redirectChain(), rules, ruleComment(opts, iptablesMaxComment), ours)
+	if err != nil {
+		log.Printf("Failed to insert redirect rule for %s (%s): %v", target, bin, err)
+		m.deleteRulesLocked(bin, "nat", m.redirectChain(), ours)
+		return fmt.Errorf("failed to ensure redirect rule(s): %w", err)
+	}
+	if !present {
+		log.Printf("Ensured redirect rules are present for %s (%s)", target, describeRedirects(opts.ports()))
+	} else if debug {
+		log.Printf("Redirect rules for %s already present", target)
+	}
+	return nil
+}
+
+// RemoveRedirectRule removes the target's NAT redirect rules to the challenge ports.
+func (m *IPTablesManager) RemoveRedirectRule(target string) error {
+	if err := m.checkFamily(target); err != nil {
+		return err
+	}
+	bin := m.binaryFor(target)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rulesRemoved, err := m.deleteRulesLocked(bin, "nat", m.redirectChain(), func(fields []string) bool {
+		return hasSource(fields, target) && isChallengeRedirect(fields)
+	})
+	if err != nil {
+		return fmt.Errorf("errors removing redirect rules for %s: %v", target, err)
+	}
+	if rulesRemoved > 0 {
+		log.Printf("Successfully removed %d redirect rule instance(s) for %s", rulesRemoved, target)
+	} else if debug {
+		log.Printf("No redirect rules found for %s", target)
+	}
+	return nil
+}
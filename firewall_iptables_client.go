@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// --- IPTables library access ---
+
+// iptablesClient is the subset of go-iptables used by IPTablesManager, so a fake can stand
+// in for *iptables.IPTables (see IPTablesManager.newClient).
+type iptablesClient interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	DeleteById(table, chain string, id int) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// clientSet holds one client per binary, created on first use.
+type clientSet struct {
+	mu      sync.Mutex
+	clients map[string]iptablesClient
+}
+
+// newIPTablesClient returns a go-iptables handle for a binary, running iptablesCommand(bin).
+// firewallCommandTimeout bounds how long each call waits for the xtables lock.
+func newIPTablesClient(bin string) (iptablesClient, error) {
+	proto := iptables.ProtocolIPv4
+	if bin == "ip6tables" {
+		proto = iptables.ProtocolIPv6
+	}
+	timeout := int(firewallCommandTimeout.Seconds())
+	if timeout < 1 {
+		timeout = 1
+	}
+	ipt, err := iptables.New(iptables.IPFamily(proto), iptables.Timeout(timeout), iptables.Path(iptablesCommand(bin)))
+	if err != nil {
+		return nil, err
+	}
+	return ipt, nil
+}
+
+// client returns the library handle for a binary (iptables or ip6tables).
+func (m *IPTablesManager) client(bin string) (iptablesClient, error) {
+	m.clients.mu.Lock()
+	defer m.clients.mu.Unlock()
+	if cl, ok := m.clients.clients[bin]; ok {
+		return cl, nil
+	}
+	newClient := m.newClient
+	if newClient == nil {
+		newClient = newIPTablesClient
+	}
+	cl, err := newClient(bin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use %s: %v", bin, err)
+	}
+	if m.clients.clients == nil {
+		m.clients.clients = make(map[string]iptablesClient)
+	}
+	m.clients.clients[bin] = cl
+	return cl, nil
+}
+
+// ipt runs one library call against a binary's tables, retrying lock contention up to
+// firewallCommandRetries times with exponential backoff. Failures are returned as a
+// *FirewallCommandError so callers and logBlockFailure treat them like exec'd commands.
+func (m *IPTablesManager) ipt(bin, op string, call func(cl iptablesClient) error) error {
+	cl, err := m.client(bin)
+	if err != nil {
+		return err
+	}
+	desc := bin + " " + op
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := call(cl)
+		if err == nil {
+			return nil
+		}
+
+		cmdErr := &FirewallCommandError{Command: desc, ExitCode: -1, Attempts: attempt, Err: err}
+		var iptErr *iptables.Error
+		if errors.As(err, &iptErr) {
+			cmdErr.ExitCode = iptErr.ExitStatus()
+		}
+		if !isLockContention(bin, err.Error(), cmdErr.ExitCode) {
+			return cmdErr
+		}
+		if attempt > firewallCommandRetries {
+			cmdErr.GaveUp = true
+			return cmdErr
+		}
+		if debug {
+			log.Printf("%s: %v, retrying in %v (attempt %d/%d)", desc, err, backoff, attempt, firewallCommandRetries+1)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// listRules returns the `-S` lines of table/chain, split into fields (see splitRuleSpec).
+func (m *IPTablesManager) listRules(bin, table, chain string) ([][]string, error) {
+	var lines []string
+	err := m.ipt(bin, "-t "+table+" -S "+chain, func(cl iptablesClient) error {
+		var err error
+		lines, err = cl.List(table, chain)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rules := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		rules = append(rules, splitRuleSpec(line))
+	}
+	return rules, nil
+}
+
+// splitRuleSpec splits an `iptables -S` line into arguments, keeping quoted comments whole.
+func splitRuleSpec(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes, started := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			started = true
+		case c == ' ' && !inQuotes:
+			if started {
+				fields = append(fields, field.String())
+				field.Reset()
+				started = false
+			}
+			continue
+		default:
+			field.WriteByte(c)
+		}
+		started = true
+	}
+	if started {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// ruleCommentOf returns the --comment value of split `iptables -S` fields, or "".
+func ruleCommentOf(fields []string) string {
+	for i, field := range fields {
+		if field == "--comment" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// iptablesRule is a rule to install, split around where the comment match goes.
+type iptablesRule struct {
+	match, jump []string
+}
+
+// spec returns the full rulespec with the given comment.
+func (r iptablesRule) spec(comment string) []string {
+	spec := append([]string{}, r.match...)
+	spec = append(spec, "-m", "comment", "--comment", comment)
+	return append(spec, r.jump...)
+}
+
+// ensureRulesLocked makes the rules of table/chain satisfying ours exactly the given rules,
+// inserted at the top of the chain. Comments carry the time a rule was added, so the
+// library's AppendUnique/InsertUnique never recognize a rule added earlier; instead the
+// existing rules' comment is reused and each wanted rule is checked with Exists. If all are
+// present nothing changes (and the original comment is kept); otherwise the old rules are
+// replaced. It reports whether the rules were already present. Caller holds m.mu.
+func (m *IPTablesManager) ensureRulesLocked(bin, table, chain string, rules []iptablesRule, comment string, ours func(fields []string) bool) (bool, error) {
+	listed, err := m.listRules(bin, table, chain)
+	if err != nil {
+		return false, fmt.Errorf("failed to list %s %s/%s: %w", bin, table, chain, err)
+	}
+	var existing [][]string
+	for _, fields := range listed {
+		if len(fields) >= 2 && fields[0] == "-A" && fields[1] == chain && ours(fields) {
+			existing = append(existing, fields)
+		}
+	}
+
+	if len(existing) == len(rules) && len(rules) > 0 {
+		oldComment := ruleCommentOf(existing[0])
+		present := true
+		for _, rule := range rules {
+			var exists bool
+			err := m.ipt(bin, "-t "+table+" -C "+chain, func(cl iptablesClient) error {
+				var err error
+				exists, err = cl.Exists(table, chain, rule.spec(oldComment)...)
+				return err
+			})
+			if err != nil || !exists {
+				present = false
+				break
+			}
+		}
+		if present {
+			return true, nil
+		}
+	}
+
+	if len(existing) > 0 {
+		if _, err := m.deleteRulesLocked(bin, table, chain, ours); err != nil && debug {
+			log.Printf("Could not clear existing %s/%s rules: %v", table, chain, err)
+		}
+	}
+	for _, rule := range rules {
+		spec := rule.spec(comment)
+		err := m.ipt(bin, "-t "+table+" -I "+chain+" 1", func(cl iptablesClient) error {
+			return cl.Insert(table, chain, 1, spec...)
+		})
+		if err != nil {
+			return false, fmt.Errorf("rule %s failed: %w", strings.Join(rule.match, " "), err)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// --- IPTables whitelist exemptions ---
+
+// exemptionCommentPrefix starts the comment of every exemption rule; the blocked subnet
+// follows, so a subnet's exemptions can be found and removed with it.
+const exemptionCommentPrefix = "apacheblock: whitelisted in "
+
+// isExemption reports whether an `iptables -S` line is a whitelist exemption. Exemptions
+// carry a -s match like block rules, so block rule matching must skip them.
+func isExemption(fields []string) bool {
+	return strings.HasPrefix(ruleCommentOf(fields), exemptionCommentPrefix)
+}
+
+// isExemptionOf reports whether an `iptables -S` line exempts an address from subnet's block.
+func isExemptionOf(fields []string, subnet string) bool {
+	return ruleCommentOf(fields) == exemptionCommentPrefix+subnet
+}
+
+// SetExemptions installs a RETURN rule for each address at the top of our chain, so traffic
+// from it skips the subnet's block rules and carries on through the parent chain. RETURN
+// rather than ACCEPT keeps the host's own rules in force for the address.
+func (m *IPTablesManager) SetExemptions(subnet string, addrs []string) error {
+	if err := m.checkFamily(subnet); err != nil {
+		return err
+	}
+	bin := m.binaryFor(subnet)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []iptablesRule
+	for _, addr := range addrs {
+		rules = append(rules, iptablesRule{match: []string{"-s", addr}, jump: []string{"-j", "RETURN"}})
+	}
+	ours := func(fields []string) bool {
+		return isExemptionOf(fields, subnet)
+	}
+	// Always rebuild: the subnet's block rules may have been re-added above old exemptions
+	if _, err := m.deleteRulesLocked(bin, "filter", m.chainName, ours); err != nil {
+		return fmt.Errorf("failed to clear exemptions for %s: %w", subnet, err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	if _, err := m.ensureRulesLocked(bin, "filter", m.chainName, rules, exemptionCommentPrefix+subnet, ours); err != nil {
+		m.deleteRulesLocked(bin, "filter", m.chainName, ours)
+		return fmt.Errorf("exemption rule for %s: %w", subnet, err)
+	}
+	if debug {
+		log.Printf("Ensured %d exemption rule(s) for subnet %s", len(rules), subnet)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// --- IPTables redirect chain ---
+
+// Challenge redirects live in a chain of their own in the nat table, jumped to from
+// PREROUTING, so they can be flushed and removed without touching the Docker and NAT rules
+// that share PREROUTING. Older versions inserted them into PREROUTING directly; those
+// are removed at setup and on flush.
+
+// redirectChain returns the name of the nat chain holding the challenge redirects.
+func (m *IPTablesManager) redirectChain() string {
+	return m.chainName + "-redirect"
+}
+
+// setupRedirectChain creates (or flushes) the redirect chain for one binary, links it from
+// PREROUTING, and removes legacy redirects from PREROUTING.
+func (m *IPTablesManager) setupRedirectChain(bin string) error {
+	chain := m.redirectChain()
+	if err := m.ipt(bin, "-t nat -N "+chain, func(cl iptablesClient) error {
+		return cl.ClearChain("nat", chain)
+	}); err != nil {
+		return fmt.Errorf("failed to create nat chain %s: %v", chain, err)
+	}
+
+	var linked bool
+	err := m.ipt(bin, "-t nat -C PREROUTING", func(cl iptablesClient) error {
+		var err error
+		linked, err = cl.Exists("nat", "PREROUTING", "-j", chain)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check PREROUTING for chain %s: %v", chain, err)
+	}
+	if !linked {
+		log.Printf("Linking chain %s to nat PREROUTING chain (%s)", chain, bin)
+		if err := m.ipt(bin, "-t nat -I PREROUTING 1", func(cl iptablesClient) error {
+			return cl.Insert("nat", "PREROUTING", 1, "-j", chain)
+		}); err != nil {
+			return fmt.Errorf("failed to link chain %s to PREROUTING: %v", chain, err)
+		}
+	}
+
+	if removed := m.removeLegacyRedirects(bin); removed > 0 {
+		log.Printf("Moved to chain %s: removed %d legacy redirect rule(s) from PREROUTING (%s)", chain, removed, bin)
+	}
+	return nil
+}
+
+// flushRedirectChain empties the redirect chain, if it exists, and removes legacy redirects.
+func (m *IPTablesManager) flushRedirectChain(bin string) {
+	chain := m.redirectChain()
+	var exists bool
+	err := m.ipt(bin, "-t nat -S "+chain, func(cl iptablesClient) error {
+		var err error
+		exists, err = cl.ChainExists("nat", chain)
+		return err
+	})
+	if err == nil && exists {
+		if n := m.countRules(bin, "nat", chain); n > 0 {
+			noteRemoval("%d redirect rule(s) in %s nat chain %s", n, bin, chain)
+		}
+		err = m.ipt(bin, "-t nat -F "+chain, func(cl iptablesClient) error {
+			return cl.ClearChain("nat", chain)
+		})
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to flush %s nat chain %s: %v", bin, chain, err)
+	} else if exists {
+		log.Printf("Flushed nat chain: %s", chain)
+	}
+
+	if cleaned := m.removeLegacyRedirects(bin); cleaned > 0 {
+		log.Printf("Cleaned up %d legacy NAT redirect rule(s) in PREROUTING", cleaned)
+		noteRemoval("%d legacy redirect rule(s) in %s nat PREROUTING", cleaned, bin)
+	}
+}
+
+// removeRedirectChain unlinks the redirect chain from PREROUTING and deletes it.
+func (m *IPTablesManager) removeRedirectChain(bin string) error {
+	chain := m.redirectChain()
+	m.mu.Lock()
+	n, err := m.deleteRuleSpecLocked(bin, "nat", "PREROUTING", "-j", chain)
+	m.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: Failed to unlink chain %s from PREROUTING: %v", chain, err)
+	}
+	if n > 0 {
+		noteRemoval("%d jump(s) to %s from %s nat PREROUTING", n, chain, bin)
+	}
+
+	if err := m.ipt(bin, "-t nat -X "+chain, func(cl iptablesClient) error {
+		return cl.DeleteChain("nat", chain)
+	}); err != nil {
+		if !strings.Contains(err.Error(), "No chain/target/match by that name") {
+			return fmt.Errorf("failed to delete %s nat chain %s: %v", bin, chain, err)
+		}
+		return nil
+	}
+	log.Printf("Removed %s nat chain %s", bin, chain)
+	noteRemoval("%s nat chain %s", bin, chain)
+	return nil
+}
+
+// removeLegacyRedirects deletes every PREROUTING REDIRECT rule with a source match that points
+// at one of the challenge ports, duplicates included, and returns how many were removed.
+// Matching on the redirect target rather than blockPorts means rules for ports since dropped
+// from blockPorts go too; requiring a source leaves port-wide redirects set up by hand alone.
+// The rules are deleted by the specification listed, not by position, as Docker may change
+// PREROUTING meanwhile.
+func (m *IPTablesManager) removeLegacyRedirects(bin string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules, err := m.listRules(bin, "nat", "PREROUTING")
+	if err != nil {
+		log.Printf("Warning: Failed to list %s nat PREROUTING for legacy redirect rules: %v", bin, err)
+		return 0
+	}
+	removed := 0
+	for _, fields := range rules {
+		if len(fields) < 3 || fields[0] != "-A" || fields[1] != "PREROUTING" || !isChallengeRedirect(fields) || !hasAnySource(fields) {
+			continue
+		}
+		n, err := m.deleteRuleSpecLocked(bin, "nat", "PREROUTING", fields[2:]...)
+		if err != nil {
+			log.Printf("Warning: Failed to clean up %s NAT redirect rules in PREROUTING: %v", bin, err)
+		}
+		removed += n
+	}
+	return removed
+}
+
+// checkRedirectChain reports whether the redirect chain was deleted or unlinked from PREROUTING.
+func (m *IPTablesManager) checkRedirectChain(bin string) error {
+	chain := m.redirectChain()
+	var exists, linked bool
+	err := m.ipt(bin, "-t nat -S "+chain, func(cl iptablesClient) error {
+		var err error
+		exists, err = cl.ChainExists("nat", chain)
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("%s nat chain %s no longer exists", bin, chain)
+	}
+	err = m.ipt(bin, "-t nat -C PREROUTING", func(cl iptablesClient) error {
+		var err error
+		linked, err = cl.Exists("nat", "PREROUTING", "-j", chain)
+		return err
+	})
+	if err == nil && !linked {
+		return fmt.Errorf("%s nat chain %s is no longer linked from PREROUTING", bin, chain)
+	}
+	return nil
+}
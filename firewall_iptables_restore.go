@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ApplyBlockRules replaces the chain contents with block rules for every target using one
+// iptables-restore (and ip6tables-restore) run per address family, instead of forking
+// iptables for each rule. It returns an error if the restore binary is missing so that
+// applyBlockList falls back to adding rules one target at a time.
+func (m *IPTablesManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	start := time.Now()
+
+	byBinary := make(map[string][]string)
+	for _, target := range targets {
+		if err := m.checkFamily(target); err != nil {
+			log.Printf("Skipping %s: %v", target, err)
+			continue
+		}
+		bin := m.binaryFor(target)
+		byBinary[bin] = append(byBinary[bin], target)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	restored := 0
+	for _, bin := range m.binaries() {
+		restoreBin := iptablesCommand(bin) + "-restore"
+		if _, err := exec.LookPath(restoreBin); err != nil {
+			return fmt.Errorf("%s command not found: %v", restoreBin, err)
+		}
+
+		script, count := m.restoreScript(byBinary[bin], opts)
+		if _, err := runFirewallCommand(script, restoreBin, "-w", "--noflush"); err != nil {
+			return err
+		}
+		restored += count
+	}
+
+	if debug {
+		log.Printf("Restored %d block rules for %d targets with iptables-restore in %v", restored, len(targets), time.Since(start))
+	}
+	return nil
+}
+
+// restoreScript builds iptables-restore input that flushes the chain and inserts the
+// block rules for targets, returning the script and the number of rules in it.
+func (m *IPTablesManager) restoreScript(targets []string, opts map[string]RuleOptions) (string, int) {
+	var script strings.Builder
+	script.WriteString("*filter\n")
+	fmt.Fprintf(&script, "-F %s\n", m.chainName)
+
+	count := 0
+	for _, target := range targets {
+		comment := ruleComment(opts[target], iptablesMaxComment)
+		jump := strings.Join(blockJump(opts[target].action(), opts[target].scope()), " ")
+		for _, match := range blockMatches(target, opts[target]) {
+			fmt.Fprintf(&script, "-A %s %s -m comment --comment \"%s\" %s\n", m.chainName, strings.Join(match, " "), comment, jump)
+			count++
+		}
+	}
+	script.WriteString("COMMIT\n")
+	return script.String(), count
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// --- IPTables rule listing helpers ---
+
+// isChallengeRedirect reports whether an `iptables -S` line redirects to a challenge port.
+func isChallengeRedirect(fields []string) bool {
+	toPorts := map[string]bool{
+		fmt.Sprintf("%d", challengeHTTPPort): true,
+		fmt.Sprintf("%d", challengePort):     true,
+	}
+	redirect := false
+	ours := false
+	for i, field := range fields {
+		if field == "REDIRECT" && i > 0 && fields[i-1] == "-j" {
+			redirect = true
+		}
+		if (field == "--to-ports" || field == "--to-port") && i+1 < len(fields) && toPorts[fields[i+1]] {
+			ours = true
+		}
+	}
+	return redirect && ours
+}
+
+// hasSource reports whether an `iptables -S` line matches exactly the given source.
+// iptables prints single hosts as /32 (or /128), so both sides are compared in host form.
+func hasSource(fields []string, target string) bool {
+	for i, field := range fields {
+		if field == "-s" && i+1 < len(fields) {
+			return hostForm(fields[i+1]) == hostForm(target)
+		}
+	}
+	return false
+}
+
+// hasAnySource reports whether an `iptables -S` line has a source match.
+func hasAnySource(fields []string) bool {
+	for i, field := range fields {
+		if field == "-s" && i+1 < len(fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostForm normalizes a target and strips a full-length prefix (1.2.3.4/32 -> 1.2.3.4).
+func hostForm(target string) string {
+	if _, ipNet, err := net.ParseCIDR(target); err == nil {
+		if ones, bits := ipNet.Mask.Size(); ones == bits {
+			return ipNet.IP.String()
+		}
+	}
+	return normalizeTarget(target)
+}
+
+// deleteRulesLocked deletes every rule in table/chain whose `iptables -S` fields satisfy
+// match, and returns how many were removed. Rules are deleted by position, highest first,
+// so the remaining positions stay valid; this also works for rules carrying comments,
+// which a delete-by-specification would have to reproduce exactly. Positions are only
+// stable in our own chains, so rules in shared ones go through deleteRuleSpecLocked.
+// Caller holds m.mu.
+func (m *IPTablesManager) deleteRulesLocked(bin, table, chain string, match func(fields []string) bool) (int, error) {
+	rules, err := m.listRules(bin, table, chain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s %s/%s: %w", bin, table, chain, err)
+	}
+
+	var positions []int
+	position := 0
+	for _, fields := range rules {
+		if len(fields) < 2 || fields[0] != "-A" || fields[1] != chain {
+			continue
+		}
+		position++
+		if match(fields) {
+			positions = append(positions, position)
+		}
+	}
+
+	var errors []string
+	removed := 0
+	for i := len(positions) - 1; i >= 0; i-- {
+		num := positions[i]
+		if err := m.ipt(bin, fmt.Sprintf("-t %s -D %s %d", table, chain, num), func(cl iptablesClient) error {
+			return cl.DeleteById(table, chain, num)
+		}); err != nil {
+			errors = append(errors, fmt.Sprintf("rule %d: %v", num, err))
+			continue
+		}
+		removed++
+	}
+	if len(errors) > 0 {
+		return removed, fmt.Errorf("failed to delete %s %s/%s rule(s): %s", bin, table, chain, strings.Join(errors, "; "))
+	}
+	return removed, nil
+}
+
+// deleteRuleSpecLocked deletes every copy of the rule spec from table/chain and returns how
+// many were removed. Deleting by specification is safe in chains such as INPUT, DOCKER-USER
+// or nat PREROUTING, where Docker, fail2ban or firewalld may add rules between a listing
+// and a delete by position. Caller holds m.mu.
+func (m *IPTablesManager) deleteRuleSpecLocked(bin, table, chain string, spec ...string) (int, error) {
+	desc := strings.Join(spec, " ")
+	removed := 0
+	for {
+		var exists bool
+		err := m.ipt(bin, "-t "+table+" -C "+chain+" "+desc, func(cl iptablesClient) error {
+			var err error
+			exists, err = cl.Exists(table, chain, spec...)
+			return err
+		})
+		if err != nil {
+			return removed, fmt.Errorf("failed to check %s %s/%s rule %s: %w", bin, table, chain, desc, err)
+		}
+		if !exists {
+			return removed, nil
+		}
+		if err := m.ipt(bin, "-t "+table+" -D "+chain+" "+desc, func(cl iptablesClient) error {
+			return cl.Delete(table, chain, spec...)
+		}); err != nil {
+			return removed, fmt.Errorf("failed to delete %s %s/%s rule %s: %w", bin, table, chain, desc, err)
+		}
+		removed++
+	}
+}
+
+// detachChain removes the jumps to our chain from every filter chain not in keep and
+// returns how many were removed. A nil keep detaches the chain everywhere. The parents
+// are shared with other tools, so the jumps are deleted by specification.
+func (m *IPTablesManager) detachChain(bin string, keep map[string]bool) int {
+	var chains []string
+	err := m.ipt(bin, "-t filter -S", func(cl iptablesClient) error {
+		var err error
+		chains, err = cl.ListChains("filter")
+		return err
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to list %s filter chains: %v", bin, err)
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for _, parent := range chains {
+		if parent == m.chainName || keep[parent] {
+			continue
+		}
+		n, err := m.deleteRuleSpecLocked(bin, "filter", parent, "-j", m.chainName)
+		if err != nil {
+			log.Printf("Warning: Failed to unlink chain %s from %s: %v", m.chainName, parent, err)
+		}
+		if n > 0 {
+			noteRemoval("%d jump(s) to %s from %s %s", n, m.chainName, bin, parent)
+		}
+		removed += n
+	}
+	return removed
+}
+
+// countRules returns the number of rules in table/chain, or 0 if it cannot be listed.
+func (m *IPTablesManager) countRules(bin, table, chain string) int {
+	rules, err := m.listRules(bin, table, chain)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, fields := range rules {
+		if len(fields) >= 2 && fields[0] == "-A" && fields[1] == chain {
+			n++
+		}
+	}
+	return n
+}
+
+// ListRuleTargets returns the sources of the block rules in our chain, or of the challenge
+// redirect rules in the redirect chain, across both address families.
+func (m *IPTablesManager) ListRuleTargets(redirect bool) ([]string, error) {
+	table, chain := "filter", m.chainName
+	if redirect {
+		table, chain = "nat", m.redirectChain()
+	}
+
+	seen := make(map[string]bool)
+	var targets []string
+	for _, bin := range m.binaries() {
+		rules, err := m.listRules(bin, table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s %s/%s: %v", bin, table, chain, err)
+		}
+		for _, fields := range rules {
+			if len(fields) < 2 || fields[0] != "-A" || fields[1] != chain {
+				continue
+			}
+			if (redirect && !isChallengeRedirect(fields)) || isExemption(fields) {
+				continue
+			}
+			for i, field := range fields {
+				if field == "-s" && i+1 < len(fields) {
+					target := hostForm(fields[i+1])
+					if !seen[target] {
+						seen[target] = true
+						targets = append(targets, target)
+					}
+					break
+				}
+			}
+		}
+	}
+	return targets, nil
+}
+
+// CheckChain reports the first problem found with our chain: deleted, or no longer linked
+// from a parent in attachChains. Parents that do not exist (e.g. DOCKER-USER before Docker
+// starts) are skipped, as are errors that do not show the chain is gone.
+func (m *IPTablesManager) CheckChain() error {
+	exists := func(bin, chain string) (bool, error) {
+		var found bool
+		err := m.ipt(bin, "-t filter -S "+chain, func(cl iptablesClient) error {
+			var err error
+			found, err = cl.ChainExists("filter", chain)
+			return err
+		})
+		return found, err
+	}
+	for _, bin := range m.binaries() {
+		found, err := exists(bin, m.chainName)
+		if err != nil {
+			continue
+		}
+		if !found {
+			return fmt.Errorf("%s chain %s no longer exists", bin, m.chainName)
+		}
+		for _, parent := range attachChains {
+			if found, err := exists(bin, parent); err != nil || !found {
+				continue
+			}
+			var linked bool
+			err := m.ipt(bin, "-t filter -C "+parent, func(cl iptablesClient) error {
+				var err error
+				linked, err = cl.Exists("filter", parent, "-j", m.chainName)
+				return err
+			})
+			if err == nil && !linked {
+				return fmt.Errorf("%s chain %s is no longer linked from %s", bin, m.chainName, parent)
+			}
+		}
+		if challengeEnable {
+			if err := m.checkRedirectChain(bin); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
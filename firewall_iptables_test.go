@@ -0,0 +1,574 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeIPTables is an iptablesClient keeping the tables of one binary in memory. Rule
+// specs are kept the way iptables prints them: sources and destinations as ranges
+// (1.2.3.4/32), --to-port as --to-ports.
+type fakeIPTables struct {
+	mu     sync.Mutex
+	tables map[string]map[string][][]string // Rules by chain by table
+	order  map[string][]string              // Chains of each table, in creation order
+	calls  []string                         // The changes made, e.g. "DeleteById filter INPUT 1"
+
+	// beforeDelete runs before each delete, as another tool changing the chain meanwhile would
+	beforeDelete func(f *fakeIPTables, table, chain string)
+}
+
+// fakeBuiltinChains are the chains each table starts with.
+var fakeBuiltinChains = map[string][]string{
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+}
+
+// newFakeIPTables returns a fake with empty built-in chains.
+func newFakeIPTables() *fakeIPTables {
+	f := &fakeIPTables{tables: make(map[string]map[string][][]string), order: make(map[string][]string)}
+	for table, chains := range fakeBuiltinChains {
+		f.tables[table] = make(map[string][][]string)
+		for _, chain := range chains {
+			f.tables[table][chain] = nil
+			f.order[table] = append(f.order[table], chain)
+		}
+	}
+	return f
+}
+
+// isBuiltin reports whether chain is a built-in chain of table.
+func (f *fakeIPTables) isBuiltin(table, chain string) bool {
+	for _, builtin := range fakeBuiltinChains[table] {
+		if builtin == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalSpec returns spec the way iptables prints it.
+func canonicalSpec(spec []string) []string {
+	out := append([]string(nil), spec...)
+	for i := range out {
+		switch {
+		case (out[i] == "-s" || out[i] == "-d") && i+1 < len(out):
+			value := out[i+1]
+			if !strings.Contains(value, "/") {
+				if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+					value += "/32"
+				} else {
+					value += "/128"
+				}
+			}
+			if _, ipNet, err := net.ParseCIDR(value); err == nil {
+				value = ipNet.String()
+			}
+			out[i+1] = value
+		case out[i] == "--to-port":
+			out[i] = "--to-ports"
+		}
+	}
+	return out
+}
+
+// chainLocked returns the rules of table/chain, and whether it exists. Caller holds f.mu.
+func (f *fakeIPTables) chainLocked(table, chain string) ([][]string, bool) {
+	rules, ok := f.tables[table][chain]
+	return rules, ok
+}
+
+// errNoChain is the error iptables gives for a missing chain or rule.
+func errNoChain(table, chain string) error {
+	return fmt.Errorf("iptables: No chain/target/match by that name (%s/%s)", table, chain)
+}
+
+// indexLocked returns the position of spec in table/chain, or -1. Caller holds f.mu.
+func (f *fakeIPTables) indexLocked(table, chain string, spec []string) int {
+	rules, _ := f.chainLocked(table, chain)
+	spec = canonicalSpec(spec)
+	for i, rule := range rules {
+		if reflect.DeepEqual(rule, spec) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.indexLocked(table, chain, rulespec) >= 0, nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, ok := f.chainLocked(table, chain)
+	if !ok {
+		return errNoChain(table, chain)
+	}
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("iptables: Index of insertion too big (%s/%s %d)", table, chain, pos)
+	}
+	rules = append(rules[:pos-1], append([][]string{canonicalSpec(rulespec)}, rules[pos-1:]...)...)
+	f.tables[table][chain] = rules
+	f.calls = append(f.calls, fmt.Sprintf("Insert %s %s %d", table, chain, pos))
+	return nil
+}
+
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, ok := f.chainLocked(table, chain)
+	if !ok {
+		return errNoChain(table, chain)
+	}
+	f.tables[table][chain] = append(rules, canonicalSpec(rulespec))
+	f.calls = append(f.calls, fmt.Sprintf("Append %s %s", table, chain))
+	return nil
+}
+
+// runBeforeDelete runs the beforeDelete hook, if any.
+func (f *fakeIPTables) runBeforeDelete(table, chain string) {
+	f.mu.Lock()
+	hook := f.beforeDelete
+	f.mu.Unlock()
+	if hook != nil {
+		hook(f, table, chain)
+	}
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	f.runBeforeDelete(table, chain)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.indexLocked(table, chain, rulespec)
+	if i < 0 {
+		return fmt.Errorf("iptables: Bad rule (does a matching rule exist in that chain?) (%s/%s)", table, chain)
+	}
+	rules := f.tables[table][chain]
+	f.tables[table][chain] = append(rules[:i:i], rules[i+1:]...)
+	f.calls = append(f.calls, fmt.Sprintf("Delete %s %s", table, chain))
+	return nil
+}
+
+func (f *fakeIPTables) DeleteById(table, chain string, id int) error {
+	f.runBeforeDelete(table, chain)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, ok := f.chainLocked(table, chain)
+	if !ok {
+		return errNoChain(table, chain)
+	}
+	if id < 1 || id > len(rules) {
+		return fmt.Errorf("iptables: Index of deletion too big (%s/%s %d)", table, chain, id)
+	}
+	f.tables[table][chain] = append(rules[:id-1:id-1], rules[id:]...)
+	f.calls = append(f.calls, fmt.Sprintf("DeleteById %s %s %d", table, chain, id))
+	return nil
+}
+
+// quoteField quotes a rule field the way iptables -S does, if it needs it.
+func quoteField(field string) string {
+	if field != "" && !strings.ContainsAny(field, " \"\\") {
+		return field
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(field) + `"`
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, ok := f.chainLocked(table, chain)
+	if !ok {
+		return nil, errNoChain(table, chain)
+	}
+	lines := []string{"-N " + chain}
+	if f.isBuiltin(table, chain) {
+		lines[0] = "-P " + chain + " ACCEPT"
+	}
+	for _, rule := range rules {
+		fields := make([]string, len(rule))
+		for i, field := range rule {
+			fields[i] = quoteField(field)
+		}
+		lines = append(lines, "-A "+chain+" "+strings.Join(fields, " "))
+	}
+	return lines, nil
+}
+
+func (f *fakeIPTables) ListChains(table string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.order[table]...), nil
+}
+
+func (f *fakeIPTables) ChainExists(table, chain string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.chainLocked(table, chain)
+	return ok, nil
+}
+
+// newChainLocked creates an empty chain. Caller holds f.mu.
+func (f *fakeIPTables) newChainLocked(table, chain string) {
+	f.tables[table][chain] = nil
+	f.order[table] = append(f.order[table], chain)
+}
+
+func (f *fakeIPTables) NewChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.chainLocked(table, chain); ok {
+		return fmt.Errorf("iptables: Chain already exists (%s/%s)", table, chain)
+	}
+	f.newChainLocked(table, chain)
+	f.calls = append(f.calls, fmt.Sprintf("NewChain %s %s", table, chain))
+	return nil
+}
+
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.chainLocked(table, chain); !ok {
+		f.newChainLocked(table, chain)
+	}
+	f.tables[table][chain] = nil
+	f.calls = append(f.calls, fmt.Sprintf("ClearChain %s %s", table, chain))
+	return nil
+}
+
+func (f *fakeIPTables) DeleteChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, ok := f.chainLocked(table, chain)
+	if !ok || f.isBuiltin(table, chain) {
+		return errNoChain(table, chain)
+	}
+	if len(rules) > 0 {
+		return fmt.Errorf("iptables: Directory not empty (%s/%s)", table, chain)
+	}
+	for _, other := range f.tables[table] {
+		for _, rule := range other {
+			if n := len(rule); n >= 2 && rule[n-2] == "-j" && rule[n-1] == chain {
+				return fmt.Errorf("iptables: Too many links (%s/%s)", table, chain)
+			}
+		}
+	}
+	delete(f.tables[table], chain)
+	for i, name := range f.order[table] {
+		if name == chain {
+			f.order[table] = append(f.order[table][:i:i], f.order[table][i+1:]...)
+			break
+		}
+	}
+	f.calls = append(f.calls, fmt.Sprintf("DeleteChain %s %s", table, chain))
+	return nil
+}
+
+// rules returns the rules of table/chain as iptables -S prints them, without the chain line.
+func (f *fakeIPTables) rules(t *testing.T, table, chain string) []string {
+	t.Helper()
+	lines, err := f.List(table, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines[1:]
+}
+
+// dump returns every chain and rule of the fake, for comparing states.
+func (f *fakeIPTables) dump(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	for _, table := range []string{"filter", "nat"} {
+		chains, _ := f.ListChains(table)
+		for _, chain := range chains {
+			listed, err := f.List(table, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range listed {
+				lines = append(lines, table+" "+line)
+			}
+		}
+	}
+	return lines
+}
+
+// add appends a rule of another tool to table/chain, creating the chain if needed.
+func (f *fakeIPTables) add(t *testing.T, table, chain string, rulespec ...string) {
+	t.Helper()
+	f.mu.Lock()
+	if _, ok := f.chainLocked(table, chain); !ok {
+		f.newChainLocked(table, chain)
+	}
+	f.mu.Unlock()
+	if err := f.Append(table, chain, rulespec...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeIPTablesManager returns a manager on fake iptables and ip6tables, with the
+// firewall settings at their defaults for the test.
+func newFakeIPTablesManager(t *testing.T) (*IPTablesManager, *fakeIPTables, *fakeIPTables) {
+	t.Helper()
+	savedChains, savedPorts, savedAction, savedScope := attachChains, blockPorts, blockAction, blockScope
+	savedChallenge, savedIPTables, savedIP6Tables := challengeEnable, iptablesPath, ip6tablesPath
+	attachChains, blockPorts, blockAction, blockScope = []string{"INPUT"}, []string{"80", "443"}, "drop", "web"
+	// Keep checkIPTablesVariant from running the real commands
+	challengeEnable, iptablesPath, ip6tablesPath = false, "/nonexistent/iptables", "/nonexistent/ip6tables"
+	t.Cleanup(func() {
+		attachChains, blockPorts, blockAction, blockScope = savedChains, savedPorts, savedAction, savedScope
+		challengeEnable, iptablesPath, ip6tablesPath = savedChallenge, savedIPTables, savedIP6Tables
+		takeRemovals()
+	})
+
+	ipt4, ipt6 := newFakeIPTables(), newFakeIPTables()
+	m := &IPTablesManager{chainName: "apacheblock", newClient: func(bin string) (iptablesClient, error) {
+		if bin == "ip6tables" {
+			return ipt6, nil
+		}
+		return ipt4, nil
+	}}
+	return m, ipt4, ipt6
+}
+
+// checkRules fails the test unless table/chain holds exactly want, ignoring comments.
+func checkRules(t *testing.T, f *fakeIPTables, table, chain string, want ...string) {
+	t.Helper()
+	var got []string
+	for _, line := range f.rules(t, table, chain) {
+		fields := splitRuleSpec(line)
+		var kept []string
+		for i := 2; i < len(fields); i++ { // After "-A chain"
+			if fields[i] == "-m" && i+3 < len(fields) && fields[i+1] == "comment" {
+				i += 3
+				continue
+			}
+			kept = append(kept, fields[i])
+		}
+		got = append(got, strings.Join(kept, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("%s/%s holds\n%s\nwant\n%s", table, chain, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestIPTablesSetupIdempotent checks that Setup creates and links the chains once, however
+// often it runs, leaving the rules of other tools alone.
+func TestIPTablesSetupIdempotent(t *testing.T) {
+	m, ipt4, ipt6 := newFakeIPTablesManager(t)
+	ipt4.add(t, "filter", "INPUT", "-s", "198.51.100.1", "-j", "ACCEPT")
+	ipt4.add(t, "nat", "PREROUTING", "-p", "tcp", "--dport", "8000", "-j", "REDIRECT", "--to-ports", "80")
+
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "INPUT", "-j apacheblock", "-s 198.51.100.1/32 -j ACCEPT")
+	checkRules(t, ipt4, "nat", "PREROUTING", "-j apacheblock-redirect", "-p tcp --dport 8000 -j REDIRECT --to-ports 80")
+	checkRules(t, ipt6, "filter", "INPUT", "-j apacheblock")
+	checkRules(t, ipt4, "filter", "apacheblock")
+	checkRules(t, ipt4, "nat", "apacheblock-redirect")
+	first4, first6 := ipt4.dump(t), ipt6.dump(t)
+
+	for i := 0; i < 2; i++ {
+		if err := m.Setup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if again := ipt4.dump(t); !reflect.DeepEqual(again, first4) {
+		t.Fatalf("iptables after repeated setups:\n%s\nafter the first:\n%s", strings.Join(again, "\n"), strings.Join(first4, "\n"))
+	}
+	if again := ipt6.dump(t); !reflect.DeepEqual(again, first6) {
+		t.Fatalf("ip6tables after repeated setups:\n%s\nafter the first:\n%s", strings.Join(again, "\n"), strings.Join(first6, "\n"))
+	}
+}
+
+// TestIPTablesBlockRules checks adding and removing block rules: adding again changes
+// nothing, a new action replaces the rules, and removing a missing rule is no error.
+func TestIPTablesBlockRules(t *testing.T) {
+	m, ipt4, ipt6 := newFakeIPTablesManager(t)
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddBlockRule("192.0.2.1", RuleOptions{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "apacheblock",
+		"-s 192.0.2.1/32 -p tcp --dport 443 -j DROP",
+		"-s 192.0.2.1/32 -p tcp --dport 80 -j DROP")
+	added := ipt4.dump(t)
+	if !strings.Contains(strings.Join(added, "\n"), "apacheblock: test ") {
+		t.Fatalf("block rules have no comment:\n%s", strings.Join(added, "\n"))
+	}
+
+	// The same rules again are left alone, comment and all
+	calls := len(ipt4.calls)
+	if err := m.AddBlockRule("192.0.2.1", RuleOptions{Reason: "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if again := ipt4.dump(t); !reflect.DeepEqual(again, added) || len(ipt4.calls) != calls {
+		t.Fatalf("adding the rules again changed them: %v", ipt4.calls[calls:])
+	}
+
+	// Another action or other ports replace them
+	if err := m.AddBlockRule("192.0.2.1", RuleOptions{Reason: "test", Action: "reject"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "apacheblock",
+		"-s 192.0.2.1/32 -p tcp --dport 443 -j REJECT --reject-with tcp-reset",
+		"-s 192.0.2.1/32 -p tcp --dport 80 -j REJECT --reject-with tcp-reset")
+	if err := m.AddBlockRule("192.0.2.1", RuleOptions{Reason: "test", Ports: []string{"22"}}); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "apacheblock", "-s 192.0.2.1/32 -p tcp --dport 22 -j DROP")
+
+	if err := m.AddBlockRule("198.51.100.0/24", RuleOptions{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddBlockRule("2001:db8::1", RuleOptions{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt6, "filter", "apacheblock",
+		"-s 2001:db8::1/128 -p tcp --dport 443 -j DROP",
+		"-s 2001:db8::1/128 -p tcp --dport 80 -j DROP")
+
+	if err := m.RemoveBlockRule("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "apacheblock",
+		"-s 198.51.100.0/24 -p tcp --dport 443 -j DROP",
+		"-s 198.51.100.0/24 -p tcp --dport 80 -j DROP")
+
+	// Removing rules that are not there is no error and changes nothing
+	before := ipt4.dump(t)
+	for _, target := range []string{"192.0.2.1", "192.0.2.2", "198.51.100.7"} {
+		if err := m.RemoveBlockRule(target); err != nil {
+			t.Fatalf("removing the missing rules of %s: %v", target, err)
+		}
+	}
+	if after := ipt4.dump(t); !reflect.DeepEqual(after, before) {
+		t.Fatalf("removing missing rules changed the rules:\n%s", strings.Join(after, "\n"))
+	}
+
+	if err := m.RemoveBlockRule("2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt6, "filter", "apacheblock")
+}
+
+// TestIPTablesUnlinkDeletesBySpec checks that the jumps to our chain are deleted from the
+// parent chains by specification, so rules other tools add meanwhile do not shift what is
+// deleted.
+func TestIPTablesUnlinkDeletesBySpec(t *testing.T) {
+	m, ipt4, _ := newFakeIPTablesManager(t)
+	ipt4.add(t, "filter", "DOCKER-USER", "-j", "RETURN")
+	ipt4.add(t, "filter", "INPUT", "-s", "198.51.100.1", "-j", "ACCEPT")
+	attachChains = []string{"INPUT", "DOCKER-USER"}
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "DOCKER-USER", "-j apacheblock", "-j RETURN")
+
+	// Another tool inserts a rule at the top of the chain before each delete
+	inserted := 0
+	ipt4.beforeDelete = func(f *fakeIPTables, table, chain string) {
+		if table == "filter" && (chain == "INPUT" || chain == "DOCKER-USER") {
+			inserted++
+			if err := f.Insert(table, chain, 1, "-s", fmt.Sprintf("203.0.113.%d", inserted), "-j", "ACCEPT"); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// Dropped from attachChains
+	attachChains = []string{"INPUT"}
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "DOCKER-USER", "-s 203.0.113.1/32 -j ACCEPT", "-j RETURN")
+	checkRules(t, ipt4, "filter", "INPUT", "-j apacheblock", "-s 198.51.100.1/32 -j ACCEPT")
+
+	// Torn down
+	if err := m.Teardown(); err != nil {
+		t.Fatal(err)
+	}
+	checkRules(t, ipt4, "filter", "INPUT", "-s 203.0.113.2/32 -j ACCEPT", "-s 198.51.100.1/32 -j ACCEPT")
+	if exists, _ := ipt4.ChainExists("filter", "apacheblock"); exists {
+		t.Fatal("chain apacheblock left after teardown")
+	}
+
+	for _, call := range ipt4.calls {
+		if strings.HasPrefix(call, "DeleteById filter INPUT ") || strings.HasPrefix(call, "DeleteById filter DOCKER-USER ") {
+			t.Errorf("%s: a parent chain rule was deleted by position", call)
+		}
+	}
+}
+
+// TestCleanRemovesChallengeRedirects blocks addresses in challenge mode, with redirects
+// left in PREROUTING by older versions too, and checks that -clean leaves the filter and
+// nat tables as empty as they started.
+func TestCleanRemovesChallengeRedirects(t *testing.T) {
+	m, ipt4, ipt6 := newFakeIPTablesManager(t)
+	useTempBlockList(t)
+	savedManager := fwManager
+	fwManager = m
+	t.Cleanup(func() { fwManager = savedManager })
+	challengeEnable = true
+
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::1"} {
+		if err := addFirewallRule(target, RuleOptions{Reason: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if strings.Contains(target, "/") {
+			addBlockedSubnetLocked(target)
+		} else {
+			blockedIPs[target] = struct{}{}
+		}
+		mu.Unlock()
+	}
+	// Blocked before challenge mode was turned on
+	if err := m.AddBlockRule("192.0.2.9", RuleOptions{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	// Redirects of older versions, duplicates included
+	for i := 0; i < 2; i++ {
+		ipt4.add(t, "nat", "PREROUTING", "-s", "192.0.2.1", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8088")
+		ipt4.add(t, "nat", "PREROUTING", "-s", "192.0.2.1", "-p", "tcp", "--dport", "443", "-j", "REDIRECT", "--to-ports", "4443")
+	}
+	checkRules(t, ipt4, "nat", "apacheblock-redirect",
+		"-s 198.51.100.0/24 -p tcp --dport 443 -j REDIRECT --to-ports 4443",
+		"-s 198.51.100.0/24 -p tcp --dport 80 -j REDIRECT --to-ports 8088",
+		"-s 192.0.2.1/32 -p tcp --dport 443 -j REDIRECT --to-ports 4443",
+		"-s 192.0.2.1/32 -p tcp --dport 80 -j REDIRECT --to-ports 8088")
+	checkRules(t, ipt6, "nat", "apacheblock-redirect",
+		"-s 2001:db8::1/128 -p tcp --dport 443 -j REDIRECT --to-ports 4443",
+		"-s 2001:db8::1/128 -p tcp --dport 80 -j REDIRECT --to-ports 8088")
+
+	// What -clean runs
+	if err := removePortBlockingRules(); err != nil {
+		t.Fatal(err)
+	}
+	empty := newFakeIPTables().dump(t)
+	for bin, fake := range map[string]*fakeIPTables{"iptables": ipt4, "ip6tables": ipt6} {
+		if left := fake.dump(t); !reflect.DeepEqual(left, empty) {
+			t.Errorf("%s after -clean:\n%s", bin, strings.Join(left, "\n"))
+		}
+	}
+	mu.Lock()
+	left := len(blockedIPs) + len(blockedSubnets)
+	mu.Unlock()
+	if left > 0 {
+		t.Errorf("%d targets left in the blocklist after -clean", left)
+	}
+}
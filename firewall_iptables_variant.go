@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// --- iptables variant detection ---
+
+// iptablesCommand returns the command run for a binary name (iptables or ip6tables):
+// iptablesPath or ip6tablesPath if set, the name itself (looked up in PATH) otherwise.
+func iptablesCommand(bin string) string {
+	if bin == "ip6tables" && ip6tablesPath != "" {
+		return ip6tablesPath
+	}
+	if bin == "iptables" && iptablesPath != "" {
+		return iptablesPath
+	}
+	return bin
+}
+
+// iptablesVariant returns "nf_tables" or "legacy" for a command, from `<command> -V`
+// ("iptables v1.8.7 (nf_tables)"). Versions before 1.8 have only the legacy backend and
+// print no suffix.
+func iptablesVariant(command string) (string, error) {
+	output, err := runFirewallCommand("", command, "-V")
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(string(output), "nf_tables") {
+		return "nf_tables", nil
+	}
+	return "legacy", nil
+}
+
+// countSavedRules returns the number of rules `<save command>` prints, or -1 if the
+// command is missing or fails.
+func countSavedRules(saveCommand string) int {
+	if _, err := exec.LookPath(saveCommand); err != nil {
+		return -1
+	}
+	output, err := runFirewallCommand("", saveCommand)
+	if err != nil {
+		return -1
+	}
+	count := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			count++
+		}
+	}
+	return count
+}
+
+// checkIPTablesVariant logs which variant a binary's command uses and warns when the
+// legacy and nf_tables backends both hold rules: typically Docker or another tool
+// manages its chains (such as DOCKER-USER) through the other one, so our chain may be
+// hooked into tables that never see the traffic it is meant to block.
+func checkIPTablesVariant(bin string) {
+	command := iptablesCommand(bin)
+	variant, err := iptablesVariant(command)
+	if err != nil {
+		if debug {
+			log.Printf("Could not determine the %s variant: %v", command, err)
+		}
+		return
+	}
+	log.Printf("Using %s (%s backend)", command, variant)
+
+	legacy := countSavedRules(bin + "-legacy-save")
+	nft := countSavedRules(bin + "-nft-save")
+	if legacy <= 0 || nft <= 0 {
+		return
+	}
+	other := bin + "-legacy"
+	if variant == "legacy" {
+		other = bin + "-nft"
+	}
+	setting := "iptablesPath"
+	if bin == "ip6tables" {
+		setting = "ip6tablesPath"
+	}
+	log.Printf("WARNING: Both %s backends hold rules (legacy: %d, nf_tables: %d), but apacheblock uses %s (%s). "+
+		"If Docker or your firewall manager uses %s, apacheblock's chain may never see that traffic; set %s = %s in the config file to use it",
+		bin, legacy, nft, command, variant, other, setting, other)
+}
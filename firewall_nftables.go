@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// --- NFTables Implementation ---
+
+// NFTablesManager implements FirewallManager using nft commands. Blocked addresses are
+// kept in named sets (see firewall_nftables_sets.go); redirects are per-target rules.
+type NFTablesManager struct {
+	tableName   string // e.g., "inet apacheblock"
+	filterChain string // e.g., "apacheblock"
+	natChain    string // e.g., "apacheblock_nat" (nft uses prerouting hook in nat table)
+
+	mu sync.Mutex // Serializes list-then-delete sequences so rule handles stay valid
+}
+
+// runNFTCommand executes an nft command and returns its output.
+func (m *NFTablesManager) runNFTCommand(args ...string) ([]byte, error) {
+	output, err := runFirewallCommand("", "nft", args...)
+	if err != nil {
+		return output, err
+	}
+	// Only log success in debug mode
+	if debug {
+		log.Printf("Successfully ran nft command: %v", args)
+	}
+	return output, nil
+}
+
+// runNFTScript feeds a multi-line script to `nft -f -` so it is applied as one transaction.
+func (m *NFTablesManager) runNFTScript(script string) ([]byte, error) {
+	return runFirewallCommand(script, "nft", "-f", "-")
+}
+
+// natTableName returns the table holding the IPv4 redirect chain.
+func (m *NFTablesManager) natTableName() (string, error) {
+	return m.natTableForFamily("ip")
+}
+
+// natTableFor returns the table holding the redirect chain for the target's address
+// family. NAT chains are kept in separate ip and ip6 tables.
+func (m *NFTablesManager) natTableFor(target string) (string, error) {
+	return m.natTableForFamily(addrFamily(target))
+}
+
+func (m *NFTablesManager) natTableForFamily(family string) (string, error) {
+	_, tableNameOnly := m.parseTableName()
+	if tableNameOnly == "" {
+		return "", fmt.Errorf("invalid nftables table name format: %s", m.tableName)
+	}
+	return family + " " + tableNameOnly, nil
+}
+
+// addrFamily returns the nft address match keyword ("ip" or "ip6") for the target.
+func addrFamily(target string) string {
+	if isIPv6Target(target) {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// Setup creates the necessary nftables table and chains.
+func (m *NFTablesManager) Setup() error {
+	log.Println("Setting up nftables...")
+	if _, err := exec.LookPath("nft"); err != nil {
+		return fmt.Errorf("nft command not found: %v", err)
+	}
+
+	// Check permissions
+	output, err := runFirewallCommand("", "nft", "list", "tables")
+	if err != nil {
+		if strings.Contains(string(output), "Operation not permitted") || strings.Contains(strings.ToLower(string(output)), "permission denied") {
+			return fmt.Errorf("cannot run nft (permission issue?): %v, output: %s", err, string(output))
+		}
+		log.Printf("Warning: nft permission check failed, proceeding cautiously: %v", err)
+	}
+
+	natTableName, err := m.natTableName()
+	if err != nil {
+		return err
+	}
+	nat6TableName, err := m.natTableForFamily("ip6")
+	if err != nil {
+		return err
+	}
+
+	// "add" is idempotent for tables and chains, so the whole setup is one transaction
+	// that succeeds whether or not the components already exist.
+	nftCommands := fmt.Sprintf(`
+add table %s
+add chain %s %s { type filter hook input priority filter; policy accept; }
+add table %s
+add chain %s %s { type nat hook prerouting priority dstnat; policy accept; }
+add table %s
+add chain %s %s { type nat hook prerouting priority dstnat; policy accept; }
+`, m.tableName, m.tableName, m.filterChain, natTableName, natTableName, m.natChain, nat6TableName, nat6TableName, m.natChain)
+
+	if _, err := m.runNFTScript(nftCommands); err != nil {
+		return fmt.Errorf("nftables setup transaction failed: %v", err)
+	}
+
+	// Start from empty chains, like the iptables backend does, so that
+	// applyBlockList does not stack duplicate rules on every restart.
+	if err := m.Flush(); err != nil {
+		return fmt.Errorf("failed to flush existing nftables chains: %v", err)
+	}
+	if err := m.setupSets(); err != nil {
+		return err
+	}
+
+	log.Printf("NFTables setup complete: filter chain %s/%s, nat chains %s/%s and %s/%s", m.tableName, m.filterChain, natTableName, m.natChain, nat6TableName, m.natChain)
+	return nil
+}
+
+// Flush removes rules from our specific chains.
+func (m *NFTablesManager) Flush() error {
+	natTableName, err := m.natTableName()
+	if err != nil {
+		return err
+	}
+	nat6TableName, err := m.natTableForFamily("ip6")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Flushing nftables chains: %s/%s, %s/%s and %s/%s", m.tableName, m.filterChain, natTableName, m.natChain, nat6TableName, m.natChain)
+	// Flush filter chain
+	_, errFilter := m.runNFTCommand("flush", "chain", m.tableName, m.filterChain)
+	if errFilter != nil && !strings.Contains(errFilter.Error(), "No such file or directory") {
+		log.Printf("Warning: Failed to flush nft filter chain: %v", errFilter)
+	}
+	// Flush nat chains
+	_, errNat := m.runNFTCommand("flush", "chain", natTableName, m.natChain)
+	if errNat != nil && !strings.Contains(errNat.Error(), "No such file or directory") {
+		log.Printf("Warning: Failed to flush nft nat chain: %v", errNat)
+	}
+	_, errNat6 := m.runNFTCommand("flush", "chain", nat6TableName, m.natChain)
+	if errNat6 != nil && !strings.Contains(errNat6.Error(), "No such file or directory") {
+		log.Printf("Warning: Failed to flush nft ip6 nat chain: %v", errNat6)
+	}
+
+	errSets := m.flushSets()
+
+	for _, e := range []error{errFilter, errNat, errNat6, errSets} {
+		if e != nil && !strings.Contains(e.Error(), "No such file or directory") {
+			return e
+		}
+	}
+	return nil
+}
+
+// Teardown deletes our tables, which removes their chains, rules, and hooks.
+func (m *NFTablesManager) Teardown() error {
+	natTableName, err := m.natTableName()
+	if err != nil {
+		return err
+	}
+	nat6TableName, err := m.natTableForFamily("ip6")
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errors []string
+	for _, table := range []string{m.tableName, natTableName, nat6TableName} {
+		if _, err := m.runNFTCommand("delete", "table", table); err != nil {
+			if !strings.Contains(err.Error(), "No such file or directory") {
+				errors = append(errors, err.Error())
+			}
+			continue
+		}
+		log.Printf("Deleted nftables table %s", table)
+		noteRemoval("nftables table %s", table)
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("errors tearing down nftables: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// IsRulePresent checks whether any rule in our chains matches the source given in
+// iptables-style checkArgs ("-s <target>"). A "nat" table argument selects the redirect chain.
+func (m *NFTablesManager) IsRulePresent(checkArgs []string) (bool, error) {
+	var target string
+	natTable := false
+	for i, arg := range checkArgs {
+		if arg == "-s" && i+1 < len(checkArgs) {
+			target = checkArgs[i+1]
+		}
+		if arg == "-t" && i+1 < len(checkArgs) && checkArgs[i+1] == "nat" {
+			natTable = true
+		}
+	}
+	if target == "" {
+		return false, nil
+	}
+
+	tableName := m.tableName
+	chainName := m.filterChain
+	if !natTable && m.hasElement(target) {
+		return true, nil
+	}
+	if natTable {
+		natTableName, err := m.natTableFor(target)
+		if err != nil {
+			return false, err
+		}
+		tableName, chainName = natTableName, m.natChain
+	}
+
+	handles, err := m.findRuleHandles(tableName, chainName, target)
+	if err != nil {
+		return false, err
+	}
+	return len(handles) > 0, nil
+}
+
+// AddBlockRule adds the target to its set, or for targets that need their own rule adds a
+// drop, reject or rate limit rule (per the rule's action and ports, or blockScope) to the
+// filter chain, replacing any existing rule for the target. An nft limit is kept per rule, so a
+// rate-limited subnet shares one allowance rather than one per address.
+func (m *NFTablesManager) AddBlockRule(target string, opts RuleOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if usesSet(opts) {
+		return m.addElement(target, opts.Timeout)
+	}
+	m.deleteElement(target)
+
+	// Delete-then-add, mirroring the iptables backend; nft happily stores duplicates.
+	if err := m.deleteRulesByTargetLocked(m.tableName, m.filterChain, target); err != nil && debug {
+		log.Printf("Could not clear existing nft block rules for %s: %v", target, err)
+	}
+
+	rule := []string{"add", "rule", m.tableName, m.filterChain, addrFamily(target), "saddr", target}
+	if opts.scope() != "all" {
+		rule = append(rule, "tcp", "dport", "{ "+strings.Join(opts.ports(), ", ")+" }")
+	}
+	action := opts.action()
+	rule = append(append(rule, nftVerdict(action, opts.scope())...), nftCommentArgs(opts)...)
+	_, err := m.runNFTCommand(rule...)
+	if err != nil {
+		return fmt.Errorf("failed to add nft block rule for %s: %w", target, err)
+	}
+	if debug {
+		log.Printf("Ensured nftables %s rule exists for %s (scope %s)", action, target, opts.scope())
+	}
+	return nil
+}
+
+// RemoveBlockRule removes the target from its set and all block rules for it from the filter chain.
+func (m *NFTablesManager) RemoveBlockRule(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleteElement(target) {
+		log.Printf("Removed %s from nft set %s", target, m.setFor(target))
+	}
+	return m.deleteRulesByTargetLocked(m.tableName, m.filterChain, target)
+}
+
+// AddRedirectRule adds redirect rules to the nat chain, replacing any existing rules for the target.
+func (m *NFTablesManager) AddRedirectRule(target string, opts RuleOptions) error {
+	natTableName, err := m.natTableFor(target)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.deleteRulesByTargetLocked(natTableName, m.natChain, target); err != nil && debug {
+		log.Printf("Could not clear existing nft redirect rules for %s: %v", target, err)
+	}
+
+	comment := nftCommentArgs(opts)
+	var rules [][]string
+	for _, port := range opts.ports() {
+		rule := []string{"add", "rule", natTableName, m.natChain, addrFamily(target), "saddr", target,
+			"tcp", "dport", port, "redirect", "to", fmt.Sprintf(":%d", redirectPortFor(port))}
+		rules = append(rules, append(rule, comment...))
+	}
+
+	var firstErr error
+	for _, rule := range rules {
+		if _, err := m.runNFTCommand(rule...); err != nil {
+			log.Printf("Failed to add nft redirect rule (%s): %v", strings.Join(rule, " "), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if debug { // Log success only in debug
+			log.Printf("Added nftables redirect rule: %s", strings.Join(rule, " "))
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to add nft redirect rule(s) for %s: %w", target, firstErr)
+	}
+	log.Printf("Ensured nftables redirect rules are present for %s (%s)", target, describeRedirects(opts.ports()))
+	return nil
+}
+
+// RemoveRedirectRule removes all redirect rules for the target from the nat chain.
+func (m *NFTablesManager) RemoveRedirectRule(target string) error {
+	natTableName, err := m.natTableFor(target)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteRulesByTargetLocked(natTableName, m.natChain, target)
+}
+
+// nftMaxComment is the longest rule comment nft accepts.
+const nftMaxComment = 128
+
+// nftCommentArgs returns the comment statement recording why and when a rule was added.
+// nft joins its arguments and parses them, so the text has to be quoted.
+func nftCommentArgs(opts RuleOptions) []string {
+	return []string{"comment", `"` + ruleComment(opts, nftMaxComment) + `"`}
+}
+
+// parseTableName splits "family name" into parts.
+func (m *NFTablesManager) parseTableName() (string, string) {
+	parts := strings.Fields(m.tableName)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", "" // Invalid format
+}
+
+var (
+	nftHandleRe = regexp.MustCompile(`# handle (\d+)`)
+	nftSaddrRe  = regexp.MustCompile(`saddr ([0-9a-fA-F:.]+(?:/\d+)?)`) // Skips "saddr @set" matches
+)
+
+// findRuleHandles returns the handles of rules in the chain whose source match is exactly target.
+func (m *NFTablesManager) findRuleHandles(tableName, chainName, target string) ([]string, error) {
+	output, err := m.runNFTCommand("-a", "list", "chain", tableName, chainName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chain %s %s: %w", tableName, chainName, err)
+	}
+
+	// Match the whole address token so 1.2.3.4 does not also select 1.2.3.45
+	saddrRe := regexp.MustCompile(`saddr ` + regexp.QuoteMeta(target) + `(\s|$)`)
+
+	var handles []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !saddrRe.MatchString(line) {
+			continue
+		}
+		if matches := nftHandleRe.FindStringSubmatch(line); len(matches) == 2 {
+			handles = append(handles, matches[1])
+		}
+	}
+	return handles, nil
+}
+
+// deleteRulesByTargetLocked deletes every rule for target from the chain. Caller holds m.mu.
+func (m *NFTablesManager) deleteRulesByTargetLocked(tableName, chainName, target string) error {
+	handles, err := m.findRuleHandles(tableName, chainName, target)
+	if err != nil {
+		return err
+	}
+
+	if len(handles) == 0 {
+		if debug {
+			log.Printf("No nft rules found for target %s in %s %s", target, tableName, chainName)
+		}
+		return nil
+	}
+
+	var errors []string
+	for _, handle := range handles {
+		if _, err := m.runNFTCommand("delete", "rule", tableName, chainName, "handle", handle); err != nil {
+			log.Printf("Warning: failed to delete nft rule handle %s: %v", handle, err)
+			errors = append(errors, err.Error())
+		} else if debug {
+			log.Printf("Deleted nft rule handle %s for target %s", handle, target)
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("errors removing nft rules for %s: %s", target, strings.Join(errors, "; "))
+	}
+
+	log.Printf("Removed %d nft rule(s) for %s in %s %s", len(handles), target, tableName, chainName)
+	return nil
+}
+
+// ListRuleTargets returns the set elements and the sources of the rules in the filter chain,
+// or the sources in both nat chains if redirect is set.
+func (m *NFTablesManager) ListRuleTargets(redirect bool) ([]string, error) {
+	chains := [][2]string{{m.tableName, m.filterChain}}
+	if redirect {
+		chains = nil
+		for _, family := range []string{"ip", "ip6"} {
+			natTableName, err := m.natTableForFamily(family)
+			if err != nil {
+				return nil, err
+			}
+			chains = append(chains, [2]string{natTableName, m.natChain})
+		}
+	}
+
+	seen := make(map[string]bool)
+	var targets []string
+	if !redirect {
+		elements, err := m.listSetTargets()
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range elements {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	for _, chain := range chains {
+		output, err := m.runNFTCommand("list", "chain", chain[0], chain[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chain %s %s: %w", chain[0], chain[1], err)
+		}
+		for _, matches := range nftSaddrRe.FindAllStringSubmatch(string(output), -1) {
+			target := hostForm(matches[1])
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// nftRate converts an iptables-style rate such as "10/min" to nft syntax ("10/minute").
+func nftRate(rate string) string {
+	count, unit, _ := strings.Cut(rate, "/")
+	switch unit {
+	case "sec":
+		unit = "second"
+	case "min":
+		unit = "minute"
+	}
+	return count + "/" + unit
+}
+
+// nftVerdict returns the statements ending a block rule for an action and scope. "with
+// tcp reset" needs a tcp match, so port-less ("all" scope) rules let nft pick the reject reply.
+func nftVerdict(action, scope string) []string {
+	switch {
+	case action == "ratelimit":
+		return []string{"ct", "state", "new", "limit", "rate", "over", nftRate(rateLimit), "drop"}
+	case action == "reject" && scope != "all":
+		return []string{"reject", "with", "tcp", "reset"}
+	case action == "reject":
+		return []string{"reject"}
+	default:
+		return []string{"drop"}
+	}
+}
+
+// CheckChain reports whether our filter chain (or its table) has been deleted.
+func (m *NFTablesManager) CheckChain() error {
+	if _, err := m.runNFTCommand("list", "chain", m.tableName, m.filterChain); err != nil && isMissingChainError(err) {
+		return fmt.Errorf("nftables chain %s %s no longer exists", m.tableName, m.filterChain)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// --- NFTables named sets ---
+
+// Block rules are kept as elements of four named sets in the filter table (addresses and
+// subnets, per family), matched by a fixed handful of rules. Elements may carry a timeout
+// so automatic blocks (blockDuration) expire in the kernel. Targets whose action differs
+// from blockAction or that have their own ports, and every target when blockAction is
+// "ratelimit" (an nft limit is shared by every address a rule matches), still get a rule
+// of their own.
+
+// nftSetSpec describes one of the managed sets.
+type nftSetSpec struct {
+	name, addrType, family string
+	interval               bool
+}
+
+// sets returns the managed sets, named after the filter chain.
+func (m *NFTablesManager) sets() []nftSetSpec {
+	return []nftSetSpec{
+		{m.filterChain + "_ip", "ipv4_addr", "ip", false},
+		{m.filterChain + "_net", "ipv4_addr", "ip", true},
+		{m.filterChain + "_ip6", "ipv6_addr", "ip6", false},
+		{m.filterChain + "_net6", "ipv6_addr", "ip6", true},
+	}
+}
+
+// setFor returns the set a target belongs in.
+func (m *NFTablesManager) setFor(target string) string {
+	name := m.filterChain + "_ip"
+	if strings.Contains(hostForm(target), "/") {
+		name = m.filterChain + "_net"
+	}
+	if isIPv6Target(target) {
+		name += "6"
+	}
+	return name
+}
+
+// usesSet reports whether a block rule with these options is stored as a set element.
+func usesSet(opts RuleOptions) bool {
+	return blockAction != "ratelimit" && opts.action() == blockAction && len(opts.Ports) == 0
+}
+
+// nftElement formats a set element, with a timeout if one is given. The timeout is
+// rounded up to whole seconds, as a "timeout 0s" element would never expire.
+func nftElement(target string, timeout time.Duration) string {
+	if timeout > 0 {
+		seconds := int64((timeout + time.Second - 1) / time.Second)
+		return fmt.Sprintf("%s timeout %ds", hostForm(target), seconds)
+	}
+	return hostForm(target)
+}
+
+// setupSets creates the sets if needed, empties them, and appends the rules matching them.
+// The filter chain must already be empty.
+func (m *NFTablesManager) setupSets() error {
+	var script strings.Builder
+	for _, set := range m.sets() {
+		flags := "timeout"
+		if set.interval {
+			flags = "interval, timeout"
+		}
+		fmt.Fprintf(&script, "add set %s %s { type %s; flags %s; }\n", m.tableName, set.name, set.addrType, flags)
+		fmt.Fprintf(&script, "flush set %s %s\n", m.tableName, set.name)
+	}
+	if blockAction != "ratelimit" {
+		match := ""
+		if blockScope != "all" {
+			match = " tcp dport { " + strings.Join(blockPorts, ", ") + " }"
+		}
+		verdict := strings.Join(nftVerdict(blockAction, blockScope), " ")
+		for _, set := range m.sets() {
+			fmt.Fprintf(&script, "add rule %s %s %s saddr @%s%s %s\n", m.tableName, m.filterChain, set.family, set.name, match, verdict)
+		}
+	}
+	if _, err := m.runNFTScript(script.String()); err != nil {
+		return fmt.Errorf("failed to set up nftables sets: %v", err)
+	}
+	if debug {
+		log.Printf("Using nftables sets %s_ip, %s_net, %s_ip6 and %s_net6 for blocked addresses",
+			m.filterChain, m.filterChain, m.filterChain, m.filterChain)
+	}
+	return nil
+}
+
+// flushSets empties the sets, ignoring sets that do not exist yet.
+func (m *NFTablesManager) flushSets() error {
+	var firstErr error
+	for _, set := range m.sets() {
+		if _, err := m.runNFTCommand("flush", "set", m.tableName, set.name); err != nil {
+			if strings.Contains(err.Error(), "No such file or directory") {
+				continue
+			}
+			log.Printf("Warning: Failed to flush nft set %s: %v", set.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// addElement adds the target to its set, replacing an existing element so a new timeout applies.
+func (m *NFTablesManager) addElement(target string, timeout time.Duration) error {
+	m.deleteElement(target)
+	element := "{ " + nftElement(target, timeout) + " }"
+	if _, err := m.runNFTCommand("add", "element", m.tableName, m.setFor(target), element); err != nil {
+		return fmt.Errorf("failed to add %s to nft set: %w", target, err)
+	}
+	if debug {
+		log.Printf("Added %s to nft set %s (timeout %v)", target, m.setFor(target), timeout)
+	}
+	return nil
+}
+
+// deleteElement removes the target from its set, reporting whether it was there.
+func (m *NFTablesManager) deleteElement(target string) bool {
+	_, err := m.runNFTCommand("delete", "element", m.tableName, m.setFor(target), "{ "+hostForm(target)+" }")
+	return err == nil
+}
+
+// hasElement reports whether the target is in its set.
+func (m *NFTablesManager) hasElement(target string) bool {
+	_, err := m.runNFTCommand("get", "element", m.tableName, m.setFor(target), "{ "+hostForm(target)+" }")
+	return err == nil
+}
+
+// listSetTargets returns the elements of all sets. Elements whose timeout has run out
+// are no longer listed.
+func (m *NFTablesManager) listSetTargets() ([]string, error) {
+	var targets []string
+	for _, set := range m.sets() {
+		output, err := m.runNFTCommand("list", "set", m.tableName, set.name)
+		if err != nil {
+			return nil, err
+		}
+		text := string(output)
+		start := strings.Index(text, "elements = {")
+		if start < 0 {
+			continue
+		}
+		text = text[start+len("elements = {"):]
+		if end := strings.Index(text, "}"); end >= 0 {
+			text = text[:end]
+		}
+		for _, element := range strings.Split(text, ",") {
+			if fields := strings.Fields(element); len(fields) > 0 {
+				targets = append(targets, hostForm(fields[0]))
+			}
+		}
+	}
+	return targets, nil
+}
+
+// ApplyBlockRules reloads the sets in one nft transaction. Elements get the remaining
+// time of their block as timeout; targets that need their own rule are added one by one.
+func (m *NFTablesManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	start := time.Now()
+	var script strings.Builder
+	for _, set := range m.sets() {
+		fmt.Fprintf(&script, "flush set %s %s\n", m.tableName, set.name)
+	}
+	var ruleTargets []string
+	for _, target := range targets {
+		if !usesSet(opts[target]) {
+			ruleTargets = append(ruleTargets, target)
+			continue
+		}
+		fmt.Fprintf(&script, "add element %s %s { %s }\n", m.tableName, m.setFor(target), nftElement(target, opts[target].Timeout))
+	}
+	if _, err := m.runNFTScript(script.String()); err != nil {
+		return fmt.Errorf("failed to restore nft sets: %v", err)
+	}
+	for _, target := range ruleTargets {
+		if err := m.AddBlockRule(target, opts[target]); err != nil {
+			log.Printf("Failed to apply firewall rule for %s: %v", target, err)
+		}
+	}
+
+	if debug {
+		log.Printf("Restored %d entries into nft sets in %v", len(targets)-len(ruleTargets), time.Since(start))
+	}
+	return nil
+}
+
+// ExpiredTargets returns the targets whose block has expired and that are no longer in
+// the firewall, as their set element timed out in the kernel. A target missing before its
+// expiry was removed behind our back, which is for the reconcile task to repair.
+func (m *NFTablesManager) ExpiredTargets(targets []string) ([]string, error) {
+	installed, err := m.ListRuleTargets(challengeEnable)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(installed))
+	for _, target := range installed {
+		present[target] = true
+	}
+	now := time.Now()
+	var expired []string
+	mu.Lock()
+	for _, target := range targets {
+		expiry, ok := blockedExpiry[target]
+		if ok && !now.Before(expiry) && !present[hostForm(target)] {
+			expired = append(expired, target)
+		}
+	}
+	mu.Unlock()
+	return expired, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNFTElementTimeout checks that element timeouts are rounded up to whole seconds, so a
+// block with less than a second left still expires.
+func TestNFTElementTimeout(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{0, "192.0.2.1"},
+		{time.Millisecond, "192.0.2.1 timeout 1s"},
+		{time.Second, "192.0.2.1 timeout 1s"},
+		{1500 * time.Millisecond, "192.0.2.1 timeout 2s"},
+		{time.Hour, "192.0.2.1 timeout 3600s"},
+	}
+	for _, test := range tests {
+		if got := nftElement("192.0.2.1", test.timeout); got != test.want {
+			t.Errorf("nftElement(%v) = %q, want %q", test.timeout, got, test.want)
+		}
+	}
+}
+
+// TestRemainingTimeout checks that a block at or past its expiry still gets a timeout.
+func TestRemainingTimeout(t *testing.T) {
+	for _, expiry := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(-1500 * time.Millisecond), time.Now()} {
+		if got := remainingTimeout(expiry); got != time.Second {
+			t.Errorf("remainingTimeout(%v from now) = %v, want 1s", time.Until(expiry).Round(time.Second), got)
+		}
+	}
+	if got := remainingTimeout(time.Now().Add(time.Hour)); got <= 59*time.Minute || got > time.Hour {
+		t.Errorf("remainingTimeout(1h from now) = %v", got)
+	}
+}
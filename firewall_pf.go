@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// --- pf Implementation ---
+
+// PFManager implements FirewallManager for pf (FreeBSD, OpenBSD) by maintaining two pf
+// tables: blocked targets, and targets whose web traffic is redirected to the challenge
+// server. It never edits the ruleset; the admin loads the rules that use the tables once,
+// for example in /etc/pf.conf:
+//
+//	table <apacheblock> persist
+//	table <apacheblock_challenge> persist
+//	rdr pass on $ext_if proto tcp from <apacheblock_challenge> to any port 80 -> 127.0.0.1 port 8088
+//	rdr pass on $ext_if proto tcp from <apacheblock_challenge> to any port 443 -> 127.0.0.1 port 4443
+//	block drop in quick from <apacheblock>
+//
+// Whether blocked traffic is dropped or rejected, and which ports are covered, is up to
+// those rules, so blockAction, blockScope, and per-rule actions do not apply.
+type PFManager struct {
+	table          string // Block table, e.g. "apacheblock"
+	challengeTable string // Redirect table, e.g. "apacheblock_challenge"
+
+	warnOnce sync.Once
+}
+
+// pfMaxTableName is the longest table name pf accepts (PF_TABLE_NAME_SIZE - 1).
+const pfMaxTableName = 31
+
+// newPFManager returns a manager for the tables named after the firewall chain.
+func newPFManager(chainName string) *PFManager {
+	return &PFManager{table: chainName, challengeTable: chainName + "_challenge"}
+}
+
+// runPfctl runs pfctl on one table with the given -T command and arguments.
+func (m *PFManager) runPfctl(table, command string, args ...string) ([]byte, error) {
+	return runFirewallCommand("", "pfctl", append([]string{"-t", table, "-T", command}, args...)...)
+}
+
+// tableFor returns the challenge table if redirect is set, the block table otherwise.
+func (m *PFManager) tableFor(redirect bool) string {
+	if redirect {
+		return m.challengeTable
+	}
+	return m.table
+}
+
+// Setup checks that pfctl is usable and empties both tables.
+func (m *PFManager) Setup() error {
+	log.Println("Setting up pf...")
+	if _, err := exec.LookPath("pfctl"); err != nil {
+		return fmt.Errorf("pfctl command not found, firewallType = pf needs a host running pf: %v", err)
+	}
+	if len(m.challengeTable) > pfMaxTableName {
+		return fmt.Errorf("pf table name %s is longer than %d characters, choose a shorter firewallChain", m.challengeTable, pfMaxTableName)
+	}
+	output, err := runFirewallCommand("", "pfctl", "-s", "info")
+	if err != nil {
+		return fmt.Errorf("cannot run pfctl (permission issue?): %v", err)
+	}
+	if strings.Contains(string(output), "Status: Disabled") {
+		log.Printf("Warning: pf is disabled (pfctl -e enables it), blocks will have no effect")
+	}
+
+	if err := m.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Using pf tables <%s> and <%s>; pf.conf must contain the rules that use them (see README)", m.table, m.challengeTable)
+	return nil
+}
+
+// addTarget adds a target to a table; pfctl creates the table if the ruleset has not.
+func (m *PFManager) addTarget(table, target string) error {
+	if _, err := m.runPfctl(table, "add", target); err != nil {
+		return fmt.Errorf("failed to add %s to pf table %s: %w", target, table, err)
+	}
+	if debug {
+		log.Printf("Added %s to pf table %s", target, table)
+	}
+	return nil
+}
+
+// deleteTarget removes a target from a table. Removing an address that is not in the
+// table, or a table that does not exist, is not an error.
+func (m *PFManager) deleteTarget(table, target string) error {
+	if _, err := m.runPfctl(table, "delete", target); err != nil {
+		if strings.Contains(err.Error(), "Table does not exist") {
+			return nil
+		}
+		return fmt.Errorf("failed to delete %s from pf table %s: %w", target, table, err)
+	}
+	if debug {
+		log.Printf("Deleted %s from pf table %s", target, table)
+	}
+	return nil
+}
+
+// AddBlockRule adds the target to the block table.
+func (m *PFManager) AddBlockRule(target string, opts RuleOptions) error {
+	if opts.action() != "drop" {
+		m.warnOnce.Do(func() {
+			log.Printf("Warning: pf blocks use the action of the pf.conf rule for <%s>, %q is not applied", m.table, opts.action())
+		})
+	}
+	return m.addTarget(m.table, target)
+}
+
+// RemoveBlockRule removes the target from the block table.
+func (m *PFManager) RemoveBlockRule(target string) error {
+	return m.deleteTarget(m.table, target)
+}
+
+// AddRedirectRule adds the target to the challenge table.
+func (m *PFManager) AddRedirectRule(target string, opts RuleOptions) error {
+	return m.addTarget(m.challengeTable, target)
+}
+
+// RemoveRedirectRule removes the target from the challenge table.
+func (m *PFManager) RemoveRedirectRule(target string) error {
+	return m.deleteTarget(m.challengeTable, target)
+}
+
+// Flush empties both tables.
+func (m *PFManager) Flush() error {
+	var errors []string
+	for _, table := range []string{m.table, m.challengeTable} {
+		if _, err := m.runPfctl(table, "flush"); err != nil {
+			if strings.Contains(err.Error(), "Table does not exist") {
+				continue
+			}
+			errors = append(errors, err.Error())
+			continue
+		}
+		log.Printf("Flushed pf table %s", table)
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("errors flushing pf tables: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// Teardown empties both tables. The tables themselves are left in place, since the
+// pf.conf rules refer to them.
+func (m *PFManager) Teardown() error {
+	for _, redirect := range []bool{false, true} {
+		if targets, err := m.listTable(m.tableFor(redirect)); err == nil && len(targets) > 0 {
+			noteRemoval("%d entries in pf table %s", len(targets), m.tableFor(redirect))
+		}
+	}
+	return m.Flush()
+}
+
+// IsRulePresent reports whether the "-s" target in checkArgs is in a table: the challenge
+// table for a "nat" table argument, the block table otherwise.
+func (m *PFManager) IsRulePresent(checkArgs []string) (bool, error) {
+	table, target := m.table, ""
+	for i, arg := range checkArgs {
+		if arg == "-t" && i+1 < len(checkArgs) && checkArgs[i+1] == "nat" {
+			table = m.challengeTable
+		}
+		if arg == "-s" && i+1 < len(checkArgs) {
+			target = checkArgs[i+1]
+		}
+	}
+	if target == "" {
+		return false, fmt.Errorf("no target (-s) in rule check %v", checkArgs)
+	}
+	_, err := m.runPfctl(table, "test", target)
+	return err == nil, nil
+}
+
+// listTable returns the addresses in a table.
+func (m *PFManager) listTable(table string) ([]string, error) {
+	output, err := m.runPfctl(table, "show")
+	if err != nil {
+		if strings.Contains(err.Error(), "Table does not exist") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var targets []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			targets = append(targets, hostForm(fields[0]))
+		}
+	}
+	return targets, nil
+}
+
+// ListRuleTargets returns the addresses in the block table, or the challenge table if redirect is set.
+func (m *PFManager) ListRuleTargets(redirect bool) ([]string, error) {
+	return m.listTable(m.tableFor(redirect))
+}
+
+// ApplyBlockRules replaces the block table's contents with targets in one pfctl run.
+func (m *PFManager) ApplyBlockRules(targets []string, opts map[string]RuleOptions) error {
+	stdin := strings.Join(targets, "\n") + "\n"
+	if _, err := runFirewallCommand(stdin, "pfctl", "-t", m.table, "-T", "replace", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to load pf table %s: %v", m.table, err)
+	}
+	if debug {
+		log.Printf("Loaded %d entries into pf table %s", len(targets), m.table)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// --- GeoIP countries ---
+
+// With geoipDBPath set to a MaxMind GeoLite2 (or GeoIP2) Country or City database, rules
+// can be limited to clients from some countries ("countries") or from every country but
+// some ("excludeCountries"), and the country of blocked IPs is added to the audit log and
+// to the list and check output. The MaxMind databases (this one and the ASN one) are
+// opened on first use and reopened when the file changes, which is looked at once a
+// minute, so geoipupdate can replace them in place. A database that is missing,
+// unreadable or older than geoipMaxAge is treated as absent: a warning is logged, rules
+// on it do not match, and what it would add is left out. Countries are the ISO 3166-1
+// alpha-2 codes of the database, e.g. "DE".
+
+// geoipMaxAge is the age of a database beyond which it counts as stale.
+const geoipMaxAge = 90 * 24 * time.Hour
+
+// geoipCheckInterval is how often the database file is looked at for changes.
+const geoipCheckInterval = time.Minute
+
+// mmdbFile is a MaxMind database file, opened on first use and reopened when it changes.
+type mmdbFile struct {
+	name string  // For messages, e.g. "GeoIP"
+	path *string // Config setting of the path; empty disables the database
+
+	mu         sync.Mutex // Guards the state below
+	reader     *maxminddb.Reader
+	modTime    time.Time // Modification time of the file reader was opened from
+	checked    time.Time // When the file was last looked at
+	openedPath string    // Path the state is for, so a reload to another path reopens
+}
+
+var (
+	geoipDBPath = "" // MaxMind database of the countries of addresses; empty disables GeoIP
+
+	geoipDB = &mmdbFile{name: "GeoIP", path: &geoipDBPath}
+)
+
+// geoipRecord is what is read of a database entry.
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// readerLocked returns the database reader, opening or reopening the database if the
+// file changed, or nil if there is no usable database. The caller must hold f.mu.
+func (f *mmdbFile) readerLocked(now time.Time) *maxminddb.Reader {
+	path := *f.path
+	if path == "" {
+		return nil
+	}
+	known := f.openedPath == path
+	if known && now.Sub(f.checked) < geoipCheckInterval {
+		return f.reader
+	}
+	f.checked = now
+	info, err := os.Stat(path)
+	if err == nil && known && info.ModTime().Equal(f.modTime) {
+		return f.reader
+	}
+	if err != nil && known && f.modTime.IsZero() {
+		return nil // Still missing, as already logged
+	}
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+	f.openedPath = path
+	if err != nil {
+		f.modTime = time.Time{}
+		log.Printf("Warning: %s database unavailable, rules on it will not match: %v", f.name, err)
+		return nil
+	}
+	f.modTime = info.ModTime()
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		log.Printf("Warning: Failed to open %s database %s, rules on it will not match: %v", f.name, path, err)
+		return nil
+	}
+	built := time.Unix(int64(reader.Metadata.BuildEpoch), 0)
+	if now.Sub(built) > geoipMaxAge {
+		log.Printf("Warning: %s database %s was built %s and is stale, rules on it will not match", f.name, path, built.Format("2006-01-02"))
+		reader.Close()
+		return nil
+	}
+	if debug {
+		log.Printf("Opened %s database %s (%s, built %s)", f.name, path, reader.Metadata.DatabaseType, built.Format("2006-01-02"))
+	}
+	f.reader = reader
+	return reader
+}
+
+// lookup decodes the entry of ip into record, returning the network of the entry (nil if
+// there is none) and false if there is no usable database.
+func (f *mmdbFile) lookup(ip string, record any) (*net.IPNet, bool) {
+	address := net.ParseIP(hostForm(ip))
+	if address == nil {
+		return nil, *f.path != ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reader := f.readerLocked(time.Now())
+	if reader == nil {
+		return nil, false
+	}
+	network, found, err := reader.LookupNetwork(address, record)
+	if err != nil {
+		if debug {
+			log.Printf("%s lookup of %s failed: %v", f.name, ip, err)
+		}
+		return nil, true
+	}
+	if !found {
+		return nil, true
+	}
+	return network, true
+}
+
+// countryOf returns the country code of ip, and false if there is no usable database.
+// The code is "" for an address the database does not know.
+func countryOf(ip string) (string, bool) {
+	var record geoipRecord
+	_, ok := geoipDB.lookup(ip, &record)
+	return record.Country.ISOCode, ok
+}
+
+// ipCountry returns the country code of an IP target, or "" if it is a subnet or its
+// country is unknown.
+func ipCountry(target string) string {
+	if strings.Contains(target, "/") || geoipDBPath == "" {
+		return ""
+	}
+	country, _ := countryOf(target)
+	return country
+}
+
+// normalizeCountries upper-cases the country codes of a rule.
+func normalizeCountries(countries []string) []string {
+	for i, country := range countries {
+		countries[i] = strings.ToUpper(strings.TrimSpace(country))
+	}
+	return countries
+}
+
+// hasCountries reports whether the rule is limited by country.
+func (r *Rule) hasCountries() bool {
+	return len(r.Countries) > 0 || len(r.ExcludeCountries) > 0
+}
+
+// matchesClient reports whether the client ip, extracted from line in format, is from a
+// country and a network (ASN) the rule applies to. The address of a trusted proxy's
+// client is the one that counts.
+func (r *Rule) matchesClient(ip, line, format string, trace *lineTrace) bool {
+	if !r.hasCountries() && len(r.ASNs) == 0 {
+		return true
+	}
+	client, ok := realClientIP(ip, line, format, nil)
+	if !ok {
+		return false
+	}
+	return r.matchesCountry(client, trace) && r.matchesASN(client, trace)
+}
+
+// matchesCountry reports whether client is from a country the rule applies to. A rule
+// limited by country never matches without a usable database, and a rule with countries
+// never matches an address of unknown country.
+func (r *Rule) matchesCountry(client string, trace *lineTrace) bool {
+	if !r.hasCountries() {
+		return true
+	}
+	country, ok := countryOf(client)
+	if !ok {
+		trace.printf("Rule %s did not match (no GeoIP database for its countries)", r.Name)
+		return false
+	}
+	if len(r.Countries) > 0 && !slices.Contains(r.Countries, country) {
+		trace.printf("Rule %s did not match (country %q of %s not in its countries)", r.Name, country, client)
+		return false
+	}
+	if slices.Contains(r.ExcludeCountries, country) {
+		trace.printf("Rule %s did not match (country %q of %s excluded)", r.Name, country, client)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// --- Honeypot paths ---
+
+// Nobody legitimate requests /.env or /wp-config.php.bak, so a rule with "instantBlock":
+// true blocks the client on its first match, with the rule name as the reason, instead
+// of counting it toward a threshold (as if the threshold were 1, which overrides do not
+// change). "paths" lists exact request paths and stands in for the regex: it becomes a
+// regex on the request line of apache, apache-vhost and nginx lines, a uriRegex for
+// caddy rules, and both for rules on all formats. The query string does not count, so
+// "/.env?x=1" is "/.env". A line counts for the first rule it matches, so an instant
+// rule needs a priority above the broad rules that would otherwise take its lines.
+
+// compilePaths sets the regex (or uriRegex) of a rule with paths, returning false if the
+// rule's format has no request line to match them on.
+func compilePaths(rule *Rule) bool {
+	alternatives := make([]string, 0, len(rule.Paths))
+	for _, path := range rule.Paths {
+		alternatives = append(alternatives, regexp.QuoteMeta(strings.TrimSpace(path)))
+	}
+	paths := "(?:" + strings.Join(alternatives, "|") + ")"
+	requestLine := ruleIPPattern + ` .* "[A-Z]+ ` + paths + `(?:\?[^\s"]*)?(?: HTTP/[\d\.]+)?" .*`
+	caddyURI := `"uri":"` + paths + `(?:\?[^"]*)?"`
+
+	if rule.Regex != "" || rule.URIRegex != "" {
+		rule.warnf("Rule %s (%s) has paths, which replace its regex and uriRegex", rule.Name, rule.source)
+	}
+	switch rule.LogFormat {
+	case "apache", "apache-vhost", "nginx":
+		rule.Regex, rule.URIRegex = requestLine, ""
+	case "caddy":
+		rule.Regex, rule.URIRegex = "", "^"+paths+`(?:\?|$)`
+	case "all":
+		rule.Regex, rule.URIRegex = requestLine+"|"+caddyURI, ""
+	default:
+		rule.warnf("Rule %s (%s) has paths, which only apply to the apache, apache-vhost, nginx and caddy formats", rule.Name, rule.source)
+		return false
+	}
+	return true
+}
+
+// instantMatch returns the match of found by an instant block rule, with the rule name as
+// its reason, and false if there is none.
+func instantMatch(found []ruleMatch) (ruleMatch, bool) {
+	for _, match := range found {
+		if rule := ruleNamed(match.rule); rule != nil && rule.InstantBlock {
+			return ruleMatch{ip: match.ip, reason: match.rule, rule: match.rule}, true
+		}
+	}
+	return ruleMatch{}, false
+}
@@ -20,24 +20,27 @@ func readIgnoreFilesFile(filePath string) error {
 	}
 	defer f.Close()
 
-	ignoredFilesMu.Lock()
-	defer ignoredFilesMu.Unlock()
-
+	// Build a new set, so a reload drops the entries removed from the file
+	loaded := make(map[string]bool)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		ignoredFiles[line] = true
+		loaded[line] = true
 	}
 
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("error reading ignore files list: %v", err)
 	}
 
+	ignoredFilesMu.Lock()
+	ignoredFiles = loaded
+	ignoredFilesMu.Unlock()
+
 	if debug {
-		log.Printf("Loaded %d ignored file patterns from %s", len(ignoredFiles), filePath)
+		log.Printf("Loaded %d ignored file patterns from %s", len(loaded), filePath)
 	}
 	return nil
 }
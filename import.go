@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Importing blocks ---
+
+// -importFile and -importFail2ban carry blocks over from other tools. The client collects the
+// entries and hands them to the running server, or applies them itself if none is running.
+// Entries already blocked are left alone; whitelisted ones are skipped. Imported entries are
+// local blocks, so they are passed on to the peers.
+
+// parseImportFile reads a plain list of IPs and CIDR ranges, one per line. Text after a #
+// is the entry's reason; lines holding only a comment are skipped.
+func parseImportFile(path string) ([]BlockEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var entries []BlockEntry
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		address, reason, _ := strings.Cut(scanner.Text(), "#")
+		address, reason = strings.TrimSpace(address), strings.TrimSpace(reason)
+		if address == "" {
+			continue
+		}
+		if !isValidIPOrCIDR(address) {
+			log.Printf("Warning: Skipping invalid address %q on line %d of %s", address, lineNum, path)
+			continue
+		}
+		if reason == "" {
+			reason = "imported from " + path
+		}
+		entries = append(entries, BlockEntry{Address: address, Reason: reason})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// importBlockEntries blocks imported entries that are not blocked yet and saves the
+// blocklist. label ("fail2ban jails sshd") names the import in the log and the result;
+// source ("socket" or "cli") goes into the audit log. It returns a summary for the client.
+func importBlockEntries(entries []BlockEntry, label, source string) (string, error) {
+	now := time.Now()
+	add := make(map[string]BlockEntry, len(entries))
+	for _, entry := range entries {
+		if !isValidIPOrCIDR(entry.Address) {
+			continue
+		}
+		target := normalizeTarget(entry.Address)
+		if _, dup := add[target]; dup {
+			continue
+		}
+		entry.Address, entry.Type = target, entryType(target)
+		if entry.BlockedAt == nil {
+			entry.BlockedAt = &now
+		}
+		if entry.FirstSeen == nil {
+			entry.FirstSeen = entry.BlockedAt
+		}
+		add[target] = entry
+	}
+	if len(add) == 0 {
+		return "", fmt.Errorf("no valid entries to import from %s", label)
+	}
+
+	mu.Lock()
+	before := make(map[string]bool, len(add))
+	for target := range add {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		before[target] = isIP || isSubnet
+	}
+	mu.Unlock()
+
+	changes := applyBlockListChanges(add, nil, "importing "+label)
+	if err := saveBlockList(); err != nil {
+		log.Printf("Warning: Failed to save blocklist after importing %s: %v", label, err)
+	}
+
+	for target, entry := range add {
+		mu.Lock()
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		mu.Unlock()
+		if (isIP || isSubnet) && !before[target] {
+			publishPeerBlock(target)
+			writeAudit(auditRecord{Action: "block", Target: target, Reason: entry.Reason, Source: source})
+		}
+	}
+
+	result := fmt.Sprintf("Imported %s: %d entries, %d blocked", label, len(add), changes.blocked)
+	if skipped := len(add) - changes.blocked - changes.whitelisted - changes.addFailed; skipped > 0 {
+		result += fmt.Sprintf(", %d already blocked or expired", skipped)
+	}
+	if changes.whitelisted > 0 {
+		result += fmt.Sprintf(", %d whitelisted skipped", changes.whitelisted)
+	}
+	if changes.addFailed > 0 {
+		result += fmt.Sprintf(", %d failed (see the server log)", changes.addFailed)
+	}
+	log.Println(result)
+	return result, nil
+}
+
+// requestImport hands imported entries to a running server. An error means the server
+// could not be reached; a failed import is reported in the response.
+func requestImport(entries []BlockEntry, label string) (*Message, error) {
+	conn, err := dialServer()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	msg := Message{Command: string(ImportCommand), Target: label, Entries: entries, APIKey: apiKey}
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return nil, fmt.Errorf("failed to send command: %v", err)
+	}
+	var response Message
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return &response, nil
+}
+
+// runImport imports entries through the running server, or directly if none is running.
+func runImport(entries []BlockEntry, label string) error {
+	response, err := requestImport(entries, label)
+	if err == nil {
+		fmt.Println(response.Result)
+		if !response.Success {
+			return fmt.Errorf("import failed")
+		}
+		return nil
+	}
+	log.Printf("Could not connect to server: %v", err)
+	log.Printf("Executing command directly")
+	if err := InitFirewallManager(); err != nil {
+		return fmt.Errorf("failed to initialize firewall manager: %v", err)
+	}
+	if err := loadBlockList(); err != nil {
+		log.Printf("Warning: Failed to load blocklist: %v", err)
+	}
+	if err := readWhitelistFile(whitelistFilePath); err != nil {
+		log.Printf("Warning: Failed to read whitelist: %v", err)
+	}
+	result, err := importBlockEntries(entries, label, "cli")
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
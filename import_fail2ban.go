@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fail2ban's bans are read from fail2ban-client, or from its database when the client is
+// not installed or fail2ban is not running. Each ban becomes an entry whose reason names
+// the jail. fail2ban-client does not report when a ban ends, so those entries are
+// permanent; bans read from the database keep their remaining ban time.
+
+// fail2banBans returns the current bans of the given jails, or of every jail if jails is
+// empty, with dbPath as the fallback.
+func fail2banBans(jails []string, dbPath string) ([]BlockEntry, error) {
+	entries, err := fail2banClientBans(jails)
+	if err == nil {
+		return entries, nil
+	}
+	log.Printf("Could not query fail2ban-client (%v), reading %s instead", err, dbPath)
+	return fail2banDBBans(jails, dbPath)
+}
+
+// runFail2banClient runs fail2ban-client with args and returns its output.
+func runFail2banClient(args ...string) (string, error) {
+	output, err := exec.Command("fail2ban-client", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("fail2ban-client %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// fail2banStatusField returns the value of a field of fail2ban-client status output,
+// e.g. "sshd, apache-auth" for "`- Jail list:\tsshd, apache-auth".
+func fail2banStatusField(output, field string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		if _, value, found := strings.Cut(line, field+":"); found {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// fail2banClientBans asks fail2ban-client for the banned IPs of each jail.
+func fail2banClientBans(jails []string) ([]BlockEntry, error) {
+	if _, err := exec.LookPath("fail2ban-client"); err != nil {
+		return nil, err
+	}
+	if len(jails) == 0 {
+		output, err := runFail2banClient("status")
+		if err != nil {
+			return nil, err
+		}
+		list, ok := fail2banStatusField(output, "Jail list")
+		if !ok {
+			return nil, fmt.Errorf("no jail list in fail2ban-client status output")
+		}
+		for _, jail := range strings.Split(list, ",") {
+			if jail = strings.TrimSpace(jail); jail != "" {
+				jails = append(jails, jail)
+			}
+		}
+	}
+
+	var entries []BlockEntry
+	for _, jail := range jails {
+		output, err := runFail2banClient("status", jail)
+		if err != nil {
+			return nil, err
+		}
+		banned, ok := fail2banStatusField(output, "Banned IP list")
+		if !ok {
+			return nil, fmt.Errorf("no banned IP list in fail2ban-client status output for jail %s", jail)
+		}
+		for _, address := range strings.Fields(banned) {
+			entries = append(entries, BlockEntry{Address: address, Reason: "fail2ban jail " + jail})
+		}
+	}
+	return entries, nil
+}
+
+// fail2banDBBans reads the bans still in force from fail2ban's database. The table keeps
+// every ban ever made, so only the latest ban of each IP per jail is considered.
+func fail2banDBBans(jails []string, dbPath string) ([]BlockEntry, error) {
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fail2ban database %s: %v", dbPath, err)
+	}
+	defer db.Close()
+
+	// bantime, in seconds (negative for permanent bans), was added in fail2ban 0.11. SQLite
+	// takes it from the row with the latest timeofban.
+	rows, err := db.Query("SELECT jail, ip, MAX(timeofban), bantime FROM bans GROUP BY jail, ip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bans from fail2ban database %s (fail2ban 0.11 or later is needed): %v", dbPath, err)
+	}
+	defer rows.Close()
+
+	wanted := make(map[string]bool, len(jails))
+	for _, jail := range jails {
+		wanted[jail] = true
+	}
+	now := time.Now()
+	var entries []BlockEntry
+	for rows.Next() {
+		var jail, ip string
+		var timeOfBan, banTime int64
+		if err := rows.Scan(&jail, &ip, &timeOfBan, &banTime); err != nil {
+			return nil, fmt.Errorf("failed to read ban from fail2ban database: %v", err)
+		}
+		if len(wanted) > 0 && !wanted[jail] {
+			continue
+		}
+		bannedAt := time.Unix(timeOfBan, 0)
+		entry := BlockEntry{Address: ip, Reason: "fail2ban jail " + jail, BlockedAt: &bannedAt}
+		if banTime >= 0 {
+			expiresAt := bannedAt.Add(time.Duration(banTime) * time.Second)
+			if !expiresAt.After(now) {
+				continue
+			}
+			entry.ExpiresAt = &expiresAt
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bans from fail2ban database: %v", err)
+	}
+	// Keep the result stable, as an IP banned in several jails is imported with the first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Reason < entries[j].Reason })
+	return entries, nil
+}
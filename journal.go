@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Reading logs from the journal ---
+
+// With logSource = journald, log lines are read from systemd-journald instead of files:
+// journalctl -f -o json follows the journal, limited to the units in journalUnit, and the
+// MESSAGE of each entry is processed like a log line in logFormat. If journalctl exits it
+// is restarted after journalRetryDelay. The cursor of the last entry read is saved to the
+// journal cursor file by the periodic save task and at shutdown, so a restart resumes
+// after it instead of rereading (or missing) entries. Without a saved cursor, the last
+// startupLines entries are read (all of them for -1, none for 0).
+
+// journalRetryDelay is how long to wait before restarting journalctl after it exits.
+const journalRetryDelay = 5 * time.Second
+
+var (
+	journalMu          sync.Mutex // Guards the cursor state below
+	journalCursor      string     // Cursor of the last entry processed
+	journalCursorSaved string     // Cursor last written to the cursor file
+)
+
+// journalEntry holds the fields of a journalctl -o json entry that are used.
+type journalEntry struct {
+	Cursor     string          `json:"__CURSOR"`
+	Message    json.RawMessage `json:"MESSAGE"`
+	Unit       string          `json:"_SYSTEMD_UNIT"`
+	Identifier string          `json:"SYSLOG_IDENTIFIER"`
+}
+
+// journalCursorPath returns the journal cursor file: journalCursorFile, or journalcursor
+// beside the blocklist.
+func journalCursorPath() string {
+	if journalCursorFile != "" {
+		return journalCursorFile
+	}
+	return filepath.Join(filepath.Dir(blocklistFilePath), "journalcursor")
+}
+
+// startJournalReader loads the saved cursor and starts following the journal.
+func startJournalReader() {
+	if data, err := os.ReadFile(journalCursorPath()); err == nil {
+		journalMu.Lock()
+		journalCursor = strings.TrimSpace(string(data))
+		journalCursorSaved = journalCursor
+		journalMu.Unlock()
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to read journal cursor file %s: %v", journalCursorPath(), err)
+	}
+
+	log.Printf("Reading logs from the journal (units: %s)", journalUnitsText())
+	go func() {
+		for {
+			err := followJournal()
+			log.Printf("Warning: journalctl exited (%v), restarting in %v", err, journalRetryDelay)
+			time.Sleep(journalRetryDelay)
+		}
+	}()
+}
+
+// journalUnits returns the units of journalUnit.
+func journalUnits() []string {
+	var units []string
+	for _, unit := range strings.Split(journalUnit, ",") {
+		if unit = strings.TrimSpace(unit); unit != "" {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+// journalUnitsText names the followed units for the log.
+func journalUnitsText() string {
+	if units := journalUnits(); len(units) > 0 {
+		return strings.Join(units, ", ")
+	}
+	return "all"
+}
+
+// journalLinesArg returns the journalctl argument reading the entries startupLines says.
+func journalLinesArg() string {
+	if startupLines < 0 {
+		return "--lines=all"
+	}
+	return "--lines=" + strconv.Itoa(startupLines)
+}
+
+// journalArgs returns the journalctl arguments to follow the journal after cursor.
+func journalArgs(cursor string) []string {
+	args := []string{"--follow", "--output=json", "--no-pager"}
+	for _, unit := range journalUnits() {
+		args = append(args, "--unit="+unit)
+	}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else if startupWindow > 0 {
+		args = append(args, "--since=@"+strconv.FormatInt(time.Now().Add(-startupWindow).Unix(), 10))
+	} else {
+		args = append(args, journalLinesArg())
+	}
+	return args
+}
+
+// followJournal runs journalctl and processes its entries until it exits.
+func followJournal() error {
+	journalMu.Lock()
+	cursor := journalCursor
+	journalMu.Unlock()
+
+	cmd := exec.Command("journalctl", journalArgs(cursor)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to set up journalctl output: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start journalctl: %v", err)
+	}
+	if debug {
+		log.Printf("Started journalctl %s", strings.Join(journalArgs(cursor), " "))
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			if verbose {
+				log.Printf("Skipping unparsable journal entry: %v", err)
+			}
+			continue
+		}
+		if message := journalMessage(entry.Message); message != "" {
+			source := "journal:" + entry.Unit
+			if entry.Unit == "" {
+				source = "journal:" + entry.Identifier
+			}
+			enqueueLogEntry(strings.TrimSpace(message), source, logFormat, nil)
+		}
+		journalMu.Lock()
+		journalCursor = entry.Cursor
+		journalMu.Unlock()
+	}
+
+	err = cmd.Wait()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+	return err
+}
+
+// journalMessage decodes a MESSAGE field, which journalctl writes as a string, or as an
+// array of bytes if it is not valid UTF-8.
+func journalMessage(raw json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil {
+		return message
+	}
+	var data []byte
+	var values []int
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return ""
+	}
+	for _, value := range values {
+		data = append(data, byte(value))
+	}
+	return string(data)
+}
+
+// saveJournalCursor writes the cursor of the last entry processed to the journal cursor
+// file, if it changed since the last save.
+func saveJournalCursor() error {
+	journalMu.Lock()
+	cursor, saved := journalCursor, journalCursorSaved
+	journalMu.Unlock()
+	if logSource != "journald" || cursor == "" || cursor == saved {
+		return nil
+	}
+	if err := writeFileAtomic(journalCursorPath(), []byte(cursor+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write journal cursor file: %v", err)
+	}
+	journalMu.Lock()
+	journalCursorSaved = cursor
+	journalMu.Unlock()
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Pathological log lines ---
+
+// An application writing multi-megabyte blobs into an access log would have every reader
+// buffer them in full and the rules' regexes scan them. Log files, rotated files and
+// standard input are read maxLineLength bytes of a line at most (default 64 KB): the
+// rest of the line is read and discarded, and the truncated line processed. Lines
+// holding NUL bytes are binary data and skipped, as are caddy lines of maxLineLength
+// bytes or more, which are truncated or too big to be worth decoding. -status counts
+// both.
+
+var (
+	truncatedLines atomic.Int64 // Lines cut to maxLineLength
+	skippedLines   atomic.Int64 // Binary and oversized JSON lines skipped
+)
+
+// readLogLine reads a line like reader.ReadString('\n'), keeping at most maxLineLength
+// bytes of it; source names the log for the warning about the first truncated line.
+func readLogLine(reader *bufio.Reader, source string) (string, error) {
+	var line []byte
+	truncated := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if room := maxLineLength - len(line); maxLineLength > 0 && len(chunk) > room {
+			line = append(line, chunk[:room]...)
+			truncated = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if truncated {
+			if truncatedLines.Add(1) == 1 || verbose {
+				log.Printf("Warning: Truncated a line of %s longer than maxLineLength (%d bytes)", source, maxLineLength)
+			}
+		}
+		return string(line), err
+	}
+}
+
+// acceptLogLine reports whether a line in format is processed, counting the lines that
+// are not.
+func acceptLogLine(line, format string) bool {
+	if strings.IndexByte(line, 0) >= 0 {
+		if skippedLines.Add(1) == 1 || verbose {
+			log.Printf("Warning: Skipping a log line with NUL bytes, the log holds binary data")
+		}
+		return false
+	}
+	if format == "caddy" && maxLineLength > 0 && len(line) >= maxLineLength {
+		if skippedLines.Add(1) == 1 || verbose {
+			log.Printf("Warning: Skipping a caddy log line of %d bytes, not below maxLineLength", len(line))
+		}
+		return false
+	}
+	return true
+}
+
+// lineGuardStatus describes the truncated and skipped lines for the status command.
+func lineGuardStatus() string {
+	return fmt.Sprintf("%d truncated to %d bytes, %d binary or oversized skipped", truncatedLines.Load(), maxLineLength, skippedLines.Load())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Log directories ---
+
+// logPath may list several directories, separated by commas, e.g. for Apache's own vhost
+// logs and Froxlor's customer logs. Each of them, and the directories below it down to
+// logDepth levels, is searched for log files (see logtree.go). A directory that does not
+// exist yet is picked up by the periodic check once it appears.
+
+// logDirs returns the log directories of logpath as clean absolute paths, so the files
+// found in them are keyed the same way in fileStates whichever way logPath spells them.
+func logDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, dir := range strings.Split(logpath, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// addLogPath adds dirs, a comma-separated list, to logpath. replace starts a new list, for
+// the first logPath setting, which overrides the default.
+func addLogPath(dirs string, replace bool) {
+	if replace || logpath == "" {
+		logpath = dirs
+	} else {
+		logpath += "," + dirs
+	}
+}
+
+// scanLogDir handles the log files in dir and its subdirectories, recording them in seen.
+func scanLogDir(dir string, seen map[string]bool) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if debug {
+			log.Printf("Log directory %s does not exist yet", dir)
+		}
+		return
+	}
+	files := findLogFiles(dir)
+	if debug {
+		log.Printf("Found %d log files with suffix %s in %s", len(files), fileSuffix, dir)
+	}
+
+	for _, file := range files {
+		if !isSelectedLogFile(file) {
+			continue
+		}
+		seen[file] = true
+
+		// Check if we're already monitoring this file
+		stateMutex.Lock()
+		_, exists := fileStates[file]
+		stateMutex.Unlock()
+
+		if !exists {
+			if debug {
+				log.Printf("New log file found: %s", file)
+			} // Log new file in debug
+			handleLogFile(file)
+		} else if debug {
+			log.Printf("Already monitoring log file: %s", file)
+		} // Log already monitoring in debug
+	}
+}
+
+// findLogFiles returns the files with the log suffix in dir and the directories below it.
+func findLogFiles(dir string) []string {
+	var files []string
+	for _, subdir := range logDirTree(dir) {
+		subfiles, err := globLogFiles(subdir)
+		if err != nil {
+			log.Printf("Warning: Failed to list log files in %s: %v", subdir, err) // Keep warning
+			continue
+		}
+		files = append(files, subfiles...)
+	}
+	return files
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Log file include/exclude patterns ---
+
+// logInclude and logExclude narrow down the files with the log suffix that are monitored.
+// Both take comma-separated glob patterns matched against a file's base name and its full
+// path. With logInclude set, only files matching one of its patterns are monitored; files
+// matching a logExclude pattern never are. SIGHUP re-reads both, and the ignore files
+// list, and stops monitoring the files they now exclude.
+
+// parseLogPatterns splits a comma-separated list of glob patterns, skipping invalid ones.
+func parseLogPatterns(key, value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			log.Printf("Warning: Invalid %s pattern %q: %v", key, pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// matchesLogPattern reports whether path's base name or full path matches one of patterns.
+func matchesLogPattern(path string, patterns []string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelectedLogFile reports whether a file with the log suffix passes logInclude,
+// logExclude and the ignore files list.
+func isSelectedLogFile(path string) bool {
+	if isIgnoredFile(path) {
+		return false
+	}
+	logFilterMu.RLock()
+	defer logFilterMu.RUnlock()
+	if len(logIncludePatterns) > 0 && !matchesLogPattern(path, logIncludePatterns) {
+		return false
+	}
+	return !matchesLogPattern(path, logExcludePatterns)
+}
+
+// readLogFilterConfig reads only the logInclude and logExclude keys of the config file, so
+// they can be changed without a restart. Keys missing from the file clear their patterns.
+func readLogFilterConfig(configPath string) error {
+	file, err := os.Open(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open configuration file: %v", err)
+	}
+	defer file.Close()
+
+	var include, exclude []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found || strings.HasPrefix(key, "#") {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "logInclude":
+			include = parseLogPatterns("logInclude", strings.TrimSpace(value))
+		case "logExclude":
+			exclude = parseLogPatterns("logExclude", strings.TrimSpace(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading configuration file: %v", err)
+	}
+
+	logFilterMu.Lock()
+	logIncludePatterns, logExcludePatterns = include, exclude
+	logFilterMu.Unlock()
+	return nil
+}
+
+// reloadLogFileSelection re-reads the log file patterns and the ignore files list, stops
+// monitoring the files they exclude now, and picks up the ones they include.
+func reloadLogFileSelection(configPath string) error {
+	if err := readLogFilterConfig(configPath); err != nil {
+		return fmt.Errorf("failed to reload log file patterns: %v", err)
+	}
+	if err := readIgnoreFilesFile(ignoreFilesPath); err != nil {
+		log.Printf("Warning: Failed to reload ignore files list: %v", err)
+	}
+
+	stateMutex.Lock()
+	for path := range fileStates {
+		if !isSelectedLogFile(path) {
+			log.Printf("Log file %s is excluded now, no longer monitoring it", path)
+			stopMonitoringLocked(path)
+		}
+	}
+	stateMutex.Unlock()
+
+	processExistingLogs()
+	logFilterMu.RLock()
+	log.Printf("Reloaded log file selection: include %v, exclude %v", logIncludePatterns, logExcludePatterns)
+	logFilterMu.RUnlock()
+	return nil
+}
+
+// stopMonitoringLocked signals the goroutine reading path to stop and forgets its state;
+// the goroutine closes the file as it exits. The caller must hold stateMutex.
+func stopMonitoringLocked(path string) {
+	state, exists := fileStates[path]
+	if !exists {
+		return
+	}
+	// Removing the state from fileStates first makes sure stopChan is closed only once
+	delete(fileStates, path)
+	if state.stopChan != nil {
+		close(state.stopChan)
+	}
+}
+
+// ownsFileLocked reports whether state is the current state of path, i.e. whether its
+// goroutine is the one reading path. The caller must hold stateMutex.
+func ownsFileLocked(path string, state *FileState) bool {
+	return fileStates[path] == state
+}
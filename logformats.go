@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+// --- Custom log formats ---
+
+// Formats other than the built-in apache, nginx and caddy are defined in the log formats
+// file and selected by name with server. A format's regex picks the fields out of a line
+// with named groups: ip (required), status, path, ts and ua. Rules for a custom format
+// match those fields with their match map, e.g. {"path": "\\.php$", "status": "^40[34]$"},
+// and may still use regex on the whole line.
+
+// DefaultLogFormatsPath is the default path of the log formats file
+const DefaultLogFormatsPath = "/etc/apacheblock/logformats.json"
+
+// defaultTimestampLayout is the layout of ts when a format gives none: Apache's %t.
+const defaultTimestampLayout = "02/Jan/2006:15:04:05 -0700"
+
+// LogFormatDef defines a custom log format
+type LogFormatDef struct {
+	Name            string `json:"name"`                      // Value of server that selects the format
+	Description     string `json:"description,omitempty"`     // What logs the format reads
+	Regex           string `json:"regex"`                     // Line regex with named groups ip, status, path, ts and ua
+	TimestampLayout string `json:"timestampLayout,omitempty"` // Go time layout of ts; empty uses Apache's
+	FileSuffix      string `json:"fileSuffix,omitempty"`      // Suffix of the log files to read; empty keeps access.log
+
+	// More Go time layouts of ts, tried after timestampLayout
+	TimestampLayouts []string `json:"timestampLayouts,omitempty"`
+
+	compiledRegex *regexp.Regexp // Not stored in JSON
+	layouts       []string       // TimestampLayout and TimestampLayouts
+}
+
+// LogFormatSet is the content of the log formats file
+type LogFormatSet struct {
+	Formats []LogFormatDef `json:"formats"`
+}
+
+// customLogFormats holds the formats loaded from logFormatsPath, by name
+var customLogFormats = map[string]*LogFormatDef{}
+
+// isBuiltinLogFormat reports whether format is one of the built-in log formats.
+func isBuiltinLogFormat(format string) bool {
+	return format == "apache" || format == "apache-vhost" || format == "apache-error" || format == "nginx" || format == "caddy"
+}
+
+// loadLogFormats loads the custom log formats. A missing file is not an error, as the
+// file is only needed for custom formats.
+func loadLogFormats() error {
+	data, err := os.ReadFile(logFormatsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read log formats file: %v", err)
+	}
+	var set LogFormatSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to unmarshal log formats: %v", err)
+	}
+
+	formats := make(map[string]*LogFormatDef, len(set.Formats))
+	for i := range set.Formats {
+		def := &set.Formats[i]
+		if def.Name == "" || isBuiltinLogFormat(def.Name) || def.Name == "all" {
+			log.Printf("Warning: Skipping log format with invalid name %q (it must not be empty, all or a built-in format)", def.Name)
+			continue
+		}
+		regex, err := regexp.Compile(def.Regex)
+		if err != nil {
+			log.Printf("Warning: Invalid regex in log format %s: %v", def.Name, err)
+			continue
+		}
+		if regex.SubexpIndex("ip") < 0 {
+			log.Printf("Warning: Regex of log format %s has no (?P<ip>...) group, skipping it", def.Name)
+			continue
+		}
+		if def.TimestampLayout == "" {
+			def.TimestampLayout = defaultTimestampLayout
+		}
+		def.layouts = append([]string{def.TimestampLayout}, def.TimestampLayouts...)
+		def.compiledRegex = regex
+		formats[def.Name] = def
+	}
+	customLogFormats = formats
+
+	if debug {
+		log.Printf("Loaded %d log formats from %s", len(formats), logFormatsPath)
+	}
+	return nil
+}
+
+// parseLogFields returns the named fields of a line in a custom format, or false if the
+// line does not match the format.
+func parseLogFields(line string, def *LogFormatDef) (map[string]string, bool) {
+	matches := def.compiledRegex.FindStringSubmatch(line)
+	if matches == nil {
+		return nil, false
+	}
+	fields := make(map[string]string, len(matches))
+	for i, name := range def.compiledRegex.SubexpNames() {
+		if name != "" {
+			fields[name] = matches[i]
+		}
+	}
+	return fields, true
+}
+
+// extractCustomTimestamp extracts the ts field of a line in a custom format.
+func extractCustomTimestamp(line string, def *LogFormatDef, source string) (time.Time, bool) {
+	fields, ok := parseLogFields(line, def)
+	if !ok || fields["ts"] == "" {
+		return time.Time{}, false
+	}
+	timestamp, ok := parseTimestamp(fields["ts"], def.layouts, source, def.Name)
+	if !ok {
+		if verbose {
+			log.Printf("Failed to parse timestamp %q with the layouts %q of log format %s", fields["ts"], def.layouts, def.Name)
+		}
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
+
+// extractCustomUserAgent extracts the ua field of a line in a custom format.
+func extractCustomUserAgent(line string, def *LogFormatDef) string {
+	fields, _ := parseLogFields(line, def)
+	return fields["ua"]
+}
+
+// matchCustomRules matches a line in a custom format against the rules for it, like
+// matchRulesExcept, the reason of a match being the rule's name and the status, if the
+// format captures it.
+func matchCustomRules(line string, def *LogFormatDef, disabled map[string]bool, trace *lineTrace) []ruleMatch {
+	fields, ok := parseLogFields(line, def)
+	if !ok {
+		trace.printf("Line does not match log format %s: %s", def.Name, line)
+		return nil
+	}
+	fieldIP := fields["ip"]
+	if parseClientIP(fieldIP) == nil {
+		trace.printf("Log format %s captured %q, which is not an IP address", def.Name, fieldIP)
+		fieldIP = ""
+	}
+
+	var found []ruleMatch
+	for _, rule := range rules {
+		if rule.LogFormat != "all" && rule.LogFormat != def.Name {
+			continue
+		}
+		if !rule.Enabled || rule.compiledRegex == nil || disabled[rule.Name] {
+			continue
+		}
+		if !rule.mayMatch(line) {
+			trace.printf("Rule %s did not match (pre-filter)", rule.Name)
+			continue
+		}
+		matches, ok := rule.submatch(line)
+		if !ok || !rule.matchesFields(fields) || !rule.matchesVhost(fields["vhost"]) {
+			trace.printf("Rule %s did not match", rule.Name)
+			continue
+		}
+		ip := fieldIP
+		if rule.ipGroup > 0 {
+			ip = rule.namedIP(matches, trace)
+		}
+		if ip == "" || !rule.matchesClient(normalizeTarget(ip), line, def.Name, trace) {
+			continue
+		}
+		reason := rule.matchReason(matches, fields["status"])
+		trace.printf("%s match: IP %s, Reason %s", def.Name, ip, reason)
+		if found = addMatch(found, ruleMatch{ip: normalizeTarget(ip), reason: reason, rule: rule.Name}, trace); !matchAll {
+			return found
+		}
+	}
+
+	if len(found) == 0 {
+		trace.printf("No rules matched for this line")
+	}
+	return found
+}
+
+// matchesFields reports whether every field regex of the rule's match map matches.
+func (r *Rule) matchesFields(fields map[string]string) bool {
+	for name, regex := range r.compiledMatch {
+		if !regex.MatchString(fields[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// compileRuleMatch compiles the field regexes of a rule's match map, reporting false if
+// one is invalid, in which case the rule is left out.
+func compileRuleMatch(rule *Rule) bool {
+	if len(rule.Match) == 0 {
+		return true
+	}
+	compiled := make(map[string]*regexp.Regexp, len(rule.Match))
+	for name, expr := range rule.Match {
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			rule.warnf("Invalid regex for field %s in rule %s (%s): %v", name, rule.Name, rule.source, err)
+			return false
+		}
+		compiled[name] = regex
+	}
+	rule.compiledMatch = compiled
+	return true
+}
@@ -5,92 +5,18 @@ import (
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-// processExistingLogs finds and processes existing log files
+// processExistingLogs finds and processes existing log files in every log directory
 func processExistingLogs() {
 	// Track which files we've seen in this run
 	seenFiles := make(map[string]bool)
-
-	// Use logpath instead of hardcoded logDir
-	files, err := filepath.Glob(filepath.Join(logpath, "*"+fileSuffix))
-	if err != nil {
-		log.Printf("Failed to list log files: %v", err)
-		return
-	}
-
-	// Only log count if debug enabled
-	if debug {
-		log.Printf("Found %d log files with suffix %s", len(files), fileSuffix)
-	}
-
-	for _, file := range files {
-		seenFiles[file] = true
-		if debug {
-			log.Printf("Found log file: %s", file)
-		} // Log file finding in debug
-
-		// Check if we're already monitoring this file
-		stateMutex.Lock()
-		_, exists := fileStates[file]
-		stateMutex.Unlock()
-
-		if !exists {
-			if debug {
-				log.Printf("New log file found: %s", file)
-			} // Log new file in debug
-			handleLogFile(file)
-		} else if debug {
-			log.Printf("Already monitoring log file: %s", file)
-		} // Log already monitoring in debug
-	}
-
-	// Also check subdirectories if they exist
-	subdirs, err := os.ReadDir(logpath)
-	if err != nil {
-		log.Printf("Warning: Failed to read log directory: %v", err) // Keep warning
-		return
-	}
-
-	for _, entry := range subdirs {
-		if entry.IsDir() {
-			subdir := filepath.Join(logpath, entry.Name())
-			subfiles, err := filepath.Glob(filepath.Join(subdir, "*"+fileSuffix))
-			if err != nil {
-				log.Printf("Warning: Failed to list log files in subdirectory %s: %v", subdir, err) // Keep warning
-				continue
-			}
-
-			// if debug && len(subfiles) > 0 { // Less important
-			// 	log.Printf("Found %d log files in subdirectory %s", len(subfiles), subdir)
-			// }
-
-			for _, file := range subfiles {
-				seenFiles[file] = true
-				if debug {
-					log.Printf("Found log file in subdirectory: %s", file)
-				} // Log file finding in debug
-
-				// Check if we're already monitoring this file
-				stateMutex.Lock()
-				_, exists := fileStates[file]
-				stateMutex.Unlock()
-
-				if !exists {
-					if debug {
-						log.Printf("New log file found in subdirectory: %s", file)
-					} // Log new file in debug
-					handleLogFile(file)
-				} else if debug {
-					log.Printf("Already monitoring log file in subdirectory: %s", file)
-				} // Log already monitoring in debug
-			}
-		}
+	for _, dir := range logDirs() {
+		scanLogDir(dir, seenFiles)
 	}
 
 	// Check for files that have been removed
@@ -100,11 +26,8 @@ func processExistingLogs() {
 			if debug {
 				log.Printf("Log file no longer exists: %s", file)
 			} // Log removal in debug
-			// Close the file and remove it from our state
-			if state, ok := fileStates[file]; ok {
-				state.File.Close()
-			}
-			delete(fileStates, file)
+			// Stop reading it and remove it from our state
+			stopMonitoringLocked(file)
 		}
 	}
 	stateMutex.Unlock()
@@ -112,11 +35,11 @@ func processExistingLogs() {
 
 // handleLogFile processes a log file (new or existing)
 func handleLogFile(filePath string) {
-	if !strings.HasSuffix(filePath, fileSuffix) {
+	if !isLogFileName(filePath) {
 		return
 	}
 
-	if isIgnoredFile(filePath) {
+	if !isSelectedLogFile(filePath) {
 		if debug {
 			log.Printf("Ignoring log file: %s", filePath)
 		}
@@ -147,9 +70,8 @@ func handleLogFile(filePath string) {
 		existingFileInfo, err := state.File.Stat()
 		if err != nil {
 			log.Printf("Error getting stats for existing file %s: %v", filePath, err) // Keep error
-			// Close the old file and open a new one
-			state.File.Close()
-			delete(fileStates, filePath)
+			// Stop reading the old file and open a new one
+			stopMonitoringLocked(filePath)
 		} else if os.SameFile(existingFileInfo, fileInfo) {
 			// Same file, check if it has grown
 			if fileInfo.Size() > state.Size {
@@ -168,8 +90,7 @@ func handleLogFile(filePath string) {
 			// Different file with same name (rotated)
 			// Keep this log as rotation is important
 			log.Printf("Log file rotated: %s", filePath)
-			state.File.Close()
-			delete(fileStates, filePath)
+			stopMonitoringLocked(filePath)
 		}
 	}
 
@@ -188,6 +109,7 @@ func handleLogFile(filePath string) {
 		Position:        0,
 		LastTimestamp:   time.Time{},
 		LastProcessedIP: "",
+		Format:          detectLogFormat(filePath),
 		stopChan:        make(chan struct{}), // Initialize the stop channel
 	}
 	fileStates[filePath] = newState
@@ -203,20 +125,32 @@ func handleLogFile(filePath string) {
 func processLogFile(filePath string, state *FileState) {
 	defer func() {
 		stateMutex.Lock()
+		// Exiting on its own (the file is gone or unreadable) stops monitoring as a stop
+		// signal does; the path may be monitored by a newer goroutine by now
+		if ownsFileLocked(filePath, state) {
+			stopMonitoringLocked(filePath)
+		}
 		if state.File != nil { // Check if file is already closed
 			state.File.Close()
 		}
-		delete(fileStates, filePath)
 		stateMutex.Unlock()
 		// Keep this log as it confirms monitoring stop
 		log.Printf("Stopped monitoring file: %s", filePath)
 	}()
 
-	// Skip to the last N lines if configured
+	// Resume where the previous run stopped, or position the file as startupWindow or
+	// startupLines say
+	format := state.Format
 	var startupLinesProcessed int
 	var isStartupMode bool
-	if startupLines > 0 {
-		if err := skipToLastLines(state.File, startupLines); err != nil {
+	if resumeLogFile(filePath, state) {
+		if debug {
+			log.Printf("Resumed file %s at position %d", filePath, state.Position)
+		}
+	} else if seekToStartupWindow(filePath, format, state) {
+		isStartupMode = true
+	} else {
+		if err := seekToStartup(state.File, startupLines); err != nil {
 			log.Printf("Error skipping lines for file %s: %v", filePath, err) // Keep error
 		}
 
@@ -226,17 +160,19 @@ func processLogFile(filePath string, state *FileState) {
 			log.Printf("Error getting file position: %v", err) // Keep error
 			return
 		}
+		stateMutex.Lock()
 		state.Position = pos
-		isStartupMode = true
+		stateMutex.Unlock()
+		isStartupMode = startupLines > 0
 
 		if debug {
-			log.Printf("Positioned to process last %d lines from file %s at position %d", startupLines, filePath, pos)
+			log.Printf("Positioned to process %s from file %s at position %d", describeStartupLines(), filePath, pos)
 		}
 	}
 
 	// Process the file
 	reader := bufio.NewReader(state.File)
-	ticker := time.NewTicker(1 * time.Second) // Ticker for periodic checks when at EOF
+	ticker := time.NewTicker(pollInterval) // Ticker for periodic checks when at EOF
 	defer ticker.Stop()
 
 	for {
@@ -249,7 +185,7 @@ func processLogFile(filePath string, state *FileState) {
 			// Continue processing
 		}
 
-		line, err := reader.ReadString('\n')
+		line, err := readLogLine(reader, filePath)
 		if err != nil {
 			if err == io.EOF {
 				// --- Handle EOF ---
@@ -287,16 +223,21 @@ func processLogFile(filePath string, state *FileState) {
 				if !os.SameFile(existingFileInfo, currentFileInfo) {
 					// --- Handle Rotation ---
 					log.Printf("Log file rotated: %s", filePath)
-					state.File.Close() // Close the old file handle
-
 					newFile, openErr := os.Open(filePath)
 					if openErr != nil {
 						log.Printf("Failed to open rotated log file %s: %v", filePath, openErr)
 						return // Exit goroutine if we can't open the new file
 					}
 
-					// Update state with new file handle and info
+					// Update state with new file handle and info, closing the old one, unless
+					// handleLogFile saw the rotation first and started a new goroutine for it
 					stateMutex.Lock()
+					if !ownsFileLocked(filePath, state) {
+						stateMutex.Unlock()
+						newFile.Close()
+						return
+					}
+					state.File.Close()
 					state.File = newFile
 					state.Size = currentFileInfo.Size()
 					state.LastMod = currentFileInfo.ModTime()
@@ -316,6 +257,23 @@ func processLogFile(filePath string, state *FileState) {
 					currentSize := state.Size
 					stateMutex.Unlock() // Unlock after reading
 
+					if currentFileInfo.Size() < currentPosition {
+						// --- Handle Truncation ---
+						// copytruncate rotation empties the file in place, keeping the inode
+						log.Printf("Log file truncated: %s (size %d, read up to %d), reading it from the start", filePath, currentFileInfo.Size(), currentPosition)
+						if _, err := state.File.Seek(0, io.SeekStart); err != nil {
+							log.Printf("Failed to seek to the start of truncated log file %s: %v", filePath, err)
+							return
+						}
+						stateMutex.Lock()
+						state.Position = 0
+						state.Size = currentFileInfo.Size()
+						state.LastMod = currentFileInfo.ModTime()
+						stateMutex.Unlock()
+						reader = bufio.NewReader(state.File) // Drop what was buffered from before the truncation
+						continue
+					}
+
 					if currentFileInfo.Size() > currentSize {
 						// File has grown, update state and continue reading
 						if debug {
@@ -370,26 +328,34 @@ func processLogFile(filePath string, state *FileState) {
 			}
 		}
 
-		// Only log every line if verbose is enabled
-		if verbose {
-			log.Printf("Processing log line from %s: %s", filePath, trimmedLine)
-		}
-		processLogEntry(trimmedLine, filePath, state)
-
 		// Update position and size after successful read
 		pos, err := state.File.Seek(0, io.SeekCurrent)
 		if err != nil {
 			log.Printf("Error getting file position after reading line in %s: %v", filePath, err)
 			// Consider if we should continue or return on position error
-		} else {
-			stateMutex.Lock()
+		}
+		// The reader reads ahead; the lines still in its buffer are not processed yet
+		pos -= int64(reader.Buffered())
+		stateMutex.Lock()
+		// A stopped goroutine may have read a line its successor reads again, so only the
+		// owner of the path processes lines
+		owner := ownsFileLocked(filePath, state)
+		if owner && err == nil {
 			state.Position = pos
 			// Update size based on current position (approximation of bytes read)
 			if pos > state.Size {
 				state.Size = pos
 			}
-			stateMutex.Unlock()
 		}
+		stateMutex.Unlock()
+		if !owner {
+			if debug {
+				log.Printf("No longer monitoring %s, dropping the line read and exiting goroutine.", filePath)
+			}
+			return
+		}
+
+		enqueueLogEntry(trimmedLine, filePath, format, state)
 	}
 }
 
@@ -400,29 +366,10 @@ func readNewContent(filePath string, state *FileState) {
 }
 */
 
-// checkNewSubdirectories checks for new subdirectories in the log path and adds them to the watcher
+// checkNewSubdirectories adds log directories that have appeared, and new subdirectories
+// of the log directories, to the watcher
 func checkNewSubdirectories(watcher *fsnotify.Watcher) {
-	// Check for new subdirectories
-	subdirs, err := os.ReadDir(logpath)
-	if err != nil {
-		log.Printf("Warning: Failed to read log directory for subdirectories: %v", err) // Keep warning
-		return
-	}
-
-	for _, entry := range subdirs {
-		if entry.IsDir() {
-			subdir := filepath.Join(logpath, entry.Name())
-			// Try to add the directory to the watcher
-			// If it's already being watched, this will return an error
-			if err := watcher.Add(subdir); err != nil {
-				if debug {
-					log.Printf("Directory already watched or error: %s - %v", subdir, err)
-				} // Log error in debug
-			} else if debug {
-				log.Printf("Added new subdirectory to watcher: %s", subdir)
-			}
-		}
-	}
+	refreshLogWatches(watcher)
 }
 
 // setupLogWatcher sets up the file system watcher for log files
@@ -446,6 +393,11 @@ func setupLogWatcher() (*fsnotify.Watcher, error) {
 					log.Printf("File system event: %s on %s", event.Op.String(), event.Name)
 				}
 
+				// Watch directories created in the log directory trees, forget removed ones
+				if handleDirEvent(watcher, event) {
+					continue
+				}
+
 				// Handle file creation and modification
 				if event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write {
 					handleLogFile(event.Name)
@@ -457,17 +409,9 @@ func setupLogWatcher() (*fsnotify.Watcher, error) {
 						log.Printf("File removed or renamed event detected: %s", event.Name)
 					}
 					stateMutex.Lock()
-					if state, exists := fileStates[event.Name]; exists {
+					if _, exists := fileStates[event.Name]; exists {
 						log.Printf("Signaling goroutine, closing handle, and removing state for removed/renamed file: %s", event.Name)
-						// Signal the goroutine to stop *before* closing the file handle
-						if state.stopChan != nil {
-							close(state.stopChan)
-						}
-						// Now close the file handle
-						if state.File != nil {
-							state.File.Close()
-						}
-						delete(fileStates, event.Name) // Remove from monitored states
+						stopMonitoringLocked(event.Name)
 					} else if debug {
 						// This might happen if the event is for a file we weren't monitoring (e.g., temp file)
 						log.Printf("Received remove/rename for non-monitored file: %s", event.Name)
@@ -483,27 +427,8 @@ func setupLogWatcher() (*fsnotify.Watcher, error) {
 		}
 	}()
 
-	// Add the main log directory to the watcher
-	if err := watcher.Add(logpath); err != nil {
-		return nil, err
-	}
-
-	// Also watch subdirectories
-	subdirs, err := os.ReadDir(logpath)
-	if err != nil {
-		log.Printf("Warning: Failed to read log directory for subdirectories: %v", err) // Keep warning
-	} else {
-		for _, entry := range subdirs {
-			if entry.IsDir() {
-				subdir := filepath.Join(logpath, entry.Name())
-				if err := watcher.Add(subdir); err != nil {
-					log.Printf("Warning: Failed to add subdirectory %s to watcher: %v", subdir, err) // Keep warning
-				} else if debug {
-					log.Printf("Added subdirectory to watcher: %s", subdir)
-				}
-			}
-		}
-	}
+	// Watch the log directories that exist; the others are picked up when they appear
+	refreshLogWatches(watcher)
 
 	return watcher, nil
 }
@@ -512,8 +437,9 @@ func setupLogWatcher() (*fsnotify.Watcher, error) {
 func startPeriodicTasks(watcher *fsnotify.Watcher) {
 	// Start a periodic check for new log files and directories
 	go func() {
-		// Use a longer interval for checking log files to reduce processing overhead
-		logCheckTicker := time.NewTicker(5 * time.Minute)
+		// Tick on the polling cadence; without polling the scans are further apart
+		logCheckTicker := time.NewTicker(polledScanFactor * pollInterval)
+		lastScan := time.Now()
 		// Use a shorter interval for saving the blocklist and cleaning up records
 		saveBlocklistTicker := time.NewTicker(1 * time.Minute)
 		defer logCheckTicker.Stop()
@@ -522,11 +448,18 @@ func startPeriodicTasks(watcher *fsnotify.Watcher) {
 		for {
 			select {
 			case <-logCheckTicker.C:
+				// Without log files (the logs come from the journal) there is nothing to scan
+				if logSource != "files" || time.Since(lastScan) < logScanInterval() {
+					continue
+				}
+				lastScan = time.Now()
 				if debug {
 					log.Println("Performing periodic check for new log files and directories")
 				} // Log periodic check in debug
-				// Check for new subdirectories to watch
-				checkNewSubdirectories(watcher)
+				// Check for new subdirectories to watch, unless polling without a watcher
+				if watcher != nil {
+					checkNewSubdirectories(watcher)
+				}
 				// Process existing logs
 				processExistingLogs()
 
@@ -534,12 +467,28 @@ func startPeriodicTasks(watcher *fsnotify.Watcher) {
 				if debug {
 					log.Println("Performing periodic blocklist save and cleanup")
 				} // Log periodic save/cleanup in debug
+				// Lift automatic blocks that have reached blockDuration
+				pruneExpiredBlocks(true)
+				// Fold dense groups of blocked IPs into covering CIDRs
+				aggregateBlocks()
 				// Periodically save the blocklist to ensure we don't lose any blocks
 				if err := saveBlockList(); err != nil && debug {
 					log.Printf("Warning: Failed to save blocklist during periodic check: %v", err)
 				}
+				// Take a rotated backup if one is due
+				rotateBlocklistBackups()
 				// Clean up expired records
 				cleanupExpiredRecords()
+				// Keep the remaining ones across restarts
+				if err := saveAccessState(); err != nil && debug {
+					log.Printf("Warning: Failed to save access records during periodic check: %v", err)
+				}
+				if err := saveJournalCursor(); err != nil {
+					log.Printf("Warning: Failed to save journal cursor during periodic check: %v", err)
+				}
+				if err := saveLogOffsets(); err != nil && debug {
+					log.Printf("Warning: Failed to save log offsets during periodic check: %v", err)
+				}
 				// Clean up expired temporary whitelist entries
 				cleanupTempWhitelist()
 			}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLineRule is the rule of the test lines written by appendTestLines.
+const testLineRule = "Test lines"
+
+// useTestLineRule loads a rule matching every test line, with a threshold no test reaches,
+// so its match count is the number of test lines processed.
+func useTestLineRule(t *testing.T) {
+	t.Helper()
+	useRules(t, RuleSet{Rules: []Rule{{
+		Name:      testLineRule,
+		LogFormat: "all",
+		Regex:     `^(\S+) test-line `,
+		Threshold: 1 << 30,
+		Duration:  Duration(time.Hour),
+		Enabled:   true,
+	}}})
+	ruleStatsMu.Lock()
+	delete(ruleStats, testLineRule)
+	ruleStatsMu.Unlock()
+}
+
+// testLineMatches returns how many test lines were matched.
+func testLineMatches() int64 {
+	ruleStatsMu.Lock()
+	defer ruleStatsMu.Unlock()
+	if stat := ruleStats[testLineRule]; stat != nil {
+		return stat.Matches
+	}
+	return 0
+}
+
+// newMonitoredLog returns the path of an empty access log in a temporary directory, with
+// polling sped up and startupLines set for the test. Monitoring of the files the test
+// adopts stops when it ends.
+func newMonitoredLog(t *testing.T, lines int) string {
+	t.Helper()
+	savedPoll, savedStartup, savedMatchAll := pollInterval, startupLines, matchAll
+	pollInterval, startupLines, matchAll = 5*time.Millisecond, lines, false
+	path := filepath.Join(t.TempDir(), "site-access.log")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stateMutex.Lock()
+		stopMonitoringLocked(path)
+		stateMutex.Unlock()
+		// Let the reader see the stop signal before the settings change back
+		time.Sleep(20 * time.Millisecond)
+		pollInterval, startupLines, matchAll = savedPoll, savedStartup, savedMatchAll
+	})
+	return path
+}
+
+// appendTestLines appends n test lines to path, numbered from first.
+func appendTestLines(t *testing.T, path string, first, n int) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := first; i < first+n; i++ {
+		if _, err := fmt.Fprintf(file, "192.0.2.%d test-line %06d\n", i%250+1, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitForMatches waits until want test lines were matched, failing the test after a few
+// seconds, then checks that no more are matched over some more polls.
+func waitForMatches(t *testing.T, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testLineMatches() < want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * pollInterval)
+	if got := testLineMatches(); got != want {
+		t.Fatalf("%d test lines matched, want %d", got, want)
+	}
+}
+
+// waitForPosition waits until the reader of path has read up to its end.
+func waitForPosition(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stateMutex.Lock()
+		state := fileStates[path]
+		done := state != nil && state.Position == info.Size()
+		stateMutex.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("the reader of %s did not reach its end", path)
+}
+
+// TestRapidEventsDoNotInflateCounts fires Create, Write and Remove events at a log file
+// from several goroutines while lines are appended to it. Lines written around a Remove
+// may be missed, but none may be counted twice, and afterwards the file has one reader.
+func TestRapidEventsDoNotInflateCounts(t *testing.T) {
+	useTestLineRule(t)
+	path := newMonitoredLog(t, 0) // New lines only, so a re-adopted file is not read again
+	handleLogFile(path)
+	waitForPosition(t, path)
+
+	const written = 500
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(remover bool) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if remover && n%8 == 0 {
+					// What the watcher does on a Remove or Rename event
+					stateMutex.Lock()
+					stopMonitoringLocked(path)
+					stateMutex.Unlock()
+				} else {
+					handleLogFile(path) // Create or Write
+				}
+				time.Sleep(time.Duration(n%3) * time.Millisecond)
+			}
+		}(i == 0)
+	}
+	for i := 0; i < written; i += 10 {
+		appendTestLines(t, path, i, 10)
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	handleLogFile(path)
+	waitForPosition(t, path)
+	time.Sleep(20 * pollInterval)
+	counted := testLineMatches()
+	if counted > written {
+		t.Fatalf("%d test lines matched, but only %d were written", counted, written)
+	}
+
+	// Exactly one reader is left, counting each new line once
+	appendTestLines(t, path, written, 50)
+	waitForMatches(t, counted+50)
+	stateMutex.Lock()
+	monitored := len(fileStates)
+	stateMutex.Unlock()
+	if monitored != 1 {
+		t.Fatalf("%d files monitored, want 1", monitored)
+	}
+}
+
+// useTempLogOffsets keeps the log offsets in a temporary file for the test.
+func useTempLogOffsets(t *testing.T) string {
+	t.Helper()
+	saved := logOffsetsFile
+	logOffsetsFile = filepath.Join(t.TempDir(), "logoffsets.json")
+	t.Cleanup(func() {
+		logOffsetsFile = saved
+		logOffsetsMu.Lock()
+		savedLogOffsets = make(map[string]logOffset)
+		logOffsetsMu.Unlock()
+	})
+	return logOffsetsFile
+}
+
+// TestConcurrentEventsAndReading handles Write events for a log file and saves the log
+// offsets while its reader processes the lines appended to it, for the race detector.
+// Without Remove events no line may be missed or counted twice.
+func TestConcurrentEventsAndReading(t *testing.T) {
+	useTestLineRule(t)
+	useTempLogOffsets(t)
+	path := newMonitoredLog(t, -1)
+	handleLogFile(path)
+
+	const written = 1000
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(saver bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if saver {
+					if err := saveLogOffsets(); err != nil {
+						t.Error(err)
+						return
+					}
+				} else {
+					handleLogFile(path) // Write
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i == 0)
+	}
+	for i := 0; i < written; i += 20 {
+		appendTestLines(t, path, i, 20)
+		time.Sleep(time.Millisecond)
+	}
+	waitForMatches(t, written)
+	close(stop)
+	wg.Wait()
+
+	// Stopping closes the file in the reader while the offsets are saved
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			saveLogOffsets()
+		}
+	}()
+	stateMutex.Lock()
+	stopMonitoringLocked(path)
+	stateMutex.Unlock()
+	<-done
+}
+
+// TestTruncatedLogReadOnce truncates a log file in place, as copytruncate rotation does,
+// and checks the lines written after it are read, once.
+func TestTruncatedLogReadOnce(t *testing.T) {
+	useTestLineRule(t)
+	path := newMonitoredLog(t, -1)
+	appendTestLines(t, path, 0, 10)
+	handleLogFile(path)
+	waitForMatches(t, 10)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTestLines(t, path, 10, 4) // Shorter than what was read before
+	waitForMatches(t, 14)
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, after) {
+		t.Fatal("truncating the file replaced it")
+	}
+	appendTestLines(t, path, 14, 3)
+	waitForMatches(t, 17)
+}
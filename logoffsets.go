@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Persisted log file offsets ---
+
+// So a restart neither counts recent lines twice nor misses the lines written while the
+// server was down, the read offset and last timestamp of every monitored file are written
+// to the log offsets file by the periodic save task and at shutdown. When a file is opened
+// after a restart and its device and inode still match, reading resumes at the saved
+// offset; a file that was rotated or truncated meanwhile falls back to startupLines.
+
+// logOffsetsVersion is the version of the log offsets file format.
+const logOffsetsVersion = 1
+
+// logOffset is where reading of a log file stopped.
+type logOffset struct {
+	Device        uint64    `json:"device"`
+	Inode         uint64    `json:"inode"`
+	Position      int64     `json:"position"`
+	LastTimestamp time.Time `json:"lastTimestamp"`
+}
+
+// logOffsetState is the content of the log offsets file.
+type logOffsetState struct {
+	Version int                  `json:"version"`
+	Files   map[string]logOffset `json:"files"`
+}
+
+var (
+	logOffsetsMu    sync.Mutex
+	savedLogOffsets = make(map[string]logOffset) // Offsets loaded at startup and not used yet, guarded by logOffsetsMu
+)
+
+// logOffsetsPath returns the log offsets file: logOffsetsFile, or logoffsets.json beside
+// the blocklist.
+func logOffsetsPath() string {
+	if logOffsetsFile != "" {
+		return logOffsetsFile
+	}
+	return filepath.Join(filepath.Dir(blocklistFilePath), "logoffsets.json")
+}
+
+// fileIdentity returns the device and inode of a file, which survive renames but not
+// rotation by recreating the file.
+func fileIdentity(info os.FileInfo) (uint64, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// loadLogOffsets reads the offsets saved by the previous run. A missing file is normal; a
+// corrupt one is ignored with a warning.
+func loadLogOffsets() {
+	path := logOffsetsPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to read log offsets file %s: %v", path, err)
+		}
+		return
+	}
+	var state logOffsetState
+	if err := json.Unmarshal(data, &state); err != nil || state.Version > logOffsetsVersion {
+		log.Printf("Warning: Ignoring log offsets file %s, which is corrupt or written by a newer version", path)
+		return
+	}
+	logOffsetsMu.Lock()
+	for file, offset := range state.Files {
+		savedLogOffsets[file] = offset
+	}
+	logOffsetsMu.Unlock()
+	if debug {
+		log.Printf("Loaded the offsets of %d log files from %s", len(state.Files), path)
+	}
+}
+
+// saveLogOffsets writes the offsets of the monitored files, and those loaded for files
+// not opened again yet, to the log offsets file.
+func saveLogOffsets() error {
+	if logSource != "files" {
+		return nil
+	}
+	state := logOffsetState{Version: logOffsetsVersion, Files: make(map[string]logOffset)}
+	logOffsetsMu.Lock()
+	for file, offset := range savedLogOffsets {
+		state.Files[file] = offset
+	}
+	logOffsetsMu.Unlock()
+
+	stateMutex.Lock()
+	for file, fileState := range fileStates {
+		if fileState.File == nil {
+			continue
+		}
+		info, err := fileState.File.Stat()
+		if err != nil {
+			continue
+		}
+		device, inode, ok := fileIdentity(info)
+		if !ok {
+			continue
+		}
+		state.Files[file] = logOffset{Device: device, Inode: inode, Position: fileState.Position, LastTimestamp: fileState.LastTimestamp}
+	}
+	stateMutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log offsets: %v", err)
+	}
+	if err := writeFileAtomic(logOffsetsPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write log offsets file: %v", err)
+	}
+	return nil
+}
+
+// resumeLogFile positions a newly opened log file at its saved offset, reporting false if
+// there is none or the file is no longer the one it was saved for. The offset is used once.
+func resumeLogFile(filePath string, state *FileState) bool {
+	logOffsetsMu.Lock()
+	saved, exists := savedLogOffsets[filePath]
+	delete(savedLogOffsets, filePath)
+	logOffsetsMu.Unlock()
+	if !exists {
+		return false
+	}
+
+	info, err := state.File.Stat()
+	if err != nil {
+		return false
+	}
+	device, inode, ok := fileIdentity(info)
+	if !ok || device != saved.Device || inode != saved.Inode || info.Size() < saved.Position {
+		log.Printf("Log file %s was rotated or truncated since the last run, not resuming at the saved offset", filePath)
+		return false
+	}
+	if _, err := state.File.Seek(saved.Position, io.SeekStart); err != nil {
+		log.Printf("Failed to seek to the saved offset %d of %s: %v", saved.Position, filePath, err)
+		return false
+	}
+
+	stateMutex.Lock()
+	state.Position = saved.Position
+	state.LastTimestamp = saved.LastTimestamp
+	stateMutex.Unlock()
+	log.Printf("Resuming log file %s at offset %d (%d bytes written since the last run)", filePath, saved.Position, info.Size()-saved.Position)
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// restartMonitoring saves the log offsets, stops monitoring path as a shutdown does, runs
+// between while the server is down, and monitors path again after loading the offsets.
+func restartMonitoring(t *testing.T, path string, between func()) {
+	t.Helper()
+	if err := saveLogOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	stateMutex.Lock()
+	stopMonitoringLocked(path)
+	stateMutex.Unlock()
+
+	between()
+
+	loadLogOffsets()
+	handleLogFile(path)
+}
+
+// TestRestartResumesAtSavedOffset checks that after a restart the lines written while the
+// server was down are read, and the ones read before are not read again.
+func TestRestartResumesAtSavedOffset(t *testing.T) {
+	useTestLineRule(t)
+	useTempLogOffsets(t)
+	path := newMonitoredLog(t, -1) // Without the offset, the whole file would be read again
+	appendTestLines(t, path, 0, 5)
+	handleLogFile(path)
+	waitForMatches(t, 5)
+
+	restartMonitoring(t, path, func() { appendTestLines(t, path, 5, 3) })
+	waitForMatches(t, 8)
+}
+
+// TestRestartAfterRotationStartsOver checks that a log file rotated or truncated while the
+// server was down is read from its start after a restart, rather than at the saved offset.
+func TestRestartAfterRotationStartsOver(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, path string)
+		lines  int64 // In the file after rotate
+	}{
+		{"new inode", func(t *testing.T, path string) {
+			// Larger than before, so only the inode tells the file apart
+			rotated := filepath.Join(filepath.Dir(path), "rotated.tmp")
+			if err := os.WriteFile(rotated, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			appendTestLines(t, rotated, 100, 8)
+			if err := os.Rename(rotated, path); err != nil {
+				t.Fatal(err)
+			}
+		}, 8},
+		{"truncated", func(t *testing.T, path string) {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			appendTestLines(t, path, 100, 2)
+		}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestLineRule(t)
+			useTempLogOffsets(t)
+			path := newMonitoredLog(t, -1)
+			appendTestLines(t, path, 0, 5)
+			handleLogFile(path)
+			waitForMatches(t, 5)
+
+			restartMonitoring(t, path, func() { test.rotate(t, path) })
+			waitForMatches(t, 5+test.lines)
+		})
+	}
+}
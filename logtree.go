@@ -0,0 +1,202 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// --- Log directory trees ---
+
+// Below each log directory, directories are searched and watched down to logDepth levels
+// (1, the default, is the directory and its direct subdirectories; Plesk's
+// /var/www/vhosts/<domain>/logs needs 2 from /var/www/vhosts). Symlinked directories are
+// followed, but every directory is visited once, so links pointing back up end the
+// descent. Directories matching a logExclude pattern are not entered, and no more than
+// maxLogDirs directories are taken from each tree, as each costs an inotify watch.
+// Directories created later are watched as soon as they appear; the watches of
+// directories that disappear are removed.
+
+// maxLogDirs caps the directories taken from each log directory tree.
+const maxLogDirs = 4096
+
+var (
+	watchedLogDirsMu sync.Mutex
+	watchedLogDirs   = make(map[string]bool) // Directories added to the watcher, guarded by watchedLogDirsMu
+)
+
+// logDirTree returns root and the directories below it down to logDepth levels.
+func logDirTree(root string) []string {
+	var dirs []string
+	visited := make(map[string]bool)
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil || visited[real] {
+			return
+		}
+		if len(dirs) >= maxLogDirs {
+			return
+		}
+		visited[real] = true
+		dirs = append(dirs, dir)
+		if depth >= logDepth {
+			return
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("Warning: Failed to read log directory %s: %v", dir, err) // Keep warning
+			return
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if !entry.IsDir() {
+				if entry.Type()&os.ModeSymlink == 0 {
+					continue
+				}
+				if info, err := os.Stat(path); err != nil || !info.IsDir() {
+					continue
+				}
+			}
+			if isExcludedLogDir(path) {
+				if debug {
+					log.Printf("Not descending into excluded directory %s", path)
+				}
+				continue
+			}
+			walk(path, depth+1)
+		}
+	}
+	walk(root, 0)
+
+	if len(dirs) >= maxLogDirs {
+		log.Printf("Warning: Only the first %d directories below %s are searched for log files; lower logDepth or exclude directories with logExclude", maxLogDirs, root)
+	}
+	return dirs
+}
+
+// isExcludedLogDir reports whether dir matches a logExclude pattern.
+func isExcludedLogDir(dir string) bool {
+	logFilterMu.RLock()
+	defer logFilterMu.RUnlock()
+	return matchesLogPattern(dir, logExcludePatterns)
+}
+
+// isWithinDir reports whether path is dir or lies below it.
+func isWithinDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// refreshLogWatches makes the watcher watch exactly the directories of the log directory
+// trees: new directories are added, and those gone or now excluded are removed.
+func refreshLogWatches(watcher *fsnotify.Watcher) {
+	current := make(map[string]bool)
+	roots := logDirs()
+	for _, root := range roots {
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		for _, dir := range logDirTree(root) {
+			current[dir] = true
+		}
+	}
+
+	watchedLogDirsMu.Lock()
+	defer watchedLogDirsMu.Unlock()
+	for _, root := range roots {
+		if watchedLogDirs[root] && !current[root] {
+			log.Printf("Warning: Log directory %s disappeared, waiting for it to come back", root)
+		} else if !watchedLogDirs[root] && !current[root] && debug {
+			log.Printf("Log directory %s does not exist yet", root)
+		}
+	}
+	for dir := range watchedLogDirs {
+		if !current[dir] {
+			// The watch of a deleted directory is already gone, so an error is expected
+			watcher.Remove(dir)
+			delete(watchedLogDirs, dir)
+			if debug {
+				log.Printf("Stopped watching directory: %s", dir)
+			}
+		}
+	}
+	for dir := range current {
+		if watchedLogDirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Warning: Failed to add directory %s to watcher: %v", dir, err) // Keep warning
+			watchFailed(dir, err)
+			continue
+		}
+		watchedLogDirs[dir] = true
+		if isLogRoot(dir, roots) {
+			log.Printf("Watching log directory: %s", dir)
+		} else if debug {
+			log.Printf("Watching subdirectory: %s", dir)
+		}
+	}
+}
+
+// isLogRoot reports whether dir is one of the log directories.
+func isLogRoot(dir string, roots []string) bool {
+	for _, root := range roots {
+		if dir == root {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDirEvent keeps the watches up to date when a directory in a log directory tree is
+// created, removed or renamed. It reports whether path was such a directory.
+func handleDirEvent(watcher *fsnotify.Watcher, event fsnotify.Event) bool {
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		info, err := os.Stat(event.Name)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+		refreshLogWatches(watcher)
+
+		// Log files may have been written before the watches were added
+		var dirs []string
+		watchedLogDirsMu.Lock()
+		for dir := range watchedLogDirs {
+			if isWithinDir(dir, event.Name) {
+				dirs = append(dirs, dir)
+			}
+		}
+		watchedLogDirsMu.Unlock()
+		for _, dir := range dirs {
+			files, _ := globLogFiles(dir)
+			for _, file := range files {
+				handleLogFile(file)
+			}
+		}
+		return len(dirs) > 0
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		watchedLogDirsMu.Lock()
+		watched := watchedLogDirs[event.Name]
+		if watched {
+			for dir := range watchedLogDirs {
+				if isWithinDir(dir, event.Name) {
+					watcher.Remove(dir)
+					delete(watchedLogDirs, dir)
+				}
+			}
+		}
+		watchedLogDirsMu.Unlock()
+		if watched && debug {
+			log.Printf("Directory %s removed, stopped watching it", event.Name)
+		}
+		return watched
+	}
+	return false
+}
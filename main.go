@@ -3,19 +3,25 @@ package main
 import (
 	"flag"
 	"log"
-	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 func main() {
 	// Basic options
-	clean := flag.Bool("clean", false, "Remove existing port blocking rules")
+	clean := flag.Bool("clean", false, "Remove existing port blocking rules and challenge redirects")
+	uninstall := flag.Bool("uninstall", false, "Remove all firewall chains, rules and jumps, and the socket file, then exit")
+	purge := flag.Bool("purge", false, "With -uninstall, also delete the blocklist file")
 	configPath := flag.String("config", DefaultConfigPath, "Path to configuration file")
-	server := flag.String("server", "apache", "Log format: apache or caddy")
-	logPath := flag.String("logPath", "/var/customers/logs", "Log path")
+	server := flag.String("server", "apache", "Log format: apache, apache-vhost, nginx, caddy or a custom format from the log formats file")
+	logPath := flag.String("logPath", "/var/customers/logs", "Log directories, separated by commas")
 	Debug := flag.Bool("debug", false, "Debug mode")
 	Verbose := flag.Bool("verbose", false, "Verbose debug mode (logs all processed lines)")
 	whitelistPath := flag.String("whitelist", whitelistFilePath, "Path to whitelist file")
@@ -24,20 +30,56 @@ func main() {
 	ignoreFilesPathFlag := flag.String("ignoreFiles", ignoreFilesPath, "Path to ignored log files list")
 	rulesPath := flag.String("rules", rulesFilePath, "Path to rules file")
 	tableName := flag.String("table", firewallChain, "Name of the iptables chain to use") // Renamed variable
+	firewallTypeFlag := flag.String("firewallType", firewallType, "Firewall backend: iptables, nftables, cloudflare, pf, denyfile or caddy")
+	blockActionFlag := flag.String("blockAction", blockAction, "Firewall action for blocked addresses: drop, reject or ratelimit")
+	blockScopeFlag := flag.String("blockScope", blockScope, "Block scope: web (blocked ports only) or all (all traffic)")
+	blockPortsFlag := flag.String("blockPorts", strings.Join(blockPorts, ","), "Comma-separated destination ports to block")
 
 	// Configuration options
 	expPeriod := flag.Duration("expirationPeriod", 5*time.Minute, "Time period to monitor for malicious activity")
 	thresholdFlag := flag.Int("threshold", 3, "Number of suspicious requests to trigger IP blocking")
 	subnetThresholdFlag := flag.Int("subnetThreshold", 3, "Number of IPs from a subnet to trigger subnet blocking")
 	_ = flag.Bool("disableSubnetBlocking", false, "Disable automatic subnet blocking")
-	startupLinesFlag := flag.Int("startupLines", 5000, "Number of log lines to process at startup")
+	startupLinesFlag := flag.Int("startupLines", 5000, "Number of log lines to process at startup (-1: whole files, 0: new lines only)")
+	fromStart := flag.Bool("fromStart", false, "Process monitored files from the beginning (same as -startupLines -1)")
+	startupWindowFlag := flag.Duration("startupWindow", 0, "Process log entries this recent at startup instead of startupLines (0 disables)")
 
 	// Client mode options
 	block := flag.String("block", "", "Block an IP address or CIDR range")
 	unblock := flag.String("unblock", "", "Unblock an IP address or CIDR range")
 	check := flag.String("check", "", "Check if an IP address or CIDR range is blocked")
+	allow := flag.String("allow", "", "Add an IP address or CIDR range to the whitelist, exempting it from blocked subnets")
+	whitelistAddFlag := flag.String("whitelistAdd", "", "Add an IP address or CIDR range to the whitelist, unblocking it and exempting it from blocked subnets")
+	whitelistRemoveFlag := flag.String("whitelistRemove", "", "Remove an IP address or CIDR range from the whitelist")
+	whitelistList := flag.Bool("whitelistList", false, "List the whitelist entries")
 	list := flag.Bool("list", false, "List all blocked IPs and subnets")
 	debugStream := flag.Bool("debug-stream", false, "Stream debug logs from the server")
+	dryRunFlag := flag.Bool("dryRun", false, "Log intended firewall changes without applying them")
+	status := flag.Bool("status", false, "Show server status, including the last firewall reconcile result")
+	stats := flag.Bool("stats", false, "Show the match and block counters of the rules, the highest IP scores (with scoreThreshold set) and the busiest clients of the rate rules of the running server")
+	statsJSON := flag.Bool("json", false, "With -stats, print the rule counters as JSON")
+	resetStats := flag.Bool("reset", false, "With -stats, zero the rule counters after printing them")
+	reload := flag.Bool("reload", false, "Make the running server re-read its configuration, whitelists and rules")
+	enableRule := flag.String("enableRule", "", "Enable the rule of this name on the running server")
+	disableRule := flag.String("disableRule", "", "Disable the rule of this name on the running server")
+	persist := flag.Bool("persist", false, "With -enableRule or -disableRule, also write the change to the rule's rules file")
+	showRulesFlag := flag.Bool("showRules", false, "List the rules of the running server with their state and match counters")
+	traceIPFlag := flag.String("traceIP", "", "Trace the log lines of this IP address in full on the running server (none to stop)")
+	force := flag.Bool("force", false, "With -unblock, keep a blocklist feed entry unblocked across feed refreshes")
+	restoreMembers := flag.Bool("restoreMembers", true, "With -unblock of a subnet, block the individual IPs it absorbed again")
+	export := flag.String("export", "", "Export the blocklist in a format for other systems: plain, csv, ipset or nft")
+	exportFile := flag.String("exportFile", "", "Write -export output to this file instead of stdout")
+	restoreBlocklist := flag.String("restoreBlocklist", "", "Apply a blocklist backup: its index (1 = newest) or the path of a blocklist file")
+	importFile := flag.String("importFile", "", "Block the IPs and CIDR ranges listed in a file, one per line with an optional # reason")
+	importFail2ban := flag.String("importFail2ban", "", "Block the current bans of these fail2ban jails (comma-separated, or all)")
+	fail2banDB := flag.String("fail2banDB", "/var/lib/fail2ban/fail2ban.sqlite3", "fail2ban database read by -importFail2ban when fail2ban-client is unavailable")
+	stdinMode := flag.Bool("stdin", false, "Process log lines from standard input instead of watching log files, then print a summary and exit")
+	testRulesFile := flag.String("testRules", "", "Run the lines of this log file through the rules and report what they would block, without blocking anything")
+	testSamples := flag.Int("testSamples", 3, "Matched lines -testRules shows per rule")
+	validateRules := flag.String("validateRules", "", "Check the rules file (or directory of rule files) at this path and report the problems of each rule, exiting non-zero if an enabled rule is unusable")
+	explain := flag.String("explain", "", "Show what every rule makes of this log line, with the captured groups")
+	initRules := flag.Bool("initRules", false, "Create the default rules file, if there is none, and exit")
+	mergeDefaults := flag.Bool("mergeDefaultRules", false, "Add the default rules the rules file lacks by name, leaving its rules alone, and exit")
 
 	// API key for socket authentication
 	apiKeyFlag := flag.String("apiKey", "", "API key for socket authentication")
@@ -77,6 +119,12 @@ func main() {
 		flagSet[f.Name] = true
 	})
 
+	// Remember what the file and the command line set, for the reload command
+	configFilePath, commandLineFlags = *configPath, flagSet
+	if values, err := readConfigValues(*configPath); err == nil {
+		loadedConfig = values
+	}
+
 	if flagSet["expirationPeriod"] {
 		expirationPeriod = *expPeriod
 	}
@@ -92,6 +140,12 @@ func main() {
 	if flagSet["startupLines"] {
 		startupLines = *startupLinesFlag
 	}
+	if *fromStart {
+		startupLines = -1
+	}
+	if flagSet["startupWindow"] {
+		startupWindow = *startupWindowFlag
+	}
 
 	// Command line flags override configuration file settings
 	// Debug logging already handled above and in config parsing
@@ -144,6 +198,57 @@ func main() {
 		}
 	}
 
+	if flagSet["firewallType"] {
+		if *firewallTypeFlag == "iptables" || *firewallTypeFlag == "nftables" || *firewallTypeFlag == "cloudflare" || *firewallTypeFlag == "pf" || *firewallTypeFlag == "denyfile" || *firewallTypeFlag == "caddy" {
+			firewallType = *firewallTypeFlag
+			if debug {
+				log.Println("Setting firewall type from command line:", firewallType)
+			}
+		} else {
+			log.Fatalf("Invalid firewallType: %s (must be 'iptables', 'nftables', 'cloudflare', 'pf', 'denyfile' or 'caddy')", *firewallTypeFlag)
+		}
+	}
+
+	if flagSet["blockAction"] {
+		if *blockActionFlag == "drop" || *blockActionFlag == "reject" || *blockActionFlag == "ratelimit" {
+			blockAction = *blockActionFlag
+			if debug {
+				log.Println("Setting block action from command line:", blockAction)
+			}
+		} else {
+			log.Fatalf("Invalid blockAction: %s (must be 'drop', 'reject' or 'ratelimit')", *blockActionFlag)
+		}
+	}
+
+	if flagSet["dryRun"] {
+		dryRun = *dryRunFlag
+		if debug {
+			log.Println("Setting dry-run mode from command line:", dryRun)
+		}
+	}
+
+	if flagSet["blockScope"] {
+		if *blockScopeFlag == "web" || *blockScopeFlag == "all" {
+			blockScope = *blockScopeFlag
+			if debug {
+				log.Println("Setting block scope from command line:", blockScope)
+			}
+		} else {
+			log.Fatalf("Invalid blockScope: %s (must be 'web' or 'all')", *blockScopeFlag)
+		}
+	}
+
+	if flagSet["blockPorts"] {
+		ports, err := parsePortList(*blockPortsFlag)
+		if err != nil {
+			log.Fatalf("Invalid blockPorts: %s (%v)", *blockPortsFlag, err)
+		}
+		blockPorts = ports
+		if debug {
+			log.Println("Setting blocked ports from command line:", strings.Join(blockPorts, ","))
+		}
+	}
+
 	// Set the API key if provided on command line or env var
 	if flagSet["apiKey"] && *apiKeyFlag != "" {
 		apiKey = *apiKeyFlag
@@ -168,18 +273,108 @@ func main() {
 	}
 
 	// Set server and log path if explicitly specified on command line
-	if flagSet["server"] && (*server == "apache" || *server == "caddy") {
+	if flagSet["server"] {
 		logFormat = *server
 	}
 
 	if flagSet["logPath"] {
-		if _, err := os.Stat(*logPath); err == nil {
-			logpath = *logPath
+		addLogPath(*logPath, true)
+	}
+
+	// Export prints the blocklist rather than a result, so it is handled apart from the other client commands
+	if *export != "" {
+		if !isExportFormat(*export) {
+			log.Fatalf("Invalid export format: %s (must be one of %s)", *export, strings.Join(exportFormats, ", "))
 		}
+		var output string
+		response, err := requestExport(*export)
+		if err == nil {
+			if !response.Success {
+				log.Fatalf("Error exporting blocklist: %s", response.Result)
+			}
+			output = response.Result
+		} else {
+			log.Printf("Could not connect to server: %v", err)
+			log.Printf("Exporting the blocklist file directly")
+			if err := loadBlockList(); err != nil {
+				log.Fatalf("Error loading blocklist: %v", err)
+			}
+			if output, err = exportBlockList(*export); err != nil {
+				log.Fatalf("Error exporting blocklist: %v", err)
+			}
+		}
+		if err := writeExport(output, *exportFile); err != nil {
+			log.Fatalf("Error exporting blocklist: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Restore is handled apart from the other client commands, as its argument is not a target
+	if *restoreBlocklist != "" {
+		spec := *restoreBlocklist
+		if _, err := strconv.Atoi(spec); err != nil {
+			// The server resolves paths from its own working directory
+			if abs, err := filepath.Abs(spec); err == nil {
+				spec = abs
+			}
+		}
+		err := sendCommand(RestoreCommand, spec)
+		if err == nil {
+			os.Exit(0)
+		}
+		log.Printf("Could not connect to server: %v", err)
+		log.Printf("Executing command directly")
+		if err := InitFirewallManager(); err != nil {
+			log.Fatalf("Error initializing firewall manager: %v", err)
+		}
+		if err := loadBlockList(); err != nil {
+			log.Printf("Warning: Failed to load blocklist: %v", err)
+		}
+		if _, err := restoreBlockList(spec); err != nil {
+			log.Fatalf("Error restoring blocklist: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Imports are handled apart from the other client commands, as they carry a list of entries
+	if *importFile != "" || *importFail2ban != "" {
+		var entries []BlockEntry
+		var label string
+		var err error
+		if *importFile != "" {
+			label = *importFile
+			entries, err = parseImportFile(*importFile)
+		} else {
+			var jails []string
+			if *importFail2ban != "all" {
+				for _, jail := range strings.Split(*importFail2ban, ",") {
+					if jail = strings.TrimSpace(jail); jail != "" {
+						jails = append(jails, jail)
+					}
+				}
+			}
+			label = "fail2ban jails " + *importFail2ban
+			entries, err = fail2banBans(jails, *fail2banDB)
+		}
+		if err != nil {
+			log.Fatalf("Error importing: %v", err)
+		}
+		if err := runImport(entries, label); err != nil {
+			log.Fatalf("Error importing: %v", err)
+		}
+		os.Exit(0)
 	}
 
+	unblockForce = *force
+	if *statsJSON {
+		statsFormat = "json"
+	}
+	statsReset = *resetStats
+	unblockSkipMembers = !*restoreMembers
+	persistRuleChange = *persist
+
 	// Check if we're in client mode
-	clientMode := *block != "" || *unblock != "" || *check != "" || *list || *debugStream
+	clientMode := *block != "" || *unblock != "" || *check != "" || *allow != "" || *list || *debugStream || *status || *stats || *reload || *traceIPFlag != "" || *enableRule != "" || *disableRule != "" || *showRulesFlag || *whitelistAddFlag != "" || *whitelistRemoveFlag != "" || *whitelistList
 
 	if clientMode {
 		// For all client mode commands, try socket first
@@ -195,12 +390,55 @@ func main() {
 		} else if *check != "" {
 			command = CheckCommand
 			target = *check
+		} else if *allow != "" {
+			command = AllowCommand
+			target = *allow
 		} else if *list {
 			command = ListCommand
 			target = ""
 		} else if *debugStream {
 			command = DebugCommand
 			target = ""
+		} else if *status {
+			command = StatusCommand
+			target = ""
+		} else if *stats {
+			command = StatsCommand
+			target = ""
+		} else if *reload {
+			command = ReloadCommand
+			target = ""
+		} else if *enableRule != "" {
+			command = EnableRuleCommand
+			target = *enableRule
+		} else if *disableRule != "" {
+			command = DisableRuleCommand
+			target = *disableRule
+		} else if *showRulesFlag {
+			command = ShowRulesCommand
+			target = ""
+		} else if *whitelistAddFlag != "" {
+			command = WhitelistAddCommand
+			target = *whitelistAddFlag
+		} else if *whitelistRemoveFlag != "" {
+			command = WhitelistRemoveCommand
+			target = *whitelistRemoveFlag
+		} else if *whitelistList {
+			command = WhitelistListCommand
+			target = ""
+		} else if *traceIPFlag != "" {
+			command = TraceCommand
+			target = *traceIPFlag
+			if target != "none" && parseClientIP(target) == nil {
+				log.Fatalf("Invalid IP address: %s", target)
+			}
+		}
+
+		if target != "" && command != TraceCommand && command != EnableRuleCommand && command != DisableRuleCommand {
+			if !isValidIPOrCIDR(target) {
+				log.Fatalf("Invalid IP address or CIDR range: %s", target)
+			}
+			target = normalizeTarget(target)
 		}
 
 		// Try to send the command to a running server first
@@ -214,9 +452,16 @@ func main() {
 		log.Printf("Could not connect to server: %v", err)
 		log.Printf("Executing command directly")
 
-		// Just load the blocklist for all commands
-		if err := loadBlockList(); err != nil {
-			log.Printf("Warning: Failed to load blocklist: %v", err)
+		// Just load the blocklist for all commands; a check against the database only
+		// needs the entries covering the target
+		var loadErr error
+		if command == CheckCommand && storage == "sqlite" {
+			loadErr = loadCoveringBlocksDB(target)
+		} else {
+			loadErr = loadBlockList()
+		}
+		if loadErr != nil {
+			log.Printf("Warning: Failed to load blocklist: %v", loadErr)
 		}
 
 		// Handle each command differently
@@ -226,6 +471,46 @@ func main() {
 			if err := clientCheckIP(target); err != nil {
 				log.Fatalf("Error checking IP: %v", err)
 			}
+		case StatusCommand:
+			log.Fatalf("Status is only available from a running server")
+		case TraceCommand:
+			log.Fatalf("Tracing is only available on a running server")
+		case StatsCommand:
+			log.Fatalf("Stats are only available from a running server")
+		case ReloadCommand:
+			log.Fatalf("Reload only applies to a running server")
+		case EnableRuleCommand, DisableRuleCommand, ShowRulesCommand:
+			log.Fatalf("Switching and listing rules only applies to a running server; edit the rules file instead")
+		case AllowCommand:
+			// Only the file changes; the server exempts the address when it applies the blocklist
+			if err := readWhitelistFile(whitelistFilePath); err != nil {
+				log.Fatalf("Error reading whitelist: %v", err)
+			}
+			result, err := clientAllowIP(target)
+			if err != nil {
+				log.Fatalf("Error whitelisting %s: %v", target, err)
+			}
+			log.Println(result)
+		case WhitelistAddCommand, WhitelistRemoveCommand, WhitelistListCommand:
+			// As for allow, only the file changes; a blocked address stays blocked until
+			// -unblock
+			if err := readWhitelistFile(whitelistFilePath); err != nil {
+				log.Fatalf("Error reading whitelist: %v", err)
+			}
+			var result string
+			var err error
+			switch command {
+			case WhitelistAddCommand:
+				result, err = whitelistAdd(target, "cli")
+			case WhitelistRemoveCommand:
+				result, err = whitelistRemove(target, "cli")
+			default:
+				result = whitelistListing()
+			}
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			log.Println(result)
 		case ListCommand:
 			// For list, we don't need to set up the firewall
 			if err := clientListBlocked(); err != nil {
@@ -256,7 +541,7 @@ func main() {
 				}
 
 				// Block the IP using the manager
-				if err := clientBlockIP(target); err != nil {
+				if err := clientBlockIP(target, "cli"); err != nil {
 					log.Fatalf("Error blocking IP: %v", err)
 				}
 			}
@@ -292,7 +577,10 @@ func main() {
 				}
 
 				// Also remove from the persistent blocklist
-				if err := clientUnblockIP(target); err != nil { // clientUnblockIP handles blocklist removal
+				if unblockForce {
+					excludeFromFeeds(target)
+				}
+				if err := clientUnblockIP(target, "cli", !unblockSkipMembers); err != nil { // clientUnblockIP handles blocklist removal
 					log.Fatalf("Error updating blocklist for %s: %v", target, err)
 				}
 				log.Printf("Successfully unblocked %s", target)
@@ -302,6 +590,32 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *uninstall {
+		if err := runUninstall(*purge); err != nil {
+			log.Fatalf("Error uninstalling: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Rule testing reads the rules and a log, and leaves the firewall alone
+	if *testRulesFile != "" {
+		os.Exit(runRuleTest(*testRulesFile, *testSamples))
+	}
+	if *validateRules != "" {
+		os.Exit(runValidateRules(*validateRules))
+	}
+	if *explain != "" {
+		os.Exit(runExplain(*explain))
+	}
+
+	// Writing the default rules leaves the firewall alone as well
+	if *initRules {
+		os.Exit(runInitRules())
+	}
+	if *mergeDefaults {
+		os.Exit(runMergeDefaultRules())
+	}
+
 	// Server mode - continue with normal operation
 
 	// Initialize the firewall manager (includes setup)
@@ -313,22 +627,46 @@ func main() {
 	if err := loadBlockList(); err != nil {
 		log.Printf("Warning: Failed to load blocklist: %v", err)
 	}
+	// Pick up the match counts of IPs not blocked yet, and where reading of each log stopped
+	loadAccessState()
+	loadLogOffsets()
 
-	// Load the rules from file
+	// Load the custom log formats and the rules from file
+	if err := loadLogFormats(); err != nil {
+		log.Printf("Warning: Failed to load log formats: %v", err)
+	}
 	if err := loadRules(); err != nil {
-		log.Printf("Warning: Failed to load rules: %v", err)
+		log.Printf("Error: Failed to load rules, no line will match until they are reloaded: %v", err)
+	}
+	if err := loadOverrides(); err != nil {
+		log.Printf("Warning: Failed to load overrides: %v", err)
 	}
 
-	if logFormat != "apache" && logFormat != "caddy" {
-		log.Fatal("Invalid server format: must be 'apache' or 'caddy'")
+	customFormat := customLogFormats[logFormat]
+	if !isBuiltinLogFormat(logFormat) && customFormat == nil {
+		log.Fatalf("Invalid server format %q: must be 'apache', 'nginx', 'caddy' or a format defined in %s", logFormat, logFormatsPath)
+	}
+	if err := parseFormatMap(); err != nil {
+		log.Fatalf("Invalid formatMap: %v", err)
 	}
-	if _, err := os.Stat(logpath); err != nil {
-		log.Fatal("logpath invalid: ", logpath)
+	if len(logDirs()) == 0 && logSource == "files" && !*stdinMode {
+		log.Fatal("logPath lists no log directories")
+	}
+	for _, dir := range logDirs() {
+		if logSource != "files" || *stdinMode {
+			break
+		}
+		if _, err := os.Stat(dir); err != nil {
+			log.Printf("Warning: Log directory %s is not available (%v), it will be watched for once it appears", dir, err)
+		}
 	}
 
 	if logFormat == "caddy" {
 		fileSuffix = ".log"
 	}
+	if customFormat != nil && customFormat.FileSuffix != "" {
+		fileSuffix = customFormat.FileSuffix
+	}
 
 	// Log configuration settings
 	// Log configuration settings only in debug mode
@@ -340,13 +678,7 @@ func main() {
 	}
 
 	// Determine whitelisted addresses from local interfaces
-	addrs, _ := net.InterfaceAddrs()
-	for _, addr := range addrs {
-		if ip, _, err := net.ParseCIDR(addr.String()); err == nil {
-			whitelist[ip.String()] = true
-			// if debug { log.Printf("Added local IP %s to whitelist", ip.String()) }
-		}
-	}
+	whitelistLocalAddresses()
 
 	// Read whitelist from file
 	if err := readWhitelistFile(whitelistFilePath); err != nil {
@@ -385,6 +717,9 @@ func main() {
 		listFirewallRules()
 	}
 
+	// Drop blocks that expired while we were not running, then apply the rest
+	pruneExpiredBlocks(false)
+
 	// Apply the blocklist to the firewall using the manager
 	// applyBlockList logs its own summary message
 	if err := applyBlockList(); err != nil {
@@ -397,6 +732,16 @@ func main() {
 		listFirewallRules()
 	}
 
+	// Stdin mode processes the piped log lines and exits, leaving a running server alone
+	if *stdinMode {
+		os.Exit(runStdin(os.Stdin))
+	}
+
+	// Start peer synchronization before the socket server, whose commands publish to the peers
+	if err := startPeerSync(); err != nil {
+		log.Printf("Warning: Peer synchronization disabled: %v", err)
+	}
+
 	// Start the socket server for client communication
 	if err := startSocketServer(); err != nil {
 		log.Printf("Warning: Failed to start socket server: %v", err)
@@ -426,27 +771,80 @@ func main() {
 	startChallengeServer()
 	// if debug { log.Println("[Startup] Returned from startChallengeServer function call.") } // Less important
 
-	// Set up the log file watcher
-	watcher, err := setupLogWatcher()
-	if err != nil {
-		log.Fatalf("Failed to set up log watcher: %v", err)
+	// Set up the log file watcher, unless the logs come from the journal or are polled
+	var watcher *fsnotify.Watcher
+	if logSource == "files" && watchMode == "poll" {
+		startPolling("watchMode = poll")
+	} else if logSource == "files" {
+		w, err := setupLogWatcher()
+		if err != nil && watchMode == "inotify" {
+			log.Fatalf("Failed to set up log watcher: %v", err)
+		} else if err != nil {
+			startPolling("cannot set up the log watcher: " + err.Error())
+		} else {
+			defer w.Close()
+			watcher = w
+		}
 	}
-	defer watcher.Close()
 
 	// Start periodic tasks
+	startAuditLog()
+	startBlockListSaver()
 	startPeriodicTasks(watcher)
+	startReconcileTask()
+	startFeedTask()
+	startRemoteRulesTask()
+	if err := startBlocklistWatch(); err != nil {
+		log.Printf("Warning: Failed to watch the blocklist file for external changes: %v", err)
+	}
+	if err := startWhitelistWatch(); err != nil {
+		log.Printf("Warning: Failed to watch the whitelist file for changes: %v", err)
+	}
+	startWhitelistRefresh()
 
-	// Process existing logs
-	processExistingLogs()
+	startMatchWorkers()
+	if err := startSyslogListeners(); err != nil {
+		log.Fatalf("Failed to start syslog listener: %v", err)
+	}
+	if logSource == "journald" {
+		startJournalReader()
+	} else {
+		// Catch up on recent entries that were rotated away, then process existing logs
+		processRotatedLogs()
+		processExistingLogs()
+	}
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal; SIGHUP reloads the log file selection
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reloadLogFileSelection(*configPath); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
 
 	log.Println("Shutting down gracefully...")
 	if err := saveBlockList(); err != nil {
 		log.Printf("Warning: Failed to save blocklist during shutdown: %v", err)
 	}
+	if err := saveAccessState(); err != nil {
+		log.Printf("Warning: Failed to save access records during shutdown: %v", err)
+	}
+	if err := saveJournalCursor(); err != nil {
+		log.Printf("Warning: Failed to save journal cursor during shutdown: %v", err)
+	}
+	if err := saveLogOffsets(); err != nil {
+		log.Printf("Warning: Failed to save log offsets during shutdown: %v", err)
+	}
+	flushAuditLog()
+	if removeRulesOnExit && fwManager != nil {
+		log.Println("Removing firewall rules (removeRulesOnExit is enabled)...")
+		if err := fwManager.Teardown(); err != nil {
+			log.Printf("Warning: Failed to remove firewall rules during shutdown: %v", err)
+		}
+	}
 	log.Println("Shutdown complete.")
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// --- Matcher worker pool ---
+
+// Readers of log files, the journal and the syslog listener do not match lines
+// themselves: they check the timestamp of each line against the last one processed for
+// the file, in order, and queue the line for a pool of matchWorkers goroutines that run
+// the rules, whitelists and blocking. A slow domain whitelist lookup then holds up one
+// worker instead of the reading of a file, and the number of goroutines contending for
+// the shared state no longer grows with the number of log files. The queue holds
+// matchQueueSize lines; when it is full, readers wait for room, so lines are never
+// dropped. Lines still queued at shutdown are not processed.
+
+// logEntry is a log line waiting for a matcher.
+type logEntry struct {
+	line         string
+	filePath     string
+	format       string
+	state        *FileState
+	timestamp    time.Time
+	hasTimestamp bool
+}
+
+var (
+	matchQueue   chan logEntry // nil until startMatchWorkers; lines are then matched inline
+	matchWaits   atomic.Int64  // Times a reader found the queue full
+	matchWorkerN int           // Workers started
+)
+
+// startMatchWorkers starts the matcher workers.
+func startMatchWorkers() {
+	matchWorkerN = matchWorkers
+	if matchWorkerN <= 0 {
+		matchWorkerN = runtime.NumCPU()
+	}
+	matchQueue = make(chan logEntry, matchQueueSize)
+	for i := 0; i < matchWorkerN; i++ {
+		go func() {
+			for entry := range matchQueue {
+				analyzeLogEntry(entry)
+			}
+		}()
+	}
+	if debug {
+		log.Printf("Started %d matcher workers with a queue of %d lines", matchWorkerN, matchQueueSize)
+	}
+}
+
+// newLogEntry extracts the timestamp of line and reports false if the entry is not newer
+// than the last one processed for state and must be skipped.
+func newLogEntry(line, filePath, format string, state *FileState) (logEntry, bool) {
+	entry := logEntry{line: line, filePath: filePath, format: format, state: state}
+	if !acceptLogLine(line, format) {
+		return entry, false
+	}
+	entry.timestamp, entry.hasTimestamp = extractTimestamp(line, format, filePath)
+	if entry.hasTimestamp && state != nil {
+		stateMutex.Lock()
+		last := state.LastTimestamp
+		stateMutex.Unlock()
+		if !isNewerThan(entry.timestamp, last) {
+			return entry, false
+		}
+	}
+	return entry, true
+}
+
+// enqueueLogEntry queues a log line for the matcher workers, waiting while the queue is
+// full. Before the workers are started, the line is matched inline.
+func enqueueLogEntry(line, filePath, format string, state *FileState) {
+	entry, ok := newLogEntry(line, filePath, format, state)
+	if !ok {
+		return
+	}
+	if matchQueue == nil {
+		analyzeLogEntry(entry)
+		return
+	}
+	select {
+	case matchQueue <- entry:
+	default:
+		if matchWaits.Add(1) == 1 {
+			log.Printf("Warning: The matcher queue is full (%d lines), log reading is slowed down; consider raising matchWorkers", matchQueueSize)
+		}
+		matchQueue <- entry
+	}
+}
+
+// markProcessed records the timestamp of entry as the last processed for its file.
+// Workers finish entries out of order, so the timestamp only moves forward.
+func markProcessed(entry logEntry, ip string) {
+	if !entry.hasTimestamp || entry.state == nil {
+		return
+	}
+	stateMutex.Lock()
+	if entry.timestamp.After(entry.state.LastTimestamp) {
+		entry.state.LastTimestamp = entry.timestamp
+		entry.state.LastProcessedIP = ip
+	}
+	stateMutex.Unlock()
+}
+
+// matchQueueStatus describes the matcher queue for the status command.
+func matchQueueStatus() string {
+	if matchQueue == nil {
+		return "not started"
+	}
+	return fmt.Sprintf("%d/%d lines queued, %d workers, full %d times", len(matchQueue), cap(matchQueue), matchWorkerN, matchWaits.Load())
+}
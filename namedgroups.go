@@ -0,0 +1,81 @@
+package main
+
+// --- Named capture groups in rule regexes ---
+
+// Rules find the client address in their first capture group (apache, apache-vhost,
+// nginx), the client_ip of Caddy entries, the [client ...] token of error logs or the ip
+// field of a custom format. A rule regex can name its groups instead: (?P<ip>...) is the
+// client address whatever the format and wherever the group is, (?P<status>...) follows
+// the rule name in the reason, and (?P<ua>...) is the user agent recorded with the
+// block. The usual places are only used for what the regex has no group for. The groups
+// of Caddy rules are used when the rule runs regex over the line, i.e. has no field
+// matchers.
+
+// compileNamedGroups records the positions of the named groups of the rule's regex.
+func (r *Rule) compileNamedGroups() {
+	r.ipGroup = r.compiledRegex.SubexpIndex("ip")
+	r.statusGroup = r.compiledRegex.SubexpIndex("status")
+	r.uaGroup = r.compiledRegex.SubexpIndex("ua")
+}
+
+// hasNamedGroups reports whether the rule's regex has any of the ip, status and ua groups.
+func (r *Rule) hasNamedGroups() bool {
+	return r.ipGroup > 0 || r.statusGroup > 0 || r.uaGroup > 0
+}
+
+// submatch matches the rule's regex against line, returning the capture groups if the
+// rule has named ones (nil otherwise, as they are not needed) and whether it matched.
+func (r *Rule) submatch(line string) ([]string, bool) {
+	if !r.hasNamedGroups() {
+		return nil, r.compiledRegex.MatchString(line)
+	}
+	matches := r.compiledRegex.FindStringSubmatch(line)
+	return matches, matches != nil
+}
+
+// group returns what the group at index captured in matches, or "" for no group.
+func group(matches []string, index int) string {
+	if index <= 0 || index >= len(matches) {
+		return ""
+	}
+	return matches[index]
+}
+
+// namedIP returns the address the rule's ip group captured, or "" if it is not an IP
+// address.
+func (r *Rule) namedIP(matches []string, trace *lineTrace) string {
+	captured := group(matches, r.ipGroup)
+	ip := parseClientIP(captured)
+	if ip == nil {
+		trace.printf("Rule %s captured %q in its ip group, which is not an IP address", r.Name, captured)
+		return ""
+	}
+	return ip.String()
+}
+
+// matchReason returns the reason for a match of the rule: its name, followed by what
+// its status group captured, or by status if it has none.
+func (r *Rule) matchReason(matches []string, status string) string {
+	if r.statusGroup > 0 {
+		status = group(matches, r.statusGroup)
+	}
+	if status == "" {
+		return r.Name
+	}
+	return r.Name + " " + status
+}
+
+// matchUserAgent returns the user agent of a line in format that matched the named rule:
+// what the rule's ua group captured, or else what extractUserAgent finds.
+func matchUserAgent(line, format, name string) string {
+	if rule := ruleNamed(name); rule != nil && rule.uaGroup > 0 && !rule.hasCaddyFields() {
+		matched := line
+		if format == "apache-vhost" {
+			_, matched = splitVhost(line)
+		}
+		if ua := group(rule.compiledRegex.FindStringSubmatch(matched), rule.uaGroup); ua != "" {
+			return ua
+		}
+	}
+	return extractUserAgent(line, format)
+}
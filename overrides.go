@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Per-site overrides ---
+
+// Sites with different traffic need different thresholds: a shop gets bursts of 404s from
+// stale product links that would get its customers blocked at threshold = 3. The
+// overrides file lists overrides of threshold, subnetThreshold and expirationPeriod, and
+// rules to leave out, for the log files matching files (globs on the name or the full
+// path, as for logInclude) or the lines of virtual hosts matching vhosts (globs on the
+// apache-vhost host, or the vhost field of a custom format). The first override matching
+// a line applies; its values replace those of the rule that matched, and fields left out
+// keep them.
+
+// DefaultOverridesPath is the default path of the overrides file
+const DefaultOverridesPath = "/etc/apacheblock/overrides.json"
+
+// Override changes the thresholds and rules for some log files or virtual hosts
+type Override struct {
+	Name             string   `json:"name"`                       // Shown by -status
+	Files            []string `json:"files,omitempty"`            // Globs on log file names or paths
+	Vhosts           []string `json:"vhosts,omitempty"`           // Globs on virtual host names
+	Threshold        int      `json:"threshold,omitempty"`        // Matches that trigger a block (0 keeps the rule's)
+	SubnetThreshold  int      `json:"subnetThreshold,omitempty"`  // Blocked IPs that trigger a subnet block (0 keeps subnetThreshold)
+	ExpirationPeriod string   `json:"expirationPeriod,omitempty"` // Time window for threshold, e.g. "10m" (empty keeps the rule's)
+	DisableRules     []string `json:"disableRules,omitempty"`     // Names of rules not applied
+
+	// Parsed ExpirationPeriod and DisableRules (not stored in JSON)
+	expiration time.Duration
+	disabled   map[string]bool
+}
+
+// OverrideSet is the content of the overrides file
+type OverrideSet struct {
+	Overrides []Override `json:"overrides"`
+}
+
+// overrides holds the overrides loaded from overridesPath, in file order
+var overrides []Override
+
+// loadOverrides loads the overrides. A missing file is not an error, as overrides are
+// optional.
+func loadOverrides() error {
+	data, err := os.ReadFile(overridesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read overrides file: %v", err)
+	}
+	var set OverrideSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to unmarshal overrides: %v", err)
+	}
+
+	var loaded []Override
+	for i := range set.Overrides {
+		o := &set.Overrides[i]
+		if len(o.Files) == 0 && len(o.Vhosts) == 0 {
+			log.Printf("Warning: Skipping override %q without files or vhosts", o.Name)
+			continue
+		}
+		if o.ExpirationPeriod != "" {
+			d, err := time.ParseDuration(o.ExpirationPeriod)
+			if err != nil || d <= 0 {
+				log.Printf("Warning: Invalid expirationPeriod %q in override %s, keeping the rules'", o.ExpirationPeriod, o.Name)
+			} else {
+				o.expiration = d
+			}
+		}
+		o.disabled = make(map[string]bool, len(o.DisableRules))
+		for _, name := range o.DisableRules {
+			o.disabled[name] = true
+		}
+		for j := range o.Vhosts {
+			o.Vhosts[j] = strings.ToLower(o.Vhosts[j])
+		}
+		loaded = append(loaded, *o)
+	}
+	overrides = loaded
+
+	if debug {
+		log.Printf("Loaded %d overrides from %s", len(loaded), overridesPath)
+	}
+	return nil
+}
+
+// overrideFor returns the first override for the log file filePath or the virtual host
+// vhost, or nil.
+func overrideFor(filePath, vhost string) *Override {
+	for i := range overrides {
+		o := &overrides[i]
+		if matchesLogPattern(filePath, o.Files) {
+			return o
+		}
+		if vhost != "" {
+			for _, pattern := range o.Vhosts {
+				if ok, _ := filepath.Match(pattern, vhost); ok {
+					return o
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lineVhost returns the virtual host of a line in format, or "" if the format has none.
+func lineVhost(line, format string) string {
+	if format == "apache-vhost" {
+		vhost, _ := splitVhost(line)
+		return vhost
+	}
+	if def := customLogFormats[format]; def != nil {
+		fields, _ := parseLogFields(line, def)
+		return strings.ToLower(fields["vhost"])
+	}
+	return ""
+}
+
+// disabledRules returns the names of the rules the override leaves out; o may be nil.
+func (o *Override) disabledRules() map[string]bool {
+	if o == nil {
+		return nil
+	}
+	return o.disabled
+}
+
+// limits returns the threshold and time window of a rule after the override; o may be nil.
+func (o *Override) limits(ruleThreshold int, ruleDuration time.Duration) (int, time.Duration) {
+	if o == nil {
+		return ruleThreshold, ruleDuration
+	}
+	if o.Threshold > 0 {
+		ruleThreshold = o.Threshold
+	}
+	if o.expiration > 0 {
+		ruleDuration = o.expiration
+	}
+	return ruleThreshold, ruleDuration
+}
+
+// subnetLimit returns the subnet threshold after the override; o may be nil.
+func (o *Override) subnetLimit() int {
+	if o == nil || o.SubnetThreshold <= 0 {
+		return subnetThreshold
+	}
+	return o.SubnetThreshold
+}
+
+// overrideStatus lists the monitored log files an override applies to, for the status
+// command. Overrides for virtual hosts are listed by name, as they apply per line.
+func overrideStatus() string {
+	if len(overrides) == 0 {
+		return "none"
+	}
+	stateMutex.Lock()
+	files := make([]string, 0, len(fileStates))
+	for file := range fileStates {
+		files = append(files, file)
+	}
+	stateMutex.Unlock()
+	sort.Strings(files)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d loaded", len(overrides))
+	for _, file := range files {
+		if o := overrideFor(file, ""); o != nil {
+			fmt.Fprintf(&b, "\n  %s: %s", file, o.Name)
+		}
+	}
+	for _, o := range overrides {
+		if len(o.Vhosts) > 0 {
+			fmt.Fprintf(&b, "\n  vhosts %s: %s", strings.Join(o.Vhosts, ", "), o.Name)
+		}
+	}
+	return b.String()
+}
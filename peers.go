@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Peer synchronization ---
+
+// With peers configured, servers share their blocks: each local block or unblock is sent to
+// every peer as an event over HTTPS, signed with peerSecret. A peer applies the event and
+// records the sending node as the entry's peer. Received events are applied but never sent
+// on, nor are feed entries, so nothing loops between servers; every server therefore lists
+// all the others. Each peer has its own queue; events for a peer that cannot be reached
+// wait there and are retried with backoff. At startup, and after a queue overflows, the two
+// servers exchange their full lists of local blocks instead.
+
+const (
+	peerEventPath       = "/apacheblock/v1/event"
+	peerSyncPath        = "/apacheblock/v1/sync"
+	peerTimestampHeader = "X-Apacheblock-Timestamp"
+	peerSignatureHeader = "X-Apacheblock-Signature"
+	peerMaxSkew         = 5 * time.Minute // How old a signed request may be
+	peerQueueLimit      = 10000           // Events queued per peer before falling back to a full exchange
+	peerBatchSize       = 500             // Events sent per request
+	peerMaxBody         = 64 << 20
+)
+
+// peerEvent is a block or unblock sent to the peers.
+type peerEvent struct {
+	ID        string     `json:"id"`
+	Node      string     `json:"node"` // peerNodeName of the server the block was made on
+	Type      string     `json:"type"` // "block" or "unblock"
+	Target    string     `json:"target"`
+	Reason    string     `json:"reason,omitempty"`
+	Action    string     `json:"action,omitempty"`
+	Ports     []string   `json:"ports,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// peerSync is a node's full list of local blocks, exchanged at startup.
+type peerSync struct {
+	Node    string      `json:"node"`
+	Entries []peerEvent `json:"entries"`
+}
+
+// peerClient sends requests to the peers. The peers serve a self-signed certificate, so
+// requests and responses are authenticated by their signature instead.
+var peerClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+// peerLinks holds one link per configured peer, set up by startPeerSync.
+var peerLinks []*peerLink
+
+// peerLink queues the events for one peer.
+type peerLink struct {
+	endpoint string
+	mu       sync.Mutex
+	queue    []peerEvent
+	resync   bool          // A full exchange is due
+	wake     chan struct{} // Signals new events to run
+}
+
+// newPeerLink returns a link that starts with a full exchange.
+func newPeerLink(endpoint string) *peerLink {
+	return &peerLink{endpoint: endpoint, resync: true, wake: make(chan struct{}, 1)}
+}
+
+// enqueue adds an event to the queue. A full queue is dropped in favour of a full exchange.
+func (l *peerLink) enqueue(event peerEvent) {
+	l.mu.Lock()
+	if len(l.queue) >= peerQueueLimit {
+		if !l.resync {
+			log.Printf("Warning: More than %d events queued for peer %s; dropping them for a full exchange once it is reachable", peerQueueLimit, l.endpoint)
+		}
+		l.queue = nil
+		l.resync = true
+	} else {
+		l.queue = append(l.queue, event)
+	}
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queue whenever events arrive, retrying with backoff while the peer is unreachable.
+func (l *peerLink) run() {
+	backoff := time.Second
+	down := false
+	for {
+		err := l.flush()
+		if err == nil {
+			if down {
+				log.Printf("Peer %s is reachable again", l.endpoint)
+				down = false
+			}
+			backoff = time.Second
+			<-l.wake
+			continue
+		}
+		if !down {
+			log.Printf("Warning: Peer %s is unreachable, queueing its events: %v", l.endpoint, err)
+			down = true
+		} else if debug {
+			log.Printf("Peer %s still unreachable (retrying in %v): %v", l.endpoint, backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// flush runs a due full exchange, then sends the queue in batches.
+func (l *peerLink) flush() error {
+	l.mu.Lock()
+	resync := l.resync
+	l.mu.Unlock()
+	if resync {
+		if err := l.exchange(); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		l.resync = false
+		l.mu.Unlock()
+	}
+
+	for {
+		l.mu.Lock()
+		n := min(len(l.queue), peerBatchSize)
+		batch := append([]peerEvent(nil), l.queue[:n]...)
+		l.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if err := postPeer(l.endpoint, peerEventPath, batch, nil); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		// An overflow while sending replaced the queue; resending events is harmless
+		if !l.resync {
+			l.queue = l.queue[n:]
+		}
+		l.mu.Unlock()
+	}
+}
+
+// exchange sends the local blocks to the peer and applies the peer's.
+func (l *peerLink) exchange() error {
+	mu.Lock()
+	local := peerSync{Node: peerNodeName, Entries: localPeerEntriesLocked()}
+	mu.Unlock()
+	var remote peerSync
+	if err := postPeer(l.endpoint, peerSyncPath, local, &remote); err != nil {
+		return err
+	}
+	applyPeerSync(remote)
+	if debug {
+		log.Printf("Exchanged blocklists with peer %s (node %s): sent %d entries, received %d", l.endpoint, remote.Node, len(local.Entries), len(remote.Entries))
+	}
+	return nil
+}
+
+// peerSignature signs a request body (or, with path + " response", a response body).
+func peerSignature(path, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(peerSecret))
+	mac.Write([]byte(path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signPeerMessage sets the timestamp and signature headers for body.
+func signPeerMessage(header http.Header, path string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(peerTimestampHeader, timestamp)
+	header.Set(peerSignatureHeader, peerSignature(path, timestamp, body))
+}
+
+// verifyPeerMessage checks the signature and age of a signed request or response.
+func verifyPeerMessage(header http.Header, path string, body []byte) error {
+	timestamp := header.Get(peerTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > peerMaxSkew || age < -peerMaxSkew {
+		return fmt.Errorf("timestamp off by %v (check the clocks)", age.Round(time.Second))
+	}
+	want := peerSignature(path, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(peerSignatureHeader)), []byte(want)) {
+		return fmt.Errorf("invalid signature (check peerSecret)")
+	}
+	return nil
+}
+
+// postPeer sends a signed request to a peer and, if out is not nil, decodes its signed response into out.
+func postPeer(endpoint, path string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid peer address: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signPeerMessage(req.Header, path, body)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, peerMaxBody))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := verifyPeerMessage(resp.Header, path+" response", data); err != nil {
+		return fmt.Errorf("rejected response: %v", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// newPeerEventID returns a random event ID, used by the peers to drop duplicates.
+func newPeerEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// peerEventLocked builds the event for a block or unblock of target. The caller must hold mu.
+func peerEventLocked(kind, target string) peerEvent {
+	event := peerEvent{ID: newPeerEventID(), Node: peerNodeName, Type: kind, Target: target}
+	if kind == "block" {
+		entry := blockEntryLocked(target)
+		event.Reason, event.Action, event.Ports, event.ExpiresAt = entry.Reason, entry.Action, entry.Ports, entry.ExpiresAt
+	}
+	return event
+}
+
+// isLocalEntryLocked reports whether an entry was blocked on this server, rather than
+// received from a peer or imported from a feed. The caller must hold mu.
+func isLocalEntryLocked(target string) bool {
+	meta := blockedMeta[target]
+	return meta == nil || (meta.Peer == "" && meta.Source == "")
+}
+
+// localPeerEntriesLocked returns block events for every local entry. The caller must hold mu.
+func localPeerEntriesLocked() []peerEvent {
+	entries := make([]peerEvent, 0, len(blockedIPs)+len(blockedSubnets))
+	for _, targets := range []map[string]struct{}{blockedIPs, blockedSubnets} {
+		for target := range targets {
+			if isLocalEntryLocked(target) {
+				entries = append(entries, peerEventLocked("block", target))
+			}
+		}
+	}
+	return entries
+}
+
+// queuePeerEvent hands an event to every peer link.
+func queuePeerEvent(event peerEvent) {
+	for _, link := range peerLinks {
+		link.enqueue(event)
+	}
+}
+
+// publishPeerBlock sends a new local block to the peers.
+func publishPeerBlock(target string) {
+	if len(peerLinks) == 0 {
+		return
+	}
+	mu.Lock()
+	if !isLocalEntryLocked(target) {
+		mu.Unlock()
+		return
+	}
+	event := peerEventLocked("block", target)
+	mu.Unlock()
+	queuePeerEvent(event)
+}
+
+// publishPeerUnblock sends an operator's unblock to the peers, whichever server made the block.
+func publishPeerUnblock(target string) {
+	if len(peerLinks) == 0 {
+		return
+	}
+	mu.Lock()
+	event := peerEventLocked("unblock", target)
+	mu.Unlock()
+	queuePeerEvent(event)
+}
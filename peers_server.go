@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// peerSeen holds the IDs of recently applied events, so a resent batch is applied once
+	peerSeen      = make(map[string]time.Time)
+	peerSeenMu    sync.Mutex
+	peerSeenPrune time.Time
+)
+
+// startPeerSync starts the peer sync server on peerListen and a link to each peer. It does
+// nothing unless peers are configured.
+func startPeerSync() error {
+	if len(peers) == 0 {
+		return nil
+	}
+	if peerSecret == "" {
+		return fmt.Errorf("peers are configured but peerSecret is empty")
+	}
+	if dryRun {
+		// Local dry-run blocks must not become real blocks on the peers
+		log.Println("Dry-run mode: peer synchronization disabled")
+		return nil
+	}
+	if peerNodeName == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine the hostname for peerNodeName: %v", err)
+		}
+		peerNodeName = host
+	}
+	if len(snakeoilCertificate.Certificate) == 0 {
+		if err := generateAndLoadSnakeoilCert(); err != nil {
+			return fmt.Errorf("failed to generate a certificate for the peer sync server: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(peerEventPath, handlePeerEvents)
+	mux.HandleFunc(peerSyncPath, handlePeerSync)
+	listener, err := net.Listen("tcp", peerListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", peerListen, err)
+	}
+	server := &http.Server{
+		Handler:           mux,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{snakeoilCertificate}},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("Peer sync server stopped: %v", err)
+		}
+	}()
+
+	for _, endpoint := range peers {
+		link := newPeerLink(endpoint)
+		peerLinks = append(peerLinks, link)
+		go link.run()
+	}
+	log.Printf("Peer sync server listening on %s as node %s, %d peers", peerListen, peerNodeName, len(peers))
+	return nil
+}
+
+// readPeerRequest reads and verifies a signed peer request, answering it if it is rejected.
+func readPeerRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, peerMaxBody))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := verifyPeerMessage(r.Header, r.URL.Path, body); err != nil {
+		log.Printf("Warning: Rejected peer request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return body, true
+}
+
+// handlePeerEvents applies a batch of events from a peer.
+func handlePeerEvents(w http.ResponseWriter, r *http.Request) {
+	body, ok := readPeerRequest(w, r)
+	if !ok {
+		return
+	}
+	var events []peerEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "invalid events", http.StatusBadRequest)
+		return
+	}
+
+	changed := false
+	for _, event := range events {
+		if event.ID == "" {
+			// Without an ID, a replayed event could not be told apart from a new one
+			log.Printf("Warning: Ignoring peer event without an ID from node %s", event.Node)
+			continue
+		}
+		if event.Node == peerNodeName || !firstPeerSighting(event.ID) {
+			continue
+		}
+		switch event.Type {
+		case "block":
+			changed = applyPeerBlock(event) || changed
+		case "unblock":
+			applyPeerUnblock(event)
+		default:
+			log.Printf("Warning: Ignoring peer event of unknown type %q from node %s", event.Type, event.Node)
+		}
+	}
+	if changed {
+		requestBlockListSave()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePeerSync applies a peer's full list of local blocks and answers with ours.
+func handlePeerSync(w http.ResponseWriter, r *http.Request) {
+	body, ok := readPeerRequest(w, r)
+	if !ok {
+		return
+	}
+	var remote peerSync
+	if err := json.Unmarshal(body, &remote); err != nil || remote.Node == "" {
+		http.Error(w, "invalid sync request", http.StatusBadRequest)
+		return
+	}
+
+	mu.Lock()
+	local := peerSync{Node: peerNodeName, Entries: localPeerEntriesLocked()}
+	mu.Unlock()
+	// Answer from the list as it was before applying the peer's, which are not ours to send back
+	data, err := json.Marshal(local)
+	if err != nil {
+		http.Error(w, "failed to encode blocklist", http.StatusInternalServerError)
+		return
+	}
+	applyPeerSync(remote)
+
+	w.Header().Set("Content-Type", "application/json")
+	signPeerMessage(w.Header(), r.URL.Path+" response", data)
+	w.Write(data)
+}
+
+// firstPeerSighting records an event ID and reports whether it was new. An empty ID is
+// never new.
+func firstPeerSighting(id string) bool {
+	if id == "" {
+		return false
+	}
+	peerSeenMu.Lock()
+	defer peerSeenMu.Unlock()
+	now := time.Now()
+	if now.Sub(peerSeenPrune) > time.Minute {
+		for seen, at := range peerSeen {
+			if now.Sub(at) > 2*peerMaxSkew {
+				delete(peerSeen, seen)
+			}
+		}
+		peerSeenPrune = now
+	}
+	if _, seen := peerSeen[id]; seen {
+		return false
+	}
+	peerSeen[id] = now
+	return true
+}
+
+// applyPeerSync blocks the entries of a peer's full list and lifts the entries received
+// from that peer that are no longer in it.
+func applyPeerSync(remote peerSync) {
+	if remote.Node == "" || remote.Node == peerNodeName {
+		if remote.Node == peerNodeName {
+			log.Printf("Warning: A peer uses this server's node name %s; set a distinct peerNodeName on each server", peerNodeName)
+		}
+		return
+	}
+	listed := make(map[string]bool, len(remote.Entries))
+	changed := false
+	for _, entry := range remote.Entries {
+		entry.Node = remote.Node
+		listed[normalizeTarget(entry.Target)] = true
+		changed = applyPeerBlock(entry) || changed
+	}
+
+	var stale []string
+	mu.Lock()
+	for target, meta := range blockedMeta {
+		if meta.Peer == remote.Node && !listed[target] {
+			stale = append(stale, target)
+		}
+	}
+	mu.Unlock()
+	for _, target := range stale {
+		if ok, _ := unblockTarget(target, true); ok {
+			log.Printf("Unblocked %s, which peer node %s no longer blocks", target, remote.Node)
+		}
+	}
+	if changed {
+		if err := saveBlockList(); err != nil {
+			log.Printf("Warning: Failed to save blocklist after syncing with peer node %s: %v", remote.Node, err)
+		}
+	}
+}
+
+// applyPeerBlock blocks a target received from a peer, tagging the entry with the peer's
+// node so it is not sent on. It reports whether the blocklist changed; the caller saves it.
+func applyPeerBlock(event peerEvent) bool {
+	if !isValidIPOrCIDR(event.Target) {
+		log.Printf("Warning: Ignoring invalid target %q from peer node %s", event.Target, event.Node)
+		return false
+	}
+	target := normalizeTarget(event.Target)
+	if event.ExpiresAt != nil && !event.ExpiresAt.After(time.Now()) {
+		return false
+	}
+	switch event.Action {
+	case "", "drop", "reject", "ratelimit":
+	default:
+		event.Action = ""
+	}
+	if len(event.Ports) > 0 {
+		event.Ports, _ = parsePortList(strings.Join(event.Ports, ","))
+	}
+	if isWhitelisted(target) {
+		if debug {
+			log.Printf("Not applying block of whitelisted %s from peer node %s", target, event.Node)
+		}
+		return false
+	}
+
+	mu.Lock()
+	_, isIP := blockedIPs[target]
+	_, isSubnet := blockedSubnets[target]
+	_, pending := pendingBlocks[target]
+	if isIP || isSubnet || pending {
+		mu.Unlock()
+		return false
+	}
+	pendingBlocks[target] = struct{}{}
+	mu.Unlock()
+
+	opts := RuleOptions{Reason: "peer " + event.Node + ": " + event.Reason, Action: event.Action, Ports: event.Ports}
+	if event.ExpiresAt != nil {
+		opts.Timeout = remainingTimeout(*event.ExpiresAt)
+	}
+	err := addFirewallRule(target, opts)
+
+	mu.Lock()
+	delete(pendingBlocks, target)
+	if err == nil {
+		if strings.Contains(target, "/") {
+			addBlockedSubnetLocked(target)
+		} else {
+			blockedIPs[target] = struct{}{}
+		}
+		setBlockedActionLocked(target, event.Action)
+		if event.ExpiresAt != nil {
+			blockedExpiry[target] = *event.ExpiresAt
+		}
+		recordBlockMetaLocked(target, event.Reason, "")
+		setBlockedPortsLocked(target, event.Ports)
+		blockedMeta[target].Peer = event.Node
+	}
+	mu.Unlock()
+
+	if err != nil {
+		logBlockFailure(entryType(target), target, err)
+		return false
+	}
+	exemptSubnet(target, false)
+	log.Printf("BLOCKED %s from peer node %s (%s)", target, event.Node, event.Reason)
+	writeAudit(auditRecord{Action: "block", Target: target, Reason: opts.Reason, Source: "peer"})
+	return true
+}
+
+// applyPeerUnblock lifts a target an operator unblocked on a peer.
+func applyPeerUnblock(event peerEvent) {
+	if !isValidIPOrCIDR(event.Target) {
+		return
+	}
+	if ok, err := unblockTarget(event.Target, true); err != nil {
+		log.Printf("Warning: Failed to apply unblock of %s from peer node %s: %v", event.Target, event.Node, err)
+	} else if ok {
+		log.Printf("Unblocked %s, unblocked on peer node %s", normalizeTarget(event.Target), event.Node)
+		writeAudit(auditRecord{Action: "unblock", Target: normalizeTarget(event.Target), Reason: "unblocked on peer node " + event.Node, Source: "peer"})
+	}
+}
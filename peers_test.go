@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// usePeerNode makes this server node "local" with a test peerSecret, blocking on a fake
+// iptables, for the test.
+func usePeerNode(t *testing.T) *fakeIPTables {
+	t.Helper()
+	m, ipt4, _ := newFakeIPTablesManager(t)
+	useTempBlockList(t)
+	savedManager, savedSecret, savedNode := fwManager, peerSecret, peerNodeName
+	fwManager, peerSecret, peerNodeName = m, "test secret", "local"
+	mu.Lock()
+	savedMeta, savedActions, savedExpiry := blockedMeta, blockedActions, blockedExpiry
+	blockedMeta, blockedActions, blockedExpiry = make(map[string]*BlockEntry), make(map[string]string), make(map[string]time.Time)
+	mu.Unlock()
+	peerSeenMu.Lock()
+	peerSeen = make(map[string]time.Time)
+	peerSeenMu.Unlock()
+	t.Cleanup(func() {
+		fwManager, peerSecret, peerNodeName = savedManager, savedSecret, savedNode
+		mu.Lock()
+		blockedMeta, blockedActions, blockedExpiry = savedMeta, savedActions, savedExpiry
+		mu.Unlock()
+		peerSeenMu.Lock()
+		peerSeen = make(map[string]time.Time)
+		peerSeenMu.Unlock()
+	})
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return ipt4
+}
+
+// signedAt returns the headers of body signed for path at time at.
+func signedAt(path string, body []byte, at time.Time) http.Header {
+	header := http.Header{}
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	header.Set(peerTimestampHeader, timestamp)
+	header.Set(peerSignatureHeader, peerSignature(path, timestamp, body))
+	return header
+}
+
+// TestVerifyPeerMessage checks that only messages signed with peerSecret for their path,
+// and recently, are accepted, and that responses are signed apart from requests.
+func TestVerifyPeerMessage(t *testing.T) {
+	savedSecret := peerSecret
+	peerSecret = "test secret"
+	t.Cleanup(func() { peerSecret = savedSecret })
+	body := []byte(`[{"id":"1","node":"peer","type":"block","target":"192.0.2.1"}]`)
+
+	header := http.Header{}
+	signPeerMessage(header, peerEventPath, body)
+	if err := verifyPeerMessage(header, peerEventPath, body); err != nil {
+		t.Fatalf("signed request rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		path   string
+		body   []byte
+	}{
+		{"other body", header, peerEventPath, []byte(`[{"id":"1","node":"peer","type":"block","target":"192.0.2.2"}]`)},
+		{"other path", header, peerSyncPath, body},
+		{"request as response", header, peerEventPath + " response", body},
+		{"no signature", http.Header{peerTimestampHeader: {header.Get(peerTimestampHeader)}}, peerEventPath, body},
+		{"no timestamp", http.Header{peerSignatureHeader: {header.Get(peerSignatureHeader)}}, peerEventPath, body},
+		{"invalid timestamp", http.Header{peerTimestampHeader: {"yesterday"}, peerSignatureHeader: {header.Get(peerSignatureHeader)}}, peerEventPath, body},
+		{"too old", signedAt(peerEventPath, body, time.Now().Add(-peerMaxSkew-time.Minute)), peerEventPath, body},
+		{"too new", signedAt(peerEventPath, body, time.Now().Add(peerMaxSkew+time.Minute)), peerEventPath, body},
+	}
+	for _, test := range tests {
+		if err := verifyPeerMessage(test.header, test.path, test.body); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+	for _, skew := range []time.Duration{-peerMaxSkew + time.Minute, peerMaxSkew - time.Minute} {
+		if err := verifyPeerMessage(signedAt(peerEventPath, body, time.Now().Add(skew)), peerEventPath, body); err != nil {
+			t.Errorf("request signed %v from now rejected: %v", skew, err)
+		}
+	}
+
+	// A response is signed for the request path with " response", as handlePeerSync does
+	response := httptest.NewRecorder()
+	signPeerMessage(response.Header(), peerSyncPath+" response", body)
+	if err := verifyPeerMessage(response.Header(), peerSyncPath+" response", body); err != nil {
+		t.Fatalf("signed response rejected: %v", err)
+	}
+	if err := verifyPeerMessage(response.Header(), peerSyncPath, body); err == nil {
+		t.Fatal("response accepted as a request")
+	}
+
+	peerSecret = "other secret"
+	if err := verifyPeerMessage(header, peerEventPath, body); err == nil {
+		t.Fatal("request signed with another secret accepted")
+	}
+}
+
+// postPeerEvents sends events to handlePeerEvents as a peer would.
+func postPeerEvents(t *testing.T, events []peerEvent) {
+	t.Helper()
+	body, err := json.Marshal(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, peerEventPath, bytes.NewReader(body))
+	signPeerMessage(req.Header, peerEventPath, body)
+	response := httptest.NewRecorder()
+	handlePeerEvents(response, req)
+	if response.Code != http.StatusOK {
+		t.Fatalf("events answered with %d", response.Code)
+	}
+}
+
+// TestPeerEventsReplayed checks that a resent event is applied once, and an event without
+// an ID, which could not be told from a resent one, not at all.
+func TestPeerEventsReplayed(t *testing.T) {
+	ipt4 := usePeerNode(t)
+	events := []peerEvent{
+		{ID: "", Node: "peer", Type: "block", Target: "192.0.2.1"},
+		{ID: "event 2", Node: "peer", Type: "block", Target: "192.0.2.2"},
+		{ID: "event 3", Node: "local", Type: "block", Target: "192.0.2.3"}, // Our own, sent back
+	}
+	postPeerEvents(t, events)
+	checkRules(t, ipt4, "filter", "apacheblock",
+		"-s 192.0.2.2/32 -p tcp --dport 443 -j DROP",
+		"-s 192.0.2.2/32 -p tcp --dport 80 -j DROP")
+
+	// Unblocked here meanwhile, so a replay of the block would show
+	if ok, err := unblockTarget("192.0.2.2", true); err != nil || !ok {
+		t.Fatalf("unblocking 192.0.2.2: %v, %v", ok, err)
+	}
+	postPeerEvents(t, events)
+	checkRules(t, ipt4, "filter", "apacheblock")
+	if firstPeerSighting("") {
+		t.Fatal("an empty event ID was new")
+	}
+}
+
+// TestPeerSyncLiftsStaleEntries checks that a peer's full list lifts the entries received
+// from that peer before which it no longer lists, and only those.
+func TestPeerSyncLiftsStaleEntries(t *testing.T) {
+	ipt4 := usePeerNode(t)
+	applyPeerSync(peerSync{Node: "peer", Entries: []peerEvent{
+		{Type: "block", Target: "192.0.2.1", Reason: "test"},
+		{Type: "block", Target: "192.0.2.2", Reason: "test"},
+		{Type: "block", Target: "198.51.100.0/24", Reason: "test"},
+	}})
+	applyPeerSync(peerSync{Node: "other", Entries: []peerEvent{{Type: "block", Target: "192.0.2.3", Reason: "test"}}})
+	if err := addFirewallRule("192.0.2.4", RuleOptions{Reason: "local"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	blockedIPs["192.0.2.4"] = struct{}{}
+	recordBlockMetaLocked("192.0.2.4", "local", "")
+	mu.Unlock()
+
+	applyPeerSync(peerSync{Node: "peer", Entries: []peerEvent{{Type: "block", Target: "192.0.2.2", Reason: "test"}}})
+	mu.Lock()
+	var left []string
+	for _, target := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "198.51.100.0/24"} {
+		_, isIP := blockedIPs[target]
+		_, isSubnet := blockedSubnets[target]
+		if isIP || isSubnet {
+			left = append(left, target)
+		}
+	}
+	mu.Unlock()
+	if want := []string{"192.0.2.2", "192.0.2.3", "192.0.2.4"}; !reflect.DeepEqual(left, want) {
+		t.Fatalf("blocked after the sync: %v, want %v", left, want)
+	}
+	for _, lifted := range []string{"192.0.2.1", "198.51.100.0/24"} {
+		for _, line := range ipt4.rules(t, "filter", "apacheblock") {
+			if hasSource(splitRuleSpec(line), lifted) {
+				t.Errorf("rule for lifted %s left: %s", lifted, line)
+			}
+		}
+	}
+}
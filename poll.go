@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// --- Polling for log changes ---
+
+// Each monitored file is checked for new lines every pollInterval once its reader reaches
+// the end. New log files are found through fsnotify events, backed by a full scan every
+// watchedScanFactor poll intervals (5 minutes by default). inotify does not see changes
+// made on another host, as on NFS, so watchMode = poll skips fsnotify and scans every
+// polledScanFactor poll intervals instead. watchMode = auto, the default, uses fsnotify
+// and switches to polling when a directory cannot be watched.
+
+const (
+	watchedScanFactor = 300 // Poll intervals between scans backing up fsnotify
+	polledScanFactor  = 10  // Poll intervals between scans when polling
+)
+
+// pollingActive is set when log directories are scanned on the polling cadence.
+var pollingActive atomic.Bool
+
+// startPolling switches to polling for new log files, logging why the first time.
+func startPolling(reason string) {
+	if !pollingActive.Swap(true) {
+		log.Printf("Polling for new log files every %v: %s", polledScanFactor*pollInterval, reason)
+	}
+}
+
+// watchFailed handles a directory that could not be watched: in auto mode the log
+// directories are polled from then on.
+func watchFailed(dir string, err error) {
+	if watchMode == "auto" {
+		startPolling("cannot watch " + dir + ": " + err.Error())
+	}
+}
+
+// logScanInterval returns how often the log directories are scanned for new files.
+func logScanInterval() time.Duration {
+	if pollingActive.Load() {
+		return polledScanFactor * pollInterval
+	}
+	return watchedScanFactor * pollInterval
+}
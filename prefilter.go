@@ -0,0 +1,178 @@
+package main
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// --- Rule pre-filter ---
+
+// Running every rule's regex over every line dominates the CPU time on busy hosts, while
+// most lines match no rule. Each rule's regex is parsed when the rules are loaded for the
+// literal strings every match contains, e.g. ".php" and `" 40` for the PHP 403/404 rule,
+// and the regex only runs on lines containing all of them. Case-insensitive parts of a
+// regex give no literals. If every rule of the apache, apache-vhost or nginx format only
+// matches 3xx or 4xx statuses, lines of the format whose status is neither are not
+// matched at all. Pre-filtering never changes which rule matches a line.
+
+// prefilterMinLength is the length below which literals are not worth checking.
+const prefilterMinLength = 3
+
+// statusHints are the literals a line has when its status is 3xx or 4xx.
+var statusHints = []string{`" 3`, `" 4`}
+
+// statusHintFormats holds the formats whose lines are only matched if they have one of
+// statusHints, set when the rules are loaded.
+var statusHintFormats = map[string]bool{}
+
+// literalInfo describes the literals of a regex: the whole of what it matches if exact,
+// else the literal its matches start and end with and the ones they contain.
+type literalInfo struct {
+	exact    bool
+	text     string // What an exact regex matches
+	prefix   string
+	suffix   string
+	literals []string
+}
+
+// regexLiterals returns the literals, at least prefilterMinLength long, that every match
+// of expr contains, longest first, or nil if expr does not parse.
+func regexLiterals(expr string) []string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	info := analyzeLiterals(re.Simplify())
+	all := info.literals
+	if info.exact {
+		all = append(all, info.text)
+	} else {
+		all = append(all, info.prefix, info.suffix)
+	}
+	seen := make(map[string]bool)
+	var literals []string
+	for _, literal := range all {
+		if len(literal) >= prefilterMinLength && !seen[literal] {
+			seen[literal] = true
+			literals = append(literals, literal)
+		}
+	}
+	sort.SliceStable(literals, func(i, j int) bool { return len(literals[i]) > len(literals[j]) })
+	return literals
+}
+
+// analyzeLiterals returns the literals of a parsed regex.
+func analyzeLiterals(re *syntax.Regexp) literalInfo {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return literalInfo{}
+		}
+		return literalInfo{exact: true, text: string(re.Rune)}
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText,
+		syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		// Zero-width, so the literals around them are adjacent
+		return literalInfo{exact: true}
+	case syntax.OpCapture:
+		return analyzeLiterals(re.Sub[0])
+	case syntax.OpPlus:
+		// The first repetition is required, but several may follow each other
+		sub := analyzeLiterals(re.Sub[0])
+		if sub.exact {
+			return literalInfo{prefix: sub.text, suffix: sub.text, literals: []string{sub.text}}
+		}
+		sub.literals = append(sub.literals, sub.prefix, sub.suffix)
+		return sub
+	case syntax.OpConcat:
+		return concatLiterals(re.Sub)
+	}
+	// Alternations, classes and optional parts require no literal
+	return literalInfo{}
+}
+
+// concatLiterals returns the literals of a concatenation, joining those of adjacent parts.
+func concatLiterals(subs []*syntax.Regexp) literalInfo {
+	result := literalInfo{exact: true}
+	var current strings.Builder // Literal the parts so far end with
+	for _, sub := range subs {
+		info := analyzeLiterals(sub)
+		if info.exact {
+			current.WriteString(info.text)
+			continue
+		}
+		current.WriteString(info.prefix)
+		if result.exact {
+			result.exact, result.prefix = false, current.String()
+		}
+		result.literals = append(result.literals, current.String())
+		result.literals = append(result.literals, info.literals...)
+		current.Reset()
+		current.WriteString(info.suffix)
+	}
+	if result.exact {
+		result.text = current.String()
+	} else {
+		result.suffix = current.String()
+		result.literals = append(result.literals, result.suffix)
+	}
+	return result
+}
+
+// mayMatch reports whether line contains every literal of the rule's regex, i.e.
+// whether the regex is worth running on it.
+func (r *Rule) mayMatch(line string) bool {
+	for _, literal := range r.prefilter {
+		if !strings.Contains(line, literal) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateStatusHintFormats sets statusHintFormats for the loaded rules.
+func updateStatusHintFormats() {
+	hintFormats := make(map[string]bool)
+	for _, format := range []string{"apache", "apache-vhost", "nginx"} {
+		hinted, found := true, false
+		for i := range rules {
+			rule := &rules[i]
+			if !rule.Enabled || rule.compiledRegex == nil || rule.compiledMatch != nil || rule.hasCaddyFields() || !ruleAppliesToFormat(rule, format) {
+				continue
+			}
+			found = true
+			if !hasStatusHint(rule.prefilter) {
+				hinted = false
+				break
+			}
+		}
+		hintFormats[format] = found && hinted
+	}
+	statusHintFormats = hintFormats
+}
+
+// hasStatusHint reports whether one of literals requires a 3xx or 4xx status.
+func hasStatusHint(literals []string) bool {
+	for _, literal := range literals {
+		for _, hint := range statusHints {
+			if strings.Contains(literal, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lacksStatusHint reports whether a line of format cannot match any rule, as the rules
+// of the format all need a 3xx or 4xx status and the line has neither.
+func lacksStatusHint(line, format string) bool {
+	if !statusHintFormats[format] {
+		return false
+	}
+	for _, hint := range statusHints {
+		if strings.Contains(line, hint) {
+			return false
+		}
+	}
+	return true
+}
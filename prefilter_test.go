@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// prefilterSamples are log lines of the built-in formats, matching the default rules and not.
+var prefilterSamples = []struct{ format, line string }{
+	{"apache", `203.0.113.5 - - [10/Oct/2026:13:55:36 +0000] "GET /wp-config.php HTTP/1.1" 404 512 "-" "curl/8.0"`},
+	{"apache", `203.0.113.5 - - [10/Oct/2026:13:55:36 +0000] "GET /index.php HTTP/1.1" 200 5120 "-" "Mozilla/5.0"`},
+	{"apache", `203.0.113.6 - - [10/Oct/2026:13:55:37 +0000] "GET /old.php?id=1 HTTP/1.1" 301 0 "-" "Mozilla/5.0"`},
+	{"apache", `203.0.113.7 - - [10/Oct/2026:13:55:38 +0000] "POST /wp-login.php HTTP/1.1" 200 1024 "-" "Mozilla/5.0"`},
+	{"apache", `203.0.113.8 - - [10/Oct/2026:13:55:39 +0000] "GET /wp-content/plugins/x/readme.txt HTTP/1.1" 404 196 "-" "Mozilla/5.0"`},
+	{"apache", `203.0.113.9 - - [10/Oct/2026:13:55:40 +0000] "GET /item?id=1%27%20union%20select HTTP/1.1" 200 88 "-" "sqlmap"`},
+	{"apache", `198.51.100.1 - - [10/Oct/2026:13:55:41 +0000] "GET /static/app.css HTTP/1.1" 304 0 "-" "Mozilla/5.0"`},
+	{"apache", `198.51.100.2 - - [10/Oct/2026:13:55:42 +0000] "GET / HTTP/1.1" 200 7340 "-" "Mozilla/5.0"`},
+	{"apache", `2001:db8::1 - - [10/Oct/2026:13:55:43 +0000] "HEAD /admin.php HTTP/1.1" 403 0 "-" "Mozilla/5.0"`},
+	{"apache", `[2001:db8::2] - - [10/Oct/2026:13:55:44 +0000] "GET /shell.php HTTP/2.0" 404 0 "-" "-"`},
+	{"apache", `203.0.113.10 - - [10/Oct/2026:13:55:45 +0000] "GET /.env HTTP/1.1" 404 196 "-" "-"`},
+	{"apache-vhost", `www.example.com:443 203.0.113.11 - - [10/Oct/2026:13:55:46 +0000] "GET /xmlrpc.php HTTP/1.1" 404 196 "-" "-"`},
+	{"apache-vhost", `www.example.com:443 203.0.113.12 - - [10/Oct/2026:13:55:47 +0000] "GET /about HTTP/1.1" 200 4096 "-" "-"`},
+	{"nginx", `203.0.113.20 - - [10/Oct/2026:13:55:48 +0000] "GET /phpinfo.php HTTP/1.1" 444 0 "-" "zgrab/0.x"`},
+	{"nginx", `203.0.113.21 - - [10/Oct/2026:13:55:49 +0000] "GET /login.php HTTP/1.1" 301 178 "-" "Mozilla/5.0"`},
+	{"nginx", `203.0.113.22 - - [10/Oct/2026:13:55:50 +0000] "POST /wp-login.php HTTP/1.1" 403 162 "-" "Mozilla/5.0"`},
+	{"nginx", `203.0.113.23 - - [10/Oct/2026:13:55:51 +0000] "GET /wp-includes/wlwmanifest.xml HTTP/1.1" 404 162 "-" "-"`},
+	{"nginx", `203.0.113.24 - - [10/Oct/2026:13:55:52 +0000] "GET /api/items HTTP/1.1" 200 2048 "-" "okhttp"`},
+	{"nginx", `fe80::1%eth0 - - [10/Oct/2026:13:55:53 +0000] "GET /test.php HTTP/1.1" 404 162 "-" "-"`},
+	{"caddy", `{"level":"info","request":{"client_ip":"203.0.113.30","host":"example.com","method":"GET","uri":"/wp-admin/setup-config.php"},"status":404}`},
+	{"caddy", `{"level":"info","request":{"client_ip":"203.0.113.31","host":"example.com","method":"GET","uri":"/index.php?p=1"},"status":301}`},
+	{"caddy", `{"level":"info","request":{"client_ip":"203.0.113.32","host":"example.com","method":"GET","uri":"/"},"status":200}`},
+	{"caddy", `{"level":"info","request":{"client_ip":"2001:db8::3","host":"example.com","method":"POST","uri":"/xmlrpc.php"},"status":403}`},
+	{"apache-error", `[Sat Oct 10 13:55:54.123456 2026] [security2:error] [pid 1234] [client 203.0.113.40:51234] ModSecurity: Access denied with code 403`},
+	{"apache-error", `[Sat Oct 10 13:55:55.123456 2026] [auth_basic:error] [pid 1235] [client 203.0.113.41:51235] AH01617: user admin: authentication failure for "/private": Password Mismatch`},
+	{"apache-error", `[Sat Oct 10 13:55:56.123456 2026] [core:info] [pid 1236] [client 203.0.113.42:51236] AH00128: File does not exist: /var/www/favicon.ico`},
+}
+
+// matchSamples returns the matches of every sample line with the loaded rules.
+func matchSamples() [][]ruleMatch {
+	results := make([][]ruleMatch, len(prefilterSamples))
+	for i, sample := range prefilterSamples {
+		results[i] = matchRulesExcept(sample.line, sample.format, nil, nil)
+	}
+	return results
+}
+
+// TestPrefilterKeepsMatches checks that the default rules match the sample lines the
+// same with and without the pre-filter, for the first match and with matchAll.
+func TestPrefilterKeepsMatches(t *testing.T) {
+	useRules(t, defaultRuleSet())
+	savedMatchAll := matchAll
+	t.Cleanup(func() { matchAll = savedMatchAll })
+
+	for _, all := range []bool{false, true} {
+		matchAll = all
+		filtered := matchSamples()
+
+		// The same rules without their literals or the status hint
+		unfiltered := append([]Rule(nil), rules...)
+		for i := range unfiltered {
+			unfiltered[i].prefilter = nil
+		}
+		savedRules, savedHints := rules, statusHintFormats
+		rules, statusHintFormats = unfiltered, map[string]bool{}
+		plain := matchSamples()
+		rules, statusHintFormats = savedRules, savedHints
+
+		matched := 0
+		for i, sample := range prefilterSamples {
+			if !reflect.DeepEqual(filtered[i], plain[i]) {
+				t.Errorf("matchAll=%v, %s line %q: %v with the pre-filter, %v without", all, sample.format, sample.line, filtered[i], plain[i])
+			}
+			if len(plain[i]) > 0 {
+				matched++
+			}
+		}
+		if matched == 0 || matched == len(prefilterSamples) {
+			t.Fatalf("matchAll=%v: %d of %d sample lines matched, the samples should include both", all, matched, len(prefilterSamples))
+		}
+	}
+}
+
+// BenchmarkMatchRules matches the sample lines against the default rules.
+func BenchmarkMatchRules(b *testing.B) {
+	useRules(b, defaultRuleSet())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sample := prefilterSamples[i%len(prefilterSamples)]
+		matchRulesExcept(sample.line, sample.format, nil, nil)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// --- Prefix lookups ---
+
+// Whether an address is in a whitelisted range or a blocked subnet is asked for every line
+// that matches a rule, and scanning the ranges for it, parsing each one, costs time in
+// proportion to their number. The ranges are kept in a binary trie by address bit
+// instead, one for IPv4 and one for IPv6, so a lookup walks at most 32 or 128 nodes
+// whatever the number of ranges. The whitelist rebuilds its trie when its ranges change;
+// blocked subnets are added to and removed from theirs as they are blocked and unblocked.
+
+// prefixTrie is a set of prefixes, by the string they are kept under elsewhere.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+// trieNode is a node of a prefixTrie, holding a prefix if key is set.
+type trieNode struct {
+	children [2]*trieNode
+	key      string // The prefix ending here, or "" if none does
+}
+
+// newPrefixTrie returns an empty trie.
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+// parseTriePrefix parses a CIDR range as kept in the whitelist or blockedSubnets.
+func parseTriePrefix(cidr string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		if prefix.Bits() < 0 {
+			return netip.Prefix{}, false
+		}
+	}
+	return prefix.Masked(), true
+}
+
+// root returns the root of the trie for addr's family.
+func (t *prefixTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// addrBit returns bit i of addr, counting from the most significant.
+func addrBit(addr netip.Addr, i int) int {
+	bytes := addr.AsSlice()
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
+
+// add adds the CIDR range cidr, ignoring anything that is not one.
+func (t *prefixTrie) add(cidr string) {
+	prefix, ok := parseTriePrefix(cidr)
+	if !ok {
+		return
+	}
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(prefix.Addr(), i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.key = cidr
+}
+
+// remove removes the CIDR range cidr. Its nodes stay, as the trie only grows to the
+// ranges blocked at once.
+func (t *prefixTrie) remove(cidr string) {
+	prefix, ok := parseTriePrefix(cidr)
+	if !ok {
+		return
+	}
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits() && node != nil; i++ {
+		node = node.children[addrBit(prefix.Addr(), i)]
+	}
+	if node != nil && node.key == cidr {
+		node.key = ""
+	}
+}
+
+// covering returns the broadest range containing the first bits of addr (all of them
+// for bits < 0), and false if there is none.
+func (t *prefixTrie) covering(addr netip.Addr, bits int) (string, bool) {
+	addr = addr.Unmap()
+	if bits < 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	node := t.root(addr)
+	for i := 0; ; i++ {
+		if node.key != "" {
+			return node.key, true
+		}
+		if i == bits {
+			return "", false
+		}
+		if node = node.children[addrBit(addr, i)]; node == nil {
+			return "", false
+		}
+	}
+}
+
+// containing returns every range containing the first bits of addr (all of them for bits
+// < 0), broadest first.
+func (t *prefixTrie) containing(addr netip.Addr, bits int) []string {
+	addr = addr.Unmap()
+	if bits < 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	var keys []string
+	node := t.root(addr)
+	for i := 0; node != nil; i++ {
+		if node.key != "" {
+			keys = append(keys, node.key)
+		}
+		if i == bits {
+			break
+		}
+		node = node.children[addrBit(addr, i)]
+	}
+	return keys
+}
+
+// buildPrefixTrie returns a trie of the CIDR ranges among entries.
+func buildPrefixTrie(entries map[string]bool) *prefixTrie {
+	trie := newPrefixTrie()
+	for entry := range entries {
+		if strings.Contains(entry, "/") {
+			trie.add(entry)
+		}
+	}
+	return trie
+}
+
+// blockedSubnetRanges holds the keys of blockedSubnets, guarded by mu.
+var blockedSubnetRanges = newPrefixTrie()
+
+// addBlockedSubnetLocked records subnet as blocked. The caller must hold mu.
+func addBlockedSubnetLocked(subnet string) {
+	blockedSubnets[subnet] = struct{}{}
+	blockedSubnetRanges.add(subnet)
+}
+
+// removeBlockedSubnetLocked records subnet as no longer blocked. The caller must hold mu.
+func removeBlockedSubnetLocked(subnet string) {
+	delete(blockedSubnets, subnet)
+	blockedSubnetRanges.remove(subnet)
+}
+
+// resetBlockedSubnetsLocked forgets every blocked subnet. The caller must hold mu.
+func resetBlockedSubnetsLocked() {
+	blockedSubnets = make(map[string]struct{})
+	blockedSubnetRanges = newPrefixTrie()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// benchRanges is the number of ranges looked up in, about what a busy server blocks.
+const benchRanges = 1000
+
+// benchLookupData returns benchRanges random /16 to /28 ranges and addresses to look up.
+func benchLookupData() (map[string]bool, []string) {
+	rng := rand.New(rand.NewSource(1))
+	ranges := make(map[string]bool, benchRanges)
+	for len(ranges) < benchRanges {
+		addr := netip.AddrFrom4([4]byte{byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))})
+		prefix := netip.PrefixFrom(addr, 16+rng.Intn(13)).Masked()
+		ranges[prefix.String()] = true
+	}
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("%d.%d.%d.%d", rng.Intn(256), rng.Intn(256), rng.Intn(256), rng.Intn(256))
+	}
+	return ranges, ips
+}
+
+// TestPrefixTrieMatchesScan checks covering and containing against a scan of every range,
+// for random IPv4 and IPv6 addresses, half of them inside a range.
+func TestPrefixTrieMatchesScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	randomAddr := func(v6 bool) netip.Addr {
+		if v6 {
+			var b [16]byte
+			rng.Read(b[:])
+			b[0], b[1] = 0x20, 0x01 // Keep to one /16, so ranges overlap
+			return netip.AddrFrom16(b)
+		}
+		var b [4]byte
+		rng.Read(b[:])
+		b[0] = 10
+		return netip.AddrFrom4(b)
+	}
+
+	ranges := make(map[string]bool)
+	var prefixes []netip.Prefix
+	for len(prefixes) < 300 {
+		v6 := len(prefixes)%2 == 1
+		bits := 8 + rng.Intn(17)
+		if v6 {
+			bits = 16 + rng.Intn(49)
+		}
+		prefix := netip.PrefixFrom(randomAddr(v6), bits).Masked()
+		if !ranges[prefix.String()] {
+			ranges[prefix.String()] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	trie := buildPrefixTrie(ranges)
+
+	for i := 0; i < 5000; i++ {
+		addr := randomAddr(i%2 == 1)
+		if i%4 < 2 {
+			// Into a random range of the address's family
+			prefix := prefixes[(rng.Intn(len(prefixes)/2))*2+i%2]
+			raw, base := addr.AsSlice(), prefix.Addr().AsSlice()
+			for bit := 0; bit < prefix.Bits(); bit++ {
+				mask := byte(0x80 >> (bit % 8))
+				raw[bit/8] = raw[bit/8]&^mask | base[bit/8]&mask
+			}
+			addr, _ = netip.AddrFromSlice(raw)
+		}
+
+		var want []string
+		ip := net.IP(addr.AsSlice())
+		for cidr := range ranges {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(ip) {
+				want = append(want, cidr)
+			}
+		}
+		got := trie.containing(addr, -1)
+		sorted := append([]string{}, got...)
+		sort.Strings(sorted)
+		sort.Strings(want)
+		if strings.Join(sorted, ",") != strings.Join(want, ",") {
+			t.Fatalf("containing(%s) = %v, the scan found %v", addr, got, want)
+		}
+		broadest, ok := trie.covering(addr, -1)
+		if ok != (len(want) > 0) || ok && broadest != got[0] {
+			t.Fatalf("covering(%s) = %q, %v; containing found %v", addr, broadest, ok, got)
+		}
+		for _, cidr := range got[1:] {
+			if netip.MustParsePrefix(cidr).Bits() <= netip.MustParsePrefix(got[0]).Bits() {
+				t.Fatalf("containing(%s) = %v, not broadest first", addr, got)
+			}
+		}
+	}
+}
+
+// BenchmarkRangeScan looks addresses up the way isWhitelisted and isIPBlocked did before
+// the trie, parsing and checking every range.
+func BenchmarkRangeScan(b *testing.B) {
+	ranges, ips := benchLookupData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := net.ParseIP(ips[i%len(ips)])
+		for cidr := range ranges {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(ip) {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkRangeTrie looks the same addresses up in a prefixTrie of the ranges.
+func BenchmarkRangeTrie(b *testing.B) {
+	ranges, ips := benchLookupData()
+	trie := buildPrefixTrie(ranges)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addr, err := netip.ParseAddr(ips[i%len(ips)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		trie.covering(addr, -1)
+	}
+}
@@ -7,21 +7,55 @@ import (
 
 // processLogEntry analyzes a log entry for suspicious activity
 func processLogEntry(line, filePath string, state *FileState) {
-	// Extract timestamp from the log entry
-	timestamp, hasTimestamp := extractTimestamp(line, logFormat)
+	processLogEntryFormat(line, filePath, logFormat, state)
+}
 
+// processLogEntryFormat analyzes a log entry in the given format, for sources whose
+// format differs from logFormat
+func processLogEntryFormat(line, filePath, format string, state *FileState) {
 	// Skip processing if this entry is older than the last processed entry
-	if hasTimestamp && state != nil && !isNewerThan(timestamp, state.LastTimestamp) {
-		// if verbose { // This can be very noisy
-		// 	log.Printf("Skipping older log entry: %s (timestamp: %s, last processed: %s)",
-		// 		line, timestamp.Format(time.RFC3339), state.LastTimestamp.Format(time.RFC3339))
-		// }
-		return
+	if entry, ok := newLogEntry(line, filePath, format, state); ok {
+		analyzeLogEntry(entry)
+	}
+}
+
+// analyzeLogEntry matches a log entry against the rules and blocks its IP once the
+// threshold is reached
+func analyzeLogEntry(entry logEntry) {
+	// A reload changes the rules and settings only between lines
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+
+	line, filePath, format := entry.line, entry.filePath, entry.format
+	trace := newLineTrace(line)
+	trace.printf("Processing log line from %s: %s", filePath, line)
+
+	// Use the rules system to match the log entry, with the override for its file or site
+	override := overrideFor(filePath, lineVhost(line, format))
+	found := matchRulesExcept(line, format, override.disabledRules(), trace)
+
+	// Rate and error-ratio rules count every request, and block at once when a client
+	// exceeds the limits of one
+	limitIP, limitRule, limitExceeded := countRequestRules(line, format, override.disabledRules(), time.Now(), trace)
+	if limitExceeded {
+		found = []ruleMatch{{ip: limitIP, reason: limitRule, rule: limitRule}}
 	}
 
-	// Use the rules system to match the log entry
-	ip, reason, matched := matchRule(line, logFormat)
+	// Honeypot rules block on the first hit, ahead of whatever else the line matched
+	instant, isInstant := instantMatch(found)
+	if isInstant {
+		found = []ruleMatch{instant}
+	}
 
+	if len(found) == 0 {
+		return
+	}
+	trace.matched()
+	recordRuleMatches(found, time.Now())
+
+	// Behind a trusted proxy, count and block the client it forwarded for
+	ip, reason, rule := found[0].ip, found[0].reason, found[0].rule
+	ip, matched := realClientIP(ip, line, format, trace)
 	if !matched {
 		return
 	}
@@ -48,6 +82,11 @@ func processLogEntry(line, filePath string, state *FileState) {
 		return
 	}
 
+	// Check verified search engine bots
+	if skipSearchBot(ip, rule, filePath, line) {
+		return
+	}
+
 	// Check temporary challenge whitelist
 	if isTempWhitelisted(ip) {
 		if debug {
@@ -59,7 +98,7 @@ func processLogEntry(line, filePath string, state *FileState) {
 	// Check if IP or subnet is already blocked
 	ipBlocked := false
 	subnetBlocked := false
-	subnet := getSubnet(ip)
+	subnet := escalationSubnet(ip)
 
 	mu.Lock()
 	if _, blocked := blockedIPs[ip]; blocked {
@@ -76,12 +115,7 @@ func processLogEntry(line, filePath string, state *FileState) {
 			log.Printf("IP %s is already blocked, skipping", ip)
 		} // Log skip in debug
 		// Update the timestamp and IP in the file state (only if needed for logic, not just logging)
-		if hasTimestamp && state != nil {
-			stateMutex.Lock()
-			state.LastTimestamp = timestamp
-			state.LastProcessedIP = ip
-			stateMutex.Unlock()
-		}
+		markProcessed(entry, ip)
 		return
 	}
 
@@ -91,93 +125,114 @@ func processLogEntry(line, filePath string, state *FileState) {
 			log.Printf("Subnet %s containing IP %s is already blocked, skipping", subnet, ip)
 		} // Log skip in debug
 		// Update the timestamp and IP in the file state (only if needed for logic, not just logging)
-		if hasTimestamp && state != nil {
-			stateMutex.Lock()
-			state.LastTimestamp = timestamp
-			state.LastProcessedIP = ip
-			stateMutex.Unlock()
-		}
+		markProcessed(entry, ip)
 		return
 	}
 
 	// Log the rule match - Keep this log as it's important
 	log.Printf("Rule match: IP %s, Reason %s, File %s", ip, reason, filePath)
+	recordRuleCounted(found)
 
 	// Get the threshold and duration for this rule
-	ruleThreshold, ruleDuration := getRuleThreshold(reason)
+	ruleThreshold, ruleDuration := override.limits(getRuleThreshold(rule))
 
+	// An instant block is not counted, so no threshold can hold it back
+	shouldBlock := isInstant
 	var currentCount int
-	mu.Lock()
-	record, exists := ipAccessLog[ip]
-	now := time.Now()
-	if !exists {
-		record = &AccessRecord{
-			Count:       1,
-			ExpiresAt:   now.Add(ruleDuration),
-			LastUpdated: now,
-			Reason:      reason,
-		}
+	var currentScore float64
+	if !isInstant {
+		mu.Lock()
+		now := time.Now()
+		record := countMatchLocked(ipAccessLog[ip], reason, rule, ruleDuration, now)
 		ipAccessLog[ip] = record
-	} else {
-		if record.Reason == reason {
-			record.Count++
-			prevUpdated := record.LastUpdated
-			record.LastUpdated = now
-			if now.Sub(prevUpdated) > time.Minute {
-				record.ExpiresAt = now.Add(ruleDuration)
+		currentCount = record.Count
+		shouldBlock = currentCount >= ruleThreshold
+		if matchAll {
+			// Every rule matched counts on its own
+			var reached ruleMatch
+			if reached, shouldBlock = countRuleMatchesLocked(ip, found, override, now); shouldBlock {
+				reason, rule = reached.reason, reached.rule
 			}
-		} else {
-			record.Count++
-			record.Reason = reason
-			record.LastUpdated = now
-			record.ExpiresAt = now.Add(ruleDuration)
 		}
+		if scoringEnabled() {
+			for _, match := range found {
+				currentScore = addScoreLocked(ip, match.reason, match.rule, now)
+			}
+			shouldBlock = currentScore >= scoreThreshold || limitExceeded
+		}
+		mu.Unlock()
 	}
-	currentCount = record.Count
-	mu.Unlock()
 
-	if currentCount >= ruleThreshold {
+	if shouldBlock {
 		// Extract User-Agent if possible
-		userAgent := extractUserAgent(line, logFormat)
+		userAgent := matchUserAgent(line, format, rule)
 
 		// Block the IP - blockIP logs the action
-		blockIP(ip, filePath, reason, line, userAgent)
+		blockIP(ip, filePath, reason, rule, line, userAgent)
+		recordRuleBlock(rule)
+		mu.Lock()
+		delete(ipScores, ip)
+		delete(ruleAccessLog, ip)
+		mu.Unlock()
 
 		// Check if we should block the subnet
-		if subnet != "" && !disableSubnetBlocking {
+		if limit, ok := subnetEscalation(rule, override); subnet != "" && ok {
 			// Update subnet blocked IPs
 			mu.Lock()
-			if subnetBlockedIPs[subnet] == nil {
-				subnetBlockedIPs[subnet] = make(map[string]struct{})
-			}
-			subnetBlockedIPs[subnet][ip] = struct{}{}
-			count := len(subnetBlockedIPs[subnet])
+			count := addSubnetMemberLocked(subnet, ip, rule)
 			mu.Unlock()
 
 			if debug { // Log subnet count only in debug
-				log.Printf("Subnet %s has %d/%d unique IPs blocked",
-					subnet, count, subnetThreshold)
+				log.Printf("Subnet %s has %d/%d unique IPs blocked with the action of %s",
+					subnet, count, limit, rule)
 			}
 
-			if count >= subnetThreshold {
-				blockSubnet(subnet)
+			if count >= limit {
+				blockSubnet(subnet, reason, rule)
 			}
 		}
-	} else if debug {
+	} else if debug && scoringEnabled() {
+		log.Printf("IP %s has a score of %.2f/%g (%s)", ip, currentScore, scoreThreshold, reason)
+	} else if debug && !matchAll {
 		log.Printf("IP %s has %d/%d suspicious requests (%s)",
 			ip, currentCount, ruleThreshold, reason)
 	}
 
 	// Update the timestamp and IP in the file state
-	if hasTimestamp && state != nil {
-		stateMutex.Lock()
-		state.LastTimestamp = timestamp
-		state.LastProcessedIP = ip
-		stateMutex.Unlock()
-
-		if verbose { // Log timestamp update only in verbose
-			log.Printf("Updated last processed timestamp to %s for file %s",
-				timestamp.Format(time.RFC3339), filePath)
+	markProcessed(entry, ip)
+	if entry.hasTimestamp && entry.state != nil {
+		trace.printf("Updated last processed timestamp to %s for file %s",
+			entry.timestamp.Format(time.RFC3339), filePath)
+	}
+}
+
+// countMatchLocked counts a match of reason by the named rule in record, starting a new
+// record if there is none, and returns the record. The caller must hold mu.
+func countMatchLocked(record *AccessRecord, reason, rule string, ruleDuration time.Duration, now time.Time) *AccessRecord {
+	if record == nil {
+		return &AccessRecord{
+			Count:       1,
+			ExpiresAt:   now.Add(ruleDuration),
+			LastUpdated: now,
+			Reason:      reason,
+			Rule:        rule,
+			FirstSeen:   now,
 		}
 	}
+	if record.Rule == rule {
+		record.Count++
+		record.Reason = reason
+		prevUpdated := record.LastUpdated
+		record.LastUpdated = now
+		if now.Sub(prevUpdated) > time.Minute {
+			record.ExpiresAt = now.Add(ruleDuration)
+		}
+	} else {
+		record.Count++
+		record.Reason = reason
+		record.Rule = rule
+		record.LastUpdated = now
+		record.ExpiresAt = now.Add(ruleDuration)
+	}
+	return record
 }
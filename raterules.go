@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Request-rate rules ---
+
+// A rule with "type": "rateLimit" counts requests instead of matching suspicious lines:
+// every request whose path matches pathRegex (any path if unset), whatever its status,
+// counts for its client, and a client making more than maxRequests of them within window
+// is blocked at once, with the rule's action (so "ratelimit" throttles it). That catches
+// floods of valid requests to expensive endpoints, which no status-based rule sees.
+//
+// Each client has a sliding-window counter per rate rule: the requests of the current
+// and of the previous window, the latter weighted by how much of it the sliding window
+// still covers. That is a fixed amount of memory per client whatever maxRequests, and the
+// expiration task drops the counters of clients idle for two windows. Rate rules apply to
+// the apache, apache-vhost, nginx and caddy formats, and to custom formats with a path
+// field.
+
+// rateLimitRuleType is the type of request-rate rules.
+const rateLimitRuleType = "rateLimit"
+
+// rateStatsLimit is the number of clients -stats lists per rate rule.
+const rateStatsLimit = 10
+
+// rateCounter counts the requests of a client for a rate rule.
+type rateCounter struct {
+	start    time.Time // Start of the current window
+	current  int       // Requests in the current window
+	previous int       // Requests in the window before
+}
+
+// rateCounters holds the counters by rule name and client, guarded by mu
+var rateCounters = make(map[string]map[string]*rateCounter)
+
+// requestLineRegex picks the path and the status out of an Apache or nginx line.
+var requestLineRegex = regexp.MustCompile(`"[A-Z]+ ([^\s"]+)[^"]*"(?: (\d{3}))?`)
+
+// loggedRequest is what the rules counting requests need of a line.
+type loggedRequest struct {
+	client string
+	path   string
+	status int // 0 if not logged
+}
+
+// isRateRule reports whether the rule is a request-rate rule.
+func (r *Rule) isRateRule() bool {
+	return r.Type == rateLimitRuleType
+}
+
+// countsRequests reports whether the rule counts requests (a rate or error-ratio rule)
+// instead of matching lines.
+func (r *Rule) countsRequests() bool {
+	return r.isRateRule() || r.isRatioRule()
+}
+
+// compileRateRule compiles the pathRegex and parses the window of a rate rule, leaving
+// the rule out (without compiledPath) if one of them or maxRequests is invalid.
+func compileRateRule(rule *Rule) {
+	window, err := time.ParseDuration(rule.Window)
+	if err != nil || window <= 0 {
+		rule.warnf("Invalid window %q in rate rule %s (%s)", rule.Window, rule.Name, rule.source)
+		return
+	}
+	if rule.MaxRequests <= 0 {
+		rule.warnf("Rate rule %s (%s) needs a maxRequests of 1 or more", rule.Name, rule.source)
+		return
+	}
+	regex, err := regexp.Compile(rule.PathRegex)
+	if err != nil {
+		rule.warnf("Invalid pathRegex in rate rule %s (%s): %v", rule.Name, rule.source, err)
+		return
+	}
+	rule.compiledPath = regex
+	rule.rateWindow = window
+}
+
+// add counts a request at now and returns the requests within the sliding window.
+func (c *rateCounter) add(now time.Time, window time.Duration) float64 {
+	if elapsed := now.Sub(c.start); elapsed >= 2*window {
+		c.start, c.current, c.previous = now, 0, 0
+	} else if elapsed >= window {
+		c.start, c.current, c.previous = c.start.Add(window), 0, c.current
+	}
+	c.current++
+	return c.rate(now, window)
+}
+
+// rate returns the requests within the sliding window ending at now.
+func (c *rateCounter) rate(now time.Time, window time.Duration) float64 {
+	elapsed := now.Sub(c.start)
+	if elapsed >= 2*window {
+		return 0
+	}
+	current, previous := c.current, c.previous
+	if elapsed >= window {
+		current, previous = 0, c.current
+		elapsed -= window
+	}
+	weight := 1 - float64(elapsed)/float64(window)
+	if weight > 1 {
+		weight = 1 // Lines out of order
+	}
+	return float64(previous)*weight + float64(current)
+}
+
+// requestOf returns the request of a line in format.
+func requestOf(line, format string) (loggedRequest, bool) {
+	if def := customLogFormats[format]; def != nil {
+		fields, ok := parseLogFields(line, def)
+		status, _ := strconv.Atoi(fields["status"])
+		return loggedRequest{fields["ip"], fields["path"], status}, ok && fields["path"] != ""
+	}
+	switch format {
+	case "caddy":
+		entry, err := (&caddyLine{raw: line}).get()
+		if err != nil {
+			return loggedRequest{}, false
+		}
+		return loggedRequest{entry.Request.ClientIP, entry.Request.URI, int(entry.Status)}, true
+	case "apache-vhost":
+		_, line = splitVhost(line)
+	case "apache", "nginx":
+	default:
+		return loggedRequest{}, false
+	}
+	client, _, _ := strings.Cut(line, " ")
+	matches := requestLineRegex.FindStringSubmatch(line)
+	if matches == nil {
+		return loggedRequest{}, false
+	}
+	status, _ := strconv.Atoi(matches[2])
+	return loggedRequest{client, matches[1], status}, true
+}
+
+// requestClient returns the address to count a request for: its client, or the client a
+// trusted proxy forwarded it for.
+func requestClient(request loggedRequest, line, format string, trace *lineTrace) (string, bool) {
+	address := parseClientIP(request.client)
+	if address == nil {
+		return "", false
+	}
+	return realClientIP(address.String(), line, format, trace)
+}
+
+// countRequestRules counts a line for the rate and error-ratio rules, returning the
+// client and the name of a rule whose limit it exceeded.
+func countRequestRules(line, format string, disabled map[string]bool, now time.Time, trace *lineTrace) (string, string, bool) {
+	rateIP, rateRule, rateExceeded := countRateRules(line, format, disabled, now, trace)
+	ratioIP, ratioRule, ratioExceeded := countRatioRules(line, format, disabled, now, trace)
+	if rateExceeded {
+		return rateIP, rateRule, true
+	}
+	return ratioIP, ratioRule, ratioExceeded
+}
+
+// countRateRules counts a line for the rate rules that apply to it, leaving out the
+// rules named in disabled, and returns the client and the name of a rule whose limit it
+// exceeded.
+func countRateRules(line, format string, disabled map[string]bool, now time.Time, trace *lineTrace) (string, string, bool) {
+	var ip, path, vhost string
+	parsed := false
+	exceeded := ""
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled || !rule.isRateRule() || rule.compiledPath == nil || disabled[rule.Name] || !ruleAppliesToFormat(rule, format) {
+			continue
+		}
+		if !parsed {
+			parsed = true
+			request, ok := requestOf(line, format)
+			if !ok {
+				return "", "", false
+			}
+			if ip, ok = requestClient(request, line, format, trace); !ok {
+				return "", "", false
+			}
+			path, vhost = request.path, lineVhost(line, format)
+		}
+		if !rule.matchesVhost(vhost) || !rule.compiledPath.MatchString(path) || !rule.matchesClient(ip, line, format, trace) {
+			continue
+		}
+
+		mu.Lock()
+		counters := rateCounters[rule.Name]
+		if counters == nil {
+			counters = make(map[string]*rateCounter)
+			rateCounters[rule.Name] = counters
+		}
+		counter := counters[ip]
+		if counter == nil {
+			counter = &rateCounter{start: now}
+			counters[ip] = counter
+		}
+		rate := counter.add(now, rule.rateWindow)
+		mu.Unlock()
+
+		trace.printf("Rate rule %s: %s made %.1f requests in %v (limit %d)", rule.Name, ip, rate, rule.rateWindow, rule.MaxRequests)
+		if rate > float64(rule.MaxRequests) && exceeded == "" {
+			exceeded = rule.Name
+		}
+	}
+	return ip, exceeded, exceeded != ""
+}
+
+// cleanupRateCountersLocked drops the counters of clients idle for two windows, and of
+// rules no longer loaded. The caller must hold reloadMu (read) and mu.
+func cleanupRateCountersLocked(now time.Time) {
+	windows := make(map[string]time.Duration)
+	for _, rule := range rules {
+		if rule.isRateRule() && rule.compiledPath != nil {
+			windows[rule.Name] = rule.rateWindow
+		}
+	}
+	for name, counters := range rateCounters {
+		window, ok := windows[name]
+		if !ok {
+			delete(rateCounters, name)
+			continue
+		}
+		for ip, counter := range counters {
+			if now.Sub(counter.start) >= 2*window {
+				delete(counters, ip)
+			}
+		}
+	}
+}
+
+// rateStats lists the busiest clients of each rate rule for the stats command, or
+// returns "" if there are no rate rules.
+func rateStats() string {
+	type busy struct {
+		ip   string
+		rate float64
+	}
+	now := time.Now()
+	var b strings.Builder
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, rule := range rules {
+		if !rule.Enabled || !rule.isRateRule() || rule.compiledPath == nil {
+			continue
+		}
+		var list []busy
+		for ip, counter := range rateCounters[rule.Name] {
+			if rate := counter.rate(now, rule.rateWindow); rate > 0 {
+				list = append(list, busy{ip, rate})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].rate > list[j].rate })
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "Rate rule %s (limit %d in %v): %d clients", rule.Name, rule.MaxRequests, rule.rateWindow, len(list))
+		for i, entry := range list {
+			if i == rateStatsLimit {
+				break
+			}
+			fmt.Fprintf(&b, "\n  %s: %.1f requests", entry.ip, entry.rate)
+		}
+	}
+	return b.String()
+}
+
+// rateRuleExplanation says whether line counts for a rate rule, for -explain.
+func rateRuleExplanation(rule *Rule, line, format string) string {
+	if rule.compiledPath == nil {
+		return "left out as invalid"
+	}
+	request, ok := requestOf(line, format)
+	switch {
+	case !ok:
+		return "the line has no request path"
+	case !rule.compiledPath.MatchString(request.path):
+		return fmt.Sprintf("path %s does not match", request.path)
+	default:
+		return fmt.Sprintf("path %s counts toward the limit of %d in %v", request.path, rule.MaxRequests, rule.rateWindow)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// --- Error-ratio rules ---
+
+// Crawlers hit a few dead links among thousands of good pages, while nearly every
+// request of a scanner fails, so an absolute threshold low enough for scanners also
+// catches crawlers. A rule with "type": "errorRatio" counts all the requests of each
+// client (to paths matching pathRegex, if given) and the errors among them (the
+// statusCodes given, or any 4xx), and blocks a client at once when, within window, it
+// has made at least minErrors errors that are at least minRatio of its requests.
+// Counting every request costs a counter update per line, which is only paid while an
+// error-ratio rule is enabled. The counters are sliding-window counters like those of
+// the rate rules, and are dropped the same way.
+
+// errorRatioRuleType is the type of error-ratio rules.
+const errorRatioRuleType = "errorRatio"
+
+// ratioCounter counts the requests of a client for an error-ratio rule, and the errors
+// among them.
+type ratioCounter struct {
+	requests rateCounter
+	errors   rateCounter
+}
+
+// ratioCounters holds the counters by rule name and client, guarded by mu
+var ratioCounters = make(map[string]map[string]*ratioCounter)
+
+// isRatioRule reports whether the rule is an error-ratio rule.
+func (r *Rule) isRatioRule() bool {
+	return r.Type == errorRatioRuleType
+}
+
+// compileRatioRule checks the limits and the window of an error-ratio rule and compiles
+// its pathRegex, leaving the rule out (without compiledPath) if one is invalid.
+func compileRatioRule(rule *Rule) {
+	window, err := time.ParseDuration(rule.Window)
+	if err != nil || window <= 0 {
+		rule.warnf("Invalid window %q in error-ratio rule %s (%s)", rule.Window, rule.Name, rule.source)
+		return
+	}
+	if rule.MinErrors <= 0 || rule.MinRatio <= 0 || rule.MinRatio > 1 {
+		rule.warnf("Error-ratio rule %s (%s) needs a minErrors of 1 or more and a minRatio above 0 and up to 1", rule.Name, rule.source)
+		return
+	}
+	regex, err := regexp.Compile(rule.PathRegex)
+	if err != nil {
+		rule.warnf("Invalid pathRegex in error-ratio rule %s (%s): %v", rule.Name, rule.source, err)
+		return
+	}
+	rule.compiledPath = regex
+	rule.rateWindow = window
+}
+
+// isErrorStatus reports whether status counts as an error for the rule.
+func (r *Rule) isErrorStatus(status int) bool {
+	if len(r.StatusCodes) > 0 {
+		return containsInt(r.StatusCodes, status)
+	}
+	return status >= 400 && status < 500
+}
+
+// countRatioRules counts a line for the error-ratio rules that apply to it, leaving out
+// the rules named in disabled, and returns the client and the name of a rule whose
+// limits it reached.
+func countRatioRules(line, format string, disabled map[string]bool, now time.Time, trace *lineTrace) (string, string, bool) {
+	var request loggedRequest
+	var ip, vhost string
+	parsed := false
+	reached := ""
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled || !rule.isRatioRule() || rule.compiledPath == nil || disabled[rule.Name] || !ruleAppliesToFormat(rule, format) {
+			continue
+		}
+		if !parsed {
+			parsed = true
+			var ok bool
+			if request, ok = requestOf(line, format); !ok || request.status == 0 {
+				return "", "", false
+			}
+			if ip, ok = requestClient(request, line, format, trace); !ok {
+				return "", "", false
+			}
+			vhost = lineVhost(line, format)
+		}
+		if !rule.matchesVhost(vhost) || !rule.compiledPath.MatchString(request.path) || !rule.matchesClient(ip, line, format, trace) {
+			continue
+		}
+
+		isError := rule.isErrorStatus(request.status)
+		mu.Lock()
+		counters := ratioCounters[rule.Name]
+		if counters == nil {
+			counters = make(map[string]*ratioCounter)
+			ratioCounters[rule.Name] = counters
+		}
+		counter := counters[ip]
+		if counter == nil {
+			counter = &ratioCounter{requests: rateCounter{start: now}, errors: rateCounter{start: now}}
+			counters[ip] = counter
+		}
+		requests := counter.requests.add(now, rule.rateWindow)
+		errors := counter.errors.rate(now, rule.rateWindow)
+		if isError {
+			errors = counter.errors.add(now, rule.rateWindow)
+		}
+		mu.Unlock()
+
+		if !isError {
+			continue
+		}
+		ratio := min(errors/requests, 1)
+		trace.printf("Error-ratio rule %s: %s made %.1f errors in %.1f requests in %v (limits %d and %.0f%%)", rule.Name, ip, errors, requests, rule.rateWindow, rule.MinErrors, rule.MinRatio*100)
+		if errors >= float64(rule.MinErrors) && ratio >= rule.MinRatio && reached == "" {
+			reached = rule.Name
+		}
+	}
+	return ip, reached, reached != ""
+}
+
+// cleanupRatioCountersLocked drops the counters of clients idle for two windows, and of
+// rules no longer loaded. The caller must hold reloadMu (read) and mu.
+func cleanupRatioCountersLocked(now time.Time) {
+	windows := make(map[string]time.Duration)
+	for _, rule := range rules {
+		if rule.isRatioRule() && rule.compiledPath != nil {
+			windows[rule.Name] = rule.rateWindow
+		}
+	}
+	for name, counters := range ratioCounters {
+		window, ok := windows[name]
+		if !ok {
+			delete(ratioCounters, name)
+			continue
+		}
+		for ip, counter := range counters {
+			if now.Sub(counter.requests.start) >= 2*window {
+				delete(counters, ip)
+			}
+		}
+	}
+}
+
+// ratioRuleExplanation says how line counts for an error-ratio rule, for -explain.
+func ratioRuleExplanation(rule *Rule, line, format string) string {
+	if rule.compiledPath == nil {
+		return "left out as invalid"
+	}
+	request, ok := requestOf(line, format)
+	switch {
+	case !ok || request.status == 0:
+		return "the line has no request path and status"
+	case !rule.compiledPath.MatchString(request.path):
+		return fmt.Sprintf("path %s does not match", request.path)
+	case rule.isErrorStatus(request.status):
+		return fmt.Sprintf("status %d counts as an error (limits %d errors and %.0f%% of the requests in %v)", request.status, rule.MinErrors, rule.MinRatio*100, rule.rateWindow)
+	default:
+		return fmt.Sprintf("status %d counts as a request that is not an error", request.status)
+	}
+}
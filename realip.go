@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// --- Client addresses behind proxies ---
+
+// Behind a CDN or load balancer the remote address of every logged request is the
+// proxy's. When it lies in trustedProxies, the client is taken from the forwarded header
+// the log line carries instead: the hops of realIPHeader are walked from the nearest one
+// back, skipping trusted proxies, and the first other address is the client. Hops further
+// out are set by the client and are never used. Lines from a trusted proxy without a
+// usable header are ignored, so the proxy itself is never blocked. The header is read from
+// the last quoted field of apache and nginx lines (log "%{X-Forwarded-For}i" or
+// "$http_x_forwarded_for" after the User-Agent), the forwarded field of custom formats,
+// and the request headers of caddy logs. Addresses outside trustedProxies are used as
+// logged, whatever header the request carried.
+
+// quotedFieldRegex matches a double-quoted field of a log line, with escaped quotes.
+var quotedFieldRegex = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			return nil, fmt.Errorf("invalid trusted proxy %q (must be an IP address or CIDR range)", item)
+		}
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether ip lies in trustedProxies.
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// realClientIP returns the address to count and block for a line whose remote address is
+// ip, and false if the line is to be ignored because it came through a trusted proxy
+// without naming a client.
+func realClientIP(ip, line, format string, trace *lineTrace) (string, bool) {
+	if len(trustedProxies) == 0 || !isTrustedProxy(ip) {
+		return ip, true
+	}
+	for _, hop := range forwardedHops(forwardedHeader(line, format)) {
+		if isTrustedProxy(hop) {
+			continue
+		}
+		client := normalizeTarget(hop)
+		trace.printf("Using client %s from %s of trusted proxy %s", client, realIPHeader, ip)
+		return client, true
+	}
+	if debug {
+		log.Printf("Ignoring request through trusted proxy %s without a client address in %s", ip, realIPHeader)
+	}
+	return "", false
+}
+
+// forwardedHeader returns the value of the forwarded header logged in line.
+func forwardedHeader(line, format string) string {
+	if def := customLogFormats[format]; def != nil {
+		fields, _ := parseLogFields(line, def)
+		return fields["forwarded"]
+	}
+	if format == "caddy" {
+		var entry struct {
+			Request struct {
+				Headers http.Header `json:"headers"`
+			} `json:"request"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return ""
+		}
+		return strings.Join(entry.Request.Headers.Values(realIPHeader), ",")
+	}
+	// Combined lines have three quoted fields: request, referrer and User-Agent
+	fields := quotedFieldRegex.FindAllStringSubmatch(line, -1)
+	if len(fields) < 4 {
+		return ""
+	}
+	// Apache escapes quotes as \", nginx as \x22
+	return strings.NewReplacer(`\"`, `"`, `\x22`, `"`).Replace(fields[len(fields)-1][1])
+}
+
+// forwardedHops returns the addresses of a forwarded header, nearest hop first. Hops that
+// are not addresses, like "unknown", end the list, as nothing before them can be placed.
+func forwardedHops(header string) []string {
+	var hops []string
+	items := strings.Split(header, ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		item := strings.TrimSpace(items[i])
+		if strings.EqualFold(realIPHeader, "Forwarded") {
+			item = forwardedFor(item)
+		}
+		if item == "" || item == "-" {
+			continue
+		}
+		addr, err := netip.ParseAddr(strings.Trim(item, "[]"))
+		if err != nil {
+			if addrPort, err := netip.ParseAddrPort(item); err == nil {
+				addr = addrPort.Addr()
+			} else {
+				break
+			}
+		}
+		hops = append(hops, addr.Unmap().String())
+	}
+	return hops
+}
+
+// forwardedFor returns the for= node of an element of an RFC 7239 Forwarded header,
+// without quotes and port.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(name, "for") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if strings.HasPrefix(value, "[") {
+			if end := strings.IndexByte(value, ']'); end > 0 {
+				return value[1:end]
+			}
+		}
+		if addrPort, err := netip.ParseAddrPort(value); err == nil {
+			return addrPort.Addr().String()
+		}
+		return value
+	}
+	return ""
+}
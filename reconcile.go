@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReconcileResult summarises one comparison of the firewall against the blocklist
+type ReconcileResult struct {
+	Time    time.Time
+	Missing int // Blocklist entries that had no firewall rule
+	Readded int // Missing entries whose rule was restored
+	Extra   int // Firewall rules for targets not in the blocklist
+	Removed int // Extra rules that were removed (reconcileRemoveExtra)
+	Err     error
+}
+
+var (
+	lastReconcile   *ReconcileResult
+	lastReconcileMu sync.Mutex
+)
+
+// String formats the result for the socket list/status output
+func (r *ReconcileResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: failed: %v", r.Time.Format(time.RFC3339), r.Err)
+	}
+	return fmt.Sprintf("%s: %d missing (%d re-added), %d extra (%d removed)",
+		r.Time.Format(time.RFC3339), r.Missing, r.Readded, r.Extra, r.Removed)
+}
+
+// getLastReconcile returns a description of the most recent reconcile run
+func getLastReconcile() string {
+	lastReconcileMu.Lock()
+	defer lastReconcileMu.Unlock()
+	if lastReconcile == nil {
+		return "never run"
+	}
+	return lastReconcile.String()
+}
+
+// reconcileFirewall compares the rules installed in the firewall with blockedIPs and
+// blockedSubnets, re-adds rules that have gone missing (e.g. after a manual flush), and
+// removes rules for unknown targets if reconcileRemoveExtra is set.
+func reconcileFirewall() *ReconcileResult {
+	result := &ReconcileResult{Time: time.Now()}
+	defer func() {
+		lastReconcileMu.Lock()
+		lastReconcile = result
+		lastReconcileMu.Unlock()
+	}()
+
+	// A deleted or detached chain is rebuilt (with the whole blocklist) before comparing
+	checkFirewallChain()
+
+	lister, ok := fwManager.(ruleLister)
+	if !ok {
+		result.Err = fmt.Errorf("firewall backend cannot list its rules")
+		return result
+	}
+
+	installed, err := lister.ListRuleTargets(challengeEnable)
+	if err != nil {
+		result.Err = err
+		log.Printf("Warning: Reconcile failed to list firewall rules: %v", err)
+		return result
+	}
+	present := make(map[string]bool, len(installed))
+	for _, target := range installed {
+		present[target] = true
+	}
+
+	mu.Lock()
+	wanted := make(map[string]bool, len(blockedIPs)+len(blockedSubnets))
+	for ip := range blockedIPs {
+		wanted[ip] = true
+	}
+	for subnet := range blockedSubnets {
+		wanted[subnet] = true
+	}
+	// Expired entries are left to pruneExpiredBlocks rather than re-added
+	for target, expiry := range blockedExpiry {
+		if wanted[target] && !time.Now().Before(expiry) {
+			delete(wanted, target)
+		}
+	}
+	mu.Unlock()
+
+	for target := range wanted {
+		if present[hostForm(target)] {
+			continue
+		}
+		result.Missing++
+		opts := ruleOptionsFor(target, "reconcile")
+		var addErr error
+		if challengeEnable {
+			addErr = fwManager.AddRedirectRule(target, opts)
+		} else {
+			addErr = fwManager.AddBlockRule(target, opts)
+		}
+		if addErr != nil {
+			log.Printf("Warning: Reconcile failed to re-add firewall rule for %s: %v", target, addErr)
+			continue
+		}
+		exemptSubnet(target, false)
+		result.Readded++
+	}
+
+	for _, target := range installed {
+		if wanted[target] {
+			continue
+		}
+		result.Extra++
+		if !reconcileRemoveExtra {
+			if debug {
+				log.Printf("Reconcile: firewall rule for %s is not in the blocklist", target)
+			}
+			continue
+		}
+		var removeErr error
+		if challengeEnable {
+			removeErr = fwManager.RemoveRedirectRule(target)
+		} else {
+			removeErr = fwManager.RemoveBlockRule(target)
+		}
+		if removeErr != nil {
+			log.Printf("Warning: Reconcile failed to remove firewall rule for %s: %v", target, removeErr)
+			continue
+		}
+		result.Removed++
+	}
+
+	if result.Missing > 0 || result.Extra > 0 {
+		log.Printf("Reconcile: %d blocklist entries were missing from the firewall (%d re-added), %d firewall rules not in the blocklist (%d removed)",
+			result.Missing, result.Readded, result.Extra, result.Removed)
+	} else if debug {
+		log.Printf("Reconcile: firewall matches the blocklist (%d entries)", len(wanted))
+	}
+	return result
+}
+
+// startReconcileTask runs reconcileFirewall every reconcileInterval. A zero interval disables it.
+func startReconcileTask() {
+	if reconcileInterval <= 0 {
+		if debug {
+			log.Println("Firewall reconciliation disabled (reconcileInterval is 0)")
+		}
+		return
+	}
+	if dryRun {
+		return // Nothing is installed to reconcile
+	}
+	if _, ok := fwManager.(ruleLister); !ok {
+		log.Printf("Warning: Firewall backend %s cannot list its rules, reconciliation disabled", firewallType)
+		return
+	}
+
+	ticker := time.NewTicker(reconcileInterval)
+	go func() {
+		for range ticker.C {
+			reconcileFirewall()
+		}
+	}()
+
+	if debug {
+		log.Printf("Started periodic firewall reconciliation every %v", reconcileInterval)
+	}
+}
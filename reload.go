@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// --- Reloading the configuration ---
+
+// The reload command re-reads the config file, the whitelists and the rules of a running
+// server. Only the settings in reloadableSettings are applied: the ones looked up afresh
+// for every line or block, and the paths of the files the reload re-reads. The others set
+// up the socket, the firewall, the log readers or the background tasks at startup, so a
+// change to them is reported as needing a restart, as is a reloadable setting removed
+// from the file (its value would have to fall back to a default the server no longer
+// knows). Settings given on the command line keep their command line values. The
+// whitelists and the rules are replaced only once they have been read in full, so a
+// failed reload leaves the old ones in place.
+
+// reloadableSettings are the config keys a reload applies.
+var reloadableSettings = map[string]bool{
+	"whitelist":             true,
+	"domainWhitelist":       true,
+	"dnsCacheTTL":           true,
+	"dnsNegativeCacheTTL":   true,
+	"dnsCacheSize":          true,
+	"dnsLookupTimeout":      true,
+	"whitelistSearchBots":   true,
+	"searchBotDomains":      true,
+	"rules":                 true,
+	"rulesDir":              true,
+	"ignoreFiles":           true,
+	"logInclude":            true,
+	"logExclude":            true,
+	"debug":                 true,
+	"verbose":               true,
+	"verboseSampleRate":     true,
+	"verboseMatchOnly":      true,
+	"expirationPeriod":      true,
+	"threshold":             true,
+	"subnetThreshold":       true,
+	"disableSubnetBlocking": true,
+	"scoreThreshold":        true,
+	"scoreHalfLife":         true,
+	"matchAll":              true,
+	"geoipDBPath":           true,
+	"asnDBPath":             true,
+	"subnetBlockMode":       true,
+	"subnetMinPrefix":       true,
+	"subnetMinPrefix6":      true,
+	"blockDuration":         true,
+	"blockEscalation":       true,
+	"maxBlockDuration":      true,
+}
+
+// logSelectionSettings are the reloadable keys reloadLogFileSelection applies, under the
+// lock of the log file patterns.
+var logSelectionSettings = map[string]bool{"logInclude": true, "logExclude": true}
+
+var (
+	configFilePath   = DefaultConfigPath   // Config file the server was started with
+	loadedConfig     = map[string]string{} // Values of the config file as last applied
+	commandLineFlags map[string]bool       // Flags set on the command line, which override the file
+)
+
+// readConfigValues reads the key = value pairs of a config file, joining the values of
+// repeated keys with newlines. A missing file has no values.
+func readConfigValues(configPath string) (map[string]string, error) {
+	values := make(map[string]string)
+	file, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open configuration file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if previous, seen := values[key]; seen {
+			value = previous + "\n" + value
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading configuration file: %v", err)
+	}
+	return values, nil
+}
+
+// changedSettings compares the values of the config file with the ones last applied,
+// returning the changed keys to apply, the ones the command line overrides and the ones
+// that need a restart, each sorted.
+func changedSettings(values map[string]string) (apply, pinned, restart []string) {
+	keys := make(map[string]bool)
+	for key, value := range values {
+		if old, seen := loadedConfig[key]; !seen || old != value {
+			keys[key] = true
+		}
+	}
+	for key := range loadedConfig {
+		if _, seen := values[key]; !seen {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		_, present := values[key]
+		switch {
+		case !reloadableSettings[key] || !present:
+			restart = append(restart, key)
+		case commandLineFlags[key]:
+			pinned = append(pinned, key)
+		default:
+			apply = append(apply, key)
+		}
+	}
+	sort.Strings(apply)
+	sort.Strings(pinned)
+	sort.Strings(restart)
+	return apply, pinned, restart
+}
+
+// reloadConfig re-reads the config file, the whitelists, the rules and the log file
+// selection, returning a line for each of them and whether they all succeeded.
+func reloadConfig() (string, bool) {
+	var b strings.Builder
+	success := true
+	report := func(component, detail string, err error) {
+		if err != nil {
+			success = false
+			fmt.Fprintf(&b, "\n  %s: failed: %v", component, err)
+			log.Printf("Warning: Reload of %s failed: %v", component, err)
+			return
+		}
+		fmt.Fprintf(&b, "\n  %s: ok%s", component, detail)
+	}
+	fmt.Fprintf(&b, "Reloaded %s", configFilePath)
+
+	// Apply the settings while no line is being analyzed. The whitelists guard themselves
+	reloadMu.Lock()
+	values, err := readConfigValues(configFilePath)
+	if err == nil {
+		apply, pinned, restart := changedSettings(values)
+		only := make(map[string]bool)
+		for _, key := range apply {
+			if !logSelectionSettings[key] {
+				only[key] = true
+			}
+		}
+		if len(only) > 0 {
+			err = readConfigKeys(configFilePath, only)
+		}
+		if err == nil {
+			for _, key := range apply {
+				loadedConfig[key] = values[key]
+			}
+		}
+		report("config", settingsDetail(apply, pinned, restart), err)
+	} else {
+		report("config", "", err)
+	}
+	err = loadRules()
+	ruleCount := len(rules)
+	reloadMu.Unlock()
+	report("rules", fmt.Sprintf(", %d rules from %s", ruleCount, ruleSources()), err)
+
+	err = readWhitelistFile(whitelistFilePath)
+	whitelistMu.RLock()
+	entryCount := len(whitelist)
+	whitelistMu.RUnlock()
+	report("whitelist", fmt.Sprintf(", %d entries from %s", entryCount, whitelistFilePath), err)
+
+	err = readDomainWhitelistFile(domainWhitelistPath)
+	domainWhitelistMu.RLock()
+	domainCount := len(domainWhitelist)
+	domainWhitelistMu.RUnlock()
+	report("domain whitelist", fmt.Sprintf(", %d domains from %s", domainCount, domainWhitelistPath), err)
+
+	// Outside reloadMu, as picking up newly included files reads their lines
+	report("log file selection", "", reloadLogFileSelection(configFilePath))
+
+	log.Print(b.String())
+	return b.String(), success
+}
+
+// settingsDetail describes the outcome of the changed settings for the reload report.
+func settingsDetail(apply, pinned, restart []string) string {
+	if len(apply)+len(pinned)+len(restart) == 0 {
+		return ", no settings changed"
+	}
+	var parts []string
+	if len(apply) > 0 {
+		parts = append(parts, "applied "+strings.Join(apply, ", "))
+	}
+	if len(pinned) > 0 {
+		parts = append(parts, "set on the command line: "+strings.Join(pinned, ", "))
+	}
+	if len(restart) > 0 {
+		parts = append(parts, "needs a restart: "+strings.Join(restart, ", "))
+	}
+	return ", " + strings.Join(parts, "; ")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// --- Rules fetched from a URL ---
+
+// With rulesURL set, the rules file is fetched from the URL at startup and every
+// rulesRefreshInterval, so a fleet of servers can pull one central rules file. A fetched
+// file must have the SHA-256 checksum rulesSHA256, if set, and carry a valid ed25519
+// signature by rulesPublicKey, if set, which is fetched from rulesSignatureURL (the URL
+// with ".minisig" appended by default). The signature is a minisign signature made with
+// "minisign -S -l" (the prehashed default signatures need BLAKE2b, which is not in the
+// standard library), or a bare base64 ed25519 signature of the file. Every regex of the
+// fetched rules must compile. A file passing all that is written to the cache next to the
+// rules file, which the rules are then loaded from in place of the rules file; rulesDir
+// still applies on top. On any failure the rules stay as they were. The cache keeps the
+// last fetched rules across restarts, so a server restarted while the rules server is
+// down still has them; until the first successful fetch, the rules file is used.
+
+// maxRemoteRulesSize caps the bytes read from rulesURL and rulesSignatureURL.
+const maxRemoteRulesSize = 4 << 20
+
+var (
+	rulesURL             string                    // URL the rules file is fetched from (empty uses the local rules file)
+	rulesRefreshInterval time.Duration = time.Hour // How often rulesURL is fetched again (0 = at startup only)
+	rulesSHA256          string                    // Hex SHA-256 checksum the fetched rules must have (empty skips the check)
+	rulesPublicKey       string                    // Base64 ed25519 or minisign public key of the rules signature (empty skips the check)
+	rulesSignatureURL    string                    // URL of the signature (empty is rulesURL with .minisig appended)
+)
+
+// rulesClient fetches the rules and their signature.
+var rulesClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteRulesCachePath returns the file the last fetched rules are kept in.
+func remoteRulesCachePath() string {
+	return rulesFilePath + ".remote"
+}
+
+// activeRulesPath returns the file loadRules reads the rules from: the cache of the
+// fetched rules, once there is one, or the rules file.
+func activeRulesPath() string {
+	if rulesURL != "" {
+		if _, err := os.Stat(remoteRulesCachePath()); err == nil {
+			return remoteRulesCachePath()
+		}
+	}
+	return rulesFilePath
+}
+
+// fetchURL downloads url, up to maxRemoteRulesSize bytes.
+func fetchURL(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	req.Header.Set("User-Agent", "apacheblock")
+	resp, err := rulesClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: HTTP %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteRulesSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", url, err)
+	}
+	if len(data) > maxRemoteRulesSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, maxRemoteRulesSize)
+	}
+	return data, nil
+}
+
+// parsePublicKey decodes a base64 ed25519 public key, bare or in the minisign format
+// (the algorithm "Ed", the key ID and the key), returning the key and the key ID, if any.
+func parsePublicKey(key string) (ed25519.PublicKey, []byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	switch {
+	case len(raw) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(raw), nil, nil
+	case len(raw) == 2+8+ed25519.PublicKeySize && string(raw[:2]) == "Ed":
+		return ed25519.PublicKey(raw[10:]), raw[2:10], nil
+	}
+	return nil, nil, fmt.Errorf("invalid public key: not an ed25519 or minisign public key")
+}
+
+// verifySignature checks the signature of data, a minisign signature file or a bare
+// base64 signature, against the public key.
+func verifySignature(data, signature []byte, publicKey string) error {
+	key, keyID, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	// The signature is the first line that is not a comment
+	var line string
+	scanner := bufio.NewScanner(bytes.NewReader(signature))
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text != "" && !strings.HasPrefix(text, "untrusted comment:") && !strings.HasPrefix(text, "trusted comment:") {
+			line = text
+			break
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || line == "" {
+		return fmt.Errorf("invalid signature file")
+	}
+	switch {
+	case len(raw) == ed25519.SignatureSize:
+	case len(raw) == 2+8+ed25519.SignatureSize && string(raw[:2]) == "Ed":
+		if keyID != nil && !bytes.Equal(raw[2:10], keyID) {
+			return fmt.Errorf("signature made with another key (key ID %X)", raw[2:10])
+		}
+		raw = raw[10:]
+	case len(raw) == 2+8+ed25519.SignatureSize && string(raw[:2]) == "ED":
+		return fmt.Errorf("prehashed minisign signatures are not supported; sign with minisign -S -l")
+	default:
+		return fmt.Errorf("invalid signature")
+	}
+	if !ed25519.Verify(key, data, raw) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// validateRules checks that the data is a rules file whose regexes all compile.
+func validateRules(data []byte) (int, error) {
+	ruleSet, err := parseRuleSet(data, false)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rules file: %v", err)
+	}
+	for _, rule := range ruleSet.Rules {
+		exprs := map[string]string{"regex": rule.Regex, "vhost": rule.Vhost, "uriRegex": rule.URIRegex, "hostRegex": rule.HostRegex, "pathRegex": rule.PathRegex}
+		for field, expr := range rule.Match {
+			exprs["match "+field] = expr
+		}
+		for field, expr := range exprs {
+			if _, err := regexp.Compile(expr); err != nil {
+				return 0, fmt.Errorf("invalid %s in rule %s: %v", field, rule.Name, err)
+			}
+		}
+	}
+	return len(ruleSet.Rules), nil
+}
+
+// refreshRemoteRules fetches and verifies the rules at rulesURL and, if they changed,
+// caches them and loads them. On any failure the rules stay as they were.
+func refreshRemoteRules() error {
+	data, err := fetchURL(rulesURL)
+	if err != nil {
+		return err
+	}
+	if rulesSHA256 != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, rulesSHA256) {
+			return fmt.Errorf("checksum mismatch: got %s, want %s", got, rulesSHA256)
+		}
+	}
+	if rulesPublicKey != "" {
+		sigURL := rulesSignatureURL
+		if sigURL == "" {
+			sigURL = rulesURL + ".minisig"
+		}
+		signature, err := fetchURL(sigURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch signature: %v", err)
+		}
+		if err := verifySignature(data, signature, rulesPublicKey); err != nil {
+			return err
+		}
+	}
+	count, err := validateRules(data)
+	if err != nil {
+		return err
+	}
+
+	cachePath := remoteRulesCachePath()
+	previous, readErr := os.ReadFile(cachePath)
+	if readErr == nil && bytes.Equal(previous, data) && activeRulesPath() == cachePath {
+		if debug {
+			log.Printf("Rules at %s are unchanged", rulesURL)
+		}
+		return nil
+	}
+	if err := writeFileAtomic(cachePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to cache rules: %v", err)
+	}
+
+	reloadMu.Lock()
+	err = loadRules()
+	reloadMu.Unlock()
+	if err != nil {
+		// Put back the cache the rules in memory came from
+		if readErr == nil {
+			err = fmt.Errorf("%v (keeping the previous rules)", err)
+			if writeErr := writeFileAtomic(cachePath, previous, 0644); writeErr != nil {
+				log.Printf("Warning: Failed to restore the rules cache %s: %v", cachePath, writeErr)
+			}
+		} else {
+			os.Remove(cachePath)
+		}
+		return err
+	}
+	log.Printf("Loaded %d rules fetched from %s", count, rulesURL)
+	return nil
+}
+
+// startRemoteRulesTask fetches rulesURL now and every rulesRefreshInterval (only now if
+// the interval is 0).
+func startRemoteRulesTask() {
+	if rulesURL == "" {
+		return
+	}
+	refresh := func() {
+		if err := refreshRemoteRules(); err != nil {
+			log.Printf("Warning: Rules from %s: %v", rulesURL, err)
+		}
+	}
+	go func() {
+		refresh()
+		if rulesRefreshInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(rulesRefreshInterval)
+		for range ticker.C {
+			refresh()
+		}
+	}()
+
+	if debug {
+		log.Printf("Started fetching rules from %s every %v", rulesURL, rulesRefreshInterval)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Rotated log files at startup ---
+
+// With processRotated, startup reads the rotated siblings of the monitored log files
+// (access.log.1, access.log.2.gz, ...) before tailing the live files, so a scan that
+// logrotate moved away shortly before a restart still counts. Only entries newer than the
+// longest rule duration (capped by processRotatedMaxAge and startupWindow) are processed; entries without a
+// timestamp are skipped, as their age is unknown. The files are read once and get no
+// FileState.
+
+// rotatedCutoff returns the time before which rotated entries are ignored: now minus the
+// longest duration of the enabled rules, or processRotatedMaxAge or startupWindow if
+// shorter.
+func rotatedCutoff(now time.Time) time.Time {
+	window := expirationPeriod
+	for _, rule := range rules {
+		if rule.Enabled && time.Duration(rule.Duration) > window {
+			window = time.Duration(rule.Duration)
+		}
+	}
+	if processRotatedMaxAge > 0 && processRotatedMaxAge < window {
+		window = processRotatedMaxAge
+	}
+	if startupWindow > 0 && startupWindow < window {
+		window = startupWindow
+	}
+	return now.Add(-window)
+}
+
+// isRotatedName reports whether name is a rotated copy of base: base followed by a
+// rotation number and/or .gz, e.g. access.log.1 or access.log.3.gz.
+func isRotatedName(name, base string) bool {
+	rest, ok := strings.CutPrefix(name, base+".")
+	if !ok {
+		return false
+	}
+	rest = strings.TrimSuffix(rest, "gz")
+	rest = strings.TrimSuffix(rest, ".")
+	return rest == "" || strings.Trim(rest, "0123456789") == ""
+}
+
+// rotatedSiblings returns the rotated copies of the log file at path changed since cutoff,
+// oldest first, so their entries are counted in the order they were written.
+func rotatedSiblings(path string, cutoff time.Time) []string {
+	candidates, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil
+	}
+	modTimes := make(map[string]time.Time)
+	var siblings []string
+	for _, candidate := range candidates {
+		if !isRotatedName(filepath.Base(candidate), filepath.Base(path)) {
+			continue
+		}
+		info, err := os.Stat(candidate)
+		// A file last written before the cutoff holds no entries after it
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(cutoff) {
+			continue
+		}
+		modTimes[candidate] = info.ModTime()
+		siblings = append(siblings, candidate)
+	}
+	sort.Slice(siblings, func(i, j int) bool { return modTimes[siblings[i]].Before(modTimes[siblings[j]]) })
+	return siblings
+}
+
+// processRotatedLogs reads the recent entries of the rotated siblings of every log file.
+func processRotatedLogs() {
+	if !processRotated {
+		return
+	}
+	cutoff := rotatedCutoff(time.Now())
+	for _, dir := range logDirs() {
+		for _, file := range findLogFiles(dir) {
+			if !isSelectedLogFile(file) {
+				continue
+			}
+			for _, rotated := range rotatedSiblings(file, cutoff) {
+				processRotatedFile(rotated, detectLogFormat(file), cutoff)
+			}
+		}
+	}
+}
+
+// processRotatedFile runs the entries of a rotated log file in format newer than cutoff
+// through processLogEntryFormat, decompressing it if it ends in .gz.
+func processRotatedFile(path, format string, cutoff time.Time) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Warning: Failed to open rotated log file %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			log.Printf("Warning: Failed to decompress rotated log file %s: %v", path, err)
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	processed := 0
+	lines := bufio.NewReader(reader)
+	var readErr error
+	for readErr == nil {
+		var line string
+		line, readErr = readLogLine(lines, path)
+		line = strings.TrimSpace(line)
+		if line == "" || !acceptLogLine(line, format) {
+			continue
+		}
+		timestamp, ok := extractTimestamp(line, format, path)
+		if !ok || timestamp.Before(cutoff) {
+			continue
+		}
+		processLogEntryFormat(line, path, format, nil)
+		processed++
+	}
+	if readErr != io.EOF {
+		log.Printf("Warning: Failed to read rotated log file %s: %v", path, readErr)
+	}
+	log.Printf("Processed %d recent entries from rotated log file %s", processed, path)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// --- Rule order and matching every rule ---
+
+// The rules are tried by priority, highest first, and by name among rules of the same
+// priority, so which rule a line counts for no longer depends on the order of the rules
+// files, and a broad rule can be given a lower priority than the specific ones it would
+// shadow. By default a line counts for the first rule it matches. With matchAll it counts
+// for every rule it matches, each with a counter of its own for the IP, so the IP is
+// blocked as soon as one of them reaches its threshold (with scoreThreshold set, every
+// match adds to the score). The shared ipAccessLog record still counts the matching lines
+// of the IP, for the status and the blocklist.
+
+// matchAll makes a line count for every rule it matches instead of the first
+var matchAll = false
+
+// ruleMatch is a rule matching a line: the client, the reason (the rule's name and the
+// status, if any) and the name of the rule, which the rule settings are looked up by.
+type ruleMatch struct {
+	ip     string
+	reason string
+	rule   string
+}
+
+// ruleAccessLog holds, with matchAll, the record of each rule for each IP, guarded by mu
+var ruleAccessLog = make(map[string]map[string]*AccessRecord)
+
+// sortRules sorts rules by priority, highest first, then by name.
+func sortRules(rules []Rule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].Name < rules[j].Name
+	})
+}
+
+// addMatch appends match to found, unless it is for another client than the first match
+// of the line (a rule with an ip group capturing another address).
+func addMatch(found []ruleMatch, match ruleMatch, trace *lineTrace) []ruleMatch {
+	if len(found) > 0 && match.ip != found[0].ip {
+		trace.printf("Rule %s matched for %s, not for %s like %s, so it does not count", match.rule, match.ip, found[0].ip, found[0].rule)
+		return found
+	}
+	return append(found, match)
+}
+
+// countRuleMatchesLocked counts every match of a line in the record of its rule for ip,
+// returning the first match whose rule reached its threshold. The caller must hold mu.
+func countRuleMatchesLocked(ip string, found []ruleMatch, override *Override, now time.Time) (ruleMatch, bool) {
+	records := ruleAccessLog[ip]
+	if records == nil {
+		records = make(map[string]*AccessRecord)
+		ruleAccessLog[ip] = records
+	}
+	var reached ruleMatch
+	ok := false
+	for _, match := range found {
+		ruleThreshold, ruleDuration := override.limits(getRuleThreshold(match.rule))
+		record := countMatchLocked(records[match.rule], match.reason, match.rule, ruleDuration, now)
+		records[match.rule] = record
+		if debug {
+			log.Printf("IP %s has %d/%d suspicious requests (%s)", ip, record.Count, ruleThreshold, match.reason)
+		}
+		if record.Count >= ruleThreshold && !ok {
+			reached, ok = match, true
+		}
+	}
+	return reached, ok
+}
+
+// cleanupRuleRecordsLocked drops the expired records of ruleAccessLog. The caller must
+// hold mu.
+func cleanupRuleRecordsLocked(now time.Time) {
+	for ip, records := range ruleAccessLog {
+		for name, record := range records {
+			if now.After(record.ExpiresAt) {
+				delete(records, name)
+			}
+		}
+		if len(records) == 0 {
+			delete(ruleAccessLog, ip)
+		}
+	}
+}
@@ -5,23 +5,79 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Rule defines a detection rule for suspicious activity
 type Rule struct {
-	Name        string        `json:"name"`        // Name of the rule
-	Description string        `json:"description"` // Description of what the rule detects
-	LogFormat   string        `json:"logFormat"`   // Log format this rule applies to (apache, caddy, or all)
-	Regex       string        `json:"regex"`       // Regular expression to match in log lines
-	Threshold   int           `json:"threshold"`   // Number of matches to trigger blocking
-	Duration    time.Duration `json:"duration"`    // Time window for threshold (e.g., "5m")
-	Enabled     bool          `json:"enabled"`     // Whether the rule is enabled
-
-	// Compiled regex (not stored in JSON)
+	Name        string   `json:"name"`             // Name of the rule
+	Description string   `json:"description"`      // Description of what the rule detects
+	LogFormat   string   `json:"logFormat"`        // Log format this rule applies to (apache, apache-vhost, apache-error, nginx, caddy, or all)
+	Regex       string   `json:"regex"`            // Regular expression to match in log lines
+	Threshold   int      `json:"threshold"`        // Number of matches to trigger blocking
+	Duration    Duration `json:"duration"`         // Time window for threshold (e.g., "5m")
+	Enabled     bool     `json:"enabled"`          // Whether the rule is enabled
+	Action      string   `json:"action,omitempty"` // Firewall action for offenders ("drop", "reject", "ratelimit"); empty uses blockAction
+	// How long blocks by this rule last, e.g. "24h"; empty uses blockDuration
+	BlockDuration string `json:"blockDuration,omitempty"`
+	// Ports to block for offenders, e.g. [25, 465, 587]; empty uses blockPorts
+	BlockPorts []int `json:"blockPorts,omitempty"`
+	// Country codes of the clients the rule applies to, or does not, with geoipDBPath set
+	Countries        []string `json:"countries,omitempty"`
+	ExcludeCountries []string `json:"excludeCountries,omitempty"`
+	// Numbers of the autonomous systems of the clients the rule applies to, with asnDBPath set
+	ASNs []uint `json:"asns,omitempty"`
+	// Regexes on the fields of a custom log format, e.g. {"status": "^404$"}; all must match
+	Match map[string]string `json:"match,omitempty"`
+	// Regex on the virtual host (apache-vhost, or the vhost field of a custom format)
+	Vhost string `json:"vhost,omitempty"`
+	// Matchers on the fields of Caddy entries; with any of them set, regex is not used
+	URIRegex    string   `json:"uriRegex,omitempty"`    // Regex on the request URI
+	StatusCodes []int    `json:"statusCodes,omitempty"` // Response statuses to match
+	Methods     []string `json:"methods,omitempty"`     // Request methods to match
+	HostRegex   string   `json:"hostRegex,omitempty"`   // Regex on the requested host
+	// Added to the IP's score by each match when scoreThreshold is set; 0 counts as 1
+	Score float64 `json:"score,omitempty"`
+	// Rules with a higher priority are tried first; rules of the same priority go by name
+	Priority int `json:"priority,omitempty"`
+	// Request-rate rules ("type": "rateLimit"): more than maxRequests requests to paths
+	// matching pathRegex within window (e.g. "1m") block the client, whatever their status
+	Type        string `json:"type,omitempty"`
+	PathRegex   string `json:"pathRegex,omitempty"`
+	MaxRequests int    `json:"maxRequests,omitempty"`
+	Window      string `json:"window,omitempty"`
+	// Error-ratio rules ("type": "errorRatio"): minErrors errors within window that are
+	// at least minRatio of the client's requests block it
+	MinErrors int     `json:"minErrors,omitempty"`
+	MinRatio  float64 `json:"minRatio,omitempty"`
+	// Subnet escalation for the IPs this rule blocks: subnetThreshold replaces the global
+	// one (and an override's), and disableSubnetBlocking keeps them from counting at all
+	SubnetThreshold       int  `json:"subnetThreshold,omitempty"`
+	DisableSubnetBlocking bool `json:"disableSubnetBlocking,omitempty"`
+	// Honeypot rules: instantBlock blocks on the first match, and paths (exact request
+	// paths, e.g. "/.env") stands in for the regex
+	InstantBlock bool     `json:"instantBlock,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+
+	// Compiled regexes and parsed BlockDuration (not stored in JSON)
 	compiledRegex *regexp.Regexp
+	compiledMatch map[string]*regexp.Regexp
+	compiledVhost *regexp.Regexp
+	compiledURI   *regexp.Regexp
+	compiledHost  *regexp.Regexp
+	prefilter     []string // Literals every match of the regex contains
+	source        string   // File the rule was read from
+	problems      []string // What loading the rule found wrong with it
+	ports         []string // Parsed BlockPorts
+	ipGroup       int      // Indexes of the ip, status and ua groups of the regex, if named
+	statusGroup   int
+	uaGroup       int
+	expireAfter   time.Duration
+	compiledPath  *regexp.Regexp // pathRegex and window of a rate or error-ratio rule
+	rateWindow    time.Duration
 }
 
 // RuleSet contains all the rules
@@ -32,69 +88,176 @@ type RuleSet struct {
 // DefaultRulesPath is the default path for the rules file
 const DefaultRulesPath = "/etc/apacheblock/rules.json"
 
+// DefaultRulesDir is the default directory of additional rule files
+const DefaultRulesDir = "/etc/apacheblock/rules.d"
+
 // Global variables
 var (
 	rulesFilePath = DefaultRulesPath
+	rulesDir      = DefaultRulesDir // Directory of additional rule files
 	rules         []Rule
 )
 
 // loadRules loads the rules from the rules file
 func loadRules() error {
-	// Ensure the directory exists
-	dir := filepath.Dir(rulesFilePath)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	// Create the default rules on the first run only: a rules file gone missing later
+	// (a mount not there yet, say) must not be replaced with them
+	path := activeRulesPath()
+	if _, err := os.Stat(rulesFilePath); path == rulesFilePath && os.IsNotExist(err) {
+		if rulesInitialized() {
+			return fmt.Errorf("rules file %s is missing, but rules were loaded from it before; restore it, or recreate the default rules with -initRules", rulesFilePath)
 		}
-	}
-
-	// Check if the file exists
-	if _, err := os.Stat(rulesFilePath); os.IsNotExist(err) {
 		log.Printf("Rules file %s does not exist, creating default rules", rulesFilePath)
-		if err := createDefaultRulesFile(); err != nil {
-			return fmt.Errorf("failed to create default rules file: %v", err)
+		if err := initRulesFile(); err != nil {
+			return err
 		}
 	}
 
-	// Read the file
-	data, err := os.ReadFile(rulesFilePath)
+	// Read the file and the ones in rulesDir
+	var ruleSet RuleSet
+	fileRules, err := readRuleFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to read rules file: %v", err)
+		return err
 	}
-
-	// Unmarshal JSON
-	var ruleSet RuleSet
-	if err := json.Unmarshal(data, &ruleSet); err != nil {
-		return fmt.Errorf("failed to unmarshal rules: %v", err)
+	dirRules, err := readRulesDir(rulesDir)
+	if err != nil {
+		return err
 	}
+	ruleSet.Rules = mergeRules(append(fileRules, dirRules...))
+	sortRules(ruleSet.Rules)
 
 	// Compile regexes
 	for i := range ruleSet.Rules {
-		if !ruleSet.Rules[i].Enabled {
-			continue
-		}
-
-		regex, err := regexp.Compile(ruleSet.Rules[i].Regex)
-		if err != nil {
-			log.Printf("Warning: Invalid regex in rule %s: %v", ruleSet.Rules[i].Name, err)
-			continue
-		}
-
-		ruleSet.Rules[i].compiledRegex = regex
+		compileRule(&ruleSet.Rules[i])
 	}
 
 	// Set the global rules
 	rules = ruleSet.Rules
+	updateStatusHintFormats()
+	pruneRuleStats()
+	markRulesInitialized()
 
 	// Log success only in debug
 	if debug {
-		log.Printf("Loaded %d rules from %s", len(rules), rulesFilePath)
+		log.Printf("Loaded %d rules from %s", len(rules), ruleSources())
 	}
 	return nil
 }
 
-// createDefaultRulesFile creates a default rules file with example rules
-func createDefaultRulesFile() error {
+// compileRule validates an enabled rule and compiles its regexes, logging what is wrong
+// with it; a rule left without compiledRegex (or compiledPath) never matches. Loading the
+// rules and -validateRules both check the rules with it.
+func compileRule(rule *Rule) {
+	if !rule.Enabled {
+		return
+	}
+	if !isBuiltinLogFormat(rule.LogFormat) && rule.LogFormat != "all" && customLogFormats[rule.LogFormat] == nil {
+		rule.warnf("Unknown logFormat %q in rule %s (%s), so it never matches", rule.LogFormat, rule.Name, rule.source)
+		return
+	}
+
+	switch rule.Action {
+	case "", "drop", "reject", "ratelimit":
+	default:
+		rule.warnf("Invalid action %q in rule %s (%s), using blockAction", rule.Action, rule.Name, rule.source)
+		rule.Action = ""
+	}
+
+	if rule.hasCountries() {
+		normalizeCountries(rule.Countries)
+		normalizeCountries(rule.ExcludeCountries)
+		if geoipDBPath == "" {
+			rule.warnf("Rule %s (%s) is limited by country but geoipDBPath is not set, so it never matches", rule.Name, rule.source)
+		}
+	}
+	if len(rule.ASNs) > 0 && asnDBPath == "" {
+		rule.warnf("Rule %s (%s) is limited by ASN but asnDBPath is not set, so it never matches", rule.Name, rule.source)
+	}
+
+	if len(rule.BlockPorts) > 0 {
+		fields := make([]string, 0, len(rule.BlockPorts))
+		for _, port := range rule.BlockPorts {
+			fields = append(fields, strconv.Itoa(port))
+		}
+		ports, err := parsePortList(strings.Join(fields, ","))
+		if err != nil {
+			rule.warnf("Invalid blockPorts in rule %s (%s), using blockPorts: %v", rule.Name, rule.source, err)
+		}
+		rule.ports = ports
+	}
+
+	if rule.BlockDuration != "" {
+		d, err := time.ParseDuration(rule.BlockDuration)
+		if err != nil || d <= 0 {
+			rule.warnf("Invalid blockDuration %q in rule %s (%s), using blockDuration", rule.BlockDuration, rule.Name, rule.source)
+		} else {
+			rule.expireAfter = d
+		}
+	}
+
+	// Rate and error-ratio rules count requests instead of matching lines, and have no
+	// compiledRegex
+	if rule.isRateRule() {
+		compileRateRule(rule)
+		return
+	}
+	if rule.isRatioRule() {
+		compileRatioRule(rule)
+		return
+	}
+
+	if !rule.InstantBlock && rule.Threshold <= 0 {
+		rule.warnf("Rule %s (%s) has a threshold of %d, so it blocks on the first match; set instantBlock for that", rule.Name, rule.source, rule.Threshold)
+	} else if !rule.InstantBlock && rule.Threshold > 1 && rule.Duration <= 0 {
+		rule.warnf("Rule %s (%s) has no duration, so its matches expire at once and rarely reach the threshold", rule.Name, rule.source)
+	}
+
+	if len(rule.Paths) > 0 && !compilePaths(rule) {
+		return
+	}
+	regex, err := regexp.Compile(rule.Regex)
+	if err != nil {
+		rule.warnf("Invalid regex in rule %s (%s): %v", rule.Name, rule.source, err)
+		return
+	}
+	// In these formats the client address is the first group, or the ip group
+	lineFormat := rule.LogFormat == "apache" || rule.LogFormat == "apache-vhost" || rule.LogFormat == "nginx"
+	if lineFormat && !rule.hasCaddyFields() && regex.NumSubexp() == 0 {
+		rule.warnf("Regex of rule %s (%s) has no capture group for the client address, so it never matches", rule.Name, rule.source)
+		return
+	}
+	if !compileRuleMatch(rule) || !compileCaddyFields(rule) {
+		return
+	}
+	if rule.Vhost != "" {
+		vhostRegex, err := regexp.Compile("(?i)" + rule.Vhost)
+		if err != nil {
+			rule.warnf("Invalid vhost regex in rule %s (%s): %v", rule.Name, rule.source, err)
+			return
+		}
+		rule.compiledVhost = vhostRegex
+	}
+
+	rule.compiledRegex = regex
+	rule.prefilter = regexLiterals(rule.Regex)
+	rule.compileNamedGroups()
+}
+
+// warnf logs a problem with the rule and keeps it for -validateRules.
+func (r *Rule) warnf(format string, args ...any) {
+	problem := fmt.Sprintf(format, args...)
+	r.problems = append(r.problems, problem)
+	log.Printf("Warning: %s", problem)
+}
+
+// ruleIPPattern starts the default rules' regexes, capturing the client address of a log
+// line: IPv4 or IPv6, with the brackets and zone some servers write around IPv6 left out
+// of the capture, e.g. [2001:db8::1] or fe80::1%eth0
+const ruleIPPattern = `^\[?([0-9a-fA-F:\.]+)(?:%[^\s\]]+)?\]?`
+
+// defaultRuleSet returns the default rules, which a new rules file is created with and
+// -mergeDefaultRules adds to an existing one
+func defaultRuleSet() RuleSet {
 	// Create default rules
 	defaultRules := RuleSet{
 		Rules: []Rule{
@@ -102,73 +265,151 @@ func createDefaultRulesFile() error {
 				Name:        "Apache PHP 403/404",
 				Description: "Detects requests to PHP files resulting in 403 or 404 status codes in Apache logs",
 				LogFormat:   "apache",
-				Regex:       `^([\d\.]+) .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" (403|404) .*`,
+				Regex:       ruleIPPattern + ` .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" (403|404) .*`,
 				Threshold:   3,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "PHP File Redirects",
 				Description: "Detects direct PHP file access resulting in redirects",
 				LogFormat:   "apache",
-				Regex:       `^([\d\.]+) .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" 301 .*`,
+				Regex:       ruleIPPattern + ` .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" 301 .*`,
 				Threshold:   3,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:        "Nginx PHP 403/404/444",
+				Description: "Detects requests to PHP files resulting in 403, 404 or 444 (connection closed) status codes in nginx logs",
+				LogFormat:   "nginx",
+				Regex:       ruleIPPattern + ` .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" (403|404|444) .*`,
+				Threshold:   3,
+				Duration:    Duration(5 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:        "Nginx PHP Redirects",
+				Description: "Detects direct PHP file access resulting in redirects in nginx logs",
+				LogFormat:   "nginx",
+				Regex:       ruleIPPattern + ` .* "(?:GET|POST|HEAD) /[^?\s]*\.php(?:\?[^\s]*)?(?:\s+HTTP/[\d\.]+)" 301 .*`,
+				Threshold:   3,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "Caddy PHP 403/404",
 				Description: "Detects requests to PHP files resulting in 403 or 404 status codes in Caddy logs",
 				LogFormat:   "caddy",
-				Regex:       `.*\.php(?:\?|/|$).*`,
+				URIRegex:    `^/[^?]*\.php(?:\?|/|$)`,
+				StatusCodes: []int{403, 404},
+				Methods:     []string{"GET", "POST", "HEAD"},
 				Threshold:   3,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "Caddy PHP Redirects",
 				Description: "Detects requests to PHP files resulting in 301 redirects in Caddy logs",
 				LogFormat:   "caddy",
-				Regex:       `.*\.php(?:\?|/|$).*`,
+				URIRegex:    `^/[^?]*\.php(?:\?|/|$)`,
+				StatusCodes: []int{301},
+				Methods:     []string{"GET", "POST", "HEAD"},
 				Threshold:   3,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "WordPress Login Attempts",
 				Description: "Detects repeated failed login attempts to WordPress admin",
 				LogFormat:   "apache",
-				Regex:       `^([\d\.]+) .* "POST .*wp-login\.php.*" (200|403) .*`,
+				Regex:       ruleIPPattern + ` .* "POST .*wp-login\.php.*" (200|403) .*`,
 				Threshold:   5,
-				Duration:    10 * time.Minute,
+				Duration:    Duration(10 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:        "Nginx WordPress Login Attempts",
+				Description: "Detects repeated failed login attempts to WordPress admin in nginx logs",
+				LogFormat:   "nginx",
+				Regex:       ruleIPPattern + ` .* "POST .*wp-login\.php.*" (200|403) .*`,
+				Threshold:   5,
+				Duration:    Duration(10 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:        "ModSecurity Denials",
+				Description: "Detects requests ModSecurity denied, from the Apache error log",
+				LogFormat:   "apache-error",
+				Regex:       `ModSecurity: Access denied`,
+				Threshold:   3,
+				Duration:    Duration(10 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:        "Apache Authentication Failures",
+				Description: "Detects failed HTTP authentication (AH01617 wrong password, AH01618 unknown user) in the Apache error log",
+				LogFormat:   "apache-error",
+				Regex:       `AH0161[78]:`,
+				Threshold:   5,
+				Duration:    Duration(10 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "SQL Injection Attempts",
 				Description: "Detects basic SQL injection attempts in URLs",
 				LogFormat:   "all",
-				Regex:       `^([\d\.]+) .* "GET .*(?:union\s+select|select\s*\*|drop\s+table|--\s|;\s*--\s|'|%27).*" .*`,
+				Regex:       ruleIPPattern + ` .* "GET .*(?:union\s+select|select\s*\*|drop\s+table|--\s|;\s*--\s|'|%27).*" .*`,
 				Threshold:   2,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
 			{
 				Name:        "WordPress File Probing",
 				Description: "Detects attempts to access common WordPress files that don't exist",
 				LogFormat:   "apache",
-				Regex:       `^([\d\.]+) .* "GET .*(?:wp-includes|wp-content|wp-admin).*" (403|404) .*`,
+				Regex:       ruleIPPattern + ` .* "GET .*(?:wp-includes|wp-content|wp-admin).*" (403|404) .*`,
 				Threshold:   3,
-				Duration:    5 * time.Minute,
+				Duration:    Duration(5 * time.Minute),
 				Enabled:     true,
 			},
+			{
+				Name:        "Nginx WordPress File Probing",
+				Description: "Detects attempts to access common WordPress files that don't exist in nginx logs",
+				LogFormat:   "nginx",
+				Regex:       ruleIPPattern + ` .* "GET .*(?:wp-includes|wp-content|wp-admin).*" (403|404|444) .*`,
+				Threshold:   3,
+				Duration:    Duration(5 * time.Minute),
+				Enabled:     true,
+			},
+			{
+				Name:         "Honeypot paths",
+				Description:  "Blocks clients on their first request for a file no legitimate visitor asks for; enable after checking the paths against your sites",
+				LogFormat:    "all",
+				Paths:        []string{"/.env", "/.git/config", "/wp-config.php.bak", "/wp-config.php~", "/.aws/credentials"},
+				InstantBlock: true,
+				Threshold:    1,
+				Priority:     100,
+				Enabled:      false,
+			},
 		},
 	}
+	return defaultRules
+}
 
+// createDefaultRulesFile creates a default rules file with example rules, in YAML if
+// the rules file is a .yaml or .yml file
+func createDefaultRulesFile() error {
 	// Marshal to JSON
-	data, err := json.MarshalIndent(defaultRules, "", "  ")
+	data, err := json.MarshalIndent(defaultRuleSet(), "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal default rules: %v", err)
 	}
+	if isYAMLFile(rulesFilePath) {
+		if data, err = jsonToYAML(data); err != nil {
+			return fmt.Errorf("failed to marshal default rules: %v", err)
+		}
+	}
 
 	// Write to file
 	if err := os.WriteFile(rulesFilePath, data, 0644); err != nil {
@@ -184,103 +425,175 @@ func createDefaultRulesFile() error {
 
 // matchRule checks if a log line matches a rule and returns the IP address and reason if it does
 func matchRule(line string, format string) (string, string, bool) {
-	// Log matching start only in verbose
-	if verbose {
-		log.Printf("Matching rules for log format: %s", format)
+	return matchRuleExcept(line, format, nil, nil)
+}
+
+// matchRuleExcept is matchRule leaving out the rules named in disabled, writing the
+// verbose output about the line to trace
+func matchRuleExcept(line, format string, disabled map[string]bool, trace *lineTrace) (string, string, bool) {
+	found := matchRulesExcept(line, format, disabled, trace)
+	if len(found) == 0 {
+		return "", "", false
 	}
+	return found[0].ip, found[0].reason, true
+}
 
-	for _, rule := range rules {
-		// Skip rules that don't apply to this log format
-		if rule.LogFormat != "all" && rule.LogFormat != format {
-			// Log skip only in verbose
-			if verbose {
-				log.Printf("Skipping rule %s (format mismatch: %s)", rule.Name, rule.LogFormat)
-			}
+// matchRulesExcept returns the first rule matching a line (in priority order), or with
+// matchAll every rule matching it for the client of the first, leaving out the rules
+// named in disabled and writing the verbose output about the line to trace
+func matchRulesExcept(line, format string, disabled map[string]bool, trace *lineTrace) []ruleMatch {
+	trace.printf("Matching rules for log format: %s", format)
+	if def := customLogFormats[format]; def != nil {
+		return matchCustomRules(line, def, disabled, trace)
+	}
+	var vhost string
+	raw := line
+	if format == "apache-vhost" {
+		vhost, line = splitVhost(line)
+	}
+	caddy := caddyLine{raw: line}
+	if lacksStatusHint(line, format) {
+		trace.printf("Skipping all rules, the line has no 3xx or 4xx status")
+		return nil
+	}
+
+	var found []ruleMatch
+	for i := range rules {
+		rule := &rules[i]
+		// Skip rules that don't apply to this log format or virtual host
+		if !ruleAppliesToFormat(rule, format) || !rule.matchesVhost(vhost) || disabled[rule.Name] {
+			trace.printf("Skipping rule %s (format mismatch: %s)", rule.Name, rule.LogFormat)
 			continue
 		}
 
-		// Skip disabled rules
-		if !rule.Enabled || rule.compiledRegex == nil {
-			// Log skip only in verbose
-			if verbose {
-				log.Printf("Skipping rule %s (disabled or invalid regex)", rule.Name)
-			}
+		// Skip disabled rules, and field rules, which only apply to custom formats
+		if !rule.Enabled || rule.compiledRegex == nil || rule.compiledMatch != nil {
+			trace.printf("Skipping rule %s (disabled or invalid regex)", rule.Name)
 			continue
 		}
 
-		// Log trying rule only in verbose
-		if verbose {
-			log.Printf("Trying rule %s with regex: %s", rule.Name, rule.Regex)
+		if ip, reason, ok := rule.matchLine(line, format, &caddy, trace); ok && rule.matchesClient(ip, raw, format, trace) {
+			if found = addMatch(found, ruleMatch{ip: ip, reason: reason, rule: rule.Name}, trace); !matchAll {
+				return found
+			}
 		}
+	}
 
-		// Check if the line matches the rule
-		matches := rule.compiledRegex.FindStringSubmatch(line)
-		if matches != nil {
-			// Log match details only in verbose
-			if verbose {
-				log.Printf("Rule %s matched! Capture groups: %v", rule.Name, matches)
-			}
+	if len(found) == 0 {
+		trace.printf("No rules matched for this line")
+	}
+	return found
+}
 
-			// For Apache-style rules, the IP is typically the first capture group
-			if format == "apache" && len(matches) > 1 {
-				ip := matches[1]
-				reason := rule.Name
-				if len(matches) > 2 {
-					reason += " " + matches[2]
-				}
+// matchLine matches a line in one of the built-in formats against the rule, returning the
+// IP address and the reason if it matches
+func (r *Rule) matchLine(line, format string, caddy *caddyLine, trace *lineTrace) (string, string, bool) {
+	// Caddy lines are matched on the fields of the decoded entry, which the rules on
+	// those fields need
+	if format == "caddy" {
+		return matchCaddyRule(r, caddy, trace)
+	}
+	if r.hasCaddyFields() {
+		return "", "", false
+	}
 
-				// Log specific match details only in verbose
-				if verbose {
-					log.Printf("Apache match: IP %s, Reason %s", ip, reason)
-				}
+	trace.printf("Trying rule %s with regex: %s", r.Name, r.Regex)
 
-				return ip, reason, true
+	// Check if the line matches the rule, unless it lacks a literal the regex needs
+	if !r.mayMatch(line) {
+		trace.printf("Rule %s did not match (pre-filter)", r.Name)
+		return "", "", false
+	}
+	matches := r.compiledRegex.FindStringSubmatch(line)
+	if matches != nil {
+		trace.printf("Rule %s matched! Capture groups: %v", r.Name, matches)
+
+		// A group named ip holds the address whatever the format
+		if r.ipGroup > 0 {
+			ip := r.namedIP(matches, trace)
+			if ip == "" {
+				return "", "", false
 			}
+			reason := r.matchReason(matches, "")
+			trace.printf("%s match: IP %s, Reason %s", format, ip, reason)
+			return ip, reason, true
+		}
 
-			// For Caddy, we need to parse the JSON to get the IP
-			if format == "caddy" {
-				var entry CaddyLogEntry
-				if err := json.Unmarshal([]byte(line), &entry); err == nil {
-					// Check if the URI matches our rule (already confirmed by regex)
-					// Include 301 status code for redirect detection
-					if (entry.Status == 403 || entry.Status == 404 || entry.Status == 301) &&
-						entry.Request.ClientIP != "" {
-						reason := rule.Name + " " + fmt.Sprint(entry.Status)
-
-						// Log specific match details only in verbose
-						if verbose {
-							log.Printf("Caddy match: IP %s, Reason %s", entry.Request.ClientIP, reason)
-						}
-
-						return entry.Request.ClientIP, reason, true
-					} else if verbose { // Log invalid status/IP only in verbose
-						log.Printf("Caddy match but status (%d) or ClientIP (%s) not valid",
-							entry.Status, entry.Request.ClientIP)
-					}
-				} else if verbose { // Log JSON parse error only in verbose
-					log.Printf("Failed to parse Caddy JSON: %v", err)
-				}
+		// For Apache-style rules (nginx's combined format too), the IP is typically the first capture group
+		if (format == "apache" || format == "apache-vhost" || format == "nginx") && len(matches) > 1 {
+			// The capture group also accepts IPv6, so make sure it really is an address
+			clientIP := parseClientIP(matches[1])
+			if clientIP == nil {
+				trace.printf("Rule %s captured %q, which is not an IP address", r.Name, matches[1])
+				return "", "", false
 			}
-		} else if verbose { // Log non-match only in verbose
-			log.Printf("Rule %s did not match", rule.Name)
+			ip := clientIP.String()
+			reason := r.matchReason(matches, group(matches, 2))
+
+			trace.printf("%s match: IP %s, Reason %s", format, ip, reason)
+
+			return ip, reason, true
 		}
-	}
 
-	// Log no match only in verbose
-	if verbose {
-		log.Printf("No rules matched for this line")
+		// For error logs, the IP is in the [client ...] token
+		if format == "apache-error" {
+			ip := errorLogClient(line)
+			if ip == "" {
+				trace.printf("Rule %s matched an error log line without a client address", r.Name)
+				return "", "", false
+			}
+			return normalizeTarget(ip), r.matchReason(matches, ""), true
+		}
+	} else {
+		trace.printf("Rule %s did not match", r.Name)
 	}
-
 	return "", "", false
 }
 
+// ruleNamed returns the rule of that name, or nil. Matches carry the name of their rule
+// apart from the reason, which has the status after the name ("Apache PHP 403/404 404").
+func ruleNamed(name string) *Rule {
+	for i := range rules {
+		if rules[i].Name == name {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
 // getRuleThreshold returns the threshold and duration for a rule by name
 func getRuleThreshold(ruleName string) (int, time.Duration) {
-	for _, rule := range rules {
-		if rule.Name == ruleName {
-			return rule.Threshold, rule.Duration
-		}
+	if rule := ruleNamed(ruleName); rule != nil && rule.countsRequests() {
+		return 1, rule.rateWindow
+	} else if rule != nil && rule.InstantBlock {
+		return 1, 0
+	} else if rule != nil {
+		return rule.Threshold, time.Duration(rule.Duration)
 	}
 
 	return threshold, expirationPeriod
 }
+
+// ruleBlockDuration returns the block duration configured on the named rule, or blockDuration.
+func ruleBlockDuration(name string) time.Duration {
+	if rule := ruleNamed(name); rule != nil && rule.expireAfter > 0 {
+		return rule.expireAfter
+	}
+	return blockDuration
+}
+
+// ruleBlockPorts returns the ports configured on the named rule, or nil to use blockPorts.
+func ruleBlockPorts(name string) []string {
+	if rule := ruleNamed(name); rule != nil {
+		return rule.ports
+	}
+	return nil
+}
+
+// ruleAction returns the action configured on the named rule, or "" to use blockAction.
+func ruleAction(name string) string {
+	if rule := ruleNamed(name); rule != nil {
+		return rule.Action
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// useRules compiles ruleSet and makes it the loaded rules for the test.
+func useRules(t testing.TB, ruleSet RuleSet) {
+	t.Helper()
+	savedRules, savedHints := rules, statusHintFormats
+	t.Cleanup(func() { rules, statusHintFormats = savedRules, savedHints })
+
+	sortRules(ruleSet.Rules)
+	for i := range ruleSet.Rules {
+		compileRule(&ruleSet.Rules[i])
+	}
+	rules = ruleSet.Rules
+	updateStatusHintFormats()
+}
+
+// TestDefaultRulesIPv6Clients checks that the default rules match the lines of IPv6
+// clients, in the forms servers write them, and report the address in canonical form.
+func TestDefaultRulesIPv6Clients(t *testing.T) {
+	useRules(t, defaultRuleSet())
+	const request = ` - - [10/Oct/2026:13:55:36 +0000] "GET /wp-config.php HTTP/1.1" 404 512 "-" "curl/8.0"`
+	tests := []struct {
+		client string
+		want   string // Empty for no match
+	}{
+		{"203.0.113.5", "203.0.113.5"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:DB8:0:0::0001", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]", "fe80::1"},
+		{"::ffff:203.0.113.5", "203.0.113.5"},
+		{"cafe", ""},
+		{"2001:db8::1::2", ""},
+	}
+	for _, format := range []string{"apache", "nginx"} {
+		for _, test := range tests {
+			ip, _, matched := matchRule(test.client+request, format)
+			if ip != test.want || matched != (test.want != "") {
+				t.Errorf("%s line of client %s: matched %v with IP %q, want %q", format, test.client, matched, ip, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// --- Additional rule files ---
+
+// Besides the rules file, loadRules reads every *.json, *.yaml and *.yml file in
+// rulesDir, in name order, so configuration management can drop in a file per
+// application (wordpress.json, nextcloud.yaml) without editing the main one. The files
+// have the layout of the rules file. A rule named like an earlier one replaces it where it was, with a warning, so
+// the last file wins. A missing directory has no rules.
+
+// readRuleFile reads the rules of a rules file, recording the file as their source.
+func readRuleFile(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %v", path, err)
+	}
+	ruleSet, err := parseRuleSet(data, isYAMLFile(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules in %s: %v", path, err)
+	}
+	for i := range ruleSet.Rules {
+		ruleSet.Rules[i].source = path
+	}
+	return ruleSet.Rules, nil
+}
+
+// ruleDirFiles returns the rule files in dir, sorted by name.
+func ruleDirFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rulesDir %s: %v", dir, err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readRulesDir reads the rules of the files in dir.
+func readRulesDir(dir string) ([]Rule, error) {
+	files, err := ruleDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var all []Rule
+	for _, file := range files {
+		fileRules, err := readRuleFile(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fileRules...)
+	}
+	return all, nil
+}
+
+// mergeRules drops the rules replaced by later ones of the same name, keeping the later
+// rule in the place of the first.
+func mergeRules(all []Rule) []Rule {
+	merged := make([]Rule, 0, len(all))
+	index := make(map[string]int, len(all))
+	for _, rule := range all {
+		if i, seen := index[rule.Name]; seen {
+			replaced := merged[i].source
+			merged[i] = rule
+			if replaced == rule.source {
+				merged[i].warnf("Rule %s is defined twice in %s, and the later one is used", rule.Name, rule.source)
+			} else {
+				merged[i].warnf("Rule %s in %s replaces the one in %s", rule.Name, rule.source, replaced)
+			}
+			continue
+		}
+		index[rule.Name] = len(merged)
+		merged = append(merged, rule)
+	}
+	return merged
+}
+
+// ruleSources describes where the rules were read from, for the log and the reload report.
+func ruleSources() string {
+	files, _ := ruleDirFiles(rulesDir)
+	if len(files) == 0 {
+		return activeRulesPath()
+	}
+	return fmt.Sprintf("%s and %d files in %s", activeRulesPath(), len(files), rulesDir)
+}
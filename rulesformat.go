@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Rule file formats ---
+
+// Rules files are JSON, or YAML if their name ends in .yaml or .yml, which spares the
+// escaping of the backslashes in the regexes. A YAML file has the layout and the key
+// names of the JSON one, and is read by converting it to JSON, so both formats go through
+// the same decoding. Durations are written like "5m" or "1h30m" in both; the nanosecond
+// numbers of the files written by older versions are still read.
+
+// Duration is a time.Duration read from and written to rules files as a string like "5m".
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string like "5m".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(formatDuration(time.Duration(d)))
+}
+
+// UnmarshalJSON reads a duration string like "5m", or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s: must be a string like \"5m\"", data)
+	}
+	return nil
+}
+
+// formatDuration writes d like time.Duration.String, without the zero minutes and
+// seconds at the end ("1h" for 1h0m0s).
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// isYAMLFile reports whether path is a YAML rules file, by its extension.
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// yamlToJSON converts a YAML document to JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	converted, err := jsonValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// jsonValue turns the maps of a decoded YAML value into maps JSON can encode.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	}
+	return value, nil
+}
+
+// jsonToYAML converts a JSON document to YAML in block style, keeping the order of the keys.
+func jsonToYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	var clearStyle func(n *yaml.Node)
+	clearStyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, child := range n.Content {
+			clearStyle(child)
+		}
+	}
+	clearStyle(&node)
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// parseRuleSet decodes a rules file, in YAML if yamlFile is set and in JSON otherwise.
+// The rules are decoded one by one, so an error names the rule it is in.
+func parseRuleSet(data []byte, yamlFile bool) (RuleSet, error) {
+	var ruleSet RuleSet
+	if yamlFile {
+		converted, err := yamlToJSON(data)
+		if err != nil {
+			return ruleSet, err
+		}
+		data = converted
+	}
+	var file struct {
+		Rules []json.RawMessage `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return ruleSet, err
+	}
+	ruleSet.Rules = make([]Rule, len(file.Rules))
+	for i, raw := range file.Rules {
+		if err := json.Unmarshal(raw, &ruleSet.Rules[i]); err != nil {
+			var named struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(raw, &named)
+			return RuleSet{}, fmt.Errorf("rule %d (%q): %v", i+1, named.Name, err)
+		}
+	}
+	return ruleSet, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRuleDurations checks that rule durations are read from the nanosecond numbers of
+// older rules files, from duration strings, and from files mixing both.
+func TestRuleDurations(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []time.Duration
+	}{
+		{"numbers", `{"rules": [{"name": "A", "duration": 300000000000}, {"name": "B", "duration": 3600000000000}]}`, []time.Duration{5 * time.Minute, time.Hour}},
+		{"strings", `{"rules": [{"name": "A", "duration": "5m"}, {"name": "B", "duration": "1h30m"}]}`, []time.Duration{5 * time.Minute, 90 * time.Minute}},
+		{"mixed", `{"rules": [{"name": "A", "duration": 300000000000}, {"name": "B", "duration": "10s"}, {"name": "C"}]}`, []time.Duration{5 * time.Minute, 10 * time.Second, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ruleSet, err := parseRuleSet([]byte(test.data), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ruleSet.Rules) != len(test.want) {
+				t.Fatalf("%d rules read, want %d", len(ruleSet.Rules), len(test.want))
+			}
+			for i, rule := range ruleSet.Rules {
+				if time.Duration(rule.Duration) != test.want[i] {
+					t.Errorf("rule %s has duration %v, want %v", rule.Name, time.Duration(rule.Duration), test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestRuleDurationErrors checks that a duration that cannot be read is an error naming
+// the rule it is in.
+func TestRuleDurationErrors(t *testing.T) {
+	for _, duration := range []string{`"5 minutes"`, `"5"`, `true`, `[300]`, `{"minutes": 5}`} {
+		data := `{"rules": [{"name": "Fine", "duration": "5m"}, {"name": "Broken", "duration": ` + duration + `}]}`
+		_, err := parseRuleSet([]byte(data), false)
+		if err == nil {
+			t.Errorf("duration %s read", duration)
+			continue
+		}
+		if !strings.Contains(err.Error(), `rule 2 ("Broken")`) {
+			t.Errorf("duration %s: error %q does not name the rule", duration, err)
+		}
+	}
+}
+
+// TestRuleDurationsWritten checks that durations are written as strings that read back
+// the same, and that the default rules are written that way.
+func TestRuleDurationsWritten(t *testing.T) {
+	for _, d := range []time.Duration{0, time.Second, 5 * time.Minute, time.Hour, 90 * time.Minute, 26*time.Hour + 30*time.Second, 1500 * time.Millisecond} {
+		data, err := json.Marshal(Duration(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), `"`) {
+			t.Errorf("%v written as %s, want a string", d, data)
+		}
+		var read Duration
+		if err := json.Unmarshal(data, &read); err != nil {
+			t.Fatalf("%v written as %s, which does not read back: %v", d, data, err)
+		}
+		if time.Duration(read) != d {
+			t.Errorf("%v written as %s, which reads back as %v", d, data, time.Duration(read))
+		}
+	}
+
+	data, err := json.Marshal(defaultRuleSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		Rules []map[string]interface{} `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range file.Rules {
+		if _, ok := rule["duration"].(string); !ok {
+			t.Errorf("default rule %v has duration %v, want a string", rule["name"], rule["duration"])
+		}
+	}
+}
+
+// TestYAMLRuleDurations checks that YAML rules files read durations the same as JSON ones.
+func TestYAMLRuleDurations(t *testing.T) {
+	data := "rules:\n  - name: A\n    duration: 5m\n  - name: B\n    duration: 300000000000\n  - name: Broken\n    duration: soon\n"
+	_, err := parseRuleSet([]byte(data), true)
+	if err == nil || !strings.Contains(err.Error(), `"Broken"`) {
+		t.Fatalf("error %v, want one naming rule Broken", err)
+	}
+	ruleSet, err := parseRuleSet([]byte(strings.SplitAfter(data, "300000000000\n")[0]), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range ruleSet.Rules {
+		if time.Duration(rule.Duration) != 5*time.Minute {
+			t.Errorf("rule %s has duration %v, want 5m", rule.Name, time.Duration(rule.Duration))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Creating and updating the default rules ---
+
+// The default rules are only written on the first run, when no rules file was ever
+// loaded: a marker next to the rules file records that one was, and a missing rules file
+// is then an error, which leaves the rules already loaded in place (at startup, there are
+// none), rather than a reason to replace the operator's rules with the defaults. A rules
+// file that cannot be read or parsed is an error the same way. -initRules writes the
+// default rules file explicitly, and -mergeDefaultRules adds the default rules a rules
+// file lacks by name (new ones shipped with an update, say), leaving its rules alone.
+
+// rulesMarkerPath returns the marker recording that the rules file was loaded before.
+func rulesMarkerPath() string {
+	return filepath.Join(filepath.Dir(rulesFilePath), "."+filepath.Base(rulesFilePath)+".initialized")
+}
+
+// rulesInitialized reports whether the rules file was loaded before.
+func rulesInitialized() bool {
+	_, err := os.Stat(rulesMarkerPath())
+	return err == nil
+}
+
+// markRulesInitialized records that the rules file was loaded, if not done yet.
+func markRulesInitialized() {
+	path := rulesMarkerPath()
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	if err := os.WriteFile(path, []byte("The rules file next to this one was loaded; delete this file to have apacheblock recreate the default rules if it is missing\n"), 0644); err != nil {
+		log.Printf("Warning: Failed to write rules marker %s: %v", path, err)
+	}
+}
+
+// initRulesFile creates the directory of the rules file and the default rules file in it.
+func initRulesFile() error {
+	dir := filepath.Dir(rulesFilePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	if err := createDefaultRulesFile(); err != nil {
+		return fmt.Errorf("failed to create default rules file: %v", err)
+	}
+	return nil
+}
+
+// runInitRules writes the default rules file for -initRules, refusing to replace an
+// existing one. It returns the exit code.
+func runInitRules() int {
+	if _, err := os.Stat(rulesFilePath); err == nil {
+		log.Printf("Error: Rules file %s already exists; use -mergeDefaultRules to add the default rules it lacks", rulesFilePath)
+		return 1
+	}
+	if err := initRulesFile(); err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	markRulesInitialized()
+	fmt.Printf("Created %s with %d default rules\n", rulesFilePath, len(defaultRuleSet().Rules))
+	return 0
+}
+
+// mergeDefaultRules adds the default rules the rules file in data lacks by name,
+// returning the new file and the names of the added rules. The rules already in the
+// file, and any other keys, are kept as they are.
+func mergeDefaultRules(data []byte) ([]byte, []string, error) {
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse rules file: %v", err)
+	}
+	var existing []json.RawMessage
+	if raw, ok := file["rules"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse the rules of the rules file: %v", err)
+		}
+	}
+	names := make(map[string]bool, len(existing))
+	for _, raw := range existing {
+		var rule struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse a rule of the rules file: %v", err)
+		}
+		names[rule.Name] = true
+	}
+
+	var added []string
+	for _, rule := range defaultRuleSet().Rules {
+		if names[rule.Name] {
+			continue
+		}
+		raw, err := json.Marshal(rule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal default rule %s: %v", rule.Name, err)
+		}
+		existing = append(existing, raw)
+		added = append(added, rule.Name)
+	}
+	if len(added) == 0 {
+		return data, nil, nil
+	}
+
+	raw, err := json.Marshal(existing)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal rules: %v", err)
+	}
+	file["rules"] = raw
+	merged, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal rules file: %v", err)
+	}
+	return append(merged, '\n'), added, nil
+}
+
+// runMergeDefaultRules adds the default rules the rules file lacks for
+// -mergeDefaultRules. It returns the exit code.
+func runMergeDefaultRules() int {
+	if isYAMLFile(rulesFilePath) {
+		log.Printf("Error: -mergeDefaultRules only works on JSON rules files")
+		return 1
+	}
+	data, err := os.ReadFile(rulesFilePath)
+	if err != nil {
+		log.Printf("Error: Failed to read rules file: %v", err)
+		return 1
+	}
+	merged, added, err := mergeDefaultRules(data)
+	if err != nil {
+		log.Printf("Error: %s: %v", rulesFilePath, err)
+		return 1
+	}
+	if len(added) == 0 {
+		fmt.Printf("%s already has all the default rules\n", rulesFilePath)
+		return 0
+	}
+	if err := writeFileAtomic(rulesFilePath, merged, 0644); err != nil {
+		log.Printf("Error: Failed to write rules file: %v", err)
+		return 1
+	}
+	fmt.Printf("Added %d default rules to %s: %s\n", len(added), rulesFilePath, strings.Join(added, ", "))
+	return 0
+}
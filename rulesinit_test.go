@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempRulesFile points the rules file at one in a temporary directory, without a
+// rules directory or rules URL, for the test. The rules loaded by the test are unloaded
+// when it ends.
+func useTempRulesFile(t *testing.T) string {
+	t.Helper()
+	useRules(t, RuleSet{})
+	savedPath, savedDir, savedURL := rulesFilePath, rulesDir, rulesURL
+	rulesFilePath, rulesDir, rulesURL = filepath.Join(t.TempDir(), "rules.json"), "", ""
+	t.Cleanup(func() { rulesFilePath, rulesDir, rulesURL = savedPath, savedDir, savedURL })
+	return rulesFilePath
+}
+
+// TestLoadRulesFirstRun checks that the default rules are created when the rules file was
+// never loaded, and that loading it is recorded.
+func TestLoadRulesFirstRun(t *testing.T) {
+	path := useTempRulesFile(t)
+	if err := loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("default rules file not created: %v", err)
+	}
+	if len(rules) != len(defaultRuleSet().Rules) {
+		t.Fatalf("%d rules loaded, want the %d default rules", len(rules), len(defaultRuleSet().Rules))
+	}
+	if !rulesInitialized() {
+		t.Fatal("loading the rules was not recorded")
+	}
+}
+
+// TestLoadRulesMissingFile checks that a rules file missing after it was loaded is an
+// error, leaving the loaded rules in place, rather than replaced by the default rules.
+func TestLoadRulesMissingFile(t *testing.T) {
+	path := useTempRulesFile(t)
+	if err := os.WriteFile(path, []byte(`{"rules": [{"name": "Tuned", "logFormat": "apache", "regex": "^(\\S+) ", "threshold": 3, "duration": "5m", "enabled": true}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadRules(); err == nil {
+		t.Fatal("loading a missing rules file succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the missing rules file was recreated (%v)", err)
+	}
+	if len(rules) != 1 || rules[0].Name != "Tuned" {
+		t.Fatalf("rules %v loaded, want the ones loaded before", rules)
+	}
+}
+
+// TestLoadRulesCorruptFile checks that a rules file that cannot be parsed, or was only
+// partly written, is an error whether or not it was loaded before, leaving the loaded
+// rules in place and the file as it is.
+func TestLoadRulesCorruptFile(t *testing.T) {
+	valid, err := json.MarshalIndent(defaultRuleSet(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not JSON", []byte("rules: [this is not JSON\n")},
+		{"partly written", valid[:len(valid)/2]},
+		{"invalid rule", []byte(`{"rules": [{"name": "Tuned", "duration": "5 minutes"}]}`)},
+	}
+	for _, test := range tests {
+		for _, loadedBefore := range []bool{false, true} {
+			name := test.name
+			if loadedBefore {
+				name += " after load"
+			}
+			t.Run(name, func(t *testing.T) {
+				path := useTempRulesFile(t)
+				if loadedBefore {
+					if err := loadRules(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				before := rules
+				if err := os.WriteFile(path, test.data, 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := loadRules(); err == nil {
+					t.Fatal("loading a corrupt rules file succeeded")
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, test.data) {
+					t.Fatal("the corrupt rules file was overwritten")
+				}
+				if len(rules) != len(before) {
+					t.Fatalf("%d rules loaded, want the %d loaded before", len(rules), len(before))
+				}
+			})
+		}
+	}
+}
+
+// TestMergeDefaultRules checks that merging adds the default rules a partial rules file
+// lacks, and leaves its own rules and other keys alone.
+func TestMergeDefaultRules(t *testing.T) {
+	defaults := defaultRuleSet().Rules
+	tuned := defaults[0]
+	tuned.Threshold = 99
+	custom := Rule{Name: "Custom", LogFormat: "apache", Regex: `^(\S+) `, Threshold: 1, Duration: Duration(time.Minute), Enabled: true}
+	data, err := json.Marshal(map[string]interface{}{
+		"comment": "tuned by hand",
+		"rules":   []Rule{tuned, custom},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, added, err := mergeDefaultRules(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != len(defaults)-1 {
+		t.Fatalf("added %d rules (%s), want %d", len(added), strings.Join(added, ", "), len(defaults)-1)
+	}
+	ruleSet, err := parseRuleSet(merged, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]Rule)
+	for _, rule := range ruleSet.Rules {
+		byName[rule.Name] = rule
+	}
+	for _, rule := range defaults {
+		if _, ok := byName[rule.Name]; !ok {
+			t.Errorf("default rule %s missing after merging", rule.Name)
+		}
+	}
+	if byName[tuned.Name].Threshold != 99 {
+		t.Errorf("rule %s has threshold %d after merging, want the file's 99", tuned.Name, byName[tuned.Name].Threshold)
+	}
+	if _, ok := byName["Custom"]; !ok || len(ruleSet.Rules) != len(defaults)+1 {
+		t.Errorf("%d rules after merging, want the %d default rules and Custom", len(ruleSet.Rules), len(defaults))
+	}
+	var file map[string]interface{}
+	if err := json.Unmarshal(merged, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file["comment"] != "tuned by hand" {
+		t.Error("merging dropped the other keys of the rules file")
+	}
+
+	// A complete file is left as it is
+	again, added, err := mergeDefaultRules(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || !bytes.Equal(again, merged) {
+		t.Fatalf("merging again added %s", strings.Join(added, ", "))
+	}
+}
+
+// TestMergeDefaultRulesCorruptFile checks that merging into a rules file that cannot be
+// parsed is an error rather than a new file.
+func TestMergeDefaultRulesCorruptFile(t *testing.T) {
+	for _, data := range []string{"", `{"rules": [`, `{"rules": {"name": "Tuned"}}`, `{"rules": ["Tuned"]}`} {
+		if merged, _, err := mergeDefaultRules([]byte(data)); err == nil {
+			t.Errorf("merging into %q succeeded, giving %q", data, merged)
+		}
+	}
+}
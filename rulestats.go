@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Per-rule statistics ---
+
+// Each rule counts the lines it matched, the matches counted for an IP (those of IPs not
+// whitelisted or blocked already), the blocks it triggered and the time of its last
+// match, so -stats shows which rules catch offenders and which only make noise. The
+// counters are kept by rule name, so they survive a reload for the rules still there,
+// and start at zero with the server or with -stats -reset.
+
+// ruleStat holds the counters of a rule.
+type ruleStat struct {
+	Matches   int64      `json:"matches"`             // Lines the rule matched
+	Counted   int64      `json:"counted"`             // Matches counted for an IP
+	Blocks    int64      `json:"blocks"`              // Blocks the rule triggered
+	LastMatch *time.Time `json:"lastMatch,omitempty"` // When the rule last matched
+}
+
+// ruleStatEntry is a rule's counters in the JSON output of -stats.
+type ruleStatEntry struct {
+	Name string `json:"name"`
+	ruleStat
+}
+
+var (
+	ruleStats   = make(map[string]*ruleStat) // Counters by rule name, guarded by ruleStatsMu
+	ruleStatsMu sync.Mutex
+	statsFormat string // -json given with -stats: "json"
+	statsReset  bool   // -reset given with -stats
+)
+
+// recordRuleMatches counts the matches of a line.
+func recordRuleMatches(found []ruleMatch, now time.Time) {
+	ruleStatsMu.Lock()
+	defer ruleStatsMu.Unlock()
+	for _, match := range found {
+		stat := ruleStatLocked(match.rule)
+		stat.Matches++
+		stat.LastMatch = &now
+	}
+}
+
+// recordRuleCounted counts the matches of a line as counted for an IP.
+func recordRuleCounted(found []ruleMatch) {
+	ruleStatsMu.Lock()
+	defer ruleStatsMu.Unlock()
+	for _, match := range found {
+		ruleStatLocked(match.rule).Counted++
+	}
+}
+
+// recordRuleBlock counts a block triggered by the named rule.
+func recordRuleBlock(name string) {
+	ruleStatsMu.Lock()
+	ruleStatLocked(name).Blocks++
+	ruleStatsMu.Unlock()
+}
+
+// ruleStatLocked returns the counters of the named rule, creating them if need be. The
+// caller must hold ruleStatsMu.
+func ruleStatLocked(name string) *ruleStat {
+	stat := ruleStats[name]
+	if stat == nil {
+		stat = &ruleStat{}
+		ruleStats[name] = stat
+	}
+	return stat
+}
+
+// pruneRuleStats drops the counters of rules no longer loaded. The caller must hold
+// reloadMu.
+func pruneRuleStats() {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	ruleStatsMu.Lock()
+	for name := range ruleStats {
+		if !names[name] {
+			delete(ruleStats, name)
+		}
+	}
+	ruleStatsMu.Unlock()
+}
+
+// ruleStatsReport lists the counters of the enabled rules in rule order, as text or, for
+// format "json", as JSON, and zeroes them if reset is set.
+func ruleStatsReport(format string, reset bool) (string, error) {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	ruleStatsMu.Lock()
+	defer ruleStatsMu.Unlock()
+
+	entries := make([]ruleStatEntry, 0, len(rules))
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		entry := ruleStatEntry{Name: rule.Name}
+		if stat := ruleStats[rule.Name]; stat != nil {
+			entry.ruleStat = *stat
+		}
+		entries = append(entries, entry)
+	}
+	if reset {
+		ruleStats = make(map[string]*ruleStat)
+	}
+
+	if format == "json" {
+		data, err := json.MarshalIndent(struct {
+			Rules []ruleStatEntry `json:"rules"`
+			Reset bool            `json:"reset,omitempty"`
+		}{entries, reset}, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal rule stats: %v", err)
+		}
+		return string(data), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rules (%d enabled):", len(entries))
+	now := time.Now()
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "\n  %s: %d matches, %d counted, %d blocks", entry.Name, entry.Matches, entry.Counted, entry.Blocks)
+		if entry.LastMatch != nil {
+			fmt.Fprintf(&b, ", last match %s ago", now.Sub(*entry.LastMatch).Round(time.Second))
+		}
+	}
+	if reset {
+		b.WriteString("\nRule counters reset")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Testing rules offline ---
+
+// -testRules runs the lines of a log file through the rules (the configured ones, or the
+// -rules file) and prints what they would have done, without touching the firewall or the
+// blocklist: the matches of each rule with some sample lines, and the IPs that would have
+// reached the threshold. The timestamps of the lines stand in for the time they arrived,
+// so the rule windows apply as they would have; lines without one count as arriving
+// together. -explain shows what every rule makes of a single line.
+
+// ruleTestStats are the matches of one rule in a -testRules run.
+type ruleTestStats struct {
+	matches int
+	samples []string
+}
+
+// ruleTestBlock is an IP that would have been blocked in a -testRules run.
+type ruleTestBlock struct {
+	ip, reason string
+	at         time.Time
+}
+
+// ruleTestRecord counts the matches of an IP like an AccessRecord.
+type ruleTestRecord struct {
+	count       int
+	rule        string
+	lastUpdated time.Time
+	expiresAt   time.Time
+}
+
+// loadMatchConfig loads what matching lines needs: the log formats, the rules, the
+// overrides, formatMap and the whitelist.
+func loadMatchConfig() error {
+	if err := loadLogFormats(); err != nil {
+		log.Printf("Warning: Failed to load log formats: %v", err)
+	}
+	if err := loadRules(); err != nil {
+		return fmt.Errorf("failed to load rules: %v", err)
+	}
+	if err := loadOverrides(); err != nil {
+		log.Printf("Warning: Failed to load overrides: %v", err)
+	}
+	if !isBuiltinLogFormat(logFormat) && customLogFormats[logFormat] == nil {
+		return fmt.Errorf("invalid server format %q", logFormat)
+	}
+	if err := parseFormatMap(); err != nil {
+		return fmt.Errorf("invalid formatMap: %v", err)
+	}
+	if err := readWhitelistFile(whitelistFilePath); err != nil {
+		log.Printf("Warning: Failed to read whitelist file: %v", err)
+	}
+	return nil
+}
+
+// runRuleTest tests the rules against the log file at path and prints the report,
+// keeping up to samples matched lines per rule. It returns the exit code.
+func runRuleTest(path string, samples int) int {
+	if err := loadMatchConfig(); err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error: Failed to open log file: %v", err)
+		return 1
+	}
+	defer file.Close()
+
+	format := detectLogFormat(path)
+	stats := make(map[string]*ruleTestStats)
+	records := make(map[string]*ruleTestRecord)
+	scores := make(map[string]*ipScore)
+	var blocks []ruleTestBlock
+	blocked := make(map[string]bool)
+	lines, matched := 0, 0
+	var last time.Time
+
+	reader := bufio.NewReader(file)
+	var readErr error
+	for readErr == nil {
+		var line string
+		line, readErr = readLogLine(reader, path)
+		if line = strings.TrimSpace(line); line == "" || !acceptLogLine(line, format) {
+			continue
+		}
+		lines++
+		if timestamp, ok := extractTimestamp(line, format, path); ok {
+			last = timestamp
+		}
+		override := overrideFor(path, lineVhost(line, format))
+		found := matchRulesExcept(line, format, override.disabledRules(), nil)
+		limitIP, limitRule, limitExceeded := countRequestRules(line, format, override.disabledRules(), last, nil)
+		if limitExceeded {
+			found = []ruleMatch{{ip: limitIP, reason: limitRule, rule: limitRule}}
+		}
+		instant, isInstant := instantMatch(found)
+		if isInstant {
+			found = []ruleMatch{instant}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		ip, ok := realClientIP(found[0].ip, line, format, nil)
+		if !ok {
+			continue
+		}
+		matched++
+
+		for _, match := range found {
+			s := stats[match.rule]
+			if s == nil {
+				s = &ruleTestStats{}
+				stats[match.rule] = s
+			}
+			s.matches++
+			if len(s.samples) < samples {
+				s.samples = append(s.samples, line)
+			}
+		}
+
+		// Count the matches as the server would, at the time of the line: only the first
+		// one, unless with matchAll, where each rule counts on its own
+		if blocked[ip] {
+			continue
+		}
+		var reachedBy *ruleMatch
+		for i, match := range found {
+			key := ip
+			if matchAll {
+				key = ip + " " + match.rule
+			}
+			ruleThreshold, ruleDuration := override.limits(getRuleThreshold(match.rule))
+			record := records[key]
+			if record != nil && last.After(record.expiresAt) {
+				record = nil
+			}
+			if record == nil {
+				record = &ruleTestRecord{rule: match.rule, lastUpdated: last, expiresAt: last.Add(ruleDuration)}
+				records[key] = record
+			} else if record.rule != match.rule || last.Sub(record.lastUpdated) > time.Minute {
+				record.expiresAt = last.Add(ruleDuration)
+			}
+			record.count++
+			record.rule = match.rule
+			record.lastUpdated = last
+			if record.count >= ruleThreshold && reachedBy == nil {
+				reachedBy = &found[i]
+			}
+		}
+
+		if scoringEnabled() {
+			score := scores[ip]
+			if score == nil {
+				score = &ipScore{Updated: last}
+				scores[ip] = score
+			}
+			score.Score = decayedScore(score, last)
+			for _, match := range found {
+				score.Score += ruleScore(match.rule)
+			}
+			score.Updated = last
+			reachedBy = nil
+			if score.Score >= scoreThreshold {
+				reachedBy = &found[0]
+			}
+		}
+		if limitExceeded || isInstant {
+			reachedBy = &found[0]
+		}
+		if reachedBy != nil {
+			blocked[ip] = true
+			blocks = append(blocks, ruleTestBlock{ip: ip, reason: reachedBy.reason, at: last})
+		}
+	}
+	if readErr != io.EOF {
+		log.Printf("Error: Failed to read log file: %v", readErr)
+		return 1
+	}
+
+	fmt.Println(ruleTestReport(path, format, lines, matched, stats, blocks))
+	return 0
+}
+
+// ruleTestReport formats the result of a -testRules run.
+func ruleTestReport(path, format string, lines, matched int, stats map[string]*ruleTestStats, blocks []ruleTestBlock) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Tested %d lines of %s (%s): %d matched a rule\n", lines, path, format, matched)
+
+	b.WriteString("\nRules:\n")
+	for _, rule := range rules {
+		if !rule.Enabled || (rule.compiledRegex == nil && rule.compiledPath == nil) || !ruleAppliesToFormat(&rule, format) {
+			continue
+		}
+		s := stats[rule.Name]
+		if s == nil {
+			s = &ruleTestStats{}
+		}
+		if rule.isRateRule() {
+			fmt.Fprintf(&b, "  %s: limit exceeded by %d requests (limit %d in %v)\n", rule.Name, s.matches, rule.MaxRequests, rule.rateWindow)
+		} else if rule.isRatioRule() {
+			fmt.Fprintf(&b, "  %s: limits reached by %d errors (%d errors and %.0f%% of the requests in %v)\n", rule.Name, s.matches, rule.MinErrors, rule.MinRatio*100, rule.rateWindow)
+		} else if rule.InstantBlock {
+			fmt.Fprintf(&b, "  %s: %d matches (blocks on the first)\n", rule.Name, s.matches)
+		} else {
+			ruleThreshold, ruleDuration := getRuleThreshold(rule.Name)
+			fmt.Fprintf(&b, "  %s: %d matches (threshold %d in %v)\n", rule.Name, s.matches, ruleThreshold, ruleDuration)
+		}
+		for _, sample := range s.samples {
+			fmt.Fprintf(&b, "      %s\n", sample)
+		}
+	}
+
+	if len(blocks) == 0 {
+		b.WriteString("\nNo IP would have been blocked")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nWould have blocked %d IPs:", len(blocks))
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].at.Before(blocks[j].at) })
+	for _, block := range blocks {
+		fmt.Fprintf(&b, "\n  %s: %s", block.ip, block.reason)
+		if !block.at.IsZero() {
+			fmt.Fprintf(&b, " at %s", block.at.Format(time.RFC3339))
+		}
+		if isWhitelisted(block.ip) {
+			b.WriteString(" (whitelisted, so not blocked)")
+		}
+	}
+	return b.String()
+}
+
+// runExplain prints what each rule makes of line, which is in the server format (or
+// Caddy's, if it is JSON). It returns the exit code.
+func runExplain(line string) int {
+	if err := loadMatchConfig(); err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	line = strings.TrimSpace(line)
+	format := logFormat
+	if strings.HasPrefix(line, "{") && (logFormat == "apache" || logFormat == "apache-vhost" || logFormat == "nginx") {
+		format = "caddy"
+	}
+	fmt.Println(explainLine(line, format))
+	return 0
+}
+
+// explainLine tries every rule on line on its own, listing the matches with their
+// verbose output (including the capture groups), and for the others the last message
+// about them, which says why they did not match. Rules for other formats are left out.
+func explainLine(line, format string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Line (%s): %s", format, line)
+	others := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		others[rule.Name] = true
+	}
+	skipped := 0
+	for _, rule := range rules {
+		if !ruleAppliesToFormat(&rule, format) {
+			skipped++
+			continue
+		}
+		if rule.isRateRule() {
+			fmt.Fprintf(&b, "\n\n%s: rate rule, %s", rule.Name, rateRuleExplanation(&rule, line, format))
+			continue
+		}
+		if rule.isRatioRule() {
+			fmt.Fprintf(&b, "\n\n%s: error-ratio rule, %s", rule.Name, ratioRuleExplanation(&rule, line, format))
+			continue
+		}
+		delete(others, rule.Name)
+		trace := &lineTrace{held: true}
+		ip, reason, ok := matchRuleExcept(line, format, others, trace)
+		others[rule.Name] = true
+
+		// Leave out the other rules being skipped
+		var messages []string
+		for _, message := range trace.pending {
+			if !strings.HasPrefix(message, "Skipping rule ") || strings.HasPrefix(message, "Skipping rule "+rule.Name+" ") {
+				messages = append(messages, message)
+			}
+		}
+		if !ok {
+			why := "did not match"
+			for _, message := range messages {
+				if strings.Contains(strings.ToLower(message), "rule "+strings.ToLower(rule.Name)+" ") || strings.HasPrefix(message, "Skipping all rules") {
+					why = message
+				}
+			}
+			fmt.Fprintf(&b, "\n\n%s: no match (%s)", rule.Name, why)
+			continue
+		}
+		fmt.Fprintf(&b, "\n\n%s: MATCH, IP %s, reason %q", rule.Name, ip, reason)
+		for _, message := range messages {
+			fmt.Fprintf(&b, "\n    %s", message)
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(&b, "\n\n(%d rules for other log formats left out)", skipped)
+	}
+	found := matchRulesExcept(line, format, nil, nil)
+	if len(found) == 0 {
+		b.WriteString("\n\nNo rule matches this line")
+	}
+	if instant, ok := instantMatch(found); ok {
+		fmt.Fprintf(&b, "\n\nThe server blocks %s at once for %q", instant.ip, instant.reason)
+		return b.String()
+	}
+	for _, match := range found {
+		fmt.Fprintf(&b, "\n\nThe server counts this line for %s as %q", match.ip, match.reason)
+	}
+	return b.String()
+}
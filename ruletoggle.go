@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Enabling and disabling rules at runtime ---
+
+// -enableRule and -disableRule switch a rule of the running server on or off at once, for
+// a rule misfiring in the middle of the day, and -showRules lists the rules with their
+// state and counters. The change applies to the loaded rules, so the next reload or
+// restart brings back the state in the rules files, unless -persist also writes it to the
+// file the rule came from. Only JSON files are written, and not the rules fetched from
+// rulesURL, which the next fetch would replace. A rule disabled in its file was never
+// compiled, so enabling it compiles it as loading would; one that fails to stays out.
+
+// persistRuleChange is set by -persist given with -enableRule or -disableRule.
+var persistRuleChange bool
+
+// setRuleEnabled switches the named rule on or off, with persist in its rules file too,
+// and returns its new state.
+func setRuleEnabled(name string, enabled, persist bool) (string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	rule := ruleNamed(name)
+	if rule == nil {
+		return "", fmt.Errorf("no rule named %q", name)
+	}
+	if persist {
+		if err := persistRuleEnabled(rule.source, name, enabled); err != nil {
+			return "", err
+		}
+	}
+
+	previous := rule.Enabled
+	rule.Enabled = enabled
+	if enabled && rule.compiledRegex == nil && rule.compiledPath == nil {
+		compileRule(rule)
+	}
+	updateStatusHintFormats()
+
+	result := fmt.Sprintf("Rule %s is now %s", name, ruleState(rule))
+	if previous == enabled {
+		result = fmt.Sprintf("Rule %s was already %s", name, ruleState(rule))
+	}
+	if persist {
+		result += ", in " + rule.source + " too"
+	} else {
+		result += ", until the next reload or restart"
+	}
+	log.Print(result)
+	return result, nil
+}
+
+// ruleState describes whether a rule is enabled, and usable if it is.
+func ruleState(rule *Rule) string {
+	switch {
+	case !rule.Enabled:
+		return "disabled"
+	case rule.compiledRegex == nil && rule.compiledPath == nil:
+		return "enabled, but invalid (see the log)"
+	default:
+		return "enabled"
+	}
+}
+
+// persistRuleEnabled sets "enabled" on the named rule in the JSON rules file at path,
+// keeping the rest of the file as it is.
+func persistRuleEnabled(path, name string, enabled bool) error {
+	if path == remoteRulesCachePath() {
+		return fmt.Errorf("rule %s comes from rulesURL, so the change cannot be persisted", name)
+	}
+	if isYAMLFile(path) {
+		return fmt.Errorf("rule %s comes from the YAML file %s, which cannot be written; edit it instead", name, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read rules file: %v", err)
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse rules file %s: %v", path, err)
+	}
+	var existing []json.RawMessage
+	if err := json.Unmarshal(file["rules"], &existing); err != nil {
+		return fmt.Errorf("failed to parse the rules of %s: %v", path, err)
+	}
+	found := false
+	for i, raw := range existing {
+		var rule struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &rule); err != nil {
+			return fmt.Errorf("failed to parse a rule of %s: %v", path, err)
+		}
+		if rule.Name != name {
+			continue
+		}
+		if existing[i], err = setJSONField(raw, "enabled", enabled); err != nil {
+			return fmt.Errorf("failed to update rule %s in %s: %v", name, path, err)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("rule %s is no longer in %s", name, path)
+	}
+
+	raw, err := json.Marshal(existing)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules: %v", err)
+	}
+	file["rules"] = raw
+	updated, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules file: %v", err)
+	}
+	if err := writeFileAtomic(path, append(updated, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write rules file: %v", err)
+	}
+	return nil
+}
+
+// setJSONField sets key to value in the JSON object raw, keeping the order of its keys
+// (a new key goes last).
+func setJSONField(raw json.RawMessage, key string, value any) (json.RawMessage, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	set := false
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var field json.RawMessage
+		if err := decoder.Decode(&field); err != nil {
+			return nil, err
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(token)
+		b.Write(name)
+		b.WriteByte(':')
+		if token == key {
+			field, set = encoded, true
+		}
+		b.Write(field)
+	}
+	if !set {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(encoded)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// showRules lists the loaded rules in rule order with their state, counters and file.
+func showRules() string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	ruleStatsMu.Lock()
+	defer ruleStatsMu.Unlock()
+
+	enabled := 0
+	for _, rule := range rules {
+		if rule.Enabled {
+			enabled++
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rules (%d, %d enabled):", len(rules), enabled)
+	now := time.Now()
+	for i := range rules {
+		rule := &rules[i]
+		fmt.Fprintf(&b, "\n  %s: %s", rule.Name, ruleState(rule))
+		if stat := ruleStats[rule.Name]; stat != nil {
+			fmt.Fprintf(&b, ", %d matches, %d blocks", stat.Matches, stat.Blocks)
+			if stat.LastMatch != nil {
+				fmt.Fprintf(&b, ", last match %s ago", now.Sub(*stat.LastMatch).Round(time.Second))
+			}
+		}
+		fmt.Fprintf(&b, " (%s)", rule.source)
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// --- Validating a rules file ---
+
+// -validateRules checks a rules file (or a directory of them, laid out like rulesDir)
+// before it is deployed, e.g. in CI: it compiles every rule as loading does, so it finds
+// the same problems with the same messages, and lists them by rule. Disabled rules are
+// checked as if they were enabled, as -enableRule would, but only an enabled rule that
+// would never match (an invalid regex, an unknown logFormat, an apache regex without a
+// capture group for the client, ...) makes the exit code non-zero. The custom log
+// formats are those of the configuration.
+
+// runValidateRules checks the rules at path and prints the report. It returns the exit
+// code: 1 if the rules cannot be read or an enabled rule is unusable.
+func runValidateRules(path string) int {
+	if err := loadLogFormats(); err != nil {
+		log.Printf("Warning: Failed to load log formats: %v", err)
+	}
+	var fileRules []Rule
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		fileRules, err = readRulesDir(path)
+	} else {
+		fileRules, err = readRuleFile(path)
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+
+	// The problems are printed by rule below, rather than logged as they are found
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	checked := mergeRules(fileRules)
+	sortRules(checked)
+	for i := range checked {
+		rule := &checked[i]
+		enabled := rule.Enabled
+		rule.Enabled = true
+		compileRule(rule)
+		rule.Enabled = enabled
+	}
+	log.SetOutput(output)
+
+	fmt.Println(validationReport(path, checked))
+	for i := range checked {
+		if checked[i].Enabled && !ruleUsable(&checked[i]) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ruleUsable reports whether a compiled rule can match at all.
+func ruleUsable(rule *Rule) bool {
+	return rule.compiledRegex != nil || rule.compiledPath != nil
+}
+
+// validationReport lists the problems of the checked rules by rule.
+func validationReport(path string, checked []Rule) string {
+	var body strings.Builder
+	unusable, warned := 0, 0
+	for i := range checked {
+		rule := &checked[i]
+		if ruleUsable(rule) && len(rule.problems) == 0 {
+			continue
+		}
+		state := "usable"
+		if !ruleUsable(rule) {
+			state = "UNUSABLE"
+			if rule.Enabled {
+				unusable++
+			}
+		}
+		if ruleUsable(rule) {
+			warned++
+		}
+		if !rule.Enabled {
+			state += ", disabled"
+		}
+		fmt.Fprintf(&body, "\n  %s (%s):", rule.Name, state)
+		for _, problem := range rule.problems {
+			fmt.Fprintf(&body, "\n      %s", problem)
+		}
+	}
+
+	if body.Len() == 0 {
+		return fmt.Sprintf("Checked %d rules in %s: no problems found", len(checked), path)
+	}
+	return fmt.Sprintf("Checked %d rules in %s: %d enabled rules unusable, %d usable with warnings%s", len(checked), path, unusable, warned, body.String())
+}
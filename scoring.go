@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Cumulative scoring ---
+
+// Per-rule thresholds let an attacker alternate between rules, e.g. wp-login posts and
+// PHP 404 probes, without crossing any of them. With scoreThreshold set, every match
+// adds the score of its rule ("score", 1 if unset) to the IP's score, which halves every
+// scoreHalfLife, and the IP is blocked when its score reaches scoreThreshold, whatever
+// rules the matches came from. The per-rule thresholds, and the overrides of them, then
+// no longer apply. -stats shows the highest scores, for tuning the rule scores and the
+// threshold.
+
+// ipScore is the score of an IP's matches as of Updated.
+type ipScore struct {
+	Score   float64
+	Updated time.Time
+	Reason  string // Reason of the last match
+}
+
+// ipScores holds the scores by IP, guarded by mu
+var ipScores = make(map[string]*ipScore)
+
+// scoreStatsLimit is the number of scores -stats lists.
+const scoreStatsLimit = 20
+
+// scoringEnabled reports whether IPs are blocked on their score instead of per-rule
+// thresholds.
+func scoringEnabled() bool {
+	return scoreThreshold > 0
+}
+
+// ruleScore returns the score of a match of the named rule.
+func ruleScore(name string) float64 {
+	if rule := ruleNamed(name); rule != nil && rule.Score > 0 {
+		return rule.Score
+	}
+	return 1
+}
+
+// decayedScore returns what s is worth at now.
+func decayedScore(s *ipScore, now time.Time) float64 {
+	if scoreHalfLife <= 0 {
+		return s.Score
+	}
+	return s.Score * math.Exp2(-float64(now.Sub(s.Updated))/float64(scoreHalfLife))
+}
+
+// addScoreLocked adds the score of a match of the named rule, with the given reason, to
+// ip's and returns the total. The caller must hold mu.
+func addScoreLocked(ip, reason, rule string, now time.Time) float64 {
+	s := ipScores[ip]
+	if s == nil {
+		s = &ipScore{}
+		ipScores[ip] = s
+	}
+	s.Score = decayedScore(s, now) + ruleScore(rule)
+	s.Updated = now
+	s.Reason = reason
+	return s.Score
+}
+
+// cleanupScoresLocked forgets the scores that have decayed to nearly nothing. The caller
+// must hold mu.
+func cleanupScoresLocked(now time.Time) {
+	for ip, s := range ipScores {
+		if decayedScore(s, now) < scoreThreshold/100 {
+			delete(ipScores, ip)
+		}
+	}
+}
+
+// scoreStats lists the highest scores for the stats command.
+func scoreStats() string {
+	if !scoringEnabled() {
+		return "Scoring is off (scoreThreshold = 0); IPs are blocked on the per-rule thresholds"
+	}
+	type scored struct {
+		ip     string
+		score  float64
+		reason string
+	}
+	now := time.Now()
+	mu.Lock()
+	list := make([]scored, 0, len(ipScores))
+	for ip, s := range ipScores {
+		list = append(list, scored{ip, decayedScore(s, now), s.Reason})
+	}
+	mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].score > list[j].score })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Scores (threshold %g, half-life %v): %d IPs", scoreThreshold, scoreHalfLife, len(list))
+	for i, entry := range list {
+		if i == scoreStatsLimit {
+			break
+		}
+		fmt.Fprintf(&b, "\n  %s: %.2f (last: %s)", entry.ip, entry.score, entry.reason)
+	}
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Verified search engine bots ---
+
+// Search engines re-crawl URLs long after they are gone, so a rule for requests to missing
+// .php files ends up blocking Googlebot. With whitelistSearchBots = true, the client of a
+// line that matched a rule is checked before its match is counted: if its reverse DNS
+// name is in one of the search engine domains and resolves back to it (the check Google
+// and Bing document for their crawlers), the line is skipped. The lookups share the cache
+// of the domain whitelist. The domains are kept here; searchBotDomains replaces them with
+// a list of domain=name entries. A skipped bot is logged and written to the audit log as
+// a "skip" once per IP and dnsCacheTTL, not for every line.
+
+// defaultSearchBotDomains are the domains of the crawlers' hostnames, with the bot name.
+var defaultSearchBotDomains = map[string]string{
+	"googlebot.com":         "Googlebot",
+	"google.com":            "Googlebot",
+	"googleusercontent.com": "Googlebot",
+	"search.msn.com":        "Bingbot",
+	"crawl.yahoo.net":       "Yahoo Slurp",
+	"yandex.com":            "YandexBot",
+	"yandex.net":            "YandexBot",
+	"yandex.ru":             "YandexBot",
+	"applebot.apple.com":    "Applebot",
+	"crawl.baidu.com":       "Baiduspider",
+	"crawl.baidu.jp":        "Baiduspider",
+	"petalsearch.com":       "PetalBot",
+}
+
+var (
+	whitelistSearchBots = false                   // Skip the lines of verified search engine bots
+	searchBotDomains    = defaultSearchBotDomains // Domains of the bots' hostnames, with the bot name
+
+	searchBotSkips   = make(map[string]time.Time) // When a bot IP was last logged as skipped
+	searchBotSkipsMu sync.Mutex
+)
+
+// parseSearchBotDomains reads a searchBotDomains value: domains separated by commas, each
+// with =name for the log and the audit log, or named after the domain.
+func parseSearchBotDomains(value string) map[string]string {
+	domains := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		domain, name, _ := strings.Cut(item, "=")
+		domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+		if domain == "" {
+			continue
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			name = domain
+		}
+		domains[domain] = name
+	}
+	return domains
+}
+
+// verifiedSearchBot returns the bot name and hostname of ip if it is a verified search
+// engine bot. The caller must hold reloadMu (read).
+func verifiedSearchBot(ip string) (string, string, bool) {
+	if !whitelistSearchBots || len(searchBotDomains) == 0 {
+		return "", "", false
+	}
+	for _, hostname := range dnsCache.verifiedHostnames(ip) {
+		hostname = strings.ToLower(hostname)
+		for domain, name := range searchBotDomains {
+			if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+				return name, hostname, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// skipSearchBot reports whether the line of ip that matched rule comes from a verified
+// search engine bot, logging the first skip of the IP in a while. The caller must hold
+// reloadMu (read).
+func skipSearchBot(ip, rule, filePath, line string) bool {
+	name, hostname, ok := verifiedSearchBot(ip)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	searchBotSkipsMu.Lock()
+	last, seen := searchBotSkips[ip]
+	report := !seen || now.Sub(last) >= dnsCacheTTL
+	if report {
+		searchBotSkips[ip] = now
+		// Forget the IPs not seen for a while, which keeps the map to the active bots
+		for skipped, at := range searchBotSkips {
+			if now.Sub(at) >= dnsCacheTTL {
+				delete(searchBotSkips, skipped)
+			}
+		}
+	}
+	searchBotSkipsMu.Unlock()
+
+	if report {
+		log.Printf("IP %s is a verified %s (%s), skipping its matches", ip, name, hostname)
+		writeAudit(auditRecord{Action: "skip", Target: ip, Reason: "verified " + name, Rule: rule, Source: "log", LogFile: filePath, Request: line, Domain: hostname})
+	} else if debug {
+		log.Printf("IP %s is a verified %s, ignoring", ip, name)
+	}
+	return true
+}
+
+// searchBotDomainList describes the domains for the debug log.
+func searchBotDomainList(domains map[string]string) string {
+	list := make([]string, 0, len(domains))
+	for domain, name := range domains {
+		list = append(list, domain+"="+name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
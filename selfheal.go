@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chainChecker is implemented by backends that can tell whether their chain is still
+// installed and hooked in, so the reconcile task can notice an external flush of it
+// even when no block is being added.
+type chainChecker interface {
+	CheckChain() error
+}
+
+// Self-heal state, reported by the socket list and status commands
+var (
+	selfHealCount     int
+	lastSelfHeal      time.Time
+	lastSelfHealCause string
+	selfHealMu        sync.Mutex
+)
+
+// getSelfHealSummary describes how often the firewall had to be rebuilt
+func getSelfHealSummary() string {
+	selfHealMu.Lock()
+	defer selfHealMu.Unlock()
+	if selfHealCount == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d (last %s: %s)", selfHealCount, lastSelfHeal.Format(time.RFC3339), lastSelfHealCause)
+}
+
+// selfHealGeneration returns the number of heals so far; see healFirewall.
+func selfHealGeneration() int {
+	selfHealMu.Lock()
+	defer selfHealMu.Unlock()
+	return selfHealCount
+}
+
+// isMissingChainError reports whether a firewall error means our chain, table, or set was
+// removed behind our back.
+func isMissingChainError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "No chain/target/match by that name") || // iptables
+		strings.Contains(msg, "No such file or directory") || // nft table, chain, or set
+		strings.Contains(msg, "set with the given name does not exist") || // ipset
+		strings.Contains(msg, "unknown object ID") // Caddy route
+}
+
+// healFirewall re-runs the backend setup and re-applies the whole blocklist. gen is the
+// selfHealGeneration seen before the failure; if another caller has healed since then,
+// nothing is done and the caller just retries.
+func healFirewall(cause string, gen int) error {
+	selfHealMu.Lock()
+	defer selfHealMu.Unlock()
+	if selfHealCount != gen {
+		return nil
+	}
+
+	log.Printf("Warning: Firewall chain %s was removed or detached (%s), setting it up again and re-applying the blocklist", firewallChain, cause)
+	if err := fwManager.Setup(); err != nil {
+		return fmt.Errorf("failed to set up firewall again: %v", err)
+	}
+	selfHealCount++
+	lastSelfHeal = time.Now()
+	lastSelfHealCause = cause
+
+	if err := applyBlockList(); err != nil {
+		log.Printf("Warning: Failed to re-apply blocklist after self-heal: %v", err)
+	}
+	return nil
+}
+
+// addFirewallRule adds the block or, in challenge mode, redirect rule for a target. If the
+// rule fails because our chain has disappeared, the firewall is healed and the rule retried.
+func addFirewallRule(target string, opts RuleOptions) error {
+	gen := selfHealGeneration()
+	err := addFirewallRuleOnce(target, opts)
+	if err == nil || !isMissingChainError(err) {
+		return err
+	}
+	if healErr := healFirewall(err.Error(), gen); healErr != nil {
+		return fmt.Errorf("%v (self-heal failed: %v)", err, healErr)
+	}
+	return addFirewallRuleOnce(target, opts)
+}
+
+func addFirewallRuleOnce(target string, opts RuleOptions) error {
+	if challengeEnable {
+		return fwManager.AddRedirectRule(target, opts)
+	}
+	return fwManager.AddBlockRule(target, opts)
+}
+
+// checkFirewallChain heals the firewall if the backend reports its chain missing or detached.
+func checkFirewallChain() {
+	checker, ok := fwManager.(chainChecker)
+	if !ok || dryRun {
+		return
+	}
+	gen := selfHealGeneration()
+	if err := checker.CheckChain(); err != nil {
+		if healErr := healFirewall(err.Error(), gen); healErr != nil {
+			log.Printf("Warning: %v", healErr)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,6 +27,15 @@ type Message struct {
 	Success bool   `json:"success"`
 	APIKey  string `json:"api_key,omitempty"`
 	Stream  bool   `json:"stream,omitempty"` // Indicates if this is a streaming response
+
+	Check  *FirewallCheck `json:"check,omitempty"`  // Blocklist and firewall state, for the check command
+	Format string         `json:"format,omitempty"` // Output format, for the export and stats commands
+	Force  bool           `json:"force,omitempty"`  // For unblock: keep a blocklist feed entry unblocked across refreshes
+
+	Entries     []BlockEntry `json:"entries,omitempty"`      // For import: the entries to block
+	SkipMembers bool         `json:"skip_members,omitempty"` // For unblock: do not restore the IPs a subnet absorbed
+	Reset       bool         `json:"reset,omitempty"`        // For stats: zero the rule counters
+	Persist     bool         `json:"persist,omitempty"`      // For enable-rule and disable-rule: write the change to the rules file
 }
 
 // startSocketServer starts a Unix domain socket server to listen for commands
@@ -134,6 +144,15 @@ func processCommand(msg Message) Message {
 	response.Target = msg.Target
 	response.Success = false
 
+	switch msg.Command {
+	case string(BlockCommand), string(UnblockCommand), string(CheckCommand), string(AllowCommand), string(WhitelistAddCommand), string(WhitelistRemoveCommand):
+		if !isValidIPOrCIDR(msg.Target) {
+			response.Result = fmt.Sprintf("Invalid IP address or CIDR range: %s", msg.Target)
+			return response
+		}
+		msg.Target = normalizeTarget(msg.Target)
+	}
+
 	switch msg.Command {
 	case string(DebugCommand):
 		// Debug command is handled specially in handleConnection
@@ -141,7 +160,7 @@ func processCommand(msg Message) Message {
 		response.Result = "Debug command must be handled with streaming connection"
 
 	case string(BlockCommand):
-		if err := clientBlockIP(msg.Target); err != nil {
+		if err := clientBlockIP(msg.Target, "socket"); err != nil {
 			response.Result = fmt.Sprintf("Failed to block %s: %v", msg.Target, err)
 		} else {
 			response.Result = fmt.Sprintf("Successfully blocked %s", msg.Target)
@@ -149,6 +168,13 @@ func processCommand(msg Message) Message {
 		}
 
 	case string(UnblockCommand):
+		mu.Lock()
+		feed := feedSourceOf(msg.Target)
+		mu.Unlock()
+		if msg.Force {
+			excludeFromFeeds(msg.Target)
+		}
+
 		// First, remove the firewall rule (redirect or block) using the manager
 		var unblockErr error
 		if fwManager == nil {
@@ -166,29 +192,38 @@ func processCommand(msg Message) Message {
 			response.Result = fmt.Sprintf("Failed to remove firewall rule for %s: %v", msg.Target, unblockErr)
 		} else {
 			// If firewall rule removed successfully, update the blocklist
-			if err := clientUnblockIP(msg.Target); err != nil { // clientUnblockIP handles blocklist removal
+			if err := clientUnblockIP(msg.Target, "socket", !msg.SkipMembers); err != nil { // clientUnblockIP handles blocklist removal
 				response.Result = fmt.Sprintf("Firewall rule removed, but failed to update blocklist for %s: %v", msg.Target, err)
 			} else {
 				response.Result = fmt.Sprintf("Successfully unblocked %s", msg.Target)
+				if feed != "" && !msg.Force {
+					response.Result += fmt.Sprintf("\n%s comes from blocklist feed %s and will be blocked again at its next refresh; use -force to keep it unblocked", msg.Target, feed)
+				}
 				response.Success = true
 			}
 		}
 
+	case string(AllowCommand):
+		if result, err := clientAllowIP(msg.Target); err != nil {
+			response.Result = fmt.Sprintf("Failed to whitelist %s: %v", msg.Target, err)
+		} else {
+			response.Result = result
+			response.Success = true
+			writeAudit(auditRecord{Action: "allow", Target: msg.Target, Source: "socket"})
+		}
+
 	case string(CheckCommand):
 		isBlocked, subnet, err := isIPBlocked(msg.Target)
 		if err != nil {
 			response.Result = fmt.Sprintf("Failed to check %s: %v", msg.Target, err)
-		} else if isBlocked {
-			if subnet != "" {
-				response.Result = fmt.Sprintf("%s is blocked (contained in subnet %s)", msg.Target, subnet)
-			} else {
-				response.Result = fmt.Sprintf("%s is blocked", msg.Target)
-			}
-			response.Success = true
 		} else {
-			response.Result = fmt.Sprintf("%s is not blocked", msg.Target)
+			response.Result = blockStateText(msg.Target, isBlocked, subnet)
 			response.Success = true
 		}
+		if err == nil {
+			response.Check = checkFirewallState(fwManager, msg.Target)
+			response.Result += "\n" + response.Check.String()
+		}
 
 	case string(ListCommand):
 		mu.Lock()
@@ -196,11 +231,11 @@ func processCommand(msg Message) Message {
 		subnets := make([]string, 0, len(blockedSubnets))
 
 		for ip := range blockedIPs {
-			ips = append(ips, ip)
+			ips = append(ips, ip+entryNoteLocked(ip))
 		}
 
 		for subnet := range blockedSubnets {
-			subnets = append(subnets, subnet)
+			subnets = append(subnets, subnet+entryNoteLocked(subnet))
 		}
 		mu.Unlock()
 
@@ -216,6 +251,116 @@ func processCommand(msg Message) Message {
 			}
 			response.Result = result
 		}
+		response.Result += fmt.Sprintf("\nLast reconcile: %s\nSelf-heal events: %s", getLastReconcile(), getSelfHealSummary())
+		if dryRun {
+			response.Result = dryRunListHeader + "\n" + response.Result
+		}
+		response.Success = true
+
+	case string(ExportCommand):
+		output, err := exportBlockList(msg.Format)
+		if err != nil {
+			response.Result = err.Error()
+		} else {
+			response.Result = output
+			response.Format = msg.Format
+			response.Success = true
+		}
+
+	case string(RestoreCommand):
+		result, err := restoreBlockList(msg.Target)
+		if err != nil {
+			response.Result = fmt.Sprintf("Error restoring blocklist: %v", err)
+		} else {
+			response.Result = result
+			response.Success = true
+			writeAudit(auditRecord{Action: "restore", Target: msg.Target, Reason: result, Source: "socket"})
+		}
+
+	case string(ImportCommand):
+		result, err := importBlockEntries(msg.Entries, msg.Target, "socket")
+		if err != nil {
+			response.Result = fmt.Sprintf("Error importing: %v", err)
+		} else {
+			response.Result = result
+			response.Success = true
+		}
+
+	case string(StatsCommand):
+		report, err := ruleStatsReport(msg.Format, msg.Reset)
+		if err != nil {
+			response.Result = err.Error()
+			break
+		}
+		response.Result = report
+		if msg.Format != "json" {
+			response.Result += "\n\n" + scoreStats()
+			response.Result += "\n\n" + dnsCacheStats(msg.Reset)
+			if rates := rateStats(); rates != "" {
+				response.Result += "\n\n" + rates
+			}
+		}
+		response.Success = true
+
+	case string(ReloadCommand):
+		response.Result, response.Success = reloadConfig()
+
+	case string(EnableRuleCommand), string(DisableRuleCommand):
+		enable := msg.Command == string(EnableRuleCommand)
+		if result, err := setRuleEnabled(msg.Target, enable, msg.Persist); err != nil {
+			response.Result = fmt.Sprintf("Failed to %s rule: %v", strings.TrimSuffix(msg.Command, "-rule"), err)
+		} else {
+			response.Result = result
+			response.Success = true
+		}
+
+	case string(ShowRulesCommand):
+		response.Result = showRules()
+		response.Success = true
+
+	case string(WhitelistAddCommand):
+		if result, err := whitelistAdd(msg.Target, "socket"); err != nil {
+			response.Result = fmt.Sprintf("Failed to whitelist %s: %v", msg.Target, err)
+		} else {
+			response.Result = result
+			response.Success = true
+		}
+
+	case string(WhitelistRemoveCommand):
+		if result, err := whitelistRemove(msg.Target, "socket"); err != nil {
+			response.Result = fmt.Sprintf("Failed to remove %s from the whitelist: %v", msg.Target, err)
+		} else {
+			response.Result = result
+			response.Success = true
+		}
+
+	case string(WhitelistListCommand):
+		response.Result = whitelistListing()
+		response.Success = true
+
+	case string(TraceCommand):
+		if result, err := setTraceIP(msg.Target); err != nil {
+			response.Result = err.Error()
+		} else {
+			response.Result = result
+			response.Success = true
+			log.Print(result)
+		}
+
+	case string(StatusCommand):
+		mu.Lock()
+		ipCount, subnetCount := len(blockedIPs), len(blockedSubnets)
+		mu.Unlock()
+
+		mode := "block"
+		if challengeEnable {
+			mode = "challenge"
+		}
+		if dryRun {
+			mode += ", dry-run"
+		}
+		response.Result = fmt.Sprintf("Firewall: %s (chain %s, mode %s)\nBlocked: %d IPs, %d subnets\nMatcher queue: %s\nLong and binary lines: %s\nOverrides: %s\nReconcile interval: %v\nLast reconcile: %s\nSelf-heal events: %s",
+			firewallType, firewallChain, mode, ipCount, subnetCount, matchQueueStatus(), lineGuardStatus(), overrideStatus(), reconcileInterval, getLastReconcile(), getSelfHealSummary())
 		response.Success = true
 
 	default:
@@ -293,25 +438,42 @@ func handleDebugCommand(conn net.Conn) {
 	}
 }
 
-// sendCommand sends a command to the server over the socket
-func sendCommand(command ClientCommand, target string) error {
+// dialServer connects to the server's socket
+func dialServer() (net.Conn, error) {
 	// Check if the socket exists
 	if _, err := os.Stat(SocketPath); os.IsNotExist(err) {
-		return fmt.Errorf("server socket not found at %s, server may not be running", SocketPath)
+		return nil, fmt.Errorf("server socket not found at %s, server may not be running", SocketPath)
 	}
 
 	// Connect to the socket
 	conn, err := net.Dial("unix", SocketPath)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	return conn, nil
+}
+
+// sendCommand sends a command to the server over the socket
+func sendCommand(command ClientCommand, target string) error {
+	conn, err := dialServer()
+	if err != nil {
+		return err
 	}
 	defer conn.Close()
 
 	// Create the message
 	msg := Message{
-		Command: string(command),
-		Target:  target,
-		APIKey:  apiKey,
+		Command:     string(command),
+		Target:      target,
+		APIKey:      apiKey,
+		Force:       unblockForce && command == UnblockCommand,
+		SkipMembers: unblockSkipMembers && command == UnblockCommand,
+	}
+	if command == StatsCommand {
+		msg.Format, msg.Reset = statsFormat, statsReset
+	}
+	if command == EnableRuleCommand || command == DisableRuleCommand {
+		msg.Persist = persistRuleChange
 	}
 
 	// Send the message
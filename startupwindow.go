@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// --- Startup window ---
+
+// startupLines reads too much of a small log file and too little of a busy one. With
+// startupWindow set, a log file opened at startup is read from its first entry within the
+// window instead, found by a binary search on the timestamps, which are assumed to grow
+// through the file. Entries older than the window are skipped even if they come later,
+// so they never count towards a block. Files whose entries have no timestamp in the
+// format fall back to startupLines. The window also caps how far back rotated files and
+// the journal are read.
+
+// startupWindowScan is the size of the file region below which the binary search stops
+// and the remaining lines are scanned.
+const startupWindowScan = 64 * 1024
+
+// seekToStartupWindow positions a newly opened log file at its first entry within
+// startupWindow, reporting false if the window is disabled or the entries have no
+// timestamps, in which case the position is undefined.
+func seekToStartupWindow(filePath, format string, state *FileState) bool {
+	if startupWindow <= 0 {
+		return false
+	}
+	cutoff := time.Now().Add(-startupWindow)
+	info, err := state.File.Stat()
+	if err != nil {
+		return false
+	}
+
+	// lo is a line start known to be older than cutoff, or 0; hi is past it
+	lo, hi := int64(0), info.Size()
+	for hi-lo > startupWindowScan {
+		mid := lo + (hi-lo)/2
+		timestamp, found, ok := timestampAfter(state.File, mid, format)
+		if !ok {
+			return false
+		}
+		if found && timestamp.Before(cutoff) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	pos, ok := firstEntryFrom(state.File, lo, format, cutoff)
+	if !ok {
+		return false
+	}
+	if _, err := state.File.Seek(pos, io.SeekStart); err != nil {
+		return false
+	}
+
+	stateMutex.Lock()
+	state.Position = pos
+	if state.LastTimestamp.Before(cutoff) {
+		state.LastTimestamp = cutoff
+	}
+	stateMutex.Unlock()
+	log.Printf("Reading log file %s from offset %d, the first entry within the last %v", filePath, pos, startupWindow)
+	return true
+}
+
+// timestampAfter returns the timestamp of the first line starting after offset. found is
+// false if there is no such line; ok is false if it has no timestamp.
+func timestampAfter(file *os.File, offset int64, format string) (timestamp time.Time, found, ok bool) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return time.Time{}, false, false
+	}
+	reader := bufio.NewReader(file)
+	if offset > 0 {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return time.Time{}, false, true // The partial line at offset is the last
+		}
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return time.Time{}, false, true
+	}
+	timestamp, ok = extractTimestamp(line, format, file.Name())
+	return timestamp, true, ok
+}
+
+// firstEntryFrom scans forward from the line at or after offset and returns the offset of
+// the first entry not older than cutoff, or the end of the file. It reports false if no
+// line scanned has a timestamp.
+func firstEntryFrom(file *os.File, offset int64, format string, cutoff time.Time) (int64, bool) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, false
+	}
+	reader := bufio.NewReader(file)
+	pos := offset
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		pos += int64(len(skipped))
+		if err != nil {
+			return pos, true
+		}
+	}
+
+	sawTimestamp := false
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" {
+			return pos, sawTimestamp
+		}
+		if timestamp, ok := extractTimestamp(line, format, file.Name()); ok {
+			sawTimestamp = true
+			if !timestamp.Before(cutoff) {
+				return pos, true
+			}
+		}
+		if err != nil {
+			// A final line without a newline is still being written, so start at it
+			return pos, sawTimestamp
+		}
+		pos += int64(len(line))
+	}
+}
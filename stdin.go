@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// --- Reading logs from standard input ---
+
+// -stdin processes log lines piped in (tail -F access.log | apacheblock -stdin) instead of
+// watching log files, and exits at the end of the input. The lines go through the normal
+// pipeline, so whitelists, thresholds and blocking (or -dryRun) apply as in server mode,
+// and the blocks are saved to the blocklist. No socket server, peer sync or periodic task
+// is started. At the end a summary of the matches and blocks is printed.
+
+// stdinSummary counts what a -stdin run did.
+type stdinSummary struct {
+	lines   int
+	matches int
+	blocked []string
+}
+
+// String formats the summary printed when the input ends.
+func (s stdinSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Processed %d lines: %d matched a rule, %d blocked", s.lines, s.matches, len(s.blocked))
+	if dryRun && len(s.blocked) > 0 {
+		b.WriteString(" (dry run)")
+	}
+	for _, target := range s.blocked {
+		fmt.Fprintf(&b, "\n  %s", target)
+	}
+	return b.String()
+}
+
+// blockedTargets returns the blocked IPs and subnets.
+func blockedTargets() map[string]bool {
+	mu.Lock()
+	defer mu.Unlock()
+	targets := make(map[string]bool, len(blockedIPs)+len(blockedSubnets))
+	for ip := range blockedIPs {
+		targets[ip] = true
+	}
+	for subnet := range blockedSubnets {
+		targets[subnet] = true
+	}
+	return targets
+}
+
+// processStdin processes the log lines of input until it ends and returns the summary.
+func processStdin(input io.Reader) (stdinSummary, error) {
+	before := blockedTargets()
+	var summary stdinSummary
+
+	reader := bufio.NewReader(input)
+	var readErr error
+	for readErr == nil {
+		var line string
+		line, readErr = readLogLine(reader, "stdin")
+		if line = strings.TrimSpace(line); line == "" || !acceptLogLine(line, logFormat) {
+			continue
+		}
+		summary.lines++
+		if _, _, matched := matchRule(line, logFormat); matched {
+			summary.matches++
+		}
+		processLogEntry(line, "stdin", nil)
+	}
+
+	for target := range blockedTargets() {
+		if !before[target] {
+			summary.blocked = append(summary.blocked, target)
+		}
+	}
+	sort.Strings(summary.blocked)
+
+	if readErr != io.EOF {
+		return summary, fmt.Errorf("failed to read standard input: %v", readErr)
+	}
+	return summary, nil
+}
+
+// runStdin processes standard input, saves the blocklist and prints the summary. It
+// returns the exit code.
+func runStdin(input io.Reader) int {
+	summary, err := processStdin(input)
+	if err := saveBlockList(); err != nil {
+		log.Printf("Warning: Failed to save blocklist: %v", err)
+	}
+	flushAuditLog()
+	fmt.Println(summary)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return 1
+	}
+	return 0
+}
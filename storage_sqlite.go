@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go driver, no cgo
+)
+
+// --- SQLite storage ---
+
+// With storage = sqlite the blocklist, its metadata and the access records live in a
+// database at storageDBPath instead of the blocklist file. The in-memory maps stay
+// authoritative; each save writes only the rows that changed since the last one, so
+// saves stay cheap with tens of thousands of entries. Each entry also stores the first
+// and last address it covers, so containment lookups (-check without a running server)
+// use an index instead of reading every subnet.
+
+const dbSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	address TEXT PRIMARY KEY,
+	type TEXT NOT NULL,
+	family INTEGER NOT NULL,
+	range_start BLOB NOT NULL,
+	range_end BLOB NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	first_seen INTEGER,
+	blocked_at INTEGER,
+	expires_at INTEGER,
+	match_count INTEGER NOT NULL DEFAULT 0,
+	last_user_agent TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL DEFAULT '',
+	peer TEXT NOT NULL DEFAULT '',
+	members TEXT NOT NULL DEFAULT '',
+	ports TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS blocks_type ON blocks (type, family, range_start);
+CREATE INDEX IF NOT EXISTS blocks_range ON blocks (family, range_start, range_end);
+CREATE TABLE IF NOT EXISTS access_records (
+	ip TEXT PRIMARY KEY,
+	count INTEGER NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	first_seen INTEGER,
+	last_updated INTEGER,
+	expires_at INTEGER,
+	rule TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS offenses (target TEXT PRIMARY KEY, count INTEGER NOT NULL);
+CREATE TABLE IF NOT EXISTS feed_exclusions (target TEXT PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS aggregate_holes (ip TEXT PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS cloudflare_rules (target TEXT PRIMARY KEY, id TEXT NOT NULL, mode TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS settings (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+`
+
+// blockRow is a blocks row; times are Unix milliseconds, NULL if unknown.
+type blockRow struct {
+	kind                            string
+	reason                          string
+	firstSeen, blockedAt, expiresAt sql.NullInt64
+	matchCount                      int
+	lastUserAgent, action, source   string
+	peer                            string
+	members                         string // JSON list of the entries folded into an aggregate
+	ports                           string // Comma-separated ports of a rule with its own blockPorts
+}
+
+// recordRow is an access_records row.
+type recordRow struct {
+	count                             int
+	reason                            string
+	firstSeen, lastUpdated, expiresAt sql.NullInt64
+	rule                              string
+}
+
+var (
+	storageDB *sql.DB
+	// storageDBMu serialises saves and guards the rows as last written
+	storageDBMu  sync.Mutex
+	savedBlocks  map[string]blockRow
+	savedRecords map[string]recordRow
+	savedCounts  map[string]int      // offenses
+	savedExclude map[string]struct{} // feed exclusions
+	savedHoles   map[string]struct{} // aggregate holes
+	savedRules   map[string]CloudflareRule
+)
+
+// activeDBPath returns the database in use; dry-run mode uses a shadow database, like
+// activeBlocklistPath.
+func activeDBPath() string {
+	if dryRun {
+		return storageDBPath + ".dryrun"
+	}
+	return storageDBPath
+}
+
+// openStorageDB opens the database and creates the schema on first use.
+// The caller must hold storageDBMu.
+func openStorageDB() (*sql.DB, error) {
+	if storageDB != nil {
+		return storageDB, nil
+	}
+	path := activeDBPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+	// WAL lets client commands read while the server writes
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %v", path, err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(dbSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %v", path, err)
+	}
+	// Columns added after the first release of the schema
+	for _, column := range []string{"blocks.peer", "blocks.members", "blocks.ports", "access_records.rule"} {
+		table, name, _ := strings.Cut(column, ".")
+		if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("failed to upgrade schema in %s: %v", path, err)
+		}
+	}
+	storageDB = db
+	return db, nil
+}
+
+// addressRange returns a target's family and its first and last address as 16-byte
+// values, which SQLite compares byte by byte.
+func addressRange(target string) (int, []byte, []byte, error) {
+	prefix, err := netip.ParsePrefix(target)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(target)
+		if addrErr != nil {
+			return 0, nil, nil, fmt.Errorf("invalid address %s", target)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	prefix = prefix.Masked()
+	family, bits := 4, prefix.Bits()
+	if prefix.Addr().Is6() {
+		family = 6
+	} else {
+		bits += 96 // Position in the IPv4-mapped form
+	}
+	start := prefix.Addr().As16()
+	end := start
+	for i := bits; i < 128; i++ {
+		end[i/8] |= 1 << (7 - i%8)
+	}
+	return family, start[:], end[:], nil
+}
+
+// millis converts an optional time to a column value.
+func millis(t *time.Time) sql.NullInt64 {
+	if t == nil || t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
+
+// fromMillis converts a column value back to an optional time.
+func fromMillis(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.UnixMilli(v.Int64)
+	return &t
+}
+
+// rowOf converts a blocklist entry to its row.
+func rowOf(entry BlockEntry) blockRow {
+	members := ""
+	if len(entry.Members) > 0 {
+		if data, err := json.Marshal(entry.Members); err == nil {
+			members = string(data)
+		}
+	}
+	return blockRow{
+		kind:          entry.Type,
+		reason:        entry.Reason,
+		firstSeen:     millis(entry.FirstSeen),
+		blockedAt:     millis(entry.BlockedAt),
+		expiresAt:     millis(entry.ExpiresAt),
+		matchCount:    entry.MatchCount,
+		lastUserAgent: entry.LastUserAgent,
+		action:        entry.Action,
+		source:        entry.Source,
+		peer:          entry.Peer,
+		members:       members,
+		ports:         strings.Join(entry.Ports, ","),
+	}
+}
+
+// syncRows applies the differences between the rows last written and the current ones.
+func syncRows[R comparable](saved, current map[string]R, upsert func(key string, row R) error, remove func(key string) error) error {
+	for key, row := range current {
+		if old, ok := saved[key]; ok && old == row {
+			continue
+		}
+		if err := upsert(key, row); err != nil {
+			return err
+		}
+	}
+	for key := range saved {
+		if _, ok := current[key]; !ok {
+			if err := remove(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveBlockListDB writes the changes since the last save to the database in one transaction.
+func saveBlockListDB() error {
+	storageDBMu.Lock()
+	defer storageDBMu.Unlock()
+	db, err := openStorageDB()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	blocklist := snapshotBlockListLocked()
+	records := make(map[string]recordRow, len(ipAccessLog))
+	for ip, record := range ipAccessLog {
+		records[ip] = recordRow{
+			count:       record.Count,
+			reason:      record.Reason,
+			rule:        record.Rule,
+			firstSeen:   millis(&record.FirstSeen),
+			lastUpdated: millis(&record.LastUpdated),
+			expiresAt:   millis(&record.ExpiresAt),
+		}
+	}
+	mu.Unlock()
+
+	blocks := make(map[string]blockRow, len(blocklist.Entries))
+	for _, entry := range blocklist.Entries {
+		blocks[entry.Address] = rowOf(entry)
+	}
+	exclusions := make(map[string]struct{}, len(blocklist.FeedExclusions))
+	for _, target := range blocklist.FeedExclusions {
+		exclusions[target] = struct{}{}
+	}
+
+	holes := make(map[string]struct{}, len(blocklist.AggregateHoles))
+	for _, ip := range blocklist.AggregateHoles {
+		holes[ip] = struct{}{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start database transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	del := func(table, column string) func(string) error {
+		return func(key string) error {
+			_, err := tx.Exec("DELETE FROM "+table+" WHERE "+column+" = ?", key)
+			return err
+		}
+	}
+	err = syncRows(savedBlocks, blocks, func(address string, r blockRow) error {
+		family, start, end, err := addressRange(address)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO blocks (address, type, family, range_start, range_end, reason,
+			first_seen, blocked_at, expires_at, match_count, last_user_agent, action, source, peer, members, ports)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			address, r.kind, family, start, end, r.reason, r.firstSeen, r.blockedAt, r.expiresAt,
+			r.matchCount, r.lastUserAgent, r.action, r.source, r.peer, r.members, r.ports)
+		return err
+	}, del("blocks", "address"))
+	if err == nil {
+		err = syncRows(savedRecords, records, func(ip string, r recordRow) error {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO access_records (ip, count, reason, first_seen, last_updated, expires_at, rule)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`, ip, r.count, r.reason, r.firstSeen, r.lastUpdated, r.expiresAt, r.rule)
+			return err
+		}, del("access_records", "ip"))
+	}
+	if err == nil {
+		err = syncRows(savedCounts, blocklist.Offenses, func(target string, count int) error {
+			_, err := tx.Exec("INSERT OR REPLACE INTO offenses (target, count) VALUES (?, ?)", target, count)
+			return err
+		}, del("offenses", "target"))
+	}
+	if err == nil {
+		err = syncRows(savedExclude, exclusions, func(target string, _ struct{}) error {
+			_, err := tx.Exec("INSERT OR REPLACE INTO feed_exclusions (target) VALUES (?)", target)
+			return err
+		}, del("feed_exclusions", "target"))
+	}
+	if err == nil {
+		err = syncRows(savedHoles, holes, func(ip string, _ struct{}) error {
+			_, err := tx.Exec("INSERT OR REPLACE INTO aggregate_holes (ip) VALUES (?)", ip)
+			return err
+		}, del("aggregate_holes", "ip"))
+	}
+	if err == nil {
+		err = syncRows(savedRules, blocklist.CloudflareRules, func(target string, rule CloudflareRule) error {
+			_, err := tx.Exec("INSERT OR REPLACE INTO cloudflare_rules (target, id, mode) VALUES (?, ?, ?)", target, rule.ID, rule.Mode)
+			return err
+		}, del("cloudflare_rules", "target"))
+	}
+	if err == nil && dryRun {
+		_, err = tx.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES ('dry_run', '1')")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write database %s: %v", activeDBPath(), err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit database %s: %v", activeDBPath(), err)
+	}
+
+	savedBlocks, savedRecords, savedCounts = blocks, records, blocklist.Offenses
+	savedExclude, savedRules, savedHoles = exclusions, blocklist.CloudflareRules, holes
+	if debug {
+		log.Printf("Saved blocklist to %s: %d IPs, %d subnets, %d access records",
+			activeDBPath(), len(blocklist.IPs), len(blocklist.Subnets), len(records))
+	}
+	return nil
+}
+
+// removeStorageDB deletes the database and its WAL files, for -uninstall -purge.
+func removeStorageDB() []string {
+	var removed []string
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		path := storageDBPath + suffix
+		if err := os.Remove(path); err == nil {
+			removed = append(removed, "database file "+path)
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove database file %s: %v", path, err)
+		}
+	}
+	return removed
+}
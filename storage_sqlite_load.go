@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- SQLite storage: loading ---
+
+// readBlocksDB reads the blocks rows matching where (with args) as blocklist entries.
+func readBlocksDB(db *sql.DB, where string, args ...any) ([]BlockEntry, map[string]blockRow, error) {
+	rows, err := db.Query(`SELECT address, type, reason, first_seen, blocked_at, expires_at, match_count,
+		last_user_agent, action, source, peer, members, ports FROM blocks `+where, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var entries []BlockEntry
+	saved := make(map[string]blockRow)
+	for rows.Next() {
+		var address string
+		var r blockRow
+		if err := rows.Scan(&address, &r.kind, &r.reason, &r.firstSeen, &r.blockedAt, &r.expiresAt, &r.matchCount,
+			&r.lastUserAgent, &r.action, &r.source, &r.peer, &r.members, &r.ports); err != nil {
+			return nil, nil, err
+		}
+		saved[address] = r
+		var members []BlockEntry
+		if r.members != "" {
+			if err := json.Unmarshal([]byte(r.members), &members); err != nil {
+				log.Printf("Warning: Ignoring invalid members of aggregate %s in the database: %v", address, err)
+			}
+		}
+		var ports []string
+		if r.ports != "" {
+			ports = strings.Split(r.ports, ",")
+		}
+		entries = append(entries, BlockEntry{
+			Address:       address,
+			Type:          r.kind,
+			Reason:        r.reason,
+			FirstSeen:     fromMillis(r.firstSeen),
+			BlockedAt:     fromMillis(r.blockedAt),
+			ExpiresAt:     fromMillis(r.expiresAt),
+			MatchCount:    r.matchCount,
+			LastUserAgent: r.lastUserAgent,
+			Action:        r.action,
+			Source:        r.source,
+			Peer:          r.peer,
+			Members:       members,
+			Ports:         ports,
+		})
+	}
+	return entries, saved, rows.Err()
+}
+
+// loadBlockListDB loads the blocklist and the unexpired access records from the database.
+// The first time, an existing blocklist file is imported.
+func loadBlockListDB() error {
+	storageDBMu.Lock()
+	db, err := openStorageDB()
+	if err != nil {
+		storageDBMu.Unlock()
+		return err
+	}
+	var imported string
+	err = db.QueryRow("SELECT value FROM settings WHERE key = 'imported_json'").Scan(&imported)
+	storageDBMu.Unlock()
+	if err == sql.ErrNoRows {
+		return importBlockListFile()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read database %s: %v", activeDBPath(), err)
+	}
+
+	storageDBMu.Lock()
+	defer storageDBMu.Unlock()
+	var dryRunDB string
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = 'dry_run'").Scan(&dryRunDB); err == nil && !dryRun {
+		return fmt.Errorf("database %s was recorded in dry-run mode, refusing to apply it", activeDBPath())
+	}
+
+	blocklist := BlockList{Version: blockListVersion}
+	entries, blocks, err := readBlocksDB(db, "")
+	if err == nil {
+		blocklist.Entries = entries
+		blocklist.Offenses, err = readOffensesDB(db)
+	}
+	exclusions := make(map[string]struct{})
+	if err == nil {
+		err = scanRows(db, "SELECT target FROM feed_exclusions", func(rows *sql.Rows) error {
+			var target string
+			if err := rows.Scan(&target); err != nil {
+				return err
+			}
+			exclusions[target] = struct{}{}
+			blocklist.FeedExclusions = append(blocklist.FeedExclusions, target)
+			return nil
+		})
+	}
+	holes := make(map[string]struct{})
+	if err == nil {
+		err = scanRows(db, "SELECT ip FROM aggregate_holes", func(rows *sql.Rows) error {
+			var ip string
+			if err := rows.Scan(&ip); err != nil {
+				return err
+			}
+			holes[ip] = struct{}{}
+			blocklist.AggregateHoles = append(blocklist.AggregateHoles, ip)
+			return nil
+		})
+	}
+	rules := make(map[string]CloudflareRule)
+	if err == nil {
+		err = scanRows(db, "SELECT target, id, mode FROM cloudflare_rules", func(rows *sql.Rows) error {
+			var target string
+			var rule CloudflareRule
+			if err := rows.Scan(&target, &rule.ID, &rule.Mode); err != nil {
+				return err
+			}
+			rules[target] = rule
+			return nil
+		})
+		blocklist.CloudflareRules = rules
+	}
+	records := make(map[string]recordRow)
+	if err == nil {
+		err = scanRows(db, "SELECT ip, count, reason, first_seen, last_updated, expires_at, rule FROM access_records", func(rows *sql.Rows) error {
+			var ip string
+			var r recordRow
+			if err := rows.Scan(&ip, &r.count, &r.reason, &r.firstSeen, &r.lastUpdated, &r.expiresAt, &r.rule); err != nil {
+				return err
+			}
+			records[ip] = r
+			return nil
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read database %s: %v", activeDBPath(), err)
+	}
+
+	now := time.Now()
+	mu.Lock()
+	applyBlockListLocked(blocklist)
+	// Records that expired while we were not running are dropped at the next save
+	for ip, r := range records {
+		if r.expiresAt.Valid && now.Before(time.UnixMilli(r.expiresAt.Int64)) {
+			ipAccessLog[ip] = &AccessRecord{
+				Count:       r.count,
+				Reason:      r.reason,
+				Rule:        r.rule,
+				FirstSeen:   timeOrZero(fromMillis(r.firstSeen)),
+				LastUpdated: timeOrZero(fromMillis(r.lastUpdated)),
+				ExpiresAt:   time.UnixMilli(r.expiresAt.Int64),
+			}
+		}
+	}
+	ipCount, subnetCount := len(blockedIPs), len(blockedSubnets)
+	mu.Unlock()
+
+	savedBlocks, savedRecords, savedCounts = blocks, records, blocklist.Offenses
+	savedExclude, savedRules, savedHoles = exclusions, rules, holes
+	if debug {
+		log.Printf("Loaded blocklist from %s: %d IPs, %d subnets, %d access records",
+			activeDBPath(), ipCount, subnetCount, len(records))
+	}
+	return nil
+}
+
+// loadCoveringBlocksDB loads only the entries that are target, contain it or lie within it,
+// through the address and range indexes. It is enough for -check without a running server.
+func loadCoveringBlocksDB(target string) error {
+	family, start, end, err := addressRange(target)
+	if err != nil {
+		return err
+	}
+	storageDBMu.Lock()
+	defer storageDBMu.Unlock()
+	db, err := openStorageDB()
+	if err != nil {
+		return err
+	}
+	entries, _, err := readBlocksDB(db, "WHERE address = ? OR (family = ? AND range_start <= ? AND range_end >= ?) OR (family = ? AND range_start >= ? AND range_end <= ?)",
+		target, family, start, end, family, start, end)
+	if err != nil {
+		return fmt.Errorf("failed to read database %s: %v", activeDBPath(), err)
+	}
+	mu.Lock()
+	applyBlockListLocked(BlockList{Version: blockListVersion, Entries: entries})
+	mu.Unlock()
+	return nil
+}
+
+// importBlockListFile moves an existing blocklist file into the database, once.
+func importBlockListFile() error {
+	path := activeBlocklistPath()
+	if _, err := os.Stat(path); err == nil {
+		if err := loadBlockListFile(); err != nil {
+			return fmt.Errorf("failed to import %s into the database: %v", path, err)
+		}
+	}
+	if err := saveBlockListDB(); err != nil {
+		return err
+	}
+
+	storageDBMu.Lock()
+	defer storageDBMu.Unlock()
+	if _, err := storageDB.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES ('imported_json', ?)",
+		path+" "+time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("failed to write database %s: %v", activeDBPath(), err)
+	}
+	mu.Lock()
+	ipCount, subnetCount := len(blockedIPs), len(blockedSubnets)
+	mu.Unlock()
+	if ipCount+subnetCount > 0 {
+		log.Printf("Imported %d IPs and %d subnets from %s into %s; the file is no longer updated",
+			ipCount, subnetCount, path, activeDBPath())
+	}
+	return nil
+}
+
+// readOffensesDB reads the offenses table.
+func readOffensesDB(db *sql.DB) (map[string]int, error) {
+	offenses := make(map[string]int)
+	err := scanRows(db, "SELECT target, count FROM offenses", func(rows *sql.Rows) error {
+		var target string
+		var count int
+		if err := rows.Scan(&target, &count); err != nil {
+			return err
+		}
+		offenses[target] = count
+		return nil
+	})
+	return offenses, err
+}
+
+// scanRows runs a query and calls scan for each row.
+func scanRows(db *sql.DB, query string, scan func(*sql.Rows) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// timeOrZero dereferences an optional time.
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
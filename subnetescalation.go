@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+// --- Subnet escalation per rule ---
+
+// A few IPs of a /24 blocked for a distributed brute force are worth blocking the /24
+// for, but a few blocked for SQL injection may well be a shared NAT full of innocent
+// users. A rule can therefore set its own subnetThreshold, or disableSubnetBlocking to
+// keep the IPs it blocks out of the count. The count only takes in the IPs of the subnet
+// blocked with the same action and ports as the block that escalates, so the IPs
+// throttled by a ratelimit rule never add up to a subnet drop, nor IPs blocked from the
+// mail ports to a block of the web ports.
+
+// subnetEscalation returns the number of blocked IPs of a subnet that escalates a block
+// by the named rule to the subnet, and false if the block does not count toward subnet
+// blocking. override may be nil.
+func subnetEscalation(name string, override *Override) (int, bool) {
+	if disableSubnetBlocking {
+		return 0, false
+	}
+	rule := ruleNamed(name)
+	if rule != nil && rule.DisableSubnetBlocking {
+		return 0, false
+	}
+	if rule != nil && rule.SubnetThreshold > 0 {
+		return rule.SubnetThreshold, true
+	}
+	return override.subnetLimit(), true
+}
+
+// addSubnetMemberLocked records ip as blocked in subnet by the named rule and returns the
+// number of IPs of the subnet blocked with the same action and ports. The caller must
+// hold mu.
+func addSubnetMemberLocked(subnet, ip, rule string) int {
+	action := RuleOptions{Action: ruleAction(rule)}.action()
+	if ports := ruleBlockPorts(rule); len(ports) > 0 {
+		action += " " + strings.Join(ports, ",")
+	}
+	if subnetBlockedIPs[subnet] == nil {
+		subnetBlockedIPs[subnet] = make(map[string]string)
+	}
+	subnetBlockedIPs[subnet][ip] = action
+	count := 0
+	for _, memberAction := range subnetBlockedIPs[subnet] {
+		if memberAction == action {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Syslog listener ---
+
+// syslogListen (udp://0.0.0.0:5514, tcp://0.0.0.0:5514, or both separated by commas)
+// receives access logs from remote web servers. The syslog header is stripped and the
+// payload processed like a line of a log file named syslog:<host>, in logFormat or in the
+// format syslogFormats gives for the sender. TCP accepts newline-delimited and
+// octet-counted framing (RFC 6587). To bound memory, messages are processed as they are
+// read, messages over syslogMaxMessage close the connection, at most syslogMaxConns TCP
+// clients are served at once, and idle clients are dropped after syslogIdleTimeout.
+
+const (
+	syslogMaxMessage  = 64 * 1024       // Longest message accepted
+	syslogMaxConns    = 64              // TCP clients served at once
+	syslogIdleTimeout = 5 * time.Minute // TCP clients sending nothing for this long are dropped
+)
+
+// syslogFormatRule selects the log format for the messages of a sender.
+type syslogFormatRule struct {
+	prefix netip.Prefix // Sender address range; invalid if host is used
+	host   string       // HOSTNAME of the syslog header
+	format string
+}
+
+// syslogFormatRules holds the parsed syslogFormats, set before the listeners start.
+var syslogFormatRules []syslogFormatRule
+
+// parseSyslogFormats parses syslogFormats, a comma-separated list of source=format, where
+// source is an IP address, a CIDR range or a syslog hostname.
+func parseSyslogFormats(value string) ([]syslogFormatRule, error) {
+	var rules []syslogFormatRule
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		source, format, found := strings.Cut(item, "=")
+		source, format = strings.TrimSpace(source), strings.TrimSpace(format)
+		if !found || source == "" {
+			return nil, fmt.Errorf("invalid syslogFormats entry %q (must be source=format)", item)
+		}
+		if !isBuiltinLogFormat(format) && customLogFormats[format] == nil {
+			return nil, fmt.Errorf("unknown log format %q for %s", format, source)
+		}
+		rule := syslogFormatRule{format: format}
+		if prefix, err := netip.ParsePrefix(source); err == nil {
+			rule.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(source); err == nil {
+			rule.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else {
+			rule.host = source
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// syslogFormatFor returns the log format of messages from sender with the given hostname.
+func syslogFormatFor(sender netip.Addr, host string) string {
+	for _, rule := range syslogFormatRules {
+		if rule.prefix.IsValid() && rule.prefix.Contains(sender.Unmap()) {
+			return rule.format
+		}
+		if rule.host != "" && strings.EqualFold(rule.host, host) {
+			return rule.format
+		}
+	}
+	return logFormat
+}
+
+// startSyslogListeners starts a listener for each address of syslogListen.
+func startSyslogListeners() error {
+	if syslogListen == "" {
+		return nil
+	}
+	rules, err := parseSyslogFormats(syslogFormats)
+	if err != nil {
+		return err
+	}
+	syslogFormatRules = rules
+
+	for _, address := range strings.Split(syslogListen, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid syslogListen address %q (must be udp://host:port or tcp://host:port)", address)
+		}
+		switch u.Scheme {
+		case "udp":
+			conn, err := net.ListenPacket("udp", u.Host)
+			if err != nil {
+				return fmt.Errorf("failed to listen for syslog on %s: %v", address, err)
+			}
+			go serveSyslogUDP(conn)
+		case "tcp":
+			listener, err := net.Listen("tcp", u.Host)
+			if err != nil {
+				return fmt.Errorf("failed to listen for syslog on %s: %v", address, err)
+			}
+			go serveSyslogTCP(listener)
+		default:
+			return fmt.Errorf("invalid syslogListen protocol %q (must be udp or tcp)", u.Scheme)
+		}
+		log.Printf("Listening for syslog messages on %s", address)
+	}
+	return nil
+}
+
+// handleSyslogMessage processes one syslog message from sender.
+func handleSyslogMessage(data string, sender netip.Addr) {
+	msg := parseSyslog(data)
+	line := strings.TrimSpace(msg.Message)
+	if line == "" {
+		return
+	}
+	host := msg.Host
+	if host == "" {
+		host = sender.Unmap().String()
+	}
+	enqueueLogEntry(line, "syslog:"+host, syslogFormatFor(sender, msg.Host), nil)
+}
+
+// serveSyslogUDP processes the datagrams received on conn, one message each.
+func serveSyslogUDP(conn net.PacketConn) {
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Warning: Syslog UDP listener stopped: %v", err)
+			return
+		}
+		var sender netip.Addr
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			sender, _ = netip.AddrFromSlice(udpAddr.IP)
+		}
+		handleSyslogMessage(string(buf[:n]), sender)
+	}
+}
+
+// serveSyslogTCP accepts syslog clients, up to syslogMaxConns at once.
+func serveSyslogTCP(listener net.Listener) {
+	slots := make(chan struct{}, syslogMaxConns)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Warning: Syslog TCP listener stopped: %v", err)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				serveSyslogConn(conn)
+			}()
+		default:
+			log.Printf("Warning: Rejecting syslog client %s, %d clients are connected already", conn.RemoteAddr(), syslogMaxConns)
+			conn.Close()
+		}
+	}
+}
+
+// idleTimeoutConn is a connection whose reads fail once it has been idle for too long.
+type idleTimeoutConn struct {
+	net.Conn
+}
+
+func (c idleTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(syslogIdleTimeout))
+	return c.Conn.Read(p)
+}
+
+// serveSyslogConn processes the messages of one TCP client until it disconnects.
+func serveSyslogConn(conn net.Conn) {
+	defer conn.Close()
+	var sender netip.Addr
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sender, _ = netip.AddrFromSlice(tcpAddr.IP)
+	}
+	if debug {
+		log.Printf("Syslog client connected: %s", conn.RemoteAddr())
+	}
+
+	scanner := bufio.NewScanner(idleTimeoutConn{conn})
+	scanner.Buffer(make([]byte, 0, 4096), syslogMaxMessage)
+	scanner.Split(splitSyslogFrame)
+	for scanner.Scan() {
+		handleSyslogMessage(scanner.Text(), sender)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Syslog client %s disconnected: %v", conn.RemoteAddr(), err)
+	} else if debug {
+		log.Printf("Syslog client disconnected: %s", conn.RemoteAddr())
+	}
+}
+
+// splitSyslogFrame is a bufio.SplitFunc for syslog over TCP: octet-counted frames
+// ("57 <134>1 ..."), or lines for newline-delimited framing.
+func splitSyslogFrame(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] >= '1' && data[0] <= '9' {
+		if space := bytes.IndexByte(data, ' '); space > 0 {
+			if length, err := strconv.Atoi(string(data[:space])); err == nil {
+				if length > syslogMaxMessage {
+					return 0, nil, bufio.ErrTooLong
+				}
+				if len(data) >= space+1+length {
+					return space + 1 + length, data[space+1 : space+1+length], nil
+				}
+				if atEOF {
+					return len(data), data[space+1:], nil
+				}
+				return 0, nil, nil // Need the rest of the frame
+			}
+		}
+	}
+	return bufio.ScanLines(data, atEOF)
+}
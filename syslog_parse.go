@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogMessage is a syslog message split into the parts that are used.
+type syslogMessage struct {
+	Host    string // HOSTNAME of the header, if there is one
+	Tag     string // APP-NAME (RFC 5424) or TAG (RFC 3164), without the PID
+	Message string // The payload: the log line
+}
+
+// parseSyslog strips the syslog header from a message, in RFC 5424 format
+// ("<134>1 2026-10-14T10:00:00Z web1 apache - - - line") or the older RFC 3164 format
+// ("<134>Oct 14 10:00:00 web1 apache: line"). Without a <PRI> the whole text is the payload.
+func parseSyslog(data string) syslogMessage {
+	data = strings.TrimRight(data, "\r\n\x00")
+	rest, ok := stripSyslogPriority(data)
+	if !ok {
+		return syslogMessage{Message: data}
+	}
+	if version, after, found := strings.Cut(rest, " "); found && version != "" && strings.Trim(version, "0123456789") == "" {
+		return parseSyslog5424(after)
+	}
+	return parseSyslog3164(rest)
+}
+
+// stripSyslogPriority removes the leading <PRI>, reporting false if there is none.
+func stripSyslogPriority(data string) (string, bool) {
+	if !strings.HasPrefix(data, "<") {
+		return data, false
+	}
+	end := strings.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return data, false
+	}
+	if _, err := strconv.Atoi(data[1:end]); err != nil {
+		return data, false
+	}
+	return data[end+1:], true
+}
+
+// parseSyslog5424 parses what follows the version of an RFC 5424 message:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG.
+func parseSyslog5424(rest string) syslogMessage {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 6 {
+		return syslogMessage{Message: rest}
+	}
+	msg := syslogMessage{Host: nilValue(fields[1]), Tag: nilValue(fields[2])}
+	msg.Message = strings.TrimPrefix(skipStructuredData(fields[5]), "\ufeff")
+	return msg
+}
+
+// nilValue maps the RFC 5424 NILVALUE "-" to "".
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// skipStructuredData skips the STRUCTURED-DATA of an RFC 5424 message, "-" or one or more
+// [id param="value"] elements, and the space after it.
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(rest[1:], " ")
+	}
+	for strings.HasPrefix(rest, "[") {
+		inQuotes := false
+		end := -1
+		for i := 1; i < len(rest) && end < 0; i++ {
+			switch {
+			case rest[i] == '\\':
+				i++ // Escaped character
+			case rest[i] == '"':
+				inQuotes = !inQuotes
+			case rest[i] == ']' && !inQuotes:
+				end = i
+			}
+		}
+		if end < 0 {
+			return rest // Malformed; keep everything
+		}
+		rest = rest[end+1:]
+	}
+	return strings.TrimPrefix(rest, " ")
+}
+
+// parseSyslog3164 parses an RFC 3164 message after the <PRI>: TIMESTAMP HOSTNAME TAG: MSG.
+// Local senders often leave out the hostname, and some use an RFC 3339 timestamp.
+func parseSyslog3164(rest string) syslogMessage {
+	if len(rest) >= len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+		}
+	}
+	if first, after, found := strings.Cut(rest, " "); found {
+		if _, err := time.Parse(time.RFC3339, first); err == nil {
+			rest = after
+		}
+	}
+
+	var msg syslogMessage
+	token, after, found := strings.Cut(rest, " ")
+	if found && !isSyslogTag(token) {
+		msg.Host, rest = token, after
+		token, after, found = strings.Cut(rest, " ")
+	}
+	if found && isSyslogTag(token) {
+		tag := strings.TrimSuffix(token, ":")
+		if i := strings.IndexByte(tag, '['); i > 0 {
+			tag = tag[:i]
+		}
+		msg.Tag, rest = tag, after
+	}
+	msg.Message = rest
+	return msg
+}
+
+// isSyslogTag reports whether token is an RFC 3164 TAG, e.g. "apache:" or "nginx[123]:".
+func isSyslogTag(token string) bool {
+	return len(token) > 1 && len(token) <= 48 && strings.HasSuffix(token, ":") && !strings.Contains(token, "::")
+}
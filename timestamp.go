@@ -3,28 +3,30 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"regexp"
 	"time"
 )
 
-// Common Apache log format timestamp pattern: [day/month/year:hour:minute:second zone]
-var apacheTimestampRegex = regexp.MustCompile(`\[(\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`)
-
-// extractTimestamp extracts the timestamp from a log entry
-func extractTimestamp(line, format string) (time.Time, bool) {
+// extractTimestamp extracts the timestamp from a log entry read from source
+func extractTimestamp(line, format, source string) (time.Time, bool) {
 	switch format {
-	case "apache":
-		return extractApacheTimestamp(line)
+	case "apache", "apache-vhost", "nginx":
+		// nginx's $time_local uses the same layout
+		return extractApacheTimestamp(line, format, source)
 	case "caddy":
 		return extractCaddyTimestamp(line)
+	case "apache-error":
+		return extractErrorLogTimestamp(line)
 	default:
+		if def := customLogFormats[format]; def != nil {
+			return extractCustomTimestamp(line, def, source)
+		}
 		return time.Time{}, false
 	}
 }
 
 // extractApacheTimestamp extracts the timestamp from an Apache log entry
-func extractApacheTimestamp(line string) (time.Time, bool) {
-	matches := apacheTimestampRegex.FindStringSubmatch(line)
+func extractApacheTimestamp(line, format, source string) (time.Time, bool) {
+	matches := bracketedTimestampRegex.FindStringSubmatch(line)
 	if len(matches) < 2 {
 		if verbose {
 			log.Printf("Failed to extract timestamp from Apache log entry: %s", line)
@@ -32,12 +34,12 @@ func extractApacheTimestamp(line string) (time.Time, bool) {
 		return time.Time{}, false
 	}
 
-	// Apache log format: 02/Jan/2006:15:04:05 -0700
-	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", matches[1])
-	if err != nil {
+	// Apache log format: 02/Jan/2006:15:04:05 -0700, or one of timestampLayouts
+	timestamp, ok := parseTimestamp(matches[1], textFormatLayouts(format), source, format)
+	if !ok {
 		// Log only if verbose
 		if verbose {
-			log.Printf("Failed to parse timestamp from Apache log entry: %s, error: %v", matches[1], err)
+			log.Printf("Failed to parse timestamp from Apache log entry: %s", matches[1])
 		}
 		return time.Time{}, false
 	}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Timestamp layouts ---
+
+// Apache's %t is not the only timestamp servers write: %{%Y-%m-%d %H:%M:%S}t, ISO 8601
+// and month names in the server's locale are common too, and a timestamp that does not
+// parse turns off the ordering of entries, so old ones are processed again. The
+// bracketed timestamp of apache, apache-vhost and nginx lines is parsed with the layouts
+// timestampLayouts gives for the format (format=layout pairs separated by commas; repeat
+// a format for more layouts), then %t and the ISO 8601 layouts. Custom formats try their
+// timestampLayout, then their timestampLayouts. Layouts without a zone are read in local
+// time. If no layout parses a timestamp, its month name is looked up among common
+// localized abbreviations (Okt, déc, ago, ...) and the layouts are tried again. The
+// layout that last parsed a file's timestamp is tried first for its next line.
+
+// bracketedTimestampRegex matches the first bracketed field after the start of a line,
+// the timestamp of the apache, apache-vhost and nginx formats.
+var bracketedTimestampRegex = regexp.MustCompile(`\s\[([^\[\]]+)\]`)
+
+// builtinTimestampLayouts are tried after the configured layouts of a text format.
+var builtinTimestampLayouts = []string{
+	"02/Jan/2006:15:04:05 -0700", // %t
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// timestampLayouts holds the layouts of timestampLayouts by format.
+var timestampLayouts = map[string][]string{}
+
+// timestampLayoutUsed holds the index of the layout that last parsed a timestamp, by
+// source and format.
+var timestampLayoutUsed sync.Map
+
+// localizedMonths maps lowercase month abbreviations of other languages to English ones.
+var localizedMonths = map[string]string{
+	"janv": "Jan", "ene": "Jan", "gen": "Jan",
+	"févr": "Feb", "fév": "Feb", "fev": "Feb",
+	"mär": "Mar", "mrz": "Mar", "mars": "Mar", "mrt": "Mar",
+	"avr": "Apr", "abr": "Apr",
+	"mai": "May", "mag": "May", "mei": "May",
+	"juin": "Jun", "giu": "Jun",
+	"juil": "Jul", "lug": "Jul",
+	"août": "Aug", "ago": "Aug",
+	"sept": "Sep", "set": "Sep",
+	"okt": "Oct", "ott": "Oct", "out": "Oct",
+	"déc": "Dec", "dez": "Dec", "dic": "Dec",
+}
+
+// monthWordRegex matches the words of a timestamp that may be a month name.
+var monthWordRegex = regexp.MustCompile(`\p{L}+\.?`)
+
+// parseTimestampLayouts parses the timestampLayouts config value.
+func parseTimestampLayouts(value string) error {
+	parsed := map[string][]string{}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		format, layout, found := strings.Cut(item, "=")
+		format, layout = strings.TrimSpace(format), strings.TrimSpace(layout)
+		if !found || layout == "" {
+			return fmt.Errorf("invalid entry %q (must be format=layout)", item)
+		}
+		if format != "apache" && format != "apache-vhost" && format != "nginx" {
+			return fmt.Errorf("format %q of %q is not apache, apache-vhost or nginx", format, item)
+		}
+		parsed[format] = append(parsed[format], layout)
+	}
+	timestampLayouts = parsed
+	return nil
+}
+
+// textFormatLayouts returns the layouts tried for a line in a text built-in format.
+func textFormatLayouts(format string) []string {
+	configured := timestampLayouts[format]
+	if len(configured) == 0 {
+		return builtinTimestampLayouts
+	}
+	return append(append([]string(nil), configured...), builtinTimestampLayouts...)
+}
+
+// parseTimestamp parses value with the first of layouts that fits, starting with the one
+// that last fit for source and format, then again with its month name in English.
+func parseTimestamp(value string, layouts []string, source, format string) (time.Time, bool) {
+	key := source + "\x00" + format
+	start := 0
+	if used, ok := timestampLayoutUsed.Load(key); ok && used.(int) < len(layouts) {
+		start = used.(int)
+	}
+	for _, candidate := range []string{value, englishMonths(value)} {
+		if candidate == "" {
+			continue
+		}
+		for i := range layouts {
+			index := (start + i) % len(layouts)
+			if timestamp, err := time.ParseInLocation(layouts[index], candidate, time.Local); err == nil {
+				if index != start {
+					timestampLayoutUsed.Store(key, index)
+				}
+				return timestamp, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// englishMonths returns value with localized month abbreviations replaced by English
+// ones, or "" if it has none.
+func englishMonths(value string) string {
+	replaced := false
+	result := monthWordRegex.ReplaceAllStringFunc(value, func(word string) string {
+		if month, ok := localizedMonths[strings.ToLower(strings.TrimSuffix(word, "."))]; ok {
+			replaced = true
+			return month
+		}
+		return word
+	})
+	if !replaced {
+		return ""
+	}
+	return result
+}
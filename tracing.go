@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Sampled verbose output ---
+
+// verbose logs every line processed and every rule tried on it, which multiplies the log
+// volume on production traffic. The output about a line is written through its
+// lineTrace instead: with verboseSampleRate = N, only one line in N is traced, and with
+// verboseMatchOnly, the output about a line is held back and only written if a rule
+// matches it. Lines holding the address set with -traceIP are always traced in full,
+// with or without verbose, so one client can be followed on a busy server. The debug
+// stream shows the log, so the same lines appear in it.
+
+var (
+	traceMu       sync.Mutex
+	traceIP       string       // Address whose lines are always traced, or ""
+	tracedLineSeq atomic.Int64 // Lines considered for sampling
+)
+
+// lineTrace writes the verbose output about one log line; a nil lineTrace writes nothing.
+type lineTrace struct {
+	held    bool     // Output is held until the line matches
+	pending []string // Output held back
+}
+
+// newLineTrace returns the trace of a line, or nil if it is not traced.
+func newLineTrace(line string) *lineTrace {
+	if ip := currentTraceIP(); ip != "" && containsIPToken(line, ip) {
+		return &lineTrace{}
+	}
+	if !verbose {
+		return nil
+	}
+	if verboseSampleRate > 1 && tracedLineSeq.Add(1)%int64(verboseSampleRate) != 0 {
+		return nil
+	}
+	return &lineTrace{held: verboseMatchOnly}
+}
+
+// printf writes a line of verbose output, or holds it back until the line matches.
+func (t *lineTrace) printf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	if t.held {
+		t.pending = append(t.pending, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// matched writes the output held back for a line that matched, and the rest as it comes.
+func (t *lineTrace) matched() {
+	if t == nil || !t.held {
+		return
+	}
+	for _, message := range t.pending {
+		log.Print(message)
+	}
+	t.held, t.pending = false, nil
+}
+
+// currentTraceIP returns the address set with -traceIP, or "".
+func currentTraceIP() string {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	return traceIP
+}
+
+// setTraceIP sets the address whose lines are traced; "" or "none" stops tracing.
+func setTraceIP(target string) (string, error) {
+	ip := ""
+	if target != "" && target != "none" {
+		parsed := parseClientIP(target)
+		if parsed == nil {
+			return "", fmt.Errorf("invalid IP address: %s", target)
+		}
+		ip = parsed.String()
+	}
+	traceMu.Lock()
+	traceIP = ip
+	traceMu.Unlock()
+	if ip == "" {
+		return "Stopped tracing", nil
+	}
+	return fmt.Sprintf("Tracing the log lines of %s", ip), nil
+}
+
+// containsIPToken reports whether line holds ip as a whole address, not as part of a
+// longer one.
+func containsIPToken(line, ip string) bool {
+	for offset := 0; ; {
+		index := strings.Index(line[offset:], ip)
+		if index < 0 {
+			return false
+		}
+		start, end := offset+index, offset+index+len(ip)
+		if (start == 0 || !isAddressByte(line[start-1])) && (end == len(line) || !isAddressByte(line[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// isAddressByte reports whether b can be part of an IP address.
+func isAddressByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F' || b == ':' || b == '.'
+}
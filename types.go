@@ -2,12 +2,16 @@ package main
 
 import (
 	"io"
+	"net/netip"
 	"os"
 	"sync"
 	"time"
 )
 
-// FileState tracks the state of a file being monitored
+// FileState tracks the state of a file being monitored. Its fields are guarded by
+// stateMutex; File is replaced and closed only by the goroutine reading it. The state in
+// fileStates is the ownership token of its path: a goroutine whose state was replaced or
+// removed no longer processes lines and exits.
 type FileState struct {
 	File            *os.File
 	Position        int64
@@ -15,6 +19,7 @@ type FileState struct {
 	LastMod         time.Time
 	LastTimestamp   time.Time     // Timestamp of the last processed log entry
 	LastProcessedIP string        // Last IP that was processed
+	Format          string        // Log format of the file's lines
 	stopChan        chan struct{} // Channel to signal the processing goroutine to stop
 }
 
@@ -26,10 +31,17 @@ var (
 	fileSuffix                 = "access.log" // Log file suffix
 	debug                      = false
 	verbose                    = false // Verbose debug mode
+	verboseSampleRate          = 1     // Trace one line in this many in verbose mode
+	verboseMatchOnly           = false // Only write the verbose output about lines that match
 	ipAccessLog                = make(map[string]*AccessRecord)
 	blockedIPs                 = make(map[string]struct{})
 	blockedSubnets             = make(map[string]struct{})
-	subnetBlockedIPs           = make(map[string]map[string]struct{}) // maps subnet to set of blocked IPs
+	pendingBlocks              = make(map[string]struct{})          // targets whose firewall rule is being added, guarded by mu
+	blockedExpiry              = make(map[string]time.Time)         // when automatic blocks end (blockDuration), guarded by mu
+	blockedActions             = make(map[string]string)            // per-entry action set by the triggering rule, e.g. "ratelimit"
+	blockOffenses              = make(map[string]int)               // automatic blocks per target so far, for escalation, guarded by mu
+	blockedMeta                = make(map[string]*BlockEntry)       // why and when each entry was blocked, guarded by mu
+	subnetBlockedIPs           = make(map[string]map[string]string) // maps subnet to its blocked IPs and the actions (and rule ports) they were blocked with
 	fileStates                 = make(map[string]*FileState)
 	logFormat           string = "apache"
 	logpath             string = "/var/customers/logs" // Example default, might be overridden
@@ -37,18 +49,95 @@ var (
 	domainWhitelistPath string = "/etc/apacheblock/domainwhitelist.txt"
 	blocklistFilePath   string = "/etc/apacheblock/blocklist.json"
 	ignoreFilesPath     string = "/etc/apacheblock/ignorefiles.txt"
+	auditLogPath        string = "" // Append-only JSON lines record of blocks, unblocks and challenges (empty disables)
+	accessStateFile     string = "" // Where access records are kept across restarts (empty: accessrecords.json beside the blocklist)
+	logOffsetsFile      string = "" // Where log file read offsets are kept across restarts (empty: logoffsets.json beside the blocklist)
+	logFormatsPath      string = DefaultLogFormatsPath
+	overridesPath       string = DefaultOverridesPath
+	logDepth            int    = 1       // Levels of directories below each log directory that are searched
+	formatMap           string = ""      // Log formats of files by glob, e.g. "*caddy*.log=caddy" (the rest use server)
+	errorLogSuffix      string = ""      // Suffix of Apache error logs monitored in the apache-error format, e.g. "error.log" (empty: none)
+	watchMode           string = "auto"  // How new log files are found: "inotify", "poll", or "auto" (inotify, polling if it fails)
+	logSource           string = "files" // Where log lines come from: "files" (logPath) or "journald"
+	journalUnit         string = ""      // Units to follow with logSource = journald, separated by commas (empty: all)
+	journalCursorFile   string = ""      // Where the journal position is kept across restarts (empty: journalcursor beside the blocklist)
+	syslogListen        string = ""      // Syslog listener addresses, e.g. "udp://0.0.0.0:5514,tcp://0.0.0.0:5514" (empty disables)
+	syslogFormats       string = ""      // Log formats of syslog senders, e.g. "10.0.0.0/24=caddy,web1=apache"
 	// rulesFilePath is declared locally in rules.go
-	firewallChain string = "apacheblock" // Renamed from firewallTable
-	firewallType  string = "iptables"    // New: "iptables" or "nftables"
-	apiKey        string = ""
+	firewallChain      string = "apacheblock"         // Renamed from firewallTable
+	firewallType       string = "iptables"            // New: "iptables", "nftables" or "cloudflare"
+	cloudflareAPIToken        = ""                    // API token for the cloudflare backend
+	cloudflareZoneID          = ""                    // Zone whose IP Access Rules the cloudflare backend manages
+	useIPSet           bool   = false                 // Keep blocked addresses in ipsets (iptables only)
+	attachChains              = []string{"INPUT"}     // iptables chains that jump to firewallChain
+	iptablesPath              = ""                    // iptables command to run, e.g. /usr/sbin/iptables-legacy (empty uses PATH)
+	ip6tablesPath             = ""                    // ip6tables command to run (empty uses PATH)
+	removeRulesOnExit         = false                 // Remove the firewall chains and rules on graceful shutdown
+	dryRun                    = false                 // Log firewall changes instead of applying them; the blocklist goes to a shadow file
+	blockAction        string = "drop"                // Firewall action for blocked addresses: "drop", "reject" or "ratelimit"
+	rateLimit          string = "10/min"              // New connections per source allowed by the "ratelimit" action
+	blockPorts                = []string{"80", "443"} // Destination ports covered by block and redirect rules
+	blockScope         string = "web"                 // "web" blocks blockPorts only, "all" blocks every port
+	apiKey             string = ""
 	// SocketPath is declared locally in socket.go
 
 	// Core Configuration variables
 	expirationPeriod      time.Duration = 5 * time.Minute
 	threshold             int           = 3
+	scoreThreshold        float64       = 0                // Score that gets an IP blocked (0 = per-rule thresholds)
+	scoreHalfLife         time.Duration = 10 * time.Minute // Time after which a score is worth half
 	subnetThreshold       int           = 3
 	disableSubnetBlocking bool          = false
 	startupLines          int           = 5000
+	startupWindow         time.Duration = 0                   // Read log files from their first entry this recent at startup (0 uses startupLines)
+	pollInterval          time.Duration = time.Second         // How often log files at their end are checked for new lines
+	matchWorkers          int           = 0                   // Goroutines matching log lines against the rules (0 = number of CPUs)
+	matchQueueSize        int           = 1000                // Log lines waiting for a matcher before readers wait
+	maxLineLength         int           = 64 * 1024           // Bytes of a log line kept; the rest is discarded (0 = no limit)
+	processRotated        bool          = false               // Read recent entries of rotated log files at startup
+	processRotatedMaxAge  time.Duration = 0                   // Cap on how far back they are read (0 = the longest rule duration)
+	reconcileInterval     time.Duration = 10 * time.Minute    // How often to check the firewall against the blocklist (0 disables)
+	reconcileRemoveExtra  bool          = false               // Remove firewall rules for targets not in the blocklist
+	blockDuration         time.Duration = 0                   // How long automatic blocks last (0 = until unblocked)
+	blockEscalation       float64       = 2                   // Factor applied to the duration for each earlier block of a target
+	maxBlockDuration      time.Duration = 30 * 24 * time.Hour // Cap on escalated durations (0 = no cap)
+
+	firewallCommandTimeout time.Duration = 10 * time.Second // Deadline for each iptables/ipset/nft invocation
+	firewallCommandRetries int           = 3                // Retries when a firewall command hits lock contention or a timeout
+
+	denyFilePath   string = "/etc/apacheblock/deny.conf" // Web server include written by the denyfile backend
+	denyFileFormat string = "apache"                     // Syntax of denyFilePath: apache or nginx
+	reloadCommand  string = ""                           // Run after denyFilePath changes, e.g. "systemctl reload apache2"
+
+	caddyAdminURL   string = "http://localhost:2019" // Admin API used by the caddy backend
+	caddyServer     string = "srv0"                  // Server under apps.http.servers that gets the block route
+	caddyAdminToken string = ""                      // Bearer token for an admin API behind an authenticating proxy
+
+	storage       string = "json"                            // Where the blocklist is kept: json (blocklistFilePath) or sqlite
+	storageDBPath string = "/etc/apacheblock/apacheblock.db" // Database used when storage is sqlite
+
+	blocklistFeeds        []string                              // URLs of one-CIDR-per-line feeds imported into the blocklist
+	blocklistFeedInterval time.Duration = time.Hour             // How often the feeds are fetched again (0 = at startup only)
+	feedExclusions                      = map[string]struct{}{} // Targets kept out of feed imports by -unblock -force, guarded by mu
+	unblockForce          bool                                  // -force given with -unblock
+	unblockSkipMembers    bool                                  // -restoreMembers=false given with -unblock
+
+	peers        []string           // host:port of the peer sync servers of other apacheblock servers
+	peerSecret   string             // Shared secret signing peer sync requests
+	peerListen   string   = ":7891" // Address of this server's peer sync server
+	peerNodeName string             // Name this server's blocks carry on the peers (default: hostname)
+
+	blocklistBackups        int           = 3         // Rotated copies of the blocklist kept as blocklist.json.1 ... .N (0 disables)
+	blocklistBackupInterval time.Duration = time.Hour // Minimum time between copies, unless blocklistBackupChanges is reached
+	blocklistBackupChanges  int           = 100       // Entries added or removed that trigger a copy early (0 = time only)
+
+	aggregateDensity    float64 = 0                     // Share of a CIDR's addresses that must be blocked to fold them into it (0 disables)
+	aggregateMinIPs     int     = 16                    // Fewest blocked IPs folded into an aggregate
+	aggregateMinPrefix  int     = 20                    // Largest IPv4 aggregate (prefix length)
+	aggregateMinPrefix6 int     = 120                   // Largest IPv6 aggregate (prefix length)
+	aggregateHoles              = map[string]struct{}{} // IPs unblocked out of an aggregate, guarded by mu
+
+	realIPHeader string = "X-Forwarded-For" // Header trusted proxies name the client in; "Forwarded" is parsed as RFC 7239
 
 	// Challenge Feature Configuration
 	challengeEnable                bool          = false
@@ -58,11 +147,14 @@ var (
 	recaptchaSiteKey               string        = ""
 	recaptchaSecretKey             string        = ""
 	challengeTempWhitelistDuration time.Duration = 5 * time.Minute
-	trustedProxies                 []string
+	trustedProxies                 []netip.Prefix
 	logOutput                      string = "stdout"
 	logWriter                      io.Writer
 	ignoredFiles                          = map[string]bool{}
 	ignoredFilesMu                 sync.RWMutex
+	logIncludePatterns             []string // Globs a monitored log file must match (empty: all), guarded by logFilterMu
+	logExcludePatterns             []string // Globs of log files never monitored, guarded by logFilterMu
+	logFilterMu                    sync.RWMutex
 
 	blockedIPInfo   map[string]*BlockInfo
 	blockedIPInfoMu sync.RWMutex
@@ -77,6 +169,8 @@ var (
 
 	tempWhitelist      map[string]time.Time // Map IP to expiry time
 	tempWhitelistMutex sync.Mutex           // Mutex for temporary whitelist map
+	whitelistMu        sync.RWMutex         // Guards whitelist, which the allow command extends at runtime
+	reloadMu           sync.RWMutex         // Held by log line analysis, so a reload swaps settings between lines
 )
 
 func init() {
@@ -86,22 +180,61 @@ func init() {
 
 // AccessRecord tracks suspicious activity for an IP address
 type AccessRecord struct {
-	Count       int
-	ExpiresAt   time.Time
-	LastUpdated time.Time
-	Reason      string // The rule that triggered this record
+	Count       int       `json:"count"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	LastUpdated time.Time `json:"lastUpdated"`
+	Reason      string    `json:"reason"`    // The match that triggered this record, for the logs
+	Rule        string    `json:"rule"`      // Name of the rule of that match
+	FirstSeen   time.Time `json:"firstSeen"` // When the IP first matched a rule
 }
 
+// blockListVersion is the version of the blocklist file format written by saveBlockList.
+// Version 1 files (no version field) hold bare ips and subnets lists.
+const blockListVersion = 2
+
 // BlockList represents the list of blocked IPs and subnets for persistence
 type BlockList struct {
+	Version int          `json:"version,omitempty"`
+	Entries []BlockEntry `json:"entries,omitempty"` // Version 2: one record per blocked IP or subnet
+	// The bare lists, still written so that older versions can read the file
 	IPs     []string `json:"ips"`
 	Subnets []string `json:"subnets"`
+	DryRun  bool     `json:"dryRun,omitempty"` // Entries were recorded in dry-run mode and never applied
+	// Cloudflare access rules created for the entries (cloudflare backend only)
+	CloudflareRules map[string]CloudflareRule `json:"cloudflareRules,omitempty"`
+	// Version 1 only: per-entry actions and expiry times, now kept in Entries
+	Actions map[string]string    `json:"actions,omitempty"`
+	Expires map[string]time.Time `json:"expires,omitempty"`
+	// Number of automatic blocks per target, kept after a block expires so re-blocks escalate
+	Offenses map[string]int `json:"offenses,omitempty"`
+	// Targets unblocked with -force, which blocklist feeds no longer import
+	FeedExclusions []string `json:"feedExclusions,omitempty"`
+	// IPs unblocked out of an aggregate, which aggregation no longer covers
+	AggregateHoles []string `json:"aggregateHoles,omitempty"`
+}
+
+// BlockEntry is a blocklist entry with the details of why and when it was blocked
+type BlockEntry struct {
+	Address       string       `json:"address"`
+	Type          string       `json:"type"`             // "ip" or "subnet"
+	Reason        string       `json:"reason,omitempty"` // The rule that triggered the block, or "manual block"
+	FirstSeen     *time.Time   `json:"firstSeen,omitempty"`
+	BlockedAt     *time.Time   `json:"blockedAt,omitempty"`
+	ExpiresAt     *time.Time   `json:"expiresAt,omitempty"` // Set for blocks with a blockDuration
+	MatchCount    int          `json:"matchCount,omitempty"`
+	LastUserAgent string       `json:"lastUserAgent,omitempty"`
+	Action        string       `json:"action,omitempty"`  // Set if it differs from blockAction
+	Ports         []string     `json:"ports,omitempty"`   // Set for blocks by a rule with its own blockPorts
+	Source        string       `json:"source,omitempty"`  // URL of the blocklist feed the entry was imported from
+	Peer          string       `json:"peer,omitempty"`    // Node name of the peer the entry was received from
+	Members       []BlockEntry `json:"members,omitempty"` // IPs folded into an aggregate or absorbed by a subnet block, restored on unblock
 }
 
 // CaddyLogEntry represents a log entry from Caddy server
 type CaddyLogEntry struct {
 	Request struct {
 		ClientIP string `json:"client_ip"`
+		Host     string `json:"host"`
 		Method   string `json:"method"`
 		URI      string `json:"uri"`
 	} `json:"request"`
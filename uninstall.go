@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Things removed by a teardown, reported by -uninstall
+var (
+	removedItems   []string
+	removedItemsMu sync.Mutex
+)
+
+// noteRemoval records something a teardown removed, for the -uninstall report.
+func noteRemoval(format string, args ...interface{}) {
+	removedItemsMu.Lock()
+	defer removedItemsMu.Unlock()
+	removedItems = append(removedItems, fmt.Sprintf(format, args...))
+}
+
+// takeRemovals returns and clears the recorded removals.
+func takeRemovals() []string {
+	removedItemsMu.Lock()
+	defer removedItemsMu.Unlock()
+	items := removedItems
+	removedItems = nil
+	return items
+}
+
+// runUninstall removes everything apacheblock installed on the system: the firewall rules,
+// the chains and the jumps to them from every parent chain (or the nft tables, ipsets, or
+// Cloudflare rules), and the socket file. With purge the blocklist file is deleted too;
+// otherwise it is kept, so a reinstall starts with the same blocks. Unlike -clean, the
+// firewall is not set up first, so the report lists only what was actually there.
+func runUninstall(purge bool) error {
+	if conn, err := net.DialTimeout("unix", SocketPath, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("an apacheblock server is running on %s, stop it before uninstalling", SocketPath)
+	}
+
+	// Cloudflare rules are only known from the blocklist
+	if err := loadBlockList(); err != nil && debug {
+		log.Printf("Could not load blocklist: %v", err)
+	}
+
+	manager, err := newFirewallManager()
+	if err != nil {
+		return err
+	}
+	takeRemovals()
+	teardownErr := manager.Teardown()
+	items := takeRemovals()
+
+	if err := os.Remove(SocketPath); err == nil {
+		items = append(items, "socket file "+SocketPath)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Warning: Failed to remove socket file %s: %v", SocketPath, err)
+	}
+	if purge {
+		paths := []string{blocklistFilePath, blocklistFilePath + ".bak"}
+		for i := 1; i <= blocklistBackups; i++ {
+			paths = append(paths, fmt.Sprintf("%s.%d", blocklistFilePath, i))
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err == nil {
+				items = append(items, "blocklist file "+path)
+			} else if !os.IsNotExist(err) {
+				log.Printf("Warning: Failed to remove blocklist file %s: %v", path, err)
+			}
+		}
+		items = append(items, removeStorageDB()...)
+		if err := os.Remove(accessStatePath()); err == nil {
+			items = append(items, "access state file "+accessStatePath())
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove access state file %s: %v", accessStatePath(), err)
+		}
+		if err := os.Remove(logOffsetsPath()); err == nil {
+			items = append(items, "log offsets file "+logOffsetsPath())
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove log offsets file %s: %v", logOffsetsPath(), err)
+		}
+		if err := os.Remove(journalCursorPath()); err == nil {
+			items = append(items, "journal cursor file "+journalCursorPath())
+		} else if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to remove journal cursor file %s: %v", journalCursorPath(), err)
+		}
+	}
+
+	if len(items) == 0 {
+		log.Println("Uninstall: nothing to remove")
+	} else {
+		log.Printf("Uninstall removed %d item(s):", len(items))
+		for _, item := range items {
+			log.Printf("  - %s", item)
+		}
+	}
+	if !purge {
+		log.Printf("Kept blocklist file %s (use -purge to delete it)", blocklistFilePath)
+	}
+	return teardownErr
+}
@@ -9,14 +9,27 @@ import (
 // This assumes the User-Agent is enclosed in double quotes after the HTTP version
 var apacheUserAgentRegex = regexp.MustCompile(`"(?:GET|POST|HEAD|PUT|DELETE) [^"]+" \d+ \d+ "(?:[^"]*)" "([^"]*)"`)
 
+// Regular expression to extract User-Agent from nginx combined log entries. nginx escapes
+// quotes inside fields and logs garbage request lines (e.g. TLS sent to the HTTP port) as
+// they arrive, so any request field is accepted.
+var nginxUserAgentRegex = regexp.MustCompile(`"[^"]*" \d{3} \d+ "(?:[^"]*)" "([^"]*)"`)
+
 // extractUserAgent extracts the User-Agent from a log entry
 func extractUserAgent(line, format string) string {
 	switch format {
-	case "apache":
+	case "apache", "apache-vhost":
 		return extractApacheUserAgent(line)
+	case "nginx":
+		if matches := nginxUserAgentRegex.FindStringSubmatch(line); len(matches) > 1 {
+			return matches[1]
+		}
+		return ""
 	case "caddy":
 		return extractCaddyUserAgent(line)
 	default:
+		if def := customLogFormats[format]; def != nil {
+			return extractCustomUserAgent(line, def)
+		}
 		return ""
 	}
 }
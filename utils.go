@@ -1,15 +1,34 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
-// getSubnet extracts the /24 subnet from an IP address
+// parseClientIP parses a client address as servers write it, also accepting IPv6 in
+// brackets ([2001:db8::1]) or with a zone (fe80::1%eth0), which is dropped. It returns
+// nil if s is not an address
+func parseClientIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if zone := strings.IndexByte(s, '%'); zone > 0 && strings.Contains(s[:zone], ":") {
+		s = s[:zone]
+	}
+	return net.ParseIP(s)
+}
+
+// getSubnet extracts the subnet used for subnet blocking from an IP address:
+// /24 for IPv4 and /64 for IPv6
 func getSubnet(ip string) string {
-	ipAddr := net.ParseIP(ip)
+	ipAddr := parseClientIP(ip)
 	if ipAddr == nil {
 		return ""
 	}
@@ -21,6 +40,61 @@ func getSubnet(ip string) string {
 	return ipAddr.Mask(mask).String() + "/64"
 }
 
+// isIPv6Target reports whether an IP address or CIDR range is IPv6
+func isIPv6Target(target string) bool {
+	addr := target
+	if idx := strings.Index(addr, "/"); idx >= 0 {
+		addr = addr[:idx]
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// normalizeTarget returns the canonical form of an IP address or CIDR range so that
+// equivalent spellings (e.g. "2001:DB8::0001" and "2001:db8::1") share one blocklist key.
+// Invalid targets are returned unchanged.
+func normalizeTarget(target string) string {
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "/") {
+		_, ipNet, err := net.ParseCIDR(target)
+		if err != nil {
+			return target
+		}
+		return ipNet.String()
+	}
+	if ip := parseClientIP(target); ip != nil {
+		return ip.String()
+	}
+	return target
+}
+
+// seekToStartup positions a newly adopted log file according to startupLines: -1 reads
+// the whole file, 0 only the lines written from now on, and n > 0 the last n lines
+func seekToStartup(file *os.File, lines int) error {
+	switch {
+	case lines < 0:
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	case lines == 0:
+		_, err := file.Seek(0, io.SeekEnd)
+		return err
+	default:
+		return skipToLastLines(file, lines)
+	}
+}
+
+// describeStartupLines describes what startupLines reads, for the log
+func describeStartupLines() string {
+	switch {
+	case startupLines < 0:
+		return "all lines"
+	case startupLines == 0:
+		return "new lines only"
+	default:
+		return fmt.Sprintf("the last %d lines", startupLines)
+	}
+}
+
 // skipToLastLines skips to the last n lines of a file
 func skipToLastLines(file *os.File, lines int) error {
 	bufferSize := int64(4096)
@@ -90,6 +164,10 @@ func skipToLastLines(file *os.File, lines int) error {
 
 // cleanupExpiredRecords removes expired records from the ipAccessLog
 func cleanupExpiredRecords() {
+	// The rate and error-ratio counters are dropped by the windows of the rules;
+	// reloadMu comes first, as in line analysis
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -99,4 +177,42 @@ func cleanupExpiredRecords() {
 			delete(ipAccessLog, ip)
 		}
 	}
+	cleanupRuleRecordsLocked(now)
+	cleanupScoresLocked(now)
+	cleanupRateCountersLocked(now)
+	cleanupRatioCountersLocked(now)
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the same directory
+// that is synced and renamed over it, so a crash or a full disk leaves either the old
+// contents or the new ones, never a truncated file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Persist the rename itself; not every filesystem supports syncing a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
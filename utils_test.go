@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSeekToStartup checks the lines read after positioning a file for each startupLines
+// mode: all of them, none, or the last n.
+func TestSeekToStartup(t *testing.T) {
+	var content strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lines int
+		first int // First line read, 0 for none
+	}{
+		{-1, 1},
+		{0, 0},
+		{1, 10},
+		{3, 8},
+		{10, 1},
+		{20, 1},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.lines), func(t *testing.T) {
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if err := seekToStartup(file, test.lines); err != nil {
+				t.Fatal(err)
+			}
+
+			var read []string
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				read = append(read, scanner.Text())
+			}
+			var want []string
+			if test.first > 0 {
+				for i := test.first; i <= 10; i++ {
+					want = append(want, fmt.Sprintf("line %d", i))
+				}
+			}
+			if strings.Join(read, "|") != strings.Join(want, "|") {
+				t.Errorf("startupLines %d read %q, want %q", test.lines, read, want)
+			}
+		})
+	}
+}
+
+// ipv6ClientForms are an IPv6 client address in the forms servers write it.
+var ipv6ClientForms = []string{"2001:db8::1:5", "2001:DB8:0:0::1:5", "[2001:db8::1:5]", "2001:db8::1:5%eth0", "[2001:db8::1:5%eth0]"}
+
+// TestParseClientIP checks the client address forms that are read, and the ones that are not.
+func TestParseClientIP(t *testing.T) {
+	tests := []struct {
+		in, want string // want is empty for no address
+	}{
+		{"203.0.113.5", "203.0.113.5"},
+		{" 203.0.113.5\n", "203.0.113.5"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%25eth0]", "fe80::1"},
+		{"::ffff:203.0.113.5", "203.0.113.5"},
+		{"203.0.113.5%eth0", ""},
+		{"[203.0.113.5", ""},
+		{"2001:db8::1]", ""},
+		{"%eth0", ""},
+		{"", ""},
+		{"example.com", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if ip := parseClientIP(test.in); ip != nil {
+			got = ip.String()
+		}
+		if got != test.want {
+			t.Errorf("parseClientIP(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+// TestIPv6ClientSubnet checks that every form of an IPv6 client address has its /64.
+func TestIPv6ClientSubnet(t *testing.T) {
+	for _, client := range ipv6ClientForms {
+		if got := getSubnet(client); got != "2001:db8::/64" {
+			t.Errorf("getSubnet(%q) = %q, want 2001:db8::/64", client, got)
+		}
+		if got := normalizeTarget(client); got != "2001:db8::1:5" {
+			t.Errorf("normalizeTarget(%q) = %q, want 2001:db8::1:5", client, got)
+		}
+	}
+	if got := getSubnet("203.0.113.5"); got != "203.0.113.0/24" {
+		t.Errorf("getSubnet(203.0.113.5) = %q, want 203.0.113.0/24", got)
+	}
+}
+
+// TestIPv6ClientWhitelisted checks that every form of an IPv6 client address is found in
+// the whitelist, as a listed address and in a listed range.
+func TestIPv6ClientWhitelisted(t *testing.T) {
+	whitelistMu.Lock()
+	savedWhitelist, savedRanges := whitelist, whitelistRanges
+	whitelistMu.Unlock()
+	t.Cleanup(func() {
+		whitelistMu.Lock()
+		whitelist, whitelistRanges = savedWhitelist, savedRanges
+		whitelistMu.Unlock()
+	})
+
+	for _, entry := range []string{"2001:db8::1:5", "2001:db8::/64"} {
+		entries := map[string]bool{entry: true}
+		whitelistMu.Lock()
+		whitelist, whitelistRanges = entries, buildPrefixTrie(entries)
+		whitelistMu.Unlock()
+		for _, client := range ipv6ClientForms {
+			if !isWhitelisted(client) {
+				t.Errorf("%s not whitelisted by %s", client, entry)
+			}
+		}
+		if isWhitelisted("2001:db8:1::5") {
+			t.Errorf("2001:db8:1::5 whitelisted by %s", entry)
+		}
+	}
+}
+
+// TestIPv6ClientBlocked checks that every form of an IPv6 client address is found blocked,
+// by itself and in a blocked subnet.
+func TestIPv6ClientBlocked(t *testing.T) {
+	mu.Lock()
+	savedIPs, savedSubnets, savedRanges := blockedIPs, blockedSubnets, blockedSubnetRanges
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		blockedIPs, blockedSubnets, blockedSubnetRanges = savedIPs, savedSubnets, savedRanges
+		mu.Unlock()
+	})
+
+	mu.Lock()
+	blockedIPs = map[string]struct{}{"2001:db8::1:5": {}}
+	resetBlockedSubnetsLocked()
+	mu.Unlock()
+	for _, client := range ipv6ClientForms {
+		if blocked, subnet, err := isIPBlocked(client); err != nil || !blocked || subnet != "" {
+			t.Errorf("isIPBlocked(%q) = %v, %q, %v, want blocked by itself", client, blocked, subnet, err)
+		}
+	}
+
+	mu.Lock()
+	blockedIPs = map[string]struct{}{}
+	addBlockedSubnetLocked("2001:db8::/64")
+	mu.Unlock()
+	for _, client := range ipv6ClientForms {
+		if blocked, subnet, err := isIPBlocked(client); err != nil || !blocked || subnet != "2001:db8::/64" {
+			t.Errorf("isIPBlocked(%q) = %v, %q, %v, want blocked in 2001:db8::/64", client, blocked, subnet, err)
+		}
+	}
+	if blocked, _, err := isIPBlocked("2001:db8:1::5"); err != nil || blocked {
+		t.Errorf("isIPBlocked(2001:db8:1::5) = %v, %v, want not blocked", blocked, err)
+	}
+}
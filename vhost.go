@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+)
+
+// --- Apache vhost_combined format ---
+
+// server = apache-vhost reads Apache's vhost_combined format ("%v:%p %h %l %u %t ..."),
+// where the virtual host and port precede the client IP. The leading token is split off
+// and the rest of the line matched like a line of the apache format, so the apache rules
+// apply unchanged; rules can be limited to virtual hosts with "vhost", for example to give
+// a site its own threshold.
+
+// splitVhost splits the leading "host:port" token off an apache-vhost line, returning the
+// virtual host without the port and the rest of the line.
+func splitVhost(line string) (string, string) {
+	token, rest, found := strings.Cut(line, " ")
+	if !found {
+		return "", line
+	}
+	if colon := strings.LastIndexByte(token, ':'); colon >= 0 && isDigits(token[colon+1:]) {
+		token = token[:colon]
+	}
+	return strings.ToLower(token), rest
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleAppliesToFormat reports whether rule is used for lines in format. apache rules also
+// apply to apache-vhost, whose lines are matched without the virtual host.
+func ruleAppliesToFormat(rule *Rule, format string) bool {
+	return rule.LogFormat == "all" || rule.LogFormat == format ||
+		(format == "apache-vhost" && rule.LogFormat == "apache")
+}
+
+// matchesVhost reports whether the rule's vhost regex, if it has one, matches vhost. A
+// rule limited to virtual hosts never matches a line without one.
+func (r *Rule) matchesVhost(vhost string) bool {
+	if r.compiledVhost == nil {
+		return true
+	}
+	return vhost != "" && r.compiledVhost.MatchString(vhost)
+}
@@ -5,12 +5,23 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-// readWhitelistFile reads IP addresses from the whitelist file and adds them to the whitelist map
+// whitelistFileLoaded is set once the whitelist file has been read, after which a file with
+// invalid lines leaves the whitelist as it is
+var whitelistFileLoaded bool
+
+// whitelistRanges holds the CIDR entries of whitelist, guarded by whitelistMu
+var whitelistRanges = newPrefixTrie()
+
+// readWhitelistFile reads IP addresses from the whitelist file and replaces the whitelist
+// map with them and the local addresses. The first read skips invalid lines; later ones
+// keep the previous whitelist and report the lines, as the file is probably half edited
 func readWhitelistFile(filePath string) error {
 	// Ensure the directory exists
 	dir := filepath.Dir(filePath)
@@ -36,8 +47,15 @@ func readWhitelistFile(filePath string) error {
 	}
 	defer file.Close()
 
+	// Build a new whitelist, which replaces the current one only once the whole file is
+	// read, so a reload drops the entries removed from it and a failed one changes nothing
+	entries := make(map[string]bool)
+	for _, ip := range localAddresses() {
+		entries[ip] = true
+	}
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
+	var invalid, hostnames []string
 	for scanner.Scan() {
 		lineNum++
 		line := strings.TrimSpace(scanner.Text())
@@ -52,18 +70,23 @@ func readWhitelistFile(filePath string) error {
 		if ip == nil {
 			// Check if it's a CIDR notation
 			_, ipNet, err := net.ParseCIDR(line)
+			if err != nil && isWhitelistHostname(line) {
+				hostnames = append(hostnames, strings.ToLower(strings.TrimSuffix(line, ".")))
+				continue
+			}
 			if err != nil {
 				log.Printf("Invalid IP address or CIDR at line %d: %s", lineNum, line)
+				invalid = append(invalid, strconv.Itoa(lineNum))
 				continue
 			}
 			// For CIDR notation, we store the network address
-			whitelist[ipNet.String()] = true
+			entries[ipNet.String()] = true
 			// Log add only in debug
 			if debug {
 				log.Printf("Added subnet %s to whitelist", ipNet.String())
 			}
 		} else {
-			whitelist[ip.String()] = true
+			entries[ip.String()] = true
 			// Log add only in debug
 			if debug {
 				log.Printf("Added IP %s to whitelist", ip.String())
@@ -75,9 +98,52 @@ func readWhitelistFile(filePath string) error {
 		return fmt.Errorf("error reading whitelist file: %v", err)
 	}
 
+	whitelistMu.RLock()
+	loaded, previous := whitelistFileLoaded, whitelistResolved
+	whitelistMu.RUnlock()
+	if len(invalid) > 0 && loaded {
+		return fmt.Errorf("invalid entries at lines %s of %s, keeping the previous whitelist", strings.Join(invalid, ", "), filePath)
+	}
+
+	// Hostnames are resolved outside the lock, as DNS may be slow
+	resolved := resolveWhitelistHostnames(hostnames, previous)
+	hostOnly := addResolvedEntries(entries, resolved)
+
+	whitelistMu.Lock()
+	whitelist = entries
+	whitelistRanges = buildPrefixTrie(entries)
+	whitelistResolved, whitelistHostOnly = resolved, hostOnly
+	whitelistGeneration++
+	whitelistFileLoaded = true
+	whitelistMu.Unlock()
 	return nil
 }
 
+// localAddresses returns the addresses of the local interfaces, which are always
+// whitelisted. They are looked up on every read of the whitelist, so addresses the host
+// gained since startup are whitelisted too.
+func localAddresses() []string {
+	addrs, _ := net.InterfaceAddrs()
+	var local []string
+	for _, addr := range addrs {
+		if ip, _, err := net.ParseCIDR(addr.String()); err == nil {
+			local = append(local, ip.String())
+		}
+	}
+	return local
+}
+
+// whitelistLocalAddresses whitelists the addresses of the local interfaces, which
+// readWhitelistFile keeps on every reload.
+func whitelistLocalAddresses() {
+	local := localAddresses()
+	whitelistMu.Lock()
+	defer whitelistMu.Unlock()
+	for _, ip := range local {
+		whitelist[ip] = true
+	}
+}
+
 // createExampleWhitelistFile creates an example whitelist file with comments and sample entries
 func createExampleWhitelistFile(filePath string) error {
 	content := `# Apache Block Whitelist
@@ -97,9 +163,46 @@ func createExampleWhitelistFile(filePath string) error {
 	return os.WriteFile(filePath, []byte(content), 0644)
 }
 
+// addWhitelistEntry appends a normalized IP or CIDR to the whitelist file and adds it to
+// the whitelist, reporting false if it was already listed.
+func addWhitelistEntry(filePath, target string) (bool, error) {
+	whitelistMu.Lock()
+	defer whitelistMu.Unlock()
+	if whitelist[target] && !whitelistHostOnly[target] {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read whitelist file: %v", err)
+	}
+	line := target + "\n"
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		line = "\n" + line
+	}
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to open whitelist file: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(line); err != nil {
+		return false, fmt.Errorf("failed to write whitelist file: %v", err)
+	}
+
+	whitelist[target] = true
+	whitelistRanges.add(target)
+	delete(whitelistHostOnly, target)
+	log.Printf("Added %s to whitelist %s", target, filePath)
+	return true, nil
+}
+
 // isWhitelisted checks if an IP is in the whitelist
 func isWhitelisted(ip string) bool {
-	// Check if IP is directly whitelisted
+	whitelistMu.RLock()
+	defer whitelistMu.RUnlock()
+
+	// Check if IP is directly whitelisted, in the canonical form the whitelist is kept in
+	ip = normalizeTarget(ip)
 	if _, whitelisted := whitelist[ip]; whitelisted {
 		// Log skip only in debug
 		if debug {
@@ -109,20 +212,13 @@ func isWhitelisted(ip string) bool {
 	}
 
 	// Check if IP is in a whitelisted CIDR range
-	ipAddr := net.ParseIP(ip)
-	if ipAddr != nil {
-		for cidr := range whitelist {
-			// Check if this is a CIDR notation
-			if strings.Contains(cidr, "/") {
-				_, ipNet, err := net.ParseCIDR(cidr)
-				if err == nil && ipNet.Contains(ipAddr) {
-					// Log skip only in debug
-					if debug {
-						log.Printf("IP %s is in whitelisted CIDR %s, skipping", ip, cidr)
-					}
-					return true
-				}
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		if cidr, covered := whitelistRanges.covering(addr, -1); covered {
+			// Log skip only in debug
+			if debug {
+				log.Printf("IP %s is in whitelisted CIDR %s, skipping", ip, cidr)
 			}
+			return true
 		}
 	}
 
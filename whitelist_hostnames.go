@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Hostnames in the whitelist ---
+
+// An admin on a dynamic-DNS address can put the hostname (home.example.net) in the
+// whitelist file instead of an IP. Hostnames are resolved (A and AAAA records) whenever
+// the file is read and every whitelistRefreshInterval, and their addresses are kept in
+// the whitelist with the others. An address the hostname no longer resolves to is
+// dropped, unless the file lists it too; one a refresh adds is unblocked if it is
+// blocked, and exempted from the blocked subnets containing it, which the audit log
+// records as an unblock by the "whitelist". A failed lookup other than "no such host"
+// keeps the addresses the hostname had, so a DNS outage does not lift the whitelisting.
+
+var whitelistRefreshInterval = 10 * time.Minute // How often whitelisted hostnames are resolved again (0 disables)
+
+var (
+	// Of the whitelist as last read, guarded by whitelistMu
+	whitelistResolved   = map[string][]string{} // Addresses of each hostname entry
+	whitelistHostOnly   = map[string]bool{}     // Addresses whitelisted only through a hostname
+	whitelistGeneration int                     // Counts the reads of the whitelist file
+)
+
+// isWhitelistHostname reports whether a whitelist line is a hostname rather than an
+// address: dot-separated labels of letters, digits and hyphens, with a letter somewhere.
+func isWhitelistHostname(entry string) bool {
+	entry = strings.TrimSuffix(entry, ".")
+	if len(entry) == 0 || len(entry) > 253 || !strings.ContainsAny(strings.ToLower(entry), "abcdefghijklmnopqrstuvwxyz") {
+		return false
+	}
+	for _, label := range strings.Split(entry, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolveWhitelistHostname returns the addresses of hostname, or previous if the lookup
+// failed for a reason other than the name not existing.
+func resolveWhitelistHostname(hostname string, previous []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, err := dnsResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return previous, fmt.Errorf("failed to resolve whitelisted hostname %s: %v", hostname, err)
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// resolveWhitelistHostnames resolves the hostname entries of the whitelist, starting from
+// the addresses they had, and logs the failed lookups.
+func resolveWhitelistHostnames(hostnames []string, previous map[string][]string) map[string][]string {
+	resolved := make(map[string][]string, len(hostnames))
+	for _, hostname := range hostnames {
+		ips, err := resolveWhitelistHostname(hostname, previous[hostname])
+		if err != nil {
+			log.Printf("Warning: %v; keeping its %d addresses", err, len(ips))
+		} else if len(ips) == 0 {
+			log.Printf("Warning: Whitelisted hostname %s does not resolve", hostname)
+		}
+		if debug {
+			log.Printf("Whitelisted hostname %s resolves to %s", hostname, strings.Join(ips, ", "))
+		}
+		resolved[hostname] = ips
+	}
+	return resolved
+}
+
+// addResolvedEntries adds the addresses of the hostnames to entries, the whitelist being
+// built, and returns the ones it did not already list.
+func addResolvedEntries(entries map[string]bool, resolved map[string][]string) map[string]bool {
+	hostOnly := make(map[string]bool)
+	for _, ips := range resolved {
+		for _, ip := range ips {
+			if !entries[ip] {
+				entries[ip] = true
+				hostOnly[ip] = true
+			}
+		}
+	}
+	return hostOnly
+}
+
+// whitelistedHostAddress reports whether a hostname of the whitelist resolves to ip. The
+// caller must hold whitelistMu.
+func whitelistedHostAddress(ip string) bool {
+	for _, ips := range whitelistResolved {
+		for _, resolved := range ips {
+			if resolved == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refreshWhitelistHostnames resolves the hostnames of the whitelist again, updating the
+// whitelist, and lifts the blocks of the addresses it adds.
+func refreshWhitelistHostnames() {
+	whitelistMu.RLock()
+	generation := whitelistGeneration
+	previous := whitelistResolved
+	whitelistMu.RUnlock()
+	if len(previous) == 0 {
+		return
+	}
+	hostnames := make([]string, 0, len(previous))
+	for hostname := range previous {
+		hostnames = append(hostnames, hostname)
+	}
+	resolved := resolveWhitelistHostnames(hostnames, previous)
+
+	whitelistMu.Lock()
+	if generation != whitelistGeneration {
+		// The file was read meanwhile, resolving the hostnames afresh
+		whitelistMu.Unlock()
+		return
+	}
+	wanted := make(map[string]string)
+	for hostname, ips := range resolved {
+		for _, ip := range ips {
+			wanted[ip] = hostname
+		}
+	}
+	var removed []string
+	for ip := range whitelistHostOnly {
+		if _, still := wanted[ip]; !still {
+			delete(whitelist, ip)
+			delete(whitelistHostOnly, ip)
+			removed = append(removed, ip)
+		}
+	}
+	added := make(map[string]string)
+	for ip, hostname := range wanted {
+		if !whitelist[ip] {
+			whitelist[ip] = true
+			whitelistHostOnly[ip] = true
+			added[ip] = hostname
+		}
+	}
+	whitelistResolved = resolved
+	whitelistMu.Unlock()
+
+	for _, ip := range removed {
+		log.Printf("Removed %s from the whitelist, as its hostname no longer resolves to it", ip)
+	}
+	for ip, hostname := range added {
+		log.Printf("Whitelisted %s, the new address of %s", ip, hostname)
+		liftWhitelistedBlocks(ip, hostname)
+	}
+}
+
+// liftWhitelistedBlocks unblocks ip, newly whitelisted as an address of hostname, and
+// exempts it from the blocked subnets that contain it.
+func liftWhitelistedBlocks(ip, hostname string) {
+	if fwManager == nil {
+		return
+	}
+	mu.Lock()
+	_, blocked := blockedIPs[ip]
+	mu.Unlock()
+	if blocked {
+		if unblocked, err := unblockTarget(ip, false); err != nil {
+			log.Printf("Warning: Failed to unblock %s, the new address of whitelisted %s: %v", ip, hostname, err)
+		} else if unblocked {
+			log.Printf("Unblocked %s, the new address of whitelisted %s", ip, hostname)
+			writeAudit(auditRecord{Action: "unblock", Target: ip, Reason: "address of whitelisted hostname " + hostname, Source: "whitelist", Domain: hostname})
+		}
+	}
+	for _, subnet := range blockedSubnetsOverlapping(ip) {
+		exemptSubnet(subnet, true)
+	}
+}
+
+// startWhitelistRefresh resolves the hostnames of the whitelist every
+// whitelistRefreshInterval.
+func startWhitelistRefresh() {
+	if whitelistRefreshInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(whitelistRefreshInterval)
+		for range ticker.C {
+			refreshWhitelistHostnames()
+		}
+	}()
+}
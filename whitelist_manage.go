@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Managing the whitelist ---
+
+// -whitelistAdd protects an address on the running server at once: it goes into the
+// whitelist and the whitelist file, after a comment saying when it was added, and an
+// address that is blocked already is unblocked, or exempted from the blocked subnets that
+// contain it. -whitelistRemove takes an entry out of both again, with the comment added
+// for it, and -whitelistList shows the whitelist. The file is rewritten in one go, keeping
+// its other lines and comments as they are. -allow only adds and exempts; it leaves a
+// blocked address blocked.
+
+// whitelistAddedComment starts the comment -whitelistAdd puts above the entries it adds.
+const whitelistAddedComment = "# Added with -whitelistAdd "
+
+// whitelistAdd whitelists target in the file and the running whitelist, and lifts its
+// blocks. source ("socket" or "cli") goes into the audit log. It returns a message
+// describing the result.
+func whitelistAdd(target, source string) (string, error) {
+	whitelistMu.Lock()
+	added := !whitelist[target] || whitelistHostOnly[target]
+	if added {
+		err := editWhitelistFile(whitelistFilePath, func(lines []string) []string {
+			comment := whitelistAddedComment + time.Now().Format("2006-01-02 15:04:05")
+			return append(lines, comment, target)
+		})
+		if err != nil {
+			whitelistMu.Unlock()
+			return "", err
+		}
+		whitelist[target] = true
+		whitelistRanges.add(target)
+		delete(whitelistHostOnly, target)
+	}
+	whitelistMu.Unlock()
+
+	result := fmt.Sprintf("%s is already whitelisted", target)
+	if added {
+		writeAudit(auditRecord{Action: "allow", Target: target, Source: source})
+		result = fmt.Sprintf("Added %s to the whitelist %s", target, whitelistFilePath)
+	}
+
+	mu.Lock()
+	_, blockedIP := blockedIPs[target]
+	_, blockedSubnet := blockedSubnets[target]
+	mu.Unlock()
+	if (blockedIP || blockedSubnet) && fwManager != nil {
+		if err := clientUnblockIP(target, source, false); err != nil {
+			return "", fmt.Errorf("%s was whitelisted, but unblocking it failed: %v", target, err)
+		}
+		result += fmt.Sprintf("\nUnblocked %s", target)
+	}
+	if fwManager != nil {
+		for _, subnet := range blockedSubnetsOverlapping(target) {
+			if subnet == target {
+				continue
+			}
+			exemptSubnet(subnet, true)
+			result += fmt.Sprintf("\nExempted it from the block of subnet %s", subnet)
+		}
+	}
+	return result, nil
+}
+
+// whitelistRemove takes target out of the whitelist file and the running whitelist, and
+// drops its exemptions from blocked subnets.
+func whitelistRemove(target, source string) (string, error) {
+	for _, local := range localAddresses() {
+		if local == target {
+			return "", fmt.Errorf("%s is an address of this host, which is always whitelisted", target)
+		}
+	}
+
+	whitelistMu.Lock()
+	found := false
+	err := editWhitelistFile(whitelistFilePath, func(lines []string) []string {
+		kept := make([]string, 0, len(lines))
+		for _, line := range lines {
+			if normalizeTarget(line) != target {
+				kept = append(kept, line)
+				continue
+			}
+			found = true
+			if n := len(kept); n > 0 && strings.HasPrefix(kept[n-1], whitelistAddedComment) {
+				kept = kept[:n-1]
+			}
+		}
+		return kept
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s is not in the whitelist %s", target, whitelistFilePath)
+		if whitelistHostOnly[target] {
+			err = fmt.Errorf("%s is whitelisted as an address of a hostname in %s; remove the hostname instead", target, whitelistFilePath)
+		}
+	}
+	if err != nil {
+		whitelistMu.Unlock()
+		return "", err
+	}
+	if whitelistedHostAddress(target) {
+		// A hostname still resolves to it, so it stays until the hostname no longer does
+		whitelistHostOnly[target] = true
+	} else {
+		delete(whitelist, target)
+		whitelistRanges.remove(target)
+	}
+	whitelistMu.Unlock()
+	writeAudit(auditRecord{Action: "disallow", Target: target, Source: source})
+
+	result := fmt.Sprintf("Removed %s from the whitelist %s", target, whitelistFilePath)
+	if fwManager != nil {
+		for _, subnet := range blockedSubnetsOverlapping(target) {
+			exemptSubnet(subnet, true)
+			result += fmt.Sprintf("\nRemoved its exemption from the block of subnet %s", subnet)
+		}
+	}
+	return result, nil
+}
+
+// editWhitelistFile replaces the lines of the whitelist file with those edit returns. The
+// caller must hold whitelistMu.
+func editWhitelistFile(filePath string, edit func(lines []string) []string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read whitelist file: %v", err)
+	}
+	var lines []string
+	if content := strings.TrimSuffix(string(data), "\n"); content != "" {
+		lines = strings.Split(content, "\n")
+	}
+	lines = edit(lines)
+	if err := writeFileAtomic(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write whitelist file: %v", err)
+	}
+	return nil
+}
+
+// whitelistListing lists the whitelist entries, sorted, marking the local addresses.
+func whitelistListing() string {
+	local := make(map[string]bool)
+	for _, ip := range localAddresses() {
+		local[ip] = true
+	}
+	whitelistMu.RLock()
+	entries := make([]string, 0, len(whitelist))
+	for entry := range whitelist {
+		entries = append(entries, entry)
+	}
+	hostnames := make(map[string][]string)
+	for hostname, ips := range whitelistResolved {
+		for _, ip := range ips {
+			hostnames[ip] = append(hostnames[ip], hostname)
+		}
+	}
+	whitelistMu.RUnlock()
+	sort.Strings(entries)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Whitelist (%d entries from %s and the local interfaces):", len(entries), whitelistFilePath)
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "\n  %s", entry)
+		if local[entry] {
+			b.WriteString(" (local interface)")
+		}
+		if names := hostnames[entry]; len(names) > 0 {
+			sort.Strings(names)
+			fmt.Fprintf(&b, " (%s)", strings.Join(names, ", "))
+		}
+	}
+	return b.String()
+}
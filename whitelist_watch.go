@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// --- Whitelist edits ---
+
+// An address added to the whitelist file takes effect shortly after the file is saved, so
+// an office blocked in the middle of an incident does not wait for a restart or -reload.
+// The file is read into a new whitelist, which replaces the old one in one go, with the
+// addresses of the local interfaces added again. A file with invalid lines leaves the old
+// whitelist in place, and the lines are logged. Blocked subnets get their exemptions
+// updated for the entries added or removed. A whitelist path changed by -reload is read
+// by the reload, and watched after the next restart.
+
+// reloadWatchedWhitelist re-reads the whitelist file after a change to it.
+func reloadWatchedWhitelist(path string) {
+	reloadMu.RLock()
+	current := filepath.Clean(whitelistFilePath)
+	reloadMu.RUnlock()
+	if current != path {
+		return
+	}
+
+	whitelistMu.RLock()
+	previous := whitelist
+	whitelistMu.RUnlock()
+	if err := readWhitelistFile(path); err != nil {
+		log.Printf("Warning: Ignoring change to whitelist %s: %v", path, err)
+		return
+	}
+	whitelistMu.RLock()
+	reloaded := whitelist
+	whitelistMu.RUnlock()
+
+	var changed []string
+	added, removed := 0, 0
+	for entry := range reloaded {
+		if !previous[entry] {
+			changed = append(changed, entry)
+			added++
+		}
+	}
+	for entry := range previous {
+		if !reloaded[entry] {
+			changed = append(changed, entry)
+			removed++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return
+	}
+	log.Printf("Whitelist %s changed, reloaded %d entries (%d added, %d removed)", path, len(reloaded), added, removed)
+
+	if fwManager == nil {
+		return
+	}
+	subnets := make(map[string]bool)
+	for _, entry := range changed {
+		for _, subnet := range blockedSubnetsOverlapping(entry) {
+			subnets[subnet] = true
+		}
+	}
+	for subnet := range subnets {
+		exemptSubnet(subnet, true)
+	}
+}
+
+// startWhitelistWatch watches the whitelist file and reloads it shortly after it changes.
+func startWhitelistWatch() error {
+	path := filepath.Clean(whitelistFilePath)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	// Watch the directory, as most editors replace the file by renaming over it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %v", filepath.Dir(path), err)
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				// Wait for a burst of writes to settle
+				if timer == nil {
+					timer = time.AfterFunc(time.Second, func() { reloadWatchedWhitelist(path) })
+				} else {
+					timer.Reset(time.Second)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Warning: Whitelist watcher error: %v", err)
+			}
+		}
+	}()
+
+	if debug {
+		log.Printf("Watching %s for changes", path)
+	}
+	return nil
+}